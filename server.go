@@ -1,7 +1,10 @@
 package main
 
-import "tabusus"
+import (
+	"os"
+	"tabusus"
+)
 
 func main() {
-	tabusus.Start()
+	os.Exit(tabusus.RunCli(os.Args[1:]))
 }
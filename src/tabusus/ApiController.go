@@ -0,0 +1,383 @@
+package tabusus
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/labstack/echo"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiResponse writes a JSON response in the common API format {"status", "message", "data"}
+func apiResponse(c echo.Context, status int, message string, data interface{}) error {
+	result := map[string]interface{}{
+		"status":  status,
+		"message": message,
+	}
+	if data != nil {
+		result["data"] = data
+	}
+	return c.JSON(status, result)
+}
+
+// GET /api/v1/keys/:fingerprint: returns the application owning the key with specified fingerprint
+func actionApiGetKeyOwner(c echo.Context) error {
+	fp := normalizeFingerprint(c.Param("fingerprint"))
+	if fp == "" {
+		return apiResponse(c, http.StatusBadRequest, "Invalid key fingerprint ["+c.Param("fingerprint")+"]!", nil)
+	}
+	app, err := AppDao.GetByFingerprint(fp)
+	if err != nil {
+		return apiResponse(c, http.StatusInternalServerError, err.Error(), nil)
+	}
+	if app == nil {
+		return apiResponse(c, http.StatusNotFound, "No application found owning key ["+fp+"]!", nil)
+	}
+	return apiResponse(c, http.StatusOK, "Ok", app.toApiData())
+}
+
+// GET /api/v1/compliance: re-evaluates all apps against current key policy and returns the violators
+func actionApiCompliance(c echo.Context) error {
+	apps := AppDao.List()
+	violations := AppKeyPolicy.CheckCompliance(apps)
+	if violations == nil {
+		violations = []KeyPolicyViolation{}
+	}
+	return apiResponse(c, http.StatusOK, "Ok", map[string]interface{}{
+		"policy":     AppKeyPolicy,
+		"total":      len(apps),
+		"violations": violations,
+	})
+}
+
+const (
+	maxChangesPerRequest = 1000
+	maxLongPollWait      = 60 * time.Second
+	sseHeartbeatInterval = 15 * time.Second
+)
+
+func changesToApiData(changes []AppChange) []map[string]interface{} {
+	result := make([]map[string]interface{}, 0, len(changes))
+	for i := range changes {
+		result = append(result, changes[i].toApiData())
+	}
+	return result
+}
+
+// GET /api/v1/changes?since=<revision>&limit=<n>&wait=<seconds>: returns changes after the given revision.
+// If there is no change yet and wait > 0, the request is held (long-poll) until a change arrives or wait expires.
+func actionApiChanges(c echo.Context) error {
+	since, _ := strconv.ParseInt(c.QueryParam("since"), 10, 64)
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	if limit <= 0 || limit > maxChangesPerRequest {
+		limit = maxChangesPerRequest
+	}
+	wait, _ := strconv.Atoi(c.QueryParam("wait"))
+	changes, err := AppChanges.Changes(since, limit)
+	if err == errRevisionTooOld {
+		return apiResponse(c, http.StatusGone, err.Error(), nil)
+	}
+	if err != nil {
+		return apiResponse(c, http.StatusInternalServerError, err.Error(), nil)
+	}
+	if len(changes) == 0 && wait > 0 {
+		timeout := time.Duration(wait) * time.Second
+		if timeout > maxLongPollWait {
+			timeout = maxLongPollWait
+		}
+		ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+		defer cancel()
+		if ch, err := AppChanges.Watch(ctx, since); err == nil {
+			if change, ok := <-ch; ok {
+				changes = append(changes, change)
+			}
+		}
+	}
+	lastRev := since
+	if len(changes) > 0 {
+		lastRev = changes[len(changes)-1].Revision
+	}
+	return apiResponse(c, http.StatusOK, "Ok", map[string]interface{}{
+		"revision": lastRev,
+		"changes":  changesToApiData(changes),
+	})
+}
+
+// GET /api/v1/changes/stream?since=<revision>: streams changes as Server-Sent Events, each event's id is the change's revision.
+// Clients can resume from a revision with query parameter "since" or header "Last-Event-ID".
+func actionApiChangeStream(c echo.Context) error {
+	sinceStr := c.Request().Header.Get("Last-Event-ID")
+	if sinceStr == "" {
+		sinceStr = c.QueryParam("since")
+	}
+	since, _ := strconv.ParseInt(sinceStr, 10, 64)
+	ctx, cancel := context.WithCancel(c.Request().Context())
+	defer cancel()
+	ch, err := AppChanges.Watch(ctx, since)
+	if err == errRevisionTooOld {
+		return apiResponse(c, http.StatusGone, err.Error(), nil)
+	}
+	if err != nil {
+		return apiResponse(c, http.StatusInternalServerError, err.Error(), nil)
+	}
+
+	resp := c.Response()
+	resp.Header().Set(echo.HeaderContentType, "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.Header().Set("Connection", "keep-alive")
+	resp.WriteHeader(http.StatusOK)
+	resp.Flush()
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case change, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			data, err := json.Marshal(change.toApiData())
+			if err != nil {
+				return err
+			}
+			msg := "id: " + strconv.FormatInt(change.Revision, 10) + "\nevent: " + change.Type + "\ndata: " + string(data) + "\n\n"
+			if _, err := resp.Write([]byte(msg)); err != nil {
+				return nil
+			}
+			resp.Flush()
+		case <-heartbeat.C:
+			if _, err := resp.Write([]byte(": heartbeat\n\n")); err != nil {
+				return nil
+			}
+			resp.Flush()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// GET /api/v1/fields: returns the schema of custom fields of applications
+func actionApiCustomFields(c echo.Context) error {
+	return apiResponse(c, http.StatusOK, "Ok", AppFields)
+}
+
+// GET /api/v1/apps?selector=<label selector>&tag=<tags>: lists applications matching label selector (e.g. "env=prod,team!=legacy,tier,!deprecated")
+// and having all specified (comma-separated) tags
+func actionApiListApps(c echo.Context) error {
+	selector, err := parseLabelSelector(c.QueryParam("selector"))
+	if err != nil {
+		return apiResponse(c, http.StatusBadRequest, err.Error(), nil)
+	}
+	tags, errMsg := parseTags(c.QueryParam("tag"))
+	if errMsg != "" {
+		return apiResponse(c, http.StatusBadRequest, errMsg, nil)
+	}
+	apps, err := AppDao.Find(selector, tags)
+	if err != nil {
+		return apiResponse(c, http.StatusInternalServerError, err.Error(), nil)
+	}
+	data := make([]map[string]interface{}, 0, len(apps))
+	for i := range apps {
+		data = append(data, apps[i].toApiData())
+	}
+	return apiResponse(c, http.StatusOK, "Ok", data)
+}
+
+// GET /api/v1/apps/export?format=json|yaml|csv: exports all applications
+func actionApiExportApps(c echo.Context) error {
+	format := normalizeFormat(c.QueryParam("format"))
+	if format == "" {
+		return apiResponse(c, http.StatusBadRequest, "Unsupported format ["+c.QueryParam("format")+"]!", nil)
+	}
+	return writeExport(c, format)
+}
+
+// POST /api/v1/apps/import?format=json|yaml|csv&strategy=skip|overwrite|fail&dry_run=true: imports applications,
+// request body is the data to import. Records cannot carry proofs of possession: if proofs are required, records
+// setting new keys fail.
+func actionApiImportApps(c echo.Context) error {
+	format := normalizeFormat(c.QueryParam("format"))
+	if format == "" {
+		return apiResponse(c, http.StatusBadRequest, "Unsupported format ["+c.QueryParam("format")+"]!", nil)
+	}
+	strategy := c.QueryParam("strategy")
+	if strategy == "" {
+		strategy = conflictFail
+	}
+	dryRun, _ := strconv.ParseBool(c.QueryParam("dry_run"))
+	data, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return apiResponse(c, http.StatusBadRequest, err.Error(), nil)
+	}
+	records, err := parseAppRecords(data, format)
+	if err != nil {
+		return apiResponse(c, http.StatusBadRequest, err.Error(), nil)
+	}
+	results, err := importApps(records, strategy, dryRun, AppKeyProof.Required, currentUser(c))
+	if err != nil {
+		return apiResponse(c, http.StatusBadRequest, err.Error(), nil)
+	}
+	status := http.StatusOK
+	for _, r := range results {
+		if r.Action == importFailed {
+			status = http.StatusUnprocessableEntity
+			break
+		}
+	}
+	return apiResponse(c, status, "Ok", map[string]interface{}{
+		"dry_run":  dryRun,
+		"strategy": strategy,
+		"results":  results,
+	})
+}
+
+// apiApp loads an app that is not in trash, returns the HTTP status and error message if the app cannot be loaded
+func apiApp(appId string) (*Application, int, string) {
+	app, err := AppDao.Get(appId)
+	if err != nil {
+		return nil, http.StatusInternalServerError, "Error while getting application info [" + appId + "]: " + err.Error()
+	}
+	if app == nil || app.IsDeleted() {
+		return nil, http.StatusNotFound, "Application not found [" + appId + "]!"
+	}
+	return app, http.StatusOK, ""
+}
+
+// GET /api/v1/apps/:id: returns an application
+func actionApiGetApp(c echo.Context) error {
+	app, status, error := apiApp(c.Param("id"))
+	if error != "" {
+		return apiResponse(c, status, error, nil)
+	}
+	return apiResponse(c, http.StatusOK, "Ok", app.toApiData())
+}
+
+// apiAppInput is the request body of creating/updating apps: an app record, optionally with a proof of possession of
+// the private key (see actionKeyChallenge)
+type apiAppInput struct {
+	appRecord
+	KeyChallenge string `json:"key_challenge"`
+	KeyProof     string `json:"key_proof"`
+}
+
+// saveApiAppRecord creates/updates an app from a record with the same rules as importing apps.
+// A new public key is checked for proof of possession once the record is known to be valid.
+func saveApiAppRecord(c echo.Context, in apiAppInput, strategy string, successStatus int) error {
+	r := in.appRecord
+	appId := strings.ToLower(strings.TrimSpace(r.Id))
+	existing, err := AppDao.Get(appId)
+	if err != nil {
+		return apiResponse(c, http.StatusInternalServerError, "Error while getting application info ["+appId+"]: "+err.Error(), nil)
+	}
+	keyChanged := existing == nil || existing.GetRsaPubKey() != strings.TrimSpace(r.PublicKey)
+	if keyChanged && (strings.TrimSpace(in.KeyProof) != "" || AppKeyProof.Required) {
+		results, err := importApps([]appRecord{r}, strategy, true, false, currentUser(c))
+		if err != nil {
+			return apiResponse(c, http.StatusBadRequest, err.Error(), nil)
+		}
+		if results[0].Action == importFailed {
+			return apiResponse(c, http.StatusUnprocessableEntity, results[0].Error, nil)
+		}
+		keyProven, error := checkKeyProof(appId, r.PublicKey, in.KeyChallenge, in.KeyProof)
+		if error != "" {
+			return apiResponse(c, http.StatusUnprocessableEntity, error, nil)
+		}
+		r.keyProven = keyProven
+	}
+	// proof has been checked above
+	results, err := importApps([]appRecord{r}, strategy, false, false, currentUser(c))
+	if err != nil {
+		return apiResponse(c, http.StatusBadRequest, err.Error(), nil)
+	}
+	result := results[0]
+	if result.Action == importFailed {
+		return apiResponse(c, http.StatusUnprocessableEntity, result.Error, nil)
+	}
+	app, status, error := apiApp(result.Id)
+	if error != "" {
+		return apiResponse(c, status, error, nil)
+	}
+	if result.Action == importPending {
+		successStatus = http.StatusAccepted
+	}
+	return apiResponse(c, successStatus, result.Action, app.toApiData())
+}
+
+// POST /api/v1/apps: creates an application, request body is a JSON object in the same format as records of exported apps,
+// plus "key_challenge" and "key_proof" to prove possession of the private key. Returns 202 if the application has been
+// created but is waiting for approval.
+func actionApiCreateApp(c echo.Context) error {
+	var r apiAppInput
+	if err := json.NewDecoder(c.Request().Body).Decode(&r); err != nil {
+		return apiResponse(c, http.StatusBadRequest, "Invalid request body: "+err.Error(), nil)
+	}
+	return saveApiAppRecord(c, r, conflictFail, http.StatusCreated)
+}
+
+// PUT /api/v1/apps/:id: replaces an application's data, request body is in the same format as for creating apps.
+// Returns 202 if the new public key is waiting for approval.
+func actionApiUpdateApp(c echo.Context) error {
+	app, status, error := apiApp(c.Param("id"))
+	if error != "" {
+		return apiResponse(c, status, error, nil)
+	}
+	var r apiAppInput
+	if err := json.NewDecoder(c.Request().Body).Decode(&r); err != nil {
+		return apiResponse(c, http.StatusBadRequest, "Invalid request body: "+err.Error(), nil)
+	}
+	r.Id = app.GetId()
+	return saveApiAppRecord(c, r, conflictOverwrite, http.StatusOK)
+}
+
+// DELETE /api/v1/apps/:id: moves an application to trash
+func actionApiDeleteApp(c echo.Context) error {
+	app, status, error := apiApp(c.Param("id"))
+	if error != "" {
+		return apiResponse(c, status, error, nil)
+	}
+	app.MarkDeleted(currentUser(c))
+	if err := AppDao.Save(app); err != nil {
+		return apiResponse(c, http.StatusInternalServerError, "Error while deleting application ["+app.GetId()+"]: "+err.Error(), nil)
+	}
+	dispatchAppEvent(c, EventAppDeleted, app)
+	return apiResponse(c, http.StatusOK, "Application ["+app.GetId()+"] has been moved to trash.", nil)
+}
+
+// PUT /api/v1/apps/:id/key: rotates an application's public key, request body is {"public_key", "key_expiry" (yyyy-mm-dd),
+// "key_challenge", "key_proof"}. Returns 202 if the new key is waiting for approval.
+func actionApiRotateKey(c echo.Context) error {
+	app, status, error := apiApp(c.Param("id"))
+	if error != "" {
+		return apiResponse(c, status, error, nil)
+	}
+	var req struct {
+		PublicKey    string `json:"public_key"`
+		KeyExpiry    string `json:"key_expiry"`
+		KeyChallenge string `json:"key_challenge"`
+		KeyProof     string `json:"key_proof"`
+	}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return apiResponse(c, http.StatusBadRequest, "Invalid request body: "+err.Error(), nil)
+	}
+	pending, error := rotateAppKey(app, req.PublicKey, req.KeyExpiry, req.KeyChallenge, req.KeyProof, currentUser(c))
+	if error != "" {
+		return apiResponse(c, http.StatusUnprocessableEntity, error, nil)
+	}
+	if pending {
+		return apiResponse(c, http.StatusAccepted, "The new public key of application ["+app.GetId()+"] is waiting for approval.", app.toApiData())
+	}
+	return apiResponse(c, http.StatusOK, "Public key of application ["+app.GetId()+"] has been rotated successfully.", app.toApiData())
+}
+
+// GET /api/v1/apps/:id/key/challenge (also served to the admin UI): issues a challenge for proving
+// possession of the private key of an application's new public key. The application does not need to exist yet, the
+// challenge is signed with the private key and submitted as "key_challenge" and "key_proof" with the key.
+func actionKeyChallenge(c echo.Context) error {
+	appId := strings.ToLower(strings.TrimSpace(c.Param("id")))
+	if !validAppId.MatchString(appId) {
+		return apiResponse(c, http.StatusBadRequest, "Invalid application id (must contains only a-z, 0-9, _, -)", nil)
+	}
+	return apiResponse(c, http.StatusOK, "Ok", AppKeyProof.Issue(appId, time.Now()))
+}
@@ -0,0 +1,322 @@
+package tabusus
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"tabusus/utils"
+	"time"
+)
+
+const (
+	attrAllowedCidrs     = "allowed_cidrs"
+	attrTimeWindows      = "time_windows"
+	attrMaxTokenTtl      = "max_token_ttl" // in seconds
+	attrAllowedAudiences = "allowed_audiences"
+	attrAllowedScopes    = "allowed_scopes"
+)
+
+// codes of constraint violations, returned in responses of verification/token endpoints and recorded in audit entries
+const (
+	violationIpNotAllowed       = "ip_not_allowed"
+	violationOutsideTimeWindow  = "outside_time_window"
+	violationTtlExceeded        = "token_lifetime_exceeded"
+	violationAudienceNotAllowed = "audience_not_allowed"
+	violationScopeNotAllowed    = "scope_not_allowed"
+)
+
+// AppConstraints restricts where, when and how an app can authenticate, empty constraints mean no restriction
+type AppConstraints struct {
+	AllowedCidrs     []string `json:"allowed_cidrs,omitempty" yaml:"allowed_cidrs,omitempty"`         // client IP ranges, e.g. 10.0.0.0/8
+	TimeWindows      []string `json:"time_windows,omitempty" yaml:"time_windows,omitempty"`           // UTC time windows, e.g. "Mon-Fri 08:00-18:00"
+	MaxTokenTtl      int64    `json:"max_token_ttl,omitempty" yaml:"max_token_ttl,omitempty"`         // maximum token lifetime in seconds
+	AllowedAudiences []string `json:"allowed_audiences,omitempty" yaml:"allowed_audiences,omitempty"` // audiences the app may request tokens for
+	AllowedScopes    []string `json:"allowed_scopes,omitempty" yaml:"allowed_scopes,omitempty"`       // scopes the app may request
+}
+
+// IsEmpty checks if no constraint is set
+func (c AppConstraints) IsEmpty() bool {
+	return len(c.AllowedCidrs) == 0 && len(c.TimeWindows) == 0 && c.MaxTokenTtl == 0 &&
+		len(c.AllowedAudiences) == 0 && len(c.AllowedScopes) == 0
+}
+
+// String summarizes the constraints, used by version history
+func (c AppConstraints) String() string {
+	var items []string
+	if len(c.AllowedCidrs) > 0 {
+		items = append(items, "cidrs: "+strings.Join(c.AllowedCidrs, ", "))
+	}
+	if len(c.TimeWindows) > 0 {
+		items = append(items, "time windows: "+strings.Join(c.TimeWindows, ", "))
+	}
+	if c.MaxTokenTtl > 0 {
+		items = append(items, "max token lifetime: "+strconv.FormatInt(c.MaxTokenTtl, 10)+"s")
+	}
+	if len(c.AllowedAudiences) > 0 {
+		items = append(items, "audiences: "+strings.Join(c.AllowedAudiences, ", "))
+	}
+	if len(c.AllowedScopes) > 0 {
+		items = append(items, "scopes: "+strings.Join(c.AllowedScopes, ", "))
+	}
+	return strings.Join(items, "; ")
+}
+
+// Validate checks syntax of the constraints, returns error message if any constraint is invalid
+func (c AppConstraints) Validate() string {
+	for _, v := range c.AllowedCidrs {
+		if _, err := parseCidr(v); err != nil {
+			return "Invalid IP range [" + v + "] (e.g. 10.0.0.0/8 or 192.168.1.10)!"
+		}
+	}
+	for _, v := range c.TimeWindows {
+		if _, err := parseTimeWindow(v); err != nil {
+			return "Invalid time window [" + v + "]: " + err.Error() + "!"
+		}
+	}
+	if c.MaxTokenTtl < 0 {
+		return "Maximum token lifetime must not be negative!"
+	}
+	return ""
+}
+
+// parseCidr parses an IP range in CIDR notation, a single IP is accepted as a range of one address
+func parseCidr(v string) (*net.IPNet, error) {
+	if !strings.Contains(v, "/") {
+		if ip := net.ParseIP(v); ip != nil {
+			if ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(v)
+	return ipNet, err
+}
+
+// parseConstraintsInput parses app's constraints submitted via UI (list values are one per line),
+// returns error message if data is invalid
+func parseConstraintsInput(formData map[string]string) (AppConstraints, string) {
+	lines := func(name string) []string {
+		var result []string
+		for _, v := range strings.Split(formData[name], "\n") {
+			if v = strings.TrimSpace(v); v != "" {
+				result = append(result, v)
+			}
+		}
+		return result
+	}
+	c := AppConstraints{
+		AllowedCidrs:     lines(attrAllowedCidrs),
+		TimeWindows:      lines(attrTimeWindows),
+		AllowedAudiences: lines(attrAllowedAudiences),
+		AllowedScopes:    lines(attrAllowedScopes),
+	}
+	if v := strings.TrimSpace(formData[attrMaxTokenTtl]); v != "" {
+		ttl, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return c, "Maximum token lifetime must be a number of seconds!"
+		}
+		c.MaxTokenTtl = ttl
+	}
+	return c, c.Validate()
+}
+
+// constraintsFormData converts app's constraints to form data (list values are one per line)
+func constraintsFormData(c AppConstraints, formData map[string]string) {
+	formData[attrAllowedCidrs] = strings.Join(c.AllowedCidrs, "\n")
+	formData[attrTimeWindows] = strings.Join(c.TimeWindows, "\n")
+	formData[attrAllowedAudiences] = strings.Join(c.AllowedAudiences, "\n")
+	formData[attrAllowedScopes] = strings.Join(c.AllowedScopes, "\n")
+	if c.MaxTokenTtl > 0 {
+		formData[attrMaxTokenTtl] = strconv.FormatInt(c.MaxTokenTtl, 10)
+	} else {
+		formData[attrMaxTokenTtl] = ""
+	}
+}
+
+func (app *Application) GetConstraints() AppConstraints {
+	c := AppConstraints{}
+	c.AllowedCidrs, _ = utils.ToStringSlice(app.Data[attrAllowedCidrs])
+	c.TimeWindows, _ = utils.ToStringSlice(app.Data[attrTimeWindows])
+	c.MaxTokenTtl, _ = utils.ToInt64(app.Data[attrMaxTokenTtl])
+	c.AllowedAudiences, _ = utils.ToStringSlice(app.Data[attrAllowedAudiences])
+	c.AllowedScopes, _ = utils.ToStringSlice(app.Data[attrAllowedScopes])
+	return c
+}
+
+// SetConstraints replaces app's constraints, constraints must have been validated
+func (app *Application) SetConstraints(c AppConstraints) *Application {
+	setList := func(attr string, v []string) {
+		if len(v) == 0 {
+			delete(app.Data, attr)
+		} else {
+			app.Data[attr] = v
+		}
+	}
+	setList(attrAllowedCidrs, c.AllowedCidrs)
+	setList(attrTimeWindows, c.TimeWindows)
+	setList(attrAllowedAudiences, c.AllowedAudiences)
+	setList(attrAllowedScopes, c.AllowedScopes)
+	if c.MaxTokenTtl > 0 {
+		app.Data[attrMaxTokenTtl] = c.MaxTokenTtl
+	} else {
+		delete(app.Data, attrMaxTokenTtl)
+	}
+	return app
+}
+
+/*----------------------------------------------------------------------*/
+
+// AuthRequest describes an authentication attempt of an app, checked against app's constraints
+type AuthRequest struct {
+	ClientIp  net.IP
+	IgnoreIp  bool // client IP is not known (verification delegated by a service), allowed CIDRs are not checked
+	Time      time.Time
+	TokenTtl  time.Duration // requested lifetime of the token/assertion, 0 if not applicable
+	Audiences []string
+	Scopes    []string
+}
+
+// ConstraintViolation is returned when an authentication attempt violates app's constraints
+type ConstraintViolation struct {
+	Code   string
+	Reason string
+}
+
+func (v *ConstraintViolation) Error() string {
+	return v.Reason
+}
+
+// CheckConstraints checks an authentication attempt against app's constraints, returns nil if the attempt is allowed
+func (app *Application) CheckConstraints(req AuthRequest) *ConstraintViolation {
+	c := app.GetConstraints()
+	if len(c.AllowedCidrs) > 0 && !req.IgnoreIp {
+		allowed := false
+		for _, v := range c.AllowedCidrs {
+			if ipNet, err := parseCidr(v); err == nil && req.ClientIp != nil && ipNet.Contains(req.ClientIp) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &ConstraintViolation{violationIpNotAllowed, "Client IP [" + req.ClientIp.String() + "] is not allowed for application [" + app.GetId() + "]"}
+		}
+	}
+	if len(c.TimeWindows) > 0 {
+		allowed := false
+		for _, v := range c.TimeWindows {
+			if w, err := parseTimeWindow(v); err == nil && w.Contains(req.Time) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &ConstraintViolation{violationOutsideTimeWindow, "Application [" + app.GetId() + "] is not allowed to authenticate at this time (allowed: " + strings.Join(c.TimeWindows, ", ") + " UTC)"}
+		}
+	}
+	if c.MaxTokenTtl > 0 && req.TokenTtl > time.Duration(c.MaxTokenTtl)*time.Second {
+		return &ConstraintViolation{violationTtlExceeded, "Requested token lifetime (" + strconv.FormatInt(int64(req.TokenTtl/time.Second), 10) + "s) exceeds the maximum of " + strconv.FormatInt(c.MaxTokenTtl, 10) + "s"}
+	}
+	if v := firstNotIn(req.Audiences, c.AllowedAudiences); v != "" {
+		return &ConstraintViolation{violationAudienceNotAllowed, "Audience [" + v + "] is not allowed for application [" + app.GetId() + "]"}
+	}
+	if v := firstNotIn(req.Scopes, c.AllowedScopes); v != "" {
+		return &ConstraintViolation{violationScopeNotAllowed, "Scope [" + v + "] is not allowed for application [" + app.GetId() + "]"}
+	}
+	return nil
+}
+
+// firstNotIn returns the first value not in allowed list, or empty string if all are allowed (or allowed list is empty)
+func firstNotIn(values, allowed []string) string {
+	if len(allowed) == 0 {
+		return ""
+	}
+	for _, v := range values {
+		found := false
+		for _, a := range allowed {
+			found = found || a == v
+		}
+		if !found {
+			return v
+		}
+	}
+	return ""
+}
+
+/*----------------------------------------------------------------------*/
+
+var weekdays = map[string]time.Weekday{"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday}
+
+// TimeWindow is a daily time range in UTC, optionally restricted to some days of week.
+// Ranges whose end is before start span midnight, e.g. "22:00-06:00".
+type TimeWindow struct {
+	Days  map[time.Weekday]bool // empty: every day
+	Start int                   // minutes since midnight
+	End   int                   // minutes since midnight
+}
+
+// parseTimeWindow parses a time window in form "[days ]HH:MM-HH:MM", days are comma-separated names or ranges, e.g.
+// "09:00-17:00", "Mon-Fri 08:00-18:00", "Sat,Sun 10:00-12:00"
+func parseTimeWindow(v string) (*TimeWindow, error) {
+	w := &TimeWindow{Days: map[time.Weekday]bool{}}
+	fields := strings.Fields(v)
+	if len(fields) < 1 || len(fields) > 2 {
+		return nil, errors.New("format [days ]HH:MM-HH:MM")
+	}
+	if len(fields) == 2 {
+		for _, item := range strings.Split(fields[0], ",") {
+			tokens := strings.SplitN(strings.ToLower(item), "-", 2)
+			from, okFrom := weekdays[tokens[0]]
+			to, okTo := from, okFrom
+			if len(tokens) == 2 {
+				to, okTo = weekdays[tokens[1]]
+			}
+			if !okFrom || !okTo {
+				return nil, errors.New("invalid days [" + item + "]")
+			}
+			for d := from; ; d = (d + 1) % 7 {
+				w.Days[d] = true
+				if d == to {
+					break
+				}
+			}
+		}
+	}
+	times := strings.SplitN(fields[len(fields)-1], "-", 2)
+	if len(times) != 2 {
+		return nil, errors.New("invalid time range [" + fields[len(fields)-1] + "]")
+	}
+	var err error
+	if w.Start, err = parseClock(times[0]); err != nil {
+		return nil, err
+	}
+	if w.End, err = parseClock(times[1]); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func parseClock(v string) (int, error) {
+	t, err := time.Parse("15:04", v)
+	if err != nil {
+		return 0, errors.New("invalid time [" + v + "]")
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Contains checks if a time is within the window; for windows spanning midnight, days refer to the day the window starts
+func (w *TimeWindow) Contains(t time.Time) bool {
+	t = t.UTC()
+	minutes := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.Start <= w.End {
+		return (len(w.Days) == 0 || w.Days[day]) && minutes >= w.Start && minutes < w.End
+	}
+	if minutes >= w.Start {
+		return len(w.Days) == 0 || w.Days[day]
+	}
+	return minutes < w.End && (len(w.Days) == 0 || w.Days[(day+6)%7])
+}
@@ -0,0 +1,129 @@
+package tabusus
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCheckConstraintsCidrs(t *testing.T) {
+	app := NewApp("app").SetConstraints(AppConstraints{AllowedCidrs: []string{"10.0.0.0/8", "192.168.1.10", "2001:db8::/32", "::1"}})
+	testCases := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"10.1.2.3", true},
+		{"11.0.0.1", false},
+		{"192.168.1.10", true},
+		{"192.168.1.11", false},
+		{"::ffff:10.0.0.1", true}, // IPv4-mapped IPv6 address
+		{"2001:db8:1::1", true},
+		{"2001:db9::1", false},
+		{"::1", true},
+		{"::2", false},
+	}
+	now := time.Now()
+	for _, testCase := range testCases {
+		v := app.CheckConstraints(AuthRequest{ClientIp: net.ParseIP(testCase.ip), Time: now})
+		if (v == nil) != testCase.allowed {
+			t.Errorf("%s: expected allowed %v, got %v", testCase.ip, testCase.allowed, v)
+		} else if v != nil && v.Code != violationIpNotAllowed {
+			t.Errorf("%s: expected [%s], got [%s]", testCase.ip, violationIpNotAllowed, v.Code)
+		}
+	}
+	if v := app.CheckConstraints(AuthRequest{Time: now}); v == nil {
+		t.Errorf("expected unknown client IP not to be allowed")
+	}
+	if v := app.CheckConstraints(AuthRequest{IgnoreIp: true, Time: now}); v != nil {
+		t.Errorf("expected IP not to be checked, got %v", v)
+	}
+}
+
+func TestTimeWindowContains(t *testing.T) {
+	// 2024-01-05 is a Friday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+	testCases := []struct {
+		window   string
+		time     time.Time
+		contains bool
+	}{
+		{"09:00-17:00", at(5, 9, 0), true},
+		{"09:00-17:00", at(5, 16, 59), true},
+		{"09:00-17:00", at(5, 17, 0), false},
+		{"09:00-17:00", at(5, 8, 59), false},
+		{"09:00-17:00", time.Date(2024, 1, 5, 18, 30, 0, 0, time.FixedZone("UTC+2", 2*3600)), true}, // 16:30 UTC
+		{"Mon-Fri 08:00-18:00", at(5, 12, 0), true},
+		{"Mon-Fri 08:00-18:00", at(6, 12, 0), false},
+		{"Sat,Sun 10:00-12:00", at(7, 11, 0), true},
+		{"Fri-Mon 10:00-12:00", at(8, 11, 0), true},
+		{"Fri-Mon 10:00-12:00", at(9, 11, 0), false},
+		// crossing midnight: the part after midnight belongs to the day the window starts
+		{"22:00-06:00", at(5, 23, 0), true},
+		{"22:00-06:00", at(6, 5, 59), true},
+		{"22:00-06:00", at(6, 6, 0), false},
+		{"22:00-06:00", at(5, 21, 59), false},
+		{"Fri 22:00-06:00", at(5, 22, 0), true},
+		{"Fri 22:00-06:00", at(6, 3, 0), true},
+		{"Fri 22:00-06:00", at(6, 22, 0), false},
+		{"Fri 22:00-06:00", at(5, 3, 0), false},
+		{"Sun 22:00-06:00", at(8, 1, 0), true}, // Monday morning
+	}
+	for _, testCase := range testCases {
+		w, err := parseTimeWindow(testCase.window)
+		if err != nil {
+			t.Fatalf("%s: %v", testCase.window, err)
+		}
+		if got := w.Contains(testCase.time); got != testCase.contains {
+			t.Errorf("%s contains %s: expected %v, got %v", testCase.window, testCase.time.Format(time.RFC1123), testCase.contains, got)
+		}
+	}
+	for _, v := range []string{"", "9-17", "Mon-Fri", "Xyz 09:00-17:00", "09:00-25:00", "Mon 09:00-17:00 UTC"} {
+		if _, err := parseTimeWindow(v); err == nil {
+			t.Errorf("%s: expected error", v)
+		}
+	}
+}
+
+func TestCheckConstraintsEmpty(t *testing.T) {
+	var c AppConstraints
+	if !c.IsEmpty() || c.Validate() != "" || c.String() != "" {
+		t.Errorf("expected empty constraints to be valid, got [%s]", c.Validate())
+	}
+	app := NewApp("app").SetConstraints(c)
+	for _, attr := range []string{attrAllowedCidrs, attrTimeWindows, attrMaxTokenTtl, attrAllowedAudiences, attrAllowedScopes} {
+		if _, ok := app.Data[attr]; ok {
+			t.Errorf("expected no constraint stored, got %v", app.Data)
+		}
+	}
+	req := AuthRequest{ClientIp: net.ParseIP("203.0.113.1"), Time: time.Now(), TokenTtl: 24 * time.Hour,
+		Audiences: []string{"api"}, Scopes: []string{"admin"}}
+	if v := app.CheckConstraints(req); v != nil {
+		t.Errorf("expected no restriction, got %v", v)
+	}
+	if v := app.CheckConstraints(AuthRequest{}); v != nil {
+		t.Errorf("expected no restriction, got %v", v)
+	}
+}
+
+func TestCheckConstraintsTokens(t *testing.T) {
+	app := NewApp("app").SetConstraints(AppConstraints{MaxTokenTtl: 3600, AllowedAudiences: []string{"api"}, AllowedScopes: []string{"read", "write"}})
+	testCases := []struct {
+		name     string
+		req      AuthRequest
+		expected string
+	}{
+		{"allowed", AuthRequest{TokenTtl: time.Hour, Audiences: []string{"api"}, Scopes: []string{"read", "write"}}, ""},
+		{"no ttl requested", AuthRequest{}, ""},
+		{"ttl exceeded", AuthRequest{TokenTtl: time.Hour + time.Second}, violationTtlExceeded},
+		{"audience", AuthRequest{Audiences: []string{"api", "admin"}}, violationAudienceNotAllowed},
+		{"scope", AuthRequest{Scopes: []string{"delete"}}, violationScopeNotAllowed},
+	}
+	for _, testCase := range testCases {
+		v := app.CheckConstraints(testCase.req)
+		if v == nil && testCase.expected != "" || v != nil && v.Code != testCase.expected {
+			t.Errorf("%s: expected [%s], got %v", testCase.name, testCase.expected, v)
+		}
+	}
+}
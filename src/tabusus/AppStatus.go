@@ -0,0 +1,208 @@
+package tabusus
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"tabusus/utils"
+	"time"
+)
+
+// Application statuses; values 0 and 1 are kept compatible with the former disabled/enabled flag
+const (
+	AppStatusDisabled   int32 = 0
+	AppStatusActive     int32 = 1
+	AppStatusPending    int32 = 2 // waiting for approval
+	AppStatusSuspended  int32 = 3 // temporarily blocked, optionally until a date
+	AppStatusDeprecated int32 = 4 // still usable for verification but no new tokens are issued
+	AppStatusRevoked    int32 = 5 // permanently blocked, final
+
+	attrSuspendReason = "suspend_reason"
+	attrSuspendUntil  = "suspend_until"
+)
+
+var appStatusNames = map[int32]string{
+	AppStatusDisabled:   "Disabled",
+	AppStatusActive:     "Active",
+	AppStatusPending:    "Pending Approval",
+	AppStatusSuspended:  "Suspended",
+	AppStatusDeprecated: "Deprecated",
+	AppStatusRevoked:    "Revoked",
+}
+
+// appStatusKeys are the short names of statuses used by CLI, API and query parameters
+var appStatusKeys = map[int32]string{
+	AppStatusDisabled:   "disabled",
+	AppStatusActive:     "active",
+	AppStatusPending:    "pending",
+	AppStatusSuspended:  "suspended",
+	AppStatusDeprecated: "deprecated",
+	AppStatusRevoked:    "revoked",
+}
+
+// appStatusOrder is the order statuses are displayed in
+var appStatusOrder = []int32{AppStatusPending, AppStatusActive, AppStatusSuspended, AppStatusDeprecated, AppStatusDisabled, AppStatusRevoked}
+
+// appInitialStatuses are statuses a new app can be created with
+var appInitialStatuses = []int32{AppStatusPending, AppStatusActive, AppStatusDisabled}
+
+// initialAppStatuses returns statuses a new app can currently be created with: if approval is required, new apps
+// can only be created as pending, otherwise an app created as disabled could be enabled without being approved
+func initialAppStatuses() []int32 {
+	if isApprovalRequired() {
+		return []int32{AppStatusPending}
+	}
+	return appInitialStatuses
+}
+
+// appStatusTransitions lists allowed status transitions (staying in the same status is always allowed, except for revoked apps).
+// If approval is required, pending apps can only be activated by approving their registration.
+var appStatusTransitions = map[int32][]int32{
+	AppStatusPending:    {AppStatusActive, AppStatusRevoked},
+	AppStatusActive:     {AppStatusSuspended, AppStatusDeprecated, AppStatusDisabled, AppStatusRevoked},
+	AppStatusSuspended:  {AppStatusActive, AppStatusDisabled, AppStatusRevoked},
+	AppStatusDeprecated: {AppStatusActive, AppStatusSuspended, AppStatusDisabled, AppStatusRevoked},
+	AppStatusDisabled:   {AppStatusActive, AppStatusRevoked},
+	AppStatusRevoked:    {},
+}
+
+// AppStatusOption is a status choice rendered in forms
+type AppStatusOption struct {
+	Value int32
+	Key   string
+	Name  string
+}
+
+func appStatusOptions(statuses []int32) []AppStatusOption {
+	result := make([]AppStatusOption, 0, len(statuses))
+	for _, s := range statuses {
+		result = append(result, AppStatusOption{Value: s, Key: appStatusKeys[s], Name: appStatusNames[s]})
+	}
+	return result
+}
+
+// parseAppStatus parses a status from its short name or numeric value
+func parseAppStatus(value string) (int32, bool) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	for s, key := range appStatusKeys {
+		if key == value {
+			return s, true
+		}
+	}
+	if s, err := strconv.Atoi(value); err == nil && isValidAppStatus(int32(s)) {
+		return int32(s), true
+	}
+	return 0, false
+}
+
+func isValidAppStatus(status int32) bool {
+	_, ok := appStatusNames[status]
+	return ok
+}
+
+func isInitialAppStatus(status int32) bool {
+	for _, s := range initialAppStatuses() {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// canTransitApp checks if an app is allowed to change from status "from" to status "to"
+func canTransitApp(from, to int32) bool {
+	if from == to {
+		return from != AppStatusRevoked
+	}
+	if from == AppStatusPending && to == AppStatusActive && isApprovalRequired() {
+		return false
+	}
+	for _, s := range appStatusTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// NextStatuses returns statuses the app can change to, including its current status
+func (app *Application) NextStatuses() []AppStatusOption {
+	current := app.GetStatus()
+	statuses := []int32{current}
+	for _, s := range appStatusOrder {
+		if s != current && canTransitApp(current, s) {
+			statuses = append(statuses, s)
+		}
+	}
+	return appStatusOptions(statuses)
+}
+
+// TransitTo changes app's status, returns error if the transition is not allowed.
+// reason and until are used only for suspension (until is nil for indefinite suspension).
+func (app *Application) TransitTo(status int32, reason string, until *time.Time) error {
+	current := app.GetStatus()
+	if !isValidAppStatus(status) {
+		return errors.New("invalid application status")
+	}
+	if !canTransitApp(current, status) {
+		return errors.New("application status cannot be changed from [" + appStatusNames[current] + "] to [" + appStatusNames[status] + "]")
+	}
+	delete(app.Data, attrSuspendReason)
+	delete(app.Data, attrSuspendUntil)
+	if status == AppStatusSuspended {
+		if until != nil && !until.After(time.Now()) {
+			return errors.New("suspension end date must be in the future")
+		}
+		app.Data[attrSuspendReason] = strings.TrimSpace(reason)
+		if until != nil {
+			app.Data[attrSuspendUntil] = until.UnixNano() / 1000000
+		}
+	}
+	app.SetStatus(status)
+	return nil
+}
+
+func (app *Application) GetSuspendReason() string {
+	v, _ := utils.ToString(app.Data[attrSuspendReason])
+	return v
+}
+
+// GetSuspendUntil returns the time suspension ends (nil for indefinite suspension or if the app is not suspended)
+func (app *Application) GetSuspendUntil() *time.Time {
+	if v, ok := utils.ToInt64(app.Data[attrSuspendUntil]); ok {
+		t := time.Unix(0, v*int64(time.Millisecond))
+		return &t
+	}
+	return nil
+}
+
+// GetSuspendUntilStr returns the date suspension ends in format yyyy-mm-dd (empty if not set)
+func (app *Application) GetSuspendUntilStr() string {
+	if t := app.GetSuspendUntil(); t != nil {
+		return t.UTC().Format(keyExpiryLayout)
+	}
+	return ""
+}
+
+// GetEffectiveStatus returns app's status, taking into account that a suspension with an end date that has passed
+// no longer applies
+func (app *Application) GetEffectiveStatus() int32 {
+	status := app.GetStatus()
+	if status == AppStatusSuspended {
+		if t := app.GetSuspendUntil(); t != nil && !t.After(time.Now()) {
+			return AppStatusActive
+		}
+	}
+	return status
+}
+
+// IsVerifiable checks if signatures made with app's key are accepted (active and deprecated apps)
+func (app *Application) IsVerifiable() bool {
+	status := app.GetEffectiveStatus()
+	return status == AppStatusActive || status == AppStatusDeprecated
+}
+
+// CanIssueTokens checks if new tokens can be issued to the app (active apps only)
+func (app *Application) CanIssueTokens() bool {
+	return app.GetEffectiveStatus() == AppStatusActive
+}
@@ -0,0 +1,75 @@
+package tabusus
+
+import "testing"
+
+func TestCanTransitApp(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to int32
+		approval bool
+		want     bool
+	}{
+		{"stay active", AppStatusActive, AppStatusActive, false, true},
+		{"suspend", AppStatusActive, AppStatusSuspended, false, true},
+		{"deprecate", AppStatusActive, AppStatusDeprecated, false, true},
+		{"disable", AppStatusActive, AppStatusDisabled, false, true},
+		{"revoke", AppStatusActive, AppStatusRevoked, false, true},
+		{"back to pending", AppStatusActive, AppStatusPending, false, false},
+		{"resume", AppStatusSuspended, AppStatusActive, false, true},
+		{"deprecated to suspended", AppStatusDeprecated, AppStatusSuspended, false, true},
+		{"suspend disabled", AppStatusDisabled, AppStatusSuspended, false, false},
+		{"enable", AppStatusDisabled, AppStatusActive, false, true},
+		{"stay revoked", AppStatusRevoked, AppStatusRevoked, false, false},
+		{"unrevoke", AppStatusRevoked, AppStatusActive, false, false},
+		{"activate pending", AppStatusPending, AppStatusActive, false, true},
+		{"activate pending with approval", AppStatusPending, AppStatusActive, true, false},
+		{"reject pending with approval", AppStatusPending, AppStatusRevoked, true, true},
+		{"unknown status", 42, AppStatusActive, false, false},
+	}
+	defer func(w *ApprovalWorkflow) { AppApprovals = w }(AppApprovals)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			AppApprovals = &ApprovalWorkflow{Enabled: test.approval}
+			if got := canTransitApp(test.from, test.to); got != test.want {
+				t.Fatalf("canTransitApp(%d, %d) = %v, expected %v", test.from, test.to, got, test.want)
+			}
+		})
+	}
+}
+
+// with approval required, apps cannot be created as disabled then enabled without being approved
+func TestCreateDisabledAppWithApproval(t *testing.T) {
+	dao := setupImportTest(t)
+	AppApprovals = &ApprovalWorkflow{Enabled: true}
+	if isInitialAppStatus(AppStatusDisabled) || isInitialAppStatus(AppStatusActive) || !isInitialAppStatus(AppStatusPending) {
+		t.Errorf("expected pending to be the only initial status, got %v", initialAppStatuses())
+	}
+	records := []appRecord{{Id: "disabled", Status: AppStatusDisabled, PublicKey: testPublicKey(t)}}
+	results, err := importApps(records, conflictOverwrite, false, false, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Action != importFailed {
+		t.Errorf("expected creating a disabled app to fail, got %+v", results[0])
+	}
+	if app, _ := dao.Get("disabled"); app != nil {
+		t.Fatalf("expected disabled app not to be created")
+	}
+
+	// apps disabled after being activated can still be enabled
+	app := NewApp("enabled").SetRsaPubKey(records[0].PublicKey)
+	app.SetStatus(AppStatusDisabled)
+	dao.Save(app)
+	records[0].Id, records[0].Status = "enabled", AppStatusActive
+	if results, _ = importApps(records, conflictOverwrite, false, false, "admin"); results[0].Action != importUpdated {
+		t.Errorf("expected existing disabled app to be enabled, got %+v", results[0])
+	}
+	if err := app.TransitTo(AppStatusActive, "", nil); err != nil {
+		t.Errorf("expected existing disabled app to be enabled, got %v", err)
+	}
+
+	AppApprovals.Enabled = false
+	if !isInitialAppStatus(AppStatusDisabled) || !isInitialAppStatus(AppStatusActive) {
+		t.Errorf("expected apps to be created as disabled or active without approval, got %v", initialAppStatuses())
+	}
+}
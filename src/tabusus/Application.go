@@ -7,6 +7,7 @@ import (
 	"github.com/labstack/gommon/log"
 	"os"
 	"strconv"
+	"time"
 )
 
 const defaultConfigFile = "./config/application.conf"
@@ -15,8 +16,22 @@ const defaultListenPort = 8080
 const staticPath = "/static"
 
 var (
-	AppConfig *HoconConfig
-	AppDao    ApplicationDao
+	AppConfig     *HoconConfig
+	AppDao        ApplicationDao
+	AppChanges    AppChangeFeed
+	AppKeyPolicy  *KeyPolicy
+	AppKeyProof   *KeyProof
+	AppFields     CustomFieldSchema
+	WebhookDao    WebhookDeliveryDao
+	AppWebhooks   *WebhookDispatcher
+	AppUserDao    UserDao
+	ApprovalDao   ApprovalRequestDao
+	AppApprovals  *ApprovalWorkflow
+	AuthAuditLog  AuthAuditDao
+	AppRateLimits *RateLimits
+	AppReplay     *ReplayProtection
+	AppUsageDao   UsageDao
+	AppUsage      *UsageRecorder
 )
 
 func loadAppConfig() *HoconConfig {
@@ -31,7 +46,46 @@ func loadAppConfig() *HoconConfig {
 func initDaos(appConfig *HoconConfig) {
 	url := appConfig.Conf.GetString("db.mongo.url")
 	db := appConfig.Conf.GetString("db.mongo.db")
-	AppDao = NewMongoApplicationDao(url, db)
+	maxChanges := int(appConfig.Conf.GetInt32("changefeed.max_entries", 10000))
+	maxRevisions := int(appConfig.Conf.GetInt32("history.max_revisions_per_app", 0))
+	AppDao = NewMongoApplicationDao(url, db, maxChanges, maxRevisions)
+	if feed, ok := AppDao.(AppChangeFeed); ok {
+		AppChanges = feed
+	} else {
+		// DAO has no native change feed, changes are recorded in an internal event log
+		dao := NewChangeLogApplicationDao(AppDao, maxChanges, maxRevisions)
+		AppDao, AppChanges = dao, dao
+	}
+	if appConfig.Conf.GetBoolean("cache.enabled", true) {
+		AppDao = NewCachingApplicationDao(AppDao, appConfig)
+		AppKeyCache = NewLruCache(int(appConfig.Conf.GetInt32("cache.max_keys", 10000)))
+	}
+	WebhookDao = NewMongoWebhookDeliveryDao(url, db)
+	AppUserDao = NewMongoUserDao(url, db)
+	ApprovalDao = NewMongoApprovalRequestDao(url, db)
+	AuthAuditLog = NewMongoAuthAuditDao(url, db, int(appConfig.Conf.GetInt32("auth.audit_retention_days", 90)))
+	AppUsageDao = NewMongoUsageDao(url, db, int(appConfig.Conf.GetInt32("usage.retention_days", 90)))
+}
+
+// initApp loads configurations and initializes DAOs, shared by the web server and the command-line tool
+func initApp(configFile string) {
+	if configFile == "" {
+		AppConfig = loadAppConfig()
+	} else {
+		AppConfig = LoadAppConfig(configFile)
+	}
+	AppKeyPolicy = loadKeyPolicy(AppConfig)
+	AppFields = loadCustomFieldSchema(AppConfig)
+	initDaos(AppConfig)
+	var err error
+	if AppKeyProof, err = loadKeyProof(AppConfig); err != nil {
+		log.Fatal("Cannot initialize proofs of possession: ", err)
+	}
+	AppSigningKeys = loadSigningKeyManager(AppConfig, NewMongoSigningKeyDao(AppConfig.Conf.GetString("db.mongo.url"), AppConfig.Conf.GetString("db.mongo.db")))
+	AppBundleSigner = loadBundleSigner(AppConfig, AppSigningKeys)
+	AppApprovals = newApprovalWorkflow(AppConfig, ApprovalDao)
+	// the command-line tool records webhook deliveries, the server delivers them
+	AppWebhooks = newWebhookDispatcher(AppConfig, WebhookDao)
 }
 
 func initEcho() *echo.Echo {
@@ -45,20 +99,92 @@ func initEcho() *echo.Echo {
 
 	// register controllers
 	s := NewStats()
+	AppRateLimits = newRateLimits(AppConfig)
+	var err error
+	if AppReplay, err = newReplayProtection(AppConfig); err != nil {
+		log.Fatal("Cannot initialize replay protection: ", err)
+	}
+	s.RateLimit = AppRateLimits.Counters
+	if cache, ok := AppDao.(*CachingApplicationDao); ok {
+		s.Caches = map[string]*LruCache{"apps": cache.Cache, "keys": AppKeyCache}
+	}
 	e.Use(s.Process)
 	e.GET("/stats", s.Handle) // Endpoint to get stats
+	e.GET("/.well-known/jwks.json", actionJwks).Name = "jwks"
+	// key bundles are public, like the JWK set: they are meant for verifiers without access to the API
+	e.GET("/api/v1/bundle", actionApiKeyBundle).Name = "apiKeyBundle"
+	e.GET("/api/v1/bundle/jwks", actionApiKeyBundleJwks).Name = "apiKeyBundleJwks"
+	e.GET("/api/v1/bundle/keys/:id", actionApiBundleKey).Name = "apiBundleKey"
 
 	e.GET("/logout", actionLogout).Name = "logout"
 	e.GET("/login", actionLogin).Name = "login"
 	e.POST("/login", actionLoginSubmit).Name = "login"
-	e.GET("/apps", actionAppList, RequiredAuthMiddleWare).Name = "apps"
-	e.GET("/createApp", actionCreateApp, RequiredAuthMiddleWare).Name = "createApp"
-	e.POST("/createApp", actionCreateAppSubmit, RequiredAuthMiddleWare).Name = "createApp"
-	e.GET("/editApp/:id", actionEditApp, RequiredAuthMiddleWare).Name = "editApp"
-	e.POST("/editApp/:id", actionEditAppSubmit, RequiredAuthMiddleWare).Name = "editApp"
-	e.GET("/deleteApp/:id", actionDeleteApp, RequiredAuthMiddleWare).Name = "deleteApp"
-	e.POST("/deleteApp/:id", actionDeleteAppSubmit, RequiredAuthMiddleWare).Name = "deleteApp"
-	e.GET("/", actionHome, RequiredAuthMiddleWare).Name = "home"
+
+	// admin console
+	adminOnly := []echo.MiddlewareFunc{RequiredAuthMiddleWare, RequiredAdminMiddleWare}
+	e.GET("/apps", actionAppList, adminOnly...).Name = "apps"
+	e.GET("/createApp", actionCreateApp, adminOnly...).Name = "createApp"
+	e.POST("/createApp", actionCreateAppSubmit, adminOnly...).Name = "createApp"
+	e.GET("/editApp/:id", actionEditApp, adminOnly...).Name = "editApp"
+	e.POST("/editApp/:id", actionEditAppSubmit, adminOnly...).Name = "editApp"
+	e.GET("/deleteApp/:id", actionDeleteApp, adminOnly...).Name = "deleteApp"
+	e.POST("/deleteApp/:id", actionDeleteAppSubmit, adminOnly...).Name = "deleteApp"
+	e.GET("/keyChallenge/:id", actionKeyChallenge, adminOnly...).Name = "keyChallenge"
+	e.GET("/searchKey", actionSearchKey, adminOnly...).Name = "searchKey"
+	e.POST("/rollbackApp/:id/:rev", actionRollbackAppSubmit, adminOnly...).Name = "rollbackApp"
+	e.GET("/trash", actionTrash, adminOnly...).Name = "trash"
+	e.POST("/restoreApp/:id", actionRestoreAppSubmit, adminOnly...).Name = "restoreApp"
+	e.GET("/compliance", actionCompliance, adminOnly...).Name = "compliance"
+	e.GET("/importExport", actionImportExport, adminOnly...).Name = "importExport"
+	e.GET("/exportApps", actionExportApps, adminOnly...).Name = "exportApps"
+	e.POST("/importApps", actionImportAppsSubmit, adminOnly...).Name = "importApps"
+	e.GET("/approvals", actionApprovalList, adminOnly...).Name = "approvals"
+	e.POST("/approvals/:id/approve", actionApprovalDecide(true), adminOnly...).Name = "approveRequest"
+	e.POST("/approvals/:id/reject", actionApprovalDecide(false), adminOnly...).Name = "rejectRequest"
+	e.GET("/webhooks", actionWebhookList, adminOnly...).Name = "webhooks"
+	e.GET("/signingKeys", actionSigningKeyList, adminOnly...).Name = "signingKeys"
+	e.POST("/signingKeys/generate", actionSigningKeyGenerate, adminOnly...).Name = "generateSigningKey"
+	e.POST("/signingKeys/import", actionSigningKeyImport, adminOnly...).Name = "importSigningKey"
+	e.POST("/signingKeys/rotate", actionSigningKeyRotate, adminOnly...).Name = "rotateSigningKey"
+	e.POST("/webhooks/:id/redeliver", actionWebhookRedeliver, adminOnly...).Name = "redeliverWebhook"
+	e.GET("/", actionHome, adminOnly...).Name = "home"
+
+	// developer portal
+	portal := e.Group("/portal", RequiredAuthMiddleWare)
+	portal.GET("", actionPortalHome).Name = "portal"
+	portal.GET("/apps/new", actionPortalCreateApp).Name = "portalCreateApp"
+	portal.POST("/apps/new", actionPortalCreateAppSubmit).Name = "portalCreateApp"
+	portal.GET("/apps/new/challenge/:id", actionPortalNewAppKeyChallenge).Name = "portalNewAppKeyChallenge"
+	portal.GET("/apps/:id", actionPortalApp).Name = "portalApp"
+	portal.POST("/apps/:id/key", actionPortalRotateKeySubmit).Name = "portalRotateKey"
+	portal.GET("/apps/:id/key/challenge", actionPortalKeyChallenge).Name = "portalKeyChallenge"
+	portal.GET("/apps/:id/config", actionPortalDownloadConfig).Name = "portalDownloadConfig"
+
+	// register API endpoints
+	api := e.Group("/api/v1", RequiredApiAuthMiddleWare)
+	api.GET("/keys/:fingerprint", actionApiGetKeyOwner).Name = "apiGetKeyOwner"
+	api.GET("/compliance", actionApiCompliance).Name = "apiCompliance"
+	api.GET("/changes", actionApiChanges).Name = "apiChanges"
+	api.GET("/changes/stream", actionApiChangeStream).Name = "apiChangeStream"
+	api.GET("/fields", actionApiCustomFields).Name = "apiCustomFields"
+	api.GET("/apps", actionApiListApps).Name = "apiListApps"
+	api.GET("/apps/export", actionApiExportApps).Name = "apiExportApps"
+	api.POST("/apps/import", actionApiImportApps).Name = "apiImportApps"
+	api.POST("/apps", actionApiCreateApp).Name = "apiCreateApp"
+	api.GET("/apps/:id", actionApiGetApp).Name = "apiGetApp"
+	api.PUT("/apps/:id", actionApiUpdateApp).Name = "apiUpdateApp"
+	api.DELETE("/apps/:id", actionApiDeleteApp).Name = "apiDeleteApp"
+	api.PUT("/apps/:id/key", actionApiRotateKey).Name = "apiRotateKey"
+	api.GET("/apps/:id/key/challenge", actionKeyChallenge).Name = "apiKeyChallenge"
+	api.GET("/audit", actionApiAuthAudit).Name = "apiAuthAudit"
+	api.GET("/usage", actionApiUsage).Name = "apiUsage"
+
+	// runtime endpoints for apps, authenticated by app's signature
+	auth := e.Group("/auth", AppRateLimits.Middleware)
+	auth.POST("/verify", actionAuthVerify).Name = "authVerify"
+	auth.POST("/token", actionAuthToken).Name = "authToken"
+	auth.POST("/verify-request", actionAuthVerifyRequest).Name = "authVerifyRequest"
+	auth.GET("/whoami", actionAuthWhoami).Name = "authWhoami"
 
 	// register session middleware
 	sessionKey := AppConfig.Conf.GetString("session.key", "secret")
@@ -67,9 +193,24 @@ func initEcho() *echo.Echo {
 }
 
 func Start() {
-	AppConfig = loadAppConfig()
+	initApp("")
+	serve()
+}
 
-	initDaos(AppConfig)
+// serve starts background jobs and the web server, configurations and DAOs must have been initialized
+func serve() {
+	if cache, ok := AppDao.(*CachingApplicationDao); ok {
+		cache.watchChanges(AppChanges)
+	}
+	go backfillKeyFingerprints(AppDao)
+	if AppSigningKeys != nil {
+		go AppSigningKeys.run(time.Duration(AppConfig.Conf.GetInt32("signing_keys.check_interval_minutes", 10)) * time.Minute)
+	}
+	AppWebhooks.start(int(AppConfig.Conf.GetInt32("webhooks.workers", 2)))
+	startKeyExpiryScheduler(AppConfig, AppDao, AppWebhooks)
+	startSuspensionScheduler(AppConfig, AppDao, AppWebhooks)
+	startTrashPurgeScheduler(AppConfig, AppDao)
+	AppUsage = newUsageRecorder(AppConfig, AppUsageDao)
 	e := initEcho()
 
 	listenAddr := AppConfig.Conf.GetString("http.listen_addr", defaultListenAddr)
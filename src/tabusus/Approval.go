@@ -0,0 +1,392 @@
+package tabusus
+
+import (
+	"context"
+	"errors"
+	"github.com/labstack/gommon/log"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/options"
+	"strings"
+	"tabusus/utils"
+	"time"
+)
+
+const (
+	tableApprovals = "approvals"
+
+	approvalAppCreate = "app.create" // registration of a new app
+	approvalKeyChange = "key.change" // change of an app's public key
+
+	approvalPending    = "pending"
+	approvalApproved   = "approved"
+	approvalRejected   = "rejected"
+	approvalSuperseded = "superseded" // replaced by a newer request for the same change
+)
+
+// ApprovalRequest is a change that must be approved by a user other than the requester before it takes effect
+type ApprovalRequest struct {
+	Id          string    `bson:"id" json:"id"`
+	Type        string    `bson:"type" json:"type"`
+	AppId       string    `bson:"app_id" json:"app_id"`
+	PublicKey   string    `bson:"public_key,omitempty" json:"public_key,omitempty"` // new key of key change requests
+	KeyExpiry   string    `bson:"key_expiry,omitempty" json:"key_expiry,omitempty"` // new key's expiry date (yyyy-mm-dd)
+	KeyProven   time.Time `bson:"key_proven,omitempty" json:"key_proven,omitempty"` // time possession of the new key was proven
+	Status      string    `bson:"status" json:"status"`
+	RequestedBy string    `bson:"requested_by" json:"requested_by"`
+	DecidedBy   string    `bson:"decided_by,omitempty" json:"decided_by,omitempty"`
+	Comment     string    `bson:"comment,omitempty" json:"comment,omitempty"`
+	TimeCreated time.Time `bson:"tc" json:"time_created"`
+	TimeDecided time.Time `bson:"td,omitempty" json:"time_decided,omitempty"`
+}
+
+func (r *ApprovalRequest) UrlApprove() string {
+	return "/approvals/" + r.Id + "/approve"
+}
+
+func (r *ApprovalRequest) UrlReject() string {
+	return "/approvals/" + r.Id + "/reject"
+}
+
+// GetKeyFingerprints returns fingerprints of the requested key (nil if not available)
+func (r *ApprovalRequest) GetKeyFingerprints() *KeyFingerprints {
+	if r.PublicKey == "" {
+		return nil
+	}
+	return NewApp(r.AppId).SetRsaPubKey(r.PublicKey).GetKeyFingerprints()
+}
+
+/*----------------------------------------------------------------------*/
+
+// ApprovalWorkflow enforces the four-eyes rule: new apps and key changes take effect only after being approved
+// by a user other than the requester
+type ApprovalWorkflow struct {
+	Enabled  bool
+	dao      ApprovalRequestDao
+	notifier Notifier
+}
+
+// newApprovalWorkflow builds the workflow from configurations at "approval"
+func newApprovalWorkflow(appConfig *HoconConfig, dao ApprovalRequestDao) *ApprovalWorkflow {
+	return &ApprovalWorkflow{
+		Enabled:  appConfig.Conf.GetBoolean("approval.enabled", false),
+		dao:      dao,
+		notifier: loadNotifier(appConfig, "approval.notification"),
+	}
+}
+
+// isApprovalRequired checks if approval is required for changes to take effect
+func isApprovalRequired() bool {
+	return AppApprovals != nil && AppApprovals.Enabled
+}
+
+func (w *ApprovalWorkflow) notify(event, subject string, r *ApprovalRequest) {
+	if w.notifier == nil {
+		return
+	}
+	n := &Notification{
+		Event:   event,
+		Subject: subject,
+		Message: subject + " (request: " + r.Id + ", app: " + r.AppId + ", requested by: " + r.RequestedBy + ").",
+		Data: map[string]interface{}{
+			"request": r,
+		},
+		Time: time.Now(),
+	}
+	if err := w.notifier.Notify(n); err != nil {
+		log.Error("Error while sending notification for approval request [", r.Id, "]: ", err)
+	}
+}
+
+func (w *ApprovalWorkflow) submit(r *ApprovalRequest) error {
+	if err := w.dao.Save(r); err != nil {
+		return err
+	}
+	subject := "Application [" + r.AppId + "] is waiting for approval"
+	if r.Type == approvalKeyChange {
+		subject = "Key change of application [" + r.AppId + "] is waiting for approval"
+	}
+	w.notify("approval.requested", subject, r)
+	return nil
+}
+
+// RequestCreate submits a request to approve a newly created app, the app must have been saved with status pending
+func (w *ApprovalWorkflow) RequestCreate(app *Application, user string) error {
+	return w.submit(&ApprovalRequest{
+		Id:          utils.RandomHex(16),
+		Type:        approvalAppCreate,
+		AppId:       app.GetId(),
+		Status:      approvalPending,
+		RequestedBy: user,
+		TimeCreated: time.Now(),
+	})
+}
+
+// RequestKeyChange submits a request to change an app's public key, pending key changes of the app are superseded.
+// keyProven is the time possession of the new key was proven (nil if not proven).
+func (w *ApprovalWorkflow) RequestKeyChange(app *Application, pubKey, keyExpiry string, keyProven *time.Time, user string) error {
+	for _, r := range w.dao.ListByApp(app.GetId(), approvalPending) {
+		if r.Type == approvalKeyChange {
+			r.Status, r.DecidedBy, r.TimeDecided = approvalSuperseded, user, time.Now()
+			// a request decided meanwhile is left as decided
+			if _, err := w.dao.Decide(&r); err != nil {
+				return err
+			}
+		}
+	}
+	r := &ApprovalRequest{
+		Id:          utils.RandomHex(16),
+		Type:        approvalKeyChange,
+		AppId:       app.GetId(),
+		PublicKey:   strings.TrimSpace(pubKey),
+		KeyExpiry:   keyExpiry,
+		Status:      approvalPending,
+		RequestedBy: user,
+		TimeCreated: time.Now(),
+	}
+	if keyProven != nil {
+		r.KeyProven = *keyProven
+	}
+	return w.submit(r)
+}
+
+// PendingKeyChange returns the pending key change request of an app (nil if none)
+func (w *ApprovalWorkflow) PendingKeyChange(appId string) *ApprovalRequest {
+	for _, r := range w.dao.ListByApp(appId, approvalPending) {
+		if r.Type == approvalKeyChange {
+			return &r
+		}
+	}
+	return nil
+}
+
+// load returns a pending request and its app, checking that user is allowed to decide on it
+func (w *ApprovalWorkflow) load(id, user string) (*ApprovalRequest, *Application, error) {
+	r, err := w.dao.Get(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if r == nil {
+		return nil, nil, errors.New("approval request [" + id + "] not found")
+	}
+	if r.Status != approvalPending {
+		return nil, nil, errors.New("approval request [" + id + "] has already been " + r.Status)
+	}
+	if r.RequestedBy == user {
+		return nil, nil, errors.New("requester cannot approve or reject their own request")
+	}
+	app, err := AppDao.Get(r.AppId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if app == nil || app.IsDeleted() {
+		return nil, nil, errors.New("application [" + r.AppId + "] no longer exists")
+	}
+	return r, app, nil
+}
+
+// decide records the decision on a request if it is still pending: the requested change must be applied only if
+// decide succeeds, so that concurrent decisions on the same request cannot both take effect
+func (w *ApprovalWorkflow) decide(r *ApprovalRequest, status, user, comment string) error {
+	r.Status, r.DecidedBy, r.Comment, r.TimeDecided = status, user, strings.TrimSpace(comment), time.Now()
+	decided, err := w.dao.Decide(r)
+	if err != nil {
+		return err
+	}
+	if !decided {
+		return errors.New("approval request [" + r.Id + "] has already been decided")
+	}
+	return nil
+}
+
+// reopen reverts the decision on a request whose change could not be applied
+func (w *ApprovalWorkflow) reopen(r *ApprovalRequest) {
+	r.Status, r.DecidedBy, r.Comment, r.TimeDecided = approvalPending, "", "", time.Time{}
+	if err := w.dao.Save(r); err != nil {
+		log.Error("Error while reopening approval request [", r.Id, "]: ", err)
+	}
+}
+
+// Approve approves a request and applies the requested change, returns the updated app
+func (w *ApprovalWorkflow) Approve(id, user, comment string) (*ApprovalRequest, *Application, error) {
+	r, app, err := w.load(id, user)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch r.Type {
+	case approvalAppCreate:
+		if app.GetStatus() != AppStatusPending {
+			return nil, nil, errors.New("application [" + app.GetId() + "] is no longer pending approval")
+		}
+	case approvalKeyChange:
+		if errMsg := validateAppInput(app.GetId(), false, r.PublicKey, r.KeyExpiry); errMsg != "" {
+			return nil, nil, errors.New(errMsg)
+		}
+	}
+	if err := w.decide(r, approvalApproved, user, comment); err != nil {
+		return nil, nil, err
+	}
+	switch r.Type {
+	case approvalAppCreate:
+		app.SetStatus(AppStatusActive)
+	case approvalKeyChange:
+		keyExpiry, _ := parseKeyExpiry(r.KeyExpiry)
+		app.SetRsaPubKey(r.PublicKey)
+		if !r.KeyProven.IsZero() {
+			app.SetKeyProven(&r.KeyProven)
+		}
+		if app.GetKeyExpiryStr() != r.KeyExpiry {
+			app.SetKeyExpiry(keyExpiry)
+		}
+	}
+	app.SetUpdatedBy(user).SetTimeUpdated(time.Now())
+	if err := AppDao.Save(app); err != nil {
+		w.reopen(r)
+		return nil, nil, err
+	}
+	w.notify("approval."+r.Status, "Request for application ["+r.AppId+"] has been "+r.Status+" by "+user, r)
+	return r, app, nil
+}
+
+// Reject rejects a request; rejected registrations are revoked
+func (w *ApprovalWorkflow) Reject(id, user, comment string) (*ApprovalRequest, *Application, error) {
+	r, app, err := w.load(id, user)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := w.decide(r, approvalRejected, user, comment); err != nil {
+		return nil, nil, err
+	}
+	if r.Type == approvalAppCreate && app.GetStatus() == AppStatusPending {
+		app.SetStatus(AppStatusRevoked).SetUpdatedBy(user).SetTimeUpdated(time.Now())
+		if err := AppDao.Save(app); err != nil {
+			w.reopen(r)
+			return nil, nil, err
+		}
+	}
+	w.notify("approval."+r.Status, "Request for application ["+r.AppId+"] has been "+r.Status+" by "+user, r)
+	return r, app, nil
+}
+
+/*----------------------------------------------------------------------*/
+
+type ApprovalRequestDao interface {
+	List(status string, limit int) []ApprovalRequest  // lists latest requests, optionally filtered by status
+	ListByApp(appId, status string) []ApprovalRequest // lists requests of an app, optionally filtered by status
+	Get(id string) (*ApprovalRequest, error)
+	Save(r *ApprovalRequest) error
+	// Decide records the decision (status, decider, comment and time) on a request if it is still pending,
+	// returns false if the request has been decided already
+	Decide(r *ApprovalRequest) (bool, error)
+}
+
+type MongoApprovalRequestDao struct {
+	url    string        // connection url
+	db     string        // database name
+	client *mongo.Client // client instance
+}
+
+func NewMongoApprovalRequestDao(url, db string) ApprovalRequestDao {
+	m := &MongoApprovalRequestDao{
+		url:    url,
+		db:     db,
+		client: mongoConnect(url),
+	}
+	collection := m.client.Database(db).Collection(tableApprovals)
+	for _, model := range []mongo.IndexModel{
+		{Keys: bson.M{"id": 1}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.M{"app_id": 1}},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_, err := collection.Indexes().CreateOne(ctx, model)
+		cancel()
+		if err != nil {
+			log.Error("Error while creating index on [", tableApprovals, "]: ", err)
+		}
+	}
+	return m
+}
+
+func (dao *MongoApprovalRequestDao) find(filter bson.M, limit int) []ApprovalRequest {
+	collection := dao.client.Database(dao.db).Collection(tableApprovals)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	opts := options.Find().SetSort(bson.M{"tc": -1})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	cur, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		log.Warn(err)
+		return nil
+	}
+	defer cur.Close(ctx)
+	var result []ApprovalRequest
+	for cur.Next(ctx) {
+		var row ApprovalRequest
+		if err := cur.Decode(&row); err != nil {
+			log.Error(err)
+		} else {
+			result = append(result, row)
+		}
+	}
+	return result
+}
+
+func (dao *MongoApprovalRequestDao) List(status string, limit int) []ApprovalRequest {
+	filter := bson.M{}
+	if status != "" {
+		filter["status"] = status
+	}
+	return dao.find(filter, limit)
+}
+
+func (dao *MongoApprovalRequestDao) ListByApp(appId, status string) []ApprovalRequest {
+	filter := bson.M{"app_id": appId}
+	if status != "" {
+		filter["status"] = status
+	}
+	return dao.find(filter, 0)
+}
+
+func (dao *MongoApprovalRequestDao) Get(id string) (*ApprovalRequest, error) {
+	collection := dao.client.Database(dao.db).Collection(tableApprovals)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dbResult := collection.FindOne(ctx, bson.M{"id": id})
+	if dbResult.Err() != nil {
+		log.Error(dbResult.Err())
+		return nil, dbResult.Err()
+	}
+	var row ApprovalRequest
+	err := dbResult.Decode(&row)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return &row, nil
+}
+
+func (dao *MongoApprovalRequestDao) Save(r *ApprovalRequest) error {
+	collection := dao.client.Database(dao.db).Collection(tableApprovals)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := collection.ReplaceOne(ctx, bson.M{"id": r.Id}, r, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (dao *MongoApprovalRequestDao) Decide(r *ApprovalRequest) (bool, error) {
+	collection := dao.client.Database(dao.db).Collection(tableApprovals)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := collection.UpdateOne(ctx, bson.M{"id": r.Id, "status": approvalPending}, bson.M{"$set": bson.M{
+		"status": r.Status, "decided_by": r.DecidedBy, "comment": r.Comment, "td": r.TimeDecided,
+	}})
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
@@ -0,0 +1,49 @@
+package tabusus
+
+import (
+	"github.com/labstack/echo"
+	"net/http"
+)
+
+func actionApprovalList(c echo.Context) error {
+	status := c.QueryParam("status")
+	if status == "" {
+		status = approvalPending
+	} else if status == "all" {
+		status = ""
+	}
+	return c.Render(http.StatusOK, "layout:approvals", map[string]interface{}{
+		"active":   "approvals",
+		"status":   c.QueryParam("status"),
+		"enabled":  isApprovalRequired(),
+		"user":     currentUser(c),
+		"requests": ApprovalDao.List(status, 500),
+	})
+}
+
+func actionApprovalDecide(approve bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := c.Param("id")
+		user := currentUser(c)
+		sess := getSession(c)
+		if approve {
+			if r, app, err := AppApprovals.Approve(id, user, c.FormValue("comment")); err != nil {
+				sess.AddFlash("Error while approving request [" + id + "]: " + err.Error())
+			} else {
+				dispatchAppEvent(c, EventAppUpdated, app)
+				sess.AddFlash("Request [" + id + "] for application [" + r.AppId + "] has been approved.")
+			}
+		} else {
+			if r, app, err := AppApprovals.Reject(id, user, c.FormValue("comment")); err != nil {
+				sess.AddFlash("Error while rejecting request [" + id + "]: " + err.Error())
+			} else {
+				if r.Type == approvalAppCreate {
+					dispatchAppEvent(c, EventAppDisabled, app)
+				}
+				sess.AddFlash("Request [" + id + "] for application [" + r.AppId + "] has been rejected.")
+			}
+		}
+		sess.Save(c.Request(), c.Response())
+		return c.Redirect(http.StatusFound, c.Echo().Reverse("approvals"))
+	}
+}
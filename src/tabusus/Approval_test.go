@@ -0,0 +1,200 @@
+package tabusus
+
+import (
+	"sync"
+	"testing"
+)
+
+// memoryApprovalRequestDao keeps requests in memory, Decide has the semantics of the Mongo implementation
+type memoryApprovalRequestDao struct {
+	mutex    sync.Mutex
+	requests []*ApprovalRequest
+}
+
+func (dao *memoryApprovalRequestDao) List(status string, limit int) []ApprovalRequest {
+	dao.mutex.Lock()
+	defer dao.mutex.Unlock()
+	var result []ApprovalRequest
+	for i := len(dao.requests) - 1; i >= 0 && (limit <= 0 || len(result) < limit); i-- {
+		if status == "" || dao.requests[i].Status == status {
+			result = append(result, *dao.requests[i])
+		}
+	}
+	return result
+}
+
+func (dao *memoryApprovalRequestDao) ListByApp(appId, status string) []ApprovalRequest {
+	var result []ApprovalRequest
+	for _, r := range dao.List(status, 0) {
+		if r.AppId == appId {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+func (dao *memoryApprovalRequestDao) Get(id string) (*ApprovalRequest, error) {
+	dao.mutex.Lock()
+	defer dao.mutex.Unlock()
+	for _, r := range dao.requests {
+		if r.Id == id {
+			result := *r
+			return &result, nil
+		}
+	}
+	return nil, nil
+}
+
+func (dao *memoryApprovalRequestDao) Save(r *ApprovalRequest) error {
+	dao.mutex.Lock()
+	defer dao.mutex.Unlock()
+	saved := *r
+	for i, v := range dao.requests {
+		if v.Id == r.Id {
+			dao.requests[i] = &saved
+			return nil
+		}
+	}
+	dao.requests = append(dao.requests, &saved)
+	return nil
+}
+
+func (dao *memoryApprovalRequestDao) Decide(r *ApprovalRequest) (bool, error) {
+	dao.mutex.Lock()
+	defer dao.mutex.Unlock()
+	for _, v := range dao.requests {
+		if v.Id == r.Id && v.Status == approvalPending {
+			v.Status, v.DecidedBy, v.Comment, v.TimeDecided = r.Status, r.DecidedBy, r.Comment, r.TimeDecided
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// setupApprovalTest enables approval with requests kept in memory
+func setupApprovalTest(t *testing.T, apps ...*Application) (*memoryApplicationDao, *memoryApprovalRequestDao) {
+	appDao := setupImportTest(t, apps...)
+	dao := &memoryApprovalRequestDao{}
+	AppApprovals = &ApprovalWorkflow{Enabled: true, dao: dao}
+	return appDao, dao
+}
+
+func TestApproveCreate(t *testing.T) {
+	app := testImportApp(t, "app", "")
+	app.SetStatus(AppStatusPending)
+	apps, dao := setupApprovalTest(t, app)
+	if err := AppApprovals.RequestCreate(app, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	id := dao.requests[0].Id
+
+	// requester cannot approve their own request
+	if _, _, err := AppApprovals.Approve(id, "alice", ""); err == nil {
+		t.Errorf("expected requester not to be able to approve their own request")
+	}
+	if _, _, err := AppApprovals.Reject(id, "alice", ""); err == nil {
+		t.Errorf("expected requester not to be able to reject their own request")
+	}
+	if r, _ := dao.Get(id); r.Status != approvalPending {
+		t.Errorf("expected request still pending, got [%s]", r.Status)
+	}
+	if app, _ := apps.Get("app"); app.GetStatus() != AppStatusPending {
+		t.Errorf("expected app still pending, got [%s]", app.GetStatusStr())
+	}
+
+	r, approved, err := AppApprovals.Approve(id, "bob", " ok ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != approvalApproved || r.DecidedBy != "bob" || r.Comment != "ok" {
+		t.Errorf("expected request approved by bob, got %+v", r)
+	}
+	if app, _ := apps.Get("app"); app.GetStatus() != AppStatusActive || approved.GetUpdatedBy() != "bob" {
+		t.Errorf("expected app activated by bob, got [%s] by [%s]", app.GetStatusStr(), app.GetUpdatedBy())
+	}
+	if _, _, err := AppApprovals.Reject(id, "carol", ""); err == nil {
+		t.Errorf("expected approved request not to be rejected")
+	}
+}
+
+func TestRejectCreate(t *testing.T) {
+	app := testImportApp(t, "app", "")
+	app.SetStatus(AppStatusPending)
+	apps, dao := setupApprovalTest(t, app)
+	AppApprovals.RequestCreate(app, "alice")
+	if _, _, err := AppApprovals.Reject(dao.requests[0].Id, "bob", "no"); err != nil {
+		t.Fatal(err)
+	}
+	if app, _ := apps.Get("app"); app.GetStatus() != AppStatusRevoked {
+		t.Errorf("expected rejected app to be revoked, got [%s]", app.GetStatusStr())
+	}
+}
+
+func TestKeyChangeSuperseded(t *testing.T) {
+	app := testImportApp(t, "app", "")
+	oldKey := app.GetRsaPubKey()
+	apps, dao := setupApprovalTest(t, app)
+	firstKey, secondKey := testPublicKey(t), testPublicKey(t)
+	if err := AppApprovals.RequestKeyChange(app, firstKey, "", nil, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	first := dao.requests[0].Id
+	if err := AppApprovals.RequestKeyChange(app, secondKey, "2030-01-31", nil, "carol"); err != nil {
+		t.Fatal(err)
+	}
+	second := dao.requests[1].Id
+
+	if r, _ := dao.Get(first); r.Status != approvalSuperseded || r.DecidedBy != "carol" {
+		t.Errorf("expected first request superseded by carol, got [%s] by [%s]", r.Status, r.DecidedBy)
+	}
+	if r := AppApprovals.PendingKeyChange("app"); r == nil || r.Id != second {
+		t.Errorf("expected second request to be pending, got %+v", r)
+	}
+	if _, _, err := AppApprovals.Approve(first, "bob", ""); err == nil {
+		t.Errorf("expected superseded request not to be approved")
+	}
+	if app, _ := apps.Get("app"); app.GetRsaPubKey() != oldKey {
+		t.Errorf("expected key unchanged after approving superseded request")
+	}
+
+	if _, _, err := AppApprovals.Approve(second, "bob", ""); err != nil {
+		t.Fatal(err)
+	}
+	if app, _ := apps.Get("app"); app.GetRsaPubKey() != NewApp("app").SetRsaPubKey(secondKey).GetRsaPubKey() || app.GetKeyExpiryStr() != "2030-01-31" {
+		t.Errorf("expected key of second request, got expiry [%s]", app.GetKeyExpiryStr())
+	}
+}
+
+func TestApproveConcurrently(t *testing.T) {
+	app := testImportApp(t, "app", "")
+	_, dao := setupApprovalTest(t, app)
+	AppApprovals.RequestKeyChange(app, testPublicKey(t), "", nil, "alice")
+	id := dao.requests[0].Id
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(approve bool) {
+			defer wg.Done()
+			var err error
+			if approve {
+				_, _, err = AppApprovals.Approve(id, "bob", "")
+			} else {
+				_, _, err = AppApprovals.Reject(id, "carol", "")
+			}
+			errs <- err
+		}(i%2 == 0)
+	}
+	wg.Wait()
+	close(errs)
+	succeeded := 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("expected exactly one decision to succeed, got %d", succeeded)
+	}
+}
@@ -0,0 +1,105 @@
+package tabusus
+
+import (
+	"github.com/labstack/echo"
+	"net"
+	"tabusus/jws"
+	"time"
+)
+
+// codes of authentication failures other than constraint violations
+const (
+	authErrInvalidAssertion = "invalid_assertion"
+	authErrUnknownApp       = "unknown_app"
+	authErrAppNotVerifiable = "app_not_verifiable"
+	authErrInvalidSignature = "invalid_signature"
+	authErrExpired          = "assertion_expired"
+	authErrRateLimited      = "rate_limited"
+	authErrMissingSignature = "missing_signature"
+	authErrSignatureExpired = "signature_expired"
+	authErrReplayed         = "replayed"
+	authErrTokensNotAllowed = "tokens_not_allowed"
+)
+
+// AuthError is returned when an app fails to authenticate, Code is machine-readable and Reason is human readable
+type AuthError struct {
+	Code   string
+	Reason string
+}
+
+func (e *AuthError) Error() string {
+	return e.Reason
+}
+
+// authClientIp returns IP address of the client, proxy headers are honoured only if "auth.trust_proxy_headers" is enabled
+func authClientIp(c echo.Context) net.IP {
+	if AppConfig.Conf.GetBoolean("auth.trust_proxy_headers", false) {
+		return net.ParseIP(c.RealIP())
+	}
+	host, _, err := net.SplitHostPort(c.Request().RemoteAddr)
+	if err != nil {
+		host = c.Request().RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// verifyAppAssertion authenticates an app by its signed assertion and checks the attempt against app's constraints.
+// If forToken is true, the assertion is to be exchanged for an access token: the app must be allowed to get new tokens
+// and the assertion is single-use regardless of "auth.assertions.single_use". Returns the app and the assertion if
+// authentication succeeds; the app is also returned (if identified) on failure.
+func verifyAppAssertion(token string, clientIp net.IP, forToken bool, now time.Time) (*Application, *jws.Assertion, *AuthError) {
+	assertion, signingInput, signature, err := jws.ParseAssertion(token)
+	if err != nil {
+		return nil, nil, &AuthError{authErrInvalidAssertion, "Invalid assertion: " + err.Error()}
+	}
+	app, err := AppDao.Get(assertion.AppId)
+	if err != nil {
+		return nil, assertion, &AuthError{authErrUnknownApp, "Error while getting application [" + assertion.AppId + "]: " + err.Error()}
+	}
+	if app == nil || app.IsDeleted() {
+		return nil, assertion, &AuthError{authErrUnknownApp, "Application [" + assertion.AppId + "] not found"}
+	}
+	if !app.IsKeyValid() {
+		return app, assertion, &AuthError{authErrAppNotVerifiable, "Application [" + app.GetId() + "] cannot be verified (status: " + app.GetStatusStr() + ", key valid: no)"}
+	}
+	pubKey := parsePublicKey(app.GetRsaPubKey())
+	if pubKey == nil {
+		return app, assertion, &AuthError{authErrAppNotVerifiable, "Public key of application [" + app.GetId() + "] is invalid"}
+	}
+	if err := jws.Verify(assertion.Alg, pubKey, signingInput, signature); err != nil {
+		return app, assertion, &AuthError{authErrInvalidSignature, "Invalid signature: " + err.Error()}
+	}
+	skew := time.Duration(AppConfig.Conf.GetInt32("auth.clock_skew_seconds", 60)) * time.Second
+	if now.After(assertion.ExpiresAt.Add(skew)) {
+		return app, assertion, &AuthError{authErrExpired, "Assertion has expired"}
+	}
+	if !assertion.NotBefore.IsZero() && now.Add(skew).Before(assertion.NotBefore) {
+		return app, assertion, &AuthError{authErrInvalidAssertion, "Assertion is not valid yet"}
+	}
+	if !assertion.IssuedAt.IsZero() && now.Add(skew).Before(assertion.IssuedAt) {
+		return app, assertion, &AuthError{authErrInvalidAssertion, "Assertion is issued in the future"}
+	}
+	if forToken && !app.CanIssueTokens() {
+		return app, assertion, &AuthError{authErrTokensNotAllowed, "New tokens cannot be issued to application [" + app.GetId() + "] (status: " + app.GetStatusStr() + ")"}
+	}
+	violation := app.CheckConstraints(AuthRequest{
+		ClientIp:  clientIp,
+		Time:      now,
+		TokenTtl:  assertion.Lifetime(),
+		Audiences: assertion.Audiences,
+		Scopes:    assertion.Scopes,
+	})
+	if violation != nil {
+		return app, assertion, &AuthError{violation.Code, violation.Reason}
+	}
+	// recorded last, so that only accepted assertions are used up
+	if forToken || AppConfig.Conf.GetBoolean("auth.assertions.single_use", true) {
+		if assertion.Jti == "" {
+			return app, assertion, &AuthError{authErrInvalidAssertion, "Claim jti is required"}
+		}
+		if !AppReplay.use("jti", app.GetId(), assertion.Jti, assertion.ExpiresAt.Add(skew)) {
+			return app, assertion, &AuthError{authErrReplayed, "Assertion [" + assertion.Jti + "] has already been used"}
+		}
+	}
+	return app, assertion, nil
+}
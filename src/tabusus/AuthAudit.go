@@ -0,0 +1,120 @@
+package tabusus
+
+import (
+	"context"
+	"github.com/labstack/gommon/log"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/options"
+	"tabusus/utils"
+	"time"
+)
+
+const tableAuthAudit = "auth_audit"
+
+// AuthAuditEntry records an authentication attempt of an app at a verification/token endpoint
+type AuthAuditEntry struct {
+	Id       string    `bson:"id" json:"id"`
+	Time     time.Time `bson:"time" json:"time"`
+	AppId    string    `bson:"app" json:"app"` // empty if the app could not be identified
+	Endpoint string    `bson:"endpoint" json:"endpoint"`
+	ClientIp string    `bson:"client_ip" json:"client_ip"`
+	Success  bool      `bson:"success" json:"success"`
+	Code     string    `bson:"code,omitempty" json:"code,omitempty"`     // rejection code, e.g. ip_not_allowed
+	Reason   string    `bson:"reason,omitempty" json:"reason,omitempty"` // human readable rejection reason
+}
+
+// recordAuthAttempt writes an audit entry of an authentication attempt, errors are logged only
+func recordAuthAttempt(entry *AuthAuditEntry) {
+	if AuthAuditLog == nil {
+		return
+	}
+	entry.Id = utils.RandomHex(16)
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	if err := AuthAuditLog.Add(entry); err != nil {
+		log.Error("Error while writing audit entry for app [", entry.AppId, "]: ", err)
+	}
+	if AppUsage != nil && entry.AppId != "" {
+		AppUsage.Record(entry.AppId, entry.Endpoint, entry.Success, entry.ClientIp, entry.Time)
+	}
+}
+
+/*----------------------------------------------------------------------*/
+
+type AuthAuditDao interface {
+	Add(entry *AuthAuditEntry) error
+	List(appId string, limit int) []AuthAuditEntry // lists latest entries, optionally filtered by app
+}
+
+type MongoAuthAuditDao struct {
+	url    string        // connection url
+	db     string        // database name
+	client *mongo.Client // client instance
+}
+
+// NewMongoAuthAuditDao creates the DAO, entries older than retentionDays are removed by a TTL index (0: kept forever)
+func NewMongoAuthAuditDao(url, db string, retentionDays int) AuthAuditDao {
+	m := &MongoAuthAuditDao{
+		url:    url,
+		db:     db,
+		client: mongoConnect(url),
+	}
+	collection := m.client.Database(db).Collection(tableAuthAudit)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	indexes := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "app", Value: 1}, {Key: "time", Value: -1}}},
+	}
+	if retentionDays > 0 {
+		indexes = append(indexes, mongo.IndexModel{
+			Keys:    bson.M{"time": 1},
+			Options: options.Index().SetExpireAfterSeconds(int32(retentionDays * 24 * 3600)),
+		})
+	}
+	for _, index := range indexes {
+		if _, err := collection.Indexes().CreateOne(ctx, index); err != nil {
+			log.Error("Error while creating index on [", tableAuthAudit, "]: ", err)
+		}
+	}
+	return m
+}
+
+func (dao *MongoAuthAuditDao) Add(entry *AuthAuditEntry) error {
+	collection := dao.client.Database(dao.db).Collection(tableAuthAudit)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := collection.InsertOne(ctx, entry)
+	return err
+}
+
+func (dao *MongoAuthAuditDao) List(appId string, limit int) []AuthAuditEntry {
+	collection := dao.client.Database(dao.db).Collection(tableAuthAudit)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	filter := bson.M{}
+	if appId != "" {
+		filter["app"] = appId
+	}
+	opts := options.Find().SetSort(bson.M{"time": -1})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	cur, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		log.Warn(err)
+		return nil
+	}
+	defer cur.Close(ctx)
+	var result []AuthAuditEntry
+	for cur.Next(ctx) {
+		var row AuthAuditEntry
+		if err := cur.Decode(&row); err != nil {
+			log.Error(err)
+		} else {
+			result = append(result, row)
+		}
+	}
+	return result
+}
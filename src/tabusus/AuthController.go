@@ -0,0 +1,242 @@
+package tabusus
+
+import (
+	"bytes"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"tabusus/jws"
+	"time"
+)
+
+const (
+	endpointVerify        = "verify"
+	endpointVerifyRequest = "verify_request"
+	endpointWhoami        = "whoami"
+)
+
+// authErrorStatus maps an authentication failure to HTTP status: 403 if the app is authenticated but not allowed, 401 otherwise
+func authErrorStatus(authErr *AuthError) int {
+	switch authErr.Code {
+	case violationIpNotAllowed, violationOutsideTimeWindow, violationTtlExceeded, violationAudienceNotAllowed, violationScopeNotAllowed,
+		authErrTokensNotAllowed:
+		return http.StatusForbidden
+	case authErrInvalidAssertion:
+		return http.StatusBadRequest
+	case authErrReplayed:
+		return http.StatusConflict
+	}
+	return http.StatusUnauthorized
+}
+
+// authenticateAssertion verifies the assertion submitted as form/JSON field "assertion", applies app's rate limit and
+// records the attempt in the audit log. If authentication fails, the rejection is sent and the returned app is nil
+// (the error is the one of sending).
+func authenticateAssertion(c echo.Context, endpoint string) (*Application, *jws.Assertion, error) {
+	var req struct {
+		Assertion string `json:"assertion" form:"assertion"`
+	}
+	if err := c.Bind(&req); err != nil || req.Assertion == "" {
+		return nil, nil, apiResponse(c, http.StatusBadRequest, "Parameter [assertion] is required!", map[string]interface{}{"error": authErrInvalidAssertion})
+	}
+	clientIp := authClientIp(c)
+	now := time.Now()
+	app, assertion, authErr := verifyAppAssertion(req.Assertion, clientIp, endpoint == endpointToken, now)
+	entry := &AuthAuditEntry{Time: now, Endpoint: endpoint, ClientIp: clientIp.String(), Success: authErr == nil}
+	if app != nil {
+		entry.AppId = app.GetId()
+	}
+	if authErr != nil {
+		entry.Code, entry.Reason = authErr.Code, authErr.Reason
+		recordAuthAttempt(entry)
+		return nil, nil, apiResponse(c, authErrorStatus(authErr), authErr.Reason, map[string]interface{}{"error": authErr.Code})
+	}
+	if ok, wait := AppRateLimits.AllowApp(app); !ok {
+		entry.Success, entry.Code, entry.Reason = false, authErrRateLimited, "Rate limit of application ["+app.GetId()+"] exceeded"
+		recordAuthAttempt(entry)
+		return nil, nil, rateLimitedResponse(c, wait, entry.Reason+", retry later!")
+	}
+	recordAuthAttempt(entry)
+	return app, assertion, nil
+}
+
+// POST /auth/verify: verifies an app assertion (JWT signed with app's private key) submitted as form/JSON field "assertion".
+// Rejections carry a machine-readable code in data.error, e.g. "ip_not_allowed", and are recorded in the audit log.
+func actionAuthVerify(c echo.Context) error {
+	app, assertion, err := authenticateAssertion(c, endpointVerify)
+	if app == nil {
+		return err
+	}
+	return apiResponse(c, http.StatusOK, "Ok", map[string]interface{}{
+		"app":        app.GetId(),
+		"audience":   assertion.Audiences,
+		"scope":      assertion.Scopes,
+		"expires_at": assertion.ExpiresAt,
+	})
+}
+
+// POST /auth/token: exchanges an app assertion (see /auth/verify) for an access token signed by Tabusus, for the
+// audiences and scopes of the assertion. Services verify tokens offline with the keys at /.well-known/jwks.json.
+// Only active apps get tokens (deprecated ones are rejected with "tokens_not_allowed"), each assertion is accepted once.
+func actionAuthToken(c echo.Context) error {
+	if AppSigningKeys == nil {
+		return apiResponse(c, http.StatusServiceUnavailable, errSigningKeysMissing.Error(), nil)
+	}
+	app, assertion, err := authenticateAssertion(c, endpointToken)
+	if app == nil {
+		return err
+	}
+	token, expiresAt, err := issueAccessToken(app, assertion, tokenIssuer(c), time.Now())
+	if err != nil {
+		log.Error("Error while issuing token to app [", app.GetId(), "]: ", err)
+		return apiResponse(c, http.StatusServiceUnavailable, "Cannot issue token, retry later!", nil)
+	}
+	return apiResponse(c, http.StatusOK, "Ok", map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int64(time.Until(expiresAt) / time.Second),
+		"expires_at":   expiresAt,
+		"app":          app.GetId(),
+		"audience":     assertion.Audiences,
+		"scope":        assertion.Scopes,
+	})
+}
+
+// GET /auth/whoami: returns the app that signed the request (HTTP message signature), lets apps test their signing
+func actionAuthWhoami(c echo.Context) error {
+	app, s, err := authenticateSignedRequest(c, signedRequestView(c.Request()), authClientIp(c), false, endpointWhoami)
+	if app == nil {
+		return err
+	}
+	return apiResponse(c, http.StatusOK, "Ok", map[string]interface{}{
+		"app":        app.GetId(),
+		"kid":        app.GetKeyId(),
+		"components": s.Components,
+	})
+}
+
+// maxForwardedBody is the maximum size of request bodies forwarded to /auth/verify-request
+const maxForwardedBody = 1 << 20
+
+// POST /auth/verify-request: verifies the signature of a request a service received from an app, submitted as JSON
+// {"method", "url" (absolute), "headers" (repeated headers joined with ", "), "body" (Base64, required if
+// content-digest is covered), "client_ip"}. Allowed CIDRs of the app are checked against "client_ip", the IP the
+// service received the request from; they are not checked if it is omitted.
+func actionAuthVerifyRequest(c echo.Context) error {
+	var req struct {
+		Method   string            `json:"method"`
+		Url      string            `json:"url"`
+		Headers  map[string]string `json:"headers"`
+		Body     []byte            `json:"body"`
+		ClientIp string            `json:"client_ip"`
+	}
+	if err := c.Bind(&req); err != nil || req.Method == "" || req.Url == "" {
+		return apiResponse(c, http.StatusBadRequest, "Parameters [method] and [url] are required!", map[string]interface{}{"error": authErrInvalidSignature})
+	}
+	if len(req.Body) > maxForwardedBody {
+		return apiResponse(c, http.StatusRequestEntityTooLarge, "Request body is too large!", nil)
+	}
+	var body io.Reader
+	if len(req.Body) > 0 {
+		body = bytes.NewReader(req.Body)
+	}
+	r, err := http.NewRequest(req.Method, req.Url, body)
+	if err != nil || !r.URL.IsAbs() {
+		return apiResponse(c, http.StatusBadRequest, "Parameter [url] must be an absolute URL!", map[string]interface{}{"error": authErrInvalidSignature})
+	}
+	for k, v := range req.Headers {
+		r.Header.Set(k, v)
+	}
+	var clientIp net.IP
+	if req.ClientIp != "" {
+		if clientIp = net.ParseIP(strings.TrimSpace(req.ClientIp)); clientIp == nil {
+			return apiResponse(c, http.StatusBadRequest, "Parameter [client_ip] must be an IP address!", map[string]interface{}{"error": authErrInvalidSignature})
+		}
+	}
+	app, s, err := authenticateSignedRequest(c, r, clientIp, clientIp == nil, endpointVerifyRequest)
+	if app == nil {
+		return err
+	}
+	data := map[string]interface{}{"app": app.GetId(), "kid": app.GetKeyId(), "components": s.Components}
+	if !s.Expires.IsZero() {
+		data["expires_at"] = s.Expires
+	}
+	return apiResponse(c, http.StatusOK, "Ok", data)
+}
+
+const maxUsageHours = 90 * 24
+
+// GET /api/v1/usage?app=<id>&hours=<n>: returns hourly usage of an app (all apps if app is empty) for the last n hours (default 24)
+func actionApiUsage(c echo.Context) error {
+	hours, _ := strconv.Atoi(c.QueryParam("hours"))
+	if hours <= 0 {
+		hours = 24
+	} else if hours > maxUsageHours {
+		hours = maxUsageHours
+	}
+	report, err := buildUsageReport(AppUsageDao, c.QueryParam("app"), hours)
+	if err != nil {
+		return apiResponse(c, http.StatusInternalServerError, err.Error(), nil)
+	}
+	return apiResponse(c, http.StatusOK, "Ok", report)
+}
+
+// GET /api/v1/audit?app=<id>&limit=<n>: lists latest authentication attempts, optionally filtered by app
+func actionApiAuthAudit(c echo.Context) error {
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	entries := AuthAuditLog.List(c.QueryParam("app"), limit)
+	if entries == nil {
+		entries = []AuthAuditEntry{}
+	}
+	return apiResponse(c, http.StatusOK, "Ok", entries)
+}
+
+// GET /api/v1/bundle: returns the signed bundle of public keys of all apps that can be verified, for offline verification
+// (no authentication required).
+// Supports conditional requests: 304 is returned if the bundle's ETag matches header If-None-Match.
+func actionApiKeyBundle(c echo.Context) error {
+	bundle, etag, err := currentKeyBundle()
+	if err == errBundleSigningKeyMissing {
+		return apiResponse(c, http.StatusServiceUnavailable, "Key bundles are not available: "+err.Error(), nil)
+	}
+	if err != nil {
+		return apiResponse(c, http.StatusInternalServerError, err.Error(), nil)
+	}
+	c.Response().Header().Set("ETag", etag)
+	c.Response().Header().Set("Cache-Control", "no-cache")
+	for _, tag := range strings.Split(c.Request().Header.Get("If-None-Match"), ",") {
+		if tag = strings.TrimSpace(tag); tag == etag || tag == "*" {
+			return c.NoContent(http.StatusNotModified)
+		}
+	}
+	return c.JSON(http.StatusOK, bundle)
+}
+
+// GET /api/v1/bundle/jwks: returns the key that signs key bundles, as a JWK set (no authentication required)
+func actionApiKeyBundleJwks(c echo.Context) error {
+	if AppBundleSigner == nil {
+		return apiResponse(c, http.StatusServiceUnavailable, "Key bundles are not available: "+errBundleSigningKeyMissing.Error(), nil)
+	}
+	return c.JSON(http.StatusOK, AppBundleSigner.Jwks())
+}
+
+// GET /api/v1/bundle/keys/:id: returns the current key of an app as listed in key bundles, for verifiers resolving
+// keys one app at a time (no authentication required: the bundle lists the same keys); 404 if the app cannot be verified
+func actionApiBundleKey(c echo.Context) error {
+	app, status, error := apiApp(strings.ToLower(strings.TrimSpace(c.Param("id"))))
+	if error != "" {
+		return apiResponse(c, status, error, nil)
+	}
+	key := newBundleKey(app)
+	if key == nil {
+		return apiResponse(c, http.StatusNotFound, "Application ["+app.GetId()+"] cannot be verified!", nil)
+	}
+	return apiResponse(c, http.StatusOK, "Ok", key)
+}
@@ -0,0 +1,247 @@
+package tabusus
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"github.com/labstack/gommon/log"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"tabusus/jws"
+	"time"
+)
+
+// bundleFormat is the version of the bundle's structure, incremented on incompatible changes
+const bundleFormat = 1
+
+// BundleKey is the public key of an app that can currently be verified
+type BundleKey struct {
+	AppId     string     `json:"app"`
+	Kid       string     `json:"kid"` // SHA-256 fingerprint of the key
+	Alg       string     `json:"alg"` // key algorithm: RSA, ECDSA or Ed25519
+	PublicKey string     `json:"public_key"`
+	NotBefore *time.Time `json:"not_before,omitempty"` // time the key was registered
+	NotAfter  *time.Time `json:"not_after,omitempty"`  // key's expiry time (absent if the key never expires)
+}
+
+// KeyBundle lists public keys of all apps that can be verified, so that verifiers can authenticate apps offline.
+// Verifiers must check the bundle's signature and stop trusting it after ExpiresAt.
+type KeyBundle struct {
+	Format    int         `json:"format"`
+	Version   int64       `json:"version"` // revision of the application registry the bundle was built from
+	IssuedAt  time.Time   `json:"iat"`
+	ExpiresAt time.Time   `json:"exp"`
+	Keys      []BundleKey `json:"keys"`
+}
+
+// SignedKeyBundle is a KeyBundle signed by Tabusus, in JWS flattened JSON serialization (RFC 7515):
+// "protected" is the base64url-encoded header (alg, kid), "payload" the base64url-encoded bundle.
+type SignedKeyBundle struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// GetKeyId returns id of app's current public key (its SHA-256 fingerprint, empty if not available)
+func (app *Application) GetKeyId() string {
+	if fp := app.GetKeyFingerprints(); fp != nil {
+		return fp.Sha256
+	}
+	return ""
+}
+
+// newBundleKey returns the bundle entry of an app, nil if the app cannot currently be verified
+func newBundleKey(app *Application) *BundleKey {
+	if !app.IsKeyValid() {
+		return nil
+	}
+	return &BundleKey{
+		AppId:     app.GetId(),
+		Kid:       app.GetKeyId(),
+		Alg:       keyAlgorithm(parsePublicKey(app.GetRsaPubKey())),
+		PublicKey: app.GetRsaPubKey(),
+		NotBefore: app.GetKeyTime(),
+		NotAfter:  app.GetKeyExpiry(),
+	}
+}
+
+// buildKeyBundle lists keys of apps that can currently be verified, ordered by app id
+func buildKeyBundle(apps []Application, version int64) *KeyBundle {
+	bundle := &KeyBundle{Format: bundleFormat, Version: version, Keys: []BundleKey{}}
+	for i := range apps {
+		if key := newBundleKey(&apps[i]); key != nil {
+			bundle.Keys = append(bundle.Keys, *key)
+		}
+	}
+	sort.Slice(bundle.Keys, func(i, j int) bool { return bundle.Keys[i].AppId < bundle.Keys[j].AppId })
+	return bundle
+}
+
+/*----------------------------------------------------------------------*/
+
+// BundleSigner signs key bundles with a private key loaded from configurations at "bundle", or with the active
+// managed signing key (see SigningKeyManager) if none is configured
+type BundleSigner struct {
+	Kid    string
+	Alg    string
+	signer crypto.Signer
+	keys   *SigningKeyManager
+	maxAge time.Duration
+
+	// the latest signed bundle is reused as long as its content has not changed
+	last        *SignedKeyBundle
+	lastEtag    string
+	lastKid     string
+	lastContent [sha256.Size]byte
+	lastIssued  time.Time
+	mutex       sync.Mutex
+}
+
+var errBundleSigningKeyMissing = errors.New("bundle signing key is not configured (bundle.signing_key_file or signing_keys.master_key)")
+
+// parsePrivateKey parses a PEM-encoded private key (PKCS#8, PKCS#1 or SEC 1)
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			return k, nil
+		case *ecdsa.PrivateKey:
+			return k, nil
+		case ed25519.PrivateKey:
+			return k, nil
+		}
+		return nil, errors.New("unsupported private key type")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unsupported private key format")
+}
+
+// loadBundleSigner loads the signing key, returns nil if no key is configured or the key is invalid (error is logged)
+func loadBundleSigner(appConfig *HoconConfig, keys *SigningKeyManager) *BundleSigner {
+	s, err := newBundleSigner(appConfig, keys)
+	if err != nil {
+		log.Error("Error while loading bundle signing key, key bundles are not available: ", err)
+	}
+	return s
+}
+
+func newBundleSigner(appConfig *HoconConfig, keys *SigningKeyManager) (*BundleSigner, error) {
+	conf := appConfig.Conf
+	maxAge := time.Duration(conf.GetInt32("bundle.max_age_hours", 24)) * time.Hour
+	keyFile := conf.GetString("bundle.signing_key_file", "")
+	if keyFile == "" {
+		if keys == nil {
+			return nil, nil
+		}
+		return &BundleSigner{keys: keys, maxAge: maxAge}, nil
+	}
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := parsePrivateKey(data)
+	if err != nil {
+		return nil, errors.New("invalid bundle signing key [" + keyFile + "]: " + err.Error())
+	}
+	s := &BundleSigner{
+		Kid:    conf.GetString("bundle.signing_key_id", ""),
+		Alg:    jws.Algorithm(signer.Public()),
+		signer: signer,
+		maxAge: maxAge,
+	}
+	if s.Alg == "" {
+		return nil, errors.New("unsupported bundle signing key [" + keyFile + "]")
+	}
+	if s.Kid == "" {
+		fp, err := calcKeyFingerprints(signer.Public())
+		if err != nil {
+			return nil, err
+		}
+		s.Kid = fp.Sha256
+	}
+	return s, nil
+}
+
+// Jwks returns the signing key as a JWK set, so that verifiers can validate bundles. Managed signing keys are all
+// published keys, including the next one, so that pinned key sets survive rotation.
+func (s *BundleSigner) Jwks() map[string]interface{} {
+	if s.keys != nil {
+		return s.keys.Jwks()
+	}
+	return map[string]interface{}{"keys": []interface{}{jws.NewJwk(s.signer.Public(), s.Kid)}}
+}
+
+// Sign returns the signed bundle and its ETag. A bundle signed earlier (with the same ETag) is returned as long as
+// its keys and version have not changed and half of its lifetime has not passed, so that verifiers polling with
+// If-None-Match re-download the bundle only when it changed or needs to be renewed before it expires.
+func (s *BundleSigner) Sign(bundle *KeyBundle) (*SignedKeyBundle, string, error) {
+	content, err := json.Marshal(map[string]interface{}{"format": bundle.Format, "version": bundle.Version, "keys": bundle.Keys})
+	if err != nil {
+		return nil, "", err
+	}
+	contentSum := sha256.Sum256(content)
+	signer, kid, alg := s.signer, s.Kid, s.Alg
+	if s.keys != nil {
+		key, keySigner, err := s.keys.Active()
+		if err != nil {
+			return nil, "", err
+		}
+		signer, kid, alg = keySigner, key.Id, key.Alg
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	if s.last != nil && s.lastContent == contentSum && s.lastKid == kid && now.Before(s.lastIssued.Add(s.maxAge/2)) {
+		return s.last, s.lastEtag, nil
+	}
+	bundle.IssuedAt = now.UTC().Truncate(time.Second)
+	bundle.ExpiresAt = bundle.IssuedAt.Add(s.maxAge)
+	payload, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, "", err
+	}
+	token, err := jws.Sign(signer, map[string]interface{}{"alg": alg, "kid": kid, "typ": "tabusus-bundle+jws"}, payload)
+	if err != nil {
+		return nil, "", err
+	}
+	parts := strings.Split(token, ".")
+	etagSum := sha256.Sum256([]byte(token))
+	s.last = &SignedKeyBundle{Protected: parts[0], Payload: parts[1], Signature: parts[2]}
+	s.lastEtag = `"` + hex.EncodeToString(etagSum[:16]) + `"`
+	s.lastContent, s.lastIssued, s.lastKid = contentSum, now, kid
+	return s.last, s.lastEtag, nil
+}
+
+// AppBundleSigner signs key bundles (nil if no signing key is configured)
+var AppBundleSigner *BundleSigner
+
+// currentKeyBundle builds and signs the bundle of the current registry
+func currentKeyBundle() (*SignedKeyBundle, string, error) {
+	if AppBundleSigner == nil {
+		return nil, "", errBundleSigningKeyMissing
+	}
+	version, err := AppChanges.LastRevision()
+	if err != nil {
+		return nil, "", err
+	}
+	return AppBundleSigner.Sign(buildKeyBundle(AppDao.List(), version))
+}
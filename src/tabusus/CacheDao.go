@@ -0,0 +1,268 @@
+package tabusus
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"github.com/labstack/gommon/log"
+	"sync"
+	"time"
+)
+
+// LruCache is a bounded cache with per-entry TTL, least recently used entries are evicted first
+type LruCache struct {
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List // front: most recently used
+	mutex    sync.Mutex
+
+	hits, negativeHits, misses, evictions, invalidations uint64
+}
+
+type lruEntry struct {
+	key     string
+	value   interface{} // nil for negative entries
+	expires time.Time
+}
+
+func NewLruCache(capacity int) *LruCache {
+	return &LruCache{capacity: capacity, entries: map[string]*list.Element{}, order: list.New()}
+}
+
+// Get returns the cached value (nil for a negative entry) and true if key is cached and not expired
+func (c *LruCache) Get(key string) (interface{}, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	el := c.entries[key]
+	if el == nil {
+		c.misses++
+		return nil, false
+	}
+	entry := el.Value.(*lruEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		c.misses++
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	if entry.value == nil {
+		c.negativeHits++
+	} else {
+		c.hits++
+	}
+	return entry.value, true
+}
+
+// Put caches a value (nil to cache the absence of key) for ttl
+func (c *LruCache) Put(key string, value interface{}, ttl time.Duration) {
+	if c.capacity <= 0 || ttl <= 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry := &lruEntry{key: key, value: value, expires: time.Now().Add(ttl)}
+	if el := c.entries[key]; el != nil {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+		c.evictions++
+	}
+}
+
+// Remove invalidates a cached key
+func (c *LruCache) Remove(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if el := c.entries[key]; el != nil {
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+	c.invalidations++
+}
+
+// Purge invalidates all cached keys
+func (c *LruCache) Purge() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.invalidations += uint64(len(c.entries))
+	c.entries = map[string]*list.Element{}
+	c.order.Init()
+}
+
+func (c *LruCache) MarshalJSON() ([]byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	hitRatio := 0.0
+	if total := c.hits + c.negativeHits + c.misses; total > 0 {
+		hitRatio = float64(c.hits+c.negativeHits) / float64(total)
+	}
+	return json.Marshal(map[string]interface{}{
+		"size":          len(c.entries),
+		"capacity":      c.capacity,
+		"hits":          c.hits,
+		"negativeHits":  c.negativeHits,
+		"misses":        c.misses,
+		"hitRatio":      hitRatio,
+		"evictions":     c.evictions,
+		"invalidations": c.invalidations,
+	})
+}
+
+/*----------------------------------------------------------------------*/
+
+// AppKeyCache caches parsed public keys by their PEM data so that keys are not re-parsed on every verification
+// (nil if caching is disabled). Entries never go stale since a key's data determines the parsed key.
+var AppKeyCache *LruCache
+
+// parsePublicKeyCached parses the public key data, using AppKeyCache if enabled
+func parsePublicKeyCached(keyData string) interface{} {
+	if AppKeyCache == nil {
+		return parsePublicKeyData(keyData)
+	}
+	if pubKey, ok := AppKeyCache.Get(keyData); ok {
+		return pubKey
+	}
+	pubKey := parsePublicKeyData(keyData)
+	if pubKey != nil {
+		AppKeyCache.Put(keyData, pubKey, 24*time.Hour)
+	}
+	return pubKey
+}
+
+/*----------------------------------------------------------------------*/
+
+// CachingApplicationDao is a read-through cache in front of an ApplicationDao: apps returned by Get are cached
+// (unknown ids as well, for a shorter time) and invalidated when changed through this DAO or, if the storage is
+// shared by several server instances, when the change feed reports a change.
+type CachingApplicationDao struct {
+	ApplicationDao
+	Cache       *LruCache
+	ttl         time.Duration
+	negativeTtl time.Duration
+	generation  uint64 // incremented on every invalidation, so that stale reads are not cached
+	mutex       sync.Mutex
+}
+
+// NewCachingApplicationDao builds the cache from configurations at "cache"
+func NewCachingApplicationDao(dao ApplicationDao, appConfig *HoconConfig) *CachingApplicationDao {
+	conf := appConfig.Conf
+	return &CachingApplicationDao{
+		ApplicationDao: dao,
+		Cache:          NewLruCache(int(conf.GetInt32("cache.max_entries", 10000))),
+		ttl:            time.Duration(conf.GetInt32("cache.ttl_seconds", 300)) * time.Second,
+		negativeTtl:    time.Duration(conf.GetInt32("cache.negative_ttl_seconds", 30)) * time.Second,
+	}
+}
+
+// copyApp returns a shallow copy of app's data, so that callers modifying the returned app do not alter the cache
+func copyApp(app *Application) *Application {
+	result := &Application{Data: make(map[string]interface{}, len(app.Data))}
+	for k, v := range app.Data {
+		result.Data[k] = v
+	}
+	return result
+}
+
+func (d *CachingApplicationDao) currentGeneration() uint64 {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.generation
+}
+
+// invalidate removes an app from the cache ("" to remove all apps)
+func (d *CachingApplicationDao) invalidate(id string) {
+	d.mutex.Lock()
+	d.generation++
+	d.mutex.Unlock()
+	if id == "" {
+		d.Cache.Purge()
+	} else {
+		d.Cache.Remove(id)
+	}
+}
+
+func (d *CachingApplicationDao) Get(id string) (*Application, error) {
+	if v, ok := d.Cache.Get(id); ok {
+		if v == nil {
+			return nil, nil
+		}
+		return copyApp(v.(*Application)), nil
+	}
+	generation := d.currentGeneration()
+	app, err := d.ApplicationDao.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if generation != d.generation {
+		// app has been changed while being loaded, the loaded copy may be stale
+		return app, nil
+	}
+	if app == nil {
+		d.Cache.Put(id, nil, d.negativeTtl)
+		return nil, nil
+	}
+	d.Cache.Put(id, copyApp(app), d.ttl)
+	return app, nil
+}
+
+func (d *CachingApplicationDao) Save(app *Application) error {
+	d.invalidate(app.GetId())
+	err := d.ApplicationDao.Save(app)
+	d.invalidate(app.GetId())
+	return err
+}
+
+func (d *CachingApplicationDao) MarkKeyNotified(app *Application) error {
+	err := d.ApplicationDao.MarkKeyNotified(app)
+	d.invalidate(app.GetId())
+	return err
+}
+
+func (d *CachingApplicationDao) Delete(app *Application) error {
+	d.invalidate(app.GetId())
+	err := d.ApplicationDao.Delete(app)
+	d.invalidate(app.GetId())
+	return err
+}
+
+// watchChanges invalidates cached apps changed by other server instances, as reported by the change feed.
+// If the feed is interrupted or skips a revision, the whole cache is invalidated.
+func (d *CachingApplicationDao) watchChanges(feed AppChangeFeed) {
+	go func() {
+		for {
+			sinceRev, err := feed.LastRevision()
+			if err == nil {
+				// changes up to sinceRev may have been missed while not watching
+				d.invalidate("")
+				var ch <-chan AppChange
+				if ch, err = feed.Watch(context.Background(), sinceRev); err == nil {
+					// changes being written when watching started may have revisions up to sinceRev without being
+					// recorded yet: the cache is invalidated again once they must have been recorded
+					time.AfterFunc(changeGapTimeout, func() { d.invalidate("") })
+					lastRev := sinceRev
+					for change := range ch {
+						if change.Revision != lastRev+1 {
+							// the feed gave up waiting for a revision, its change may be recorded late or never
+							d.invalidate("")
+						}
+						d.invalidate(change.AppId)
+						lastRev = change.Revision
+					}
+				}
+			}
+			if err != nil {
+				log.Error("Error while watching app changes for cache invalidation: ", err)
+			}
+			time.Sleep(5 * time.Second)
+		}
+	}()
+}
@@ -0,0 +1,143 @@
+package tabusus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLruCacheEviction(t *testing.T) {
+	c := NewLruCache(2)
+	c.Put("a", 1, time.Hour)
+	c.Put("b", 2, time.Hour)
+	c.Get("a") // b becomes least recently used
+	c.Put("c", 3, time.Hour)
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("expected least recently used entry to be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("expected [%s] to be cached", key)
+		}
+	}
+	c.Put("a", 10, time.Hour) // replacing an entry does not evict, a becomes most recently used
+	c.Put("d", 4, time.Hour)
+	if v, ok := c.Get("a"); !ok || v != 10 {
+		t.Errorf("expected replaced value of [a], got %v", v)
+	}
+	if _, ok := c.Get("c"); ok {
+		t.Errorf("expected [c] to be evicted")
+	}
+	if c.evictions != 2 || len(c.entries) != 2 || c.order.Len() != 2 {
+		t.Errorf("expected 2 evictions and 2 entries, got %d and %d/%d", c.evictions, len(c.entries), c.order.Len())
+	}
+
+	c.Remove("a")
+	c.Purge()
+	if _, ok := c.Get("d"); ok || len(c.entries) != 0 || c.invalidations != 2 {
+		t.Errorf("expected cache to be empty after 2 invalidations, got %d entries and %d invalidations", len(c.entries), c.invalidations)
+	}
+
+	disabled := NewLruCache(0)
+	disabled.Put("a", 1, time.Hour)
+	c.Put("b", 2, 0)
+	if _, ok := disabled.Get("a"); ok {
+		t.Errorf("expected nothing to be cached with no capacity")
+	}
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("expected nothing to be cached with no TTL")
+	}
+}
+
+func TestLruCacheExpiry(t *testing.T) {
+	c := NewLruCache(10)
+	c.Put("positive", 1, 30*time.Millisecond)
+	c.Put("negative", nil, 30*time.Millisecond)
+	c.Put("long", 2, time.Hour)
+	if v, ok := c.Get("negative"); !ok || v != nil {
+		t.Errorf("expected negative entry to be cached, got %v / %v", v, ok)
+	}
+	if v, ok := c.Get("positive"); !ok || v != 1 {
+		t.Errorf("expected entry to be cached, got %v / %v", v, ok)
+	}
+	time.Sleep(50 * time.Millisecond)
+	for _, key := range []string{"positive", "negative"} {
+		if _, ok := c.Get(key); ok {
+			t.Errorf("expected [%s] to be expired", key)
+		}
+	}
+	if _, ok := c.Get("long"); !ok || len(c.entries) != 1 {
+		t.Errorf("expected only unexpired entry to be kept, got %d entries", len(c.entries))
+	}
+	if c.hits != 2 || c.negativeHits != 1 || c.misses != 2 {
+		t.Errorf("expected 2 hits, 1 negative hit and 2 misses, got %d, %d and %d", c.hits, c.negativeHits, c.misses)
+	}
+}
+
+// countingApplicationDao counts reads of the wrapped DAO, onGet is called during reads
+type countingApplicationDao struct {
+	ApplicationDao
+	gets  int
+	onGet func()
+}
+
+func (dao *countingApplicationDao) Get(id string) (*Application, error) {
+	dao.gets++
+	if dao.onGet != nil {
+		dao.onGet()
+	}
+	return dao.ApplicationDao.Get(id)
+}
+
+func TestCachingApplicationDao(t *testing.T) {
+	backend := &countingApplicationDao{ApplicationDao: newMemoryApplicationDao(NewApp("app").SetDescription("v1"))}
+	dao := &CachingApplicationDao{ApplicationDao: backend, Cache: NewLruCache(10), ttl: time.Hour, negativeTtl: 30 * time.Millisecond}
+	get := func(id string, expectedGets int) *Application {
+		t.Helper()
+		app, err := dao.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if backend.gets != expectedGets {
+			t.Errorf("get [%s]: expected %d reads of storage, got %d", id, expectedGets, backend.gets)
+		}
+		return app
+	}
+
+	get("app", 1).SetDescription("changed by caller")
+	if app := get("app", 1); app.GetDescription() != "v1" {
+		t.Errorf("expected cached app not to be altered by callers, got [%s]", app.GetDescription())
+	}
+
+	// unknown ids are cached for the negative TTL
+	if app := get("unknown", 2); app != nil {
+		t.Fatalf("expected unknown app, got %v", app.Data)
+	}
+	get("unknown", 2)
+	time.Sleep(50 * time.Millisecond)
+	get("unknown", 3)
+	dao.Save(NewApp("unknown"))
+	if app := get("unknown", 4); app == nil {
+		t.Errorf("expected negative entry to be invalidated on save")
+	}
+
+	app := get("app", 4)
+	dao.Save(app.SetDescription("v2"))
+	if app := get("app", 5); app.GetDescription() != "v2" {
+		t.Errorf("expected app to be invalidated on save, got [%s]", app.GetDescription())
+	}
+	get("app", 5)
+	dao.MarkKeyNotified(app)
+	get("app", 6)
+	dao.Delete(app)
+	if app := get("app", 7); app != nil {
+		t.Errorf("expected app to be invalidated on delete")
+	}
+	get("app", 7)
+
+	// an app changed while being read is not cached
+	backend.onGet = func() { dao.Save(NewApp("racy")) }
+	get("racy", 8)
+	backend.onGet = nil
+	get("racy", 9)
+	get("racy", 9)
+}
@@ -0,0 +1,600 @@
+package tabusus
+
+import (
+	"context"
+	"errors"
+	"github.com/labstack/gommon/log"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/options"
+	"strings"
+	"sync"
+	"tabusus/utils"
+	"time"
+)
+
+const (
+	ChangeCreated = "created"
+	ChangeUpdated = "updated"
+	ChangeDeleted = "deleted"
+
+	tableAppChanges = "app_changes"
+	tableAppHistory = "app_history"
+	tableCounters   = "counters"
+
+	// revision and type (empty: created or updated) of the latest change of an app document until the change is
+	// recorded in the change feed
+	attrChangeRev  = "_change_rev"
+	attrChangeType = "_change_type"
+)
+
+// errRevisionTooOld is returned when changes since the requested revision are no longer retained
+var errRevisionTooOld = errors.New("requested revision is no longer available, please resync")
+
+// AppChange is an entry of the application registry's change feed
+type AppChange struct {
+	Revision int64                  `bson:"rev"`
+	Type     string                 `bson:"type"`
+	AppId    string                 `bson:"app_id"`
+	Data     map[string]interface{} `bson:"data"` // app's data after the change (nil for permanent deletions)
+	Time     time.Time              `bson:"t"`
+}
+
+// toApiData converts the change to a map suitable to be returned by API endpoints
+func (ch *AppChange) toApiData() map[string]interface{} {
+	data := map[string]interface{}{
+		"revision": ch.Revision,
+		"type":     ch.Type,
+		"app_id":   ch.AppId,
+		"time":     ch.Time,
+	}
+	if ch.Data != nil {
+		data["app"] = NewAppFromJson(ch.Data).toApiData()
+	}
+	return data
+}
+
+// AppChangeFeed provides changes of the application registry, ordered by a monotonically increasing revision
+type AppChangeFeed interface {
+	// LastRevision returns revision of the latest change (0 if there is no change)
+	LastRevision() (int64, error)
+	// Changes returns at most limit changes with revision greater than sinceRev
+	Changes(sinceRev int64, limit int) ([]AppChange, error)
+	// Watch streams changes with revision greater than sinceRev until ctx is done
+	Watch(ctx context.Context, sinceRev int64) (<-chan AppChange, error)
+	// History returns at most limit (0: no limit) changes of an app, latest first. History is retained independently
+	// of the change feed: changes removed from the feed are kept in history.
+	History(appId string, limit int) ([]AppChange, error)
+}
+
+/*----------------------------------------------------------------------*/
+
+// ChangeLogApplicationDao wraps an ApplicationDao that has no native change feed and records changes made
+// through it in an internal (in-memory, bounded) event log and per-app history
+type ChangeLogApplicationDao struct {
+	ApplicationDao
+	maxEntries   int
+	maxRevisions int // per app
+	log          []AppChange
+	history      map[string][]AppChange // oldest first
+	revision     int64
+	mutex        sync.Mutex
+	cond         *sync.Cond
+}
+
+func NewChangeLogApplicationDao(dao ApplicationDao, maxEntries, maxRevisions int) *ChangeLogApplicationDao {
+	d := &ChangeLogApplicationDao{ApplicationDao: dao, maxEntries: maxEntries, maxRevisions: maxRevisions, history: map[string][]AppChange{}}
+	d.cond = sync.NewCond(&d.mutex)
+	return d
+}
+
+// record appends a change to the log, app's data is recorded if withData is true
+func (d *ChangeLogApplicationDao) record(changeType string, app *Application, withData bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.revision++
+	change := AppChange{Revision: d.revision, Type: changeType, AppId: app.GetId(), Time: time.Now()}
+	if withData {
+		change.Data = map[string]interface{}{}
+		for k, v := range app.Data {
+			change.Data[k] = v
+		}
+	}
+	d.log = append(d.log, change)
+	if d.maxEntries > 0 && len(d.log) > d.maxEntries {
+		d.log = d.log[len(d.log)-d.maxEntries:]
+	}
+	history := append(d.history[change.AppId], change)
+	if d.maxRevisions > 0 && len(history) > d.maxRevisions {
+		history = history[len(history)-d.maxRevisions:]
+	}
+	d.history[change.AppId] = history
+	d.cond.Broadcast()
+}
+
+func (d *ChangeLogApplicationDao) Save(app *Application) error {
+	existing, err := d.ApplicationDao.Get(app.GetId())
+	if err != nil {
+		return err
+	}
+	if err := d.ApplicationDao.Save(app); err != nil {
+		return err
+	}
+	switch {
+	case app.IsDeleted():
+		d.record(ChangeDeleted, app, true)
+	case existing == nil || existing.IsDeleted():
+		d.record(ChangeCreated, app, true)
+	default:
+		d.record(ChangeUpdated, app, true)
+	}
+	return nil
+}
+
+func (d *ChangeLogApplicationDao) Delete(app *Application) error {
+	if err := d.ApplicationDao.Delete(app); err != nil {
+		return err
+	}
+	d.record(ChangeDeleted, app, false)
+	return nil
+}
+
+func (d *ChangeLogApplicationDao) LastRevision() (int64, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.revision, nil
+}
+
+// changes must be called with mutex held
+func (d *ChangeLogApplicationDao) changes(sinceRev int64, limit int) ([]AppChange, error) {
+	if len(d.log) > 0 && sinceRev < d.log[0].Revision-1 {
+		return nil, errRevisionTooOld
+	}
+	var result []AppChange
+	for _, change := range d.log {
+		if change.Revision > sinceRev && (limit <= 0 || len(result) < limit) {
+			result = append(result, change)
+		}
+	}
+	return result, nil
+}
+
+func (d *ChangeLogApplicationDao) Changes(sinceRev int64, limit int) ([]AppChange, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.changes(sinceRev, limit)
+}
+
+func (d *ChangeLogApplicationDao) History(appId string, limit int) ([]AppChange, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	history := d.history[appId]
+	var result []AppChange
+	for i := len(history) - 1; i >= 0 && (limit <= 0 || len(result) < limit); i-- {
+		result = append(result, history[i])
+	}
+	return result, nil
+}
+
+func (d *ChangeLogApplicationDao) Watch(ctx context.Context, sinceRev int64) (<-chan AppChange, error) {
+	if _, err := d.Changes(sinceRev, 1); err != nil {
+		return nil, err
+	}
+	ch := make(chan AppChange)
+	go func() {
+		// wake up waiting goroutine when ctx is done
+		<-ctx.Done()
+		d.mutex.Lock()
+		d.cond.Broadcast()
+		d.mutex.Unlock()
+	}()
+	go func() {
+		defer close(ch)
+		lastRev := sinceRev
+		for {
+			d.mutex.Lock()
+			for d.revision <= lastRev && ctx.Err() == nil {
+				d.cond.Wait()
+			}
+			changes, err := d.changes(lastRev, 0)
+			d.mutex.Unlock()
+			if ctx.Err() != nil || err != nil {
+				return
+			}
+			for _, change := range changes {
+				select {
+				case ch <- change:
+					lastRev = change.Revision
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+/*----------------------------------------------------------------------*/
+
+// MongoDB implementation: every change is recorded in collection "app_changes" with a revision taken from
+// collection "counters"; live changes are signaled by MongoDB change streams (polling if not supported).
+// Changes are also recorded in collection "app_history", which is not trimmed with the change feed.
+//
+// A revision is taken before the change is written, so concurrent writers may record changes out of revision order,
+// and a revision is lost if writing its change fails. Changes are therefore read up to the first missing revision,
+// which is waited for until changeGapTimeout has passed since a later revision was recorded.
+
+const (
+	// changeGapTimeout is how long a missing revision is waited for, longer than writing a change can take
+	changeGapTimeout = 30 * time.Second
+	// changeTrimInterval is the number of revisions between removals of changes exceeding the configured maximum
+	changeTrimInterval = 100
+)
+
+func (dao *MongoApplicationDao) ensureChangeFeedIndexes() {
+	collection := dao.client.Database(dao.db).Collection(tableAppChanges)
+	for _, model := range []mongo.IndexModel{
+		{Keys: bson.M{"rev": 1}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.M{"app_id": 1}},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_, err := collection.Indexes().CreateOne(ctx, model)
+		cancel()
+		if err != nil {
+			log.Error("Error while creating index on [", tableAppChanges, "]: ", err)
+		}
+	}
+	collection = dao.client.Database(dao.db).Collection(tableAppHistory)
+	for _, model := range []mongo.IndexModel{
+		{Keys: bson.M{"rev": 1}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "app_id", Value: 1}, {Key: "rev", Value: -1}}},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_, err := collection.Indexes().CreateOne(ctx, model)
+		cancel()
+		if err != nil {
+			log.Error("Error while creating index on [", tableAppHistory, "]: ", err)
+		}
+	}
+	dao.migrateHistory()
+}
+
+// migrateHistory copies changes to app history if history is empty: history used to be read from the change feed
+func (dao *MongoApplicationDao) migrateHistory() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	history := dao.client.Database(dao.db).Collection(tableAppHistory)
+	if n, err := history.CountDocuments(ctx, bson.M{}); err != nil || n > 0 {
+		return
+	}
+	cur, err := dao.client.Database(dao.db).Collection(tableAppChanges).Find(ctx, bson.M{})
+	if err != nil {
+		log.Error("Error while migrating app history: ", err)
+		return
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var row AppChange
+		if err := cur.Decode(&row); err != nil {
+			log.Error("Error while migrating app history: ", err)
+			return
+		}
+		if _, err := history.InsertOne(ctx, &row); err != nil && !isMongoDuplicateKey(err) {
+			log.Error("Error while migrating app history: ", err)
+			return
+		}
+	}
+}
+
+// nextRevision atomically increases and returns the registry's revision counter
+func (dao *MongoApplicationDao) nextRevision() (int64, error) {
+	collection := dao.client.Database(dao.db).Collection(tableCounters)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	dbResult := collection.FindOneAndUpdate(ctx, bson.M{"_id": tableApps}, bson.M{"$inc": bson.M{"seq": 1}}, opts)
+	if dbResult.Err() != nil {
+		return 0, dbResult.Err()
+	}
+	var row bson.M
+	if err := dbResult.Decode(&row); err != nil {
+		return 0, err
+	}
+	rev, _ := utils.ToInt64(row["seq"])
+	return rev, nil
+}
+
+// recordChange records a change in app's history then in the change feed; a change already recorded (revisions are
+// unique) is not an error
+func (dao *MongoApplicationDao) recordChange(rev int64, changeType, appId string, data bson.M) error {
+	if data != nil {
+		delete(data, "_id")
+	}
+	change := &AppChange{Revision: rev, Type: changeType, AppId: appId, Data: data, Time: time.Now()}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := dao.client.Database(dao.db).Collection(tableAppHistory).InsertOne(ctx, change)
+	if err == nil && dao.maxRevisions > 0 {
+		dao.trimHistory(appId)
+	} else if err != nil && !isMongoDuplicateKey(err) {
+		return err
+	}
+	_, err = dao.client.Database(dao.db).Collection(tableAppChanges).InsertOne(ctx, change)
+	if isMongoDuplicateKey(err) {
+		return nil
+	}
+	if err == nil && dao.maxChanges > 0 && rev%changeTrimInterval == 0 && rev > dao.maxChanges {
+		dao.trimChanges(rev - dao.maxChanges)
+	}
+	return err
+}
+
+// trimHistory removes revisions of an app exceeding the configured maximum
+func (dao *MongoApplicationDao) trimHistory(appId string) {
+	collection := dao.client.Database(dao.db).Collection(tableAppHistory)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	opts := options.FindOne().SetSort(bson.M{"rev": -1}).SetSkip(dao.maxRevisions)
+	var row AppChange
+	if err := collection.FindOne(ctx, bson.M{"app_id": appId}, opts).Decode(&row); err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Error("Error while trimming history of application [", appId, "]: ", err)
+		}
+		return
+	}
+	if _, err := collection.DeleteMany(ctx, bson.M{"app_id": appId, "rev": bson.M{"$lte": row.Revision}}); err != nil {
+		log.Error("Error while trimming history of application [", appId, "]: ", err)
+	}
+}
+
+// isMongoDuplicateKey checks if err reports a violated unique index
+func isMongoDuplicateKey(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "E11000")
+}
+
+// recoverChange records the change kept in an app document (see Save), if it is not recorded yet
+func (dao *MongoApplicationDao) recoverChange(doc bson.M) error {
+	rev, _ := utils.ToInt64(doc[attrChangeRev])
+	changeType, _ := doc[attrChangeType].(string)
+	appId, _ := doc[attrId].(string)
+	data := bson.M{}
+	for k, v := range doc {
+		if k != attrChangeRev && k != attrChangeType {
+			data[k] = v
+		}
+	}
+	if changeType == "" {
+		changeType = ChangeUpdated
+		if history, err := dao.History(appId, 1); err != nil {
+			return err
+		} else if len(history) == 0 || history[0].Type == ChangeDeleted {
+			changeType = ChangeCreated
+		}
+	}
+	return dao.recordChange(rev, changeType, appId, data)
+}
+
+// recoverRevision records the change of revision rev if an app document still keeps it (its writer failed to record it
+// or has not recorded it yet)
+func (dao *MongoApplicationDao) recoverRevision(rev int64) {
+	collection := dao.client.Database(dao.db).Collection(tableApps)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var doc bson.M
+	if err := collection.FindOne(ctx, bson.M{attrChangeRev: rev}).Decode(&doc); err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Error("Error while looking up change [", rev, "]: ", err)
+		}
+		return
+	}
+	if err := dao.recoverChange(doc); err != nil {
+		log.Error("Error while recovering change [", rev, "]: ", err)
+		return
+	}
+	appId, _ := doc[attrId].(string)
+	dao.clearChange(appId, rev)
+}
+
+// clearChange removes the change of revision rev from the app document once it is recorded
+func (dao *MongoApplicationDao) clearChange(appId string, rev int64) {
+	collection := dao.client.Database(dao.db).Collection(tableApps)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := collection.UpdateOne(ctx, bson.M{attrId: appId, attrChangeRev: rev}, bson.M{"$unset": bson.M{attrChangeRev: "", attrChangeType: ""}})
+	if err != nil {
+		// harmless: the change is already recorded
+		log.Warn("Error while clearing change [", rev, "] of application [", appId, "]: ", err)
+	}
+}
+
+// trimChanges removes changes up to revision rev, which is recorded as the oldest revision changes can be read from
+func (dao *MongoApplicationDao) trimChanges(rev int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	counters := dao.client.Database(dao.db).Collection(tableCounters)
+	if _, err := counters.UpdateOne(ctx, bson.M{"_id": tableApps}, bson.M{"$max": bson.M{"trimmed": rev}}); err != nil {
+		log.Error("Error while trimming app changes: ", err)
+		return
+	}
+	collection := dao.client.Database(dao.db).Collection(tableAppChanges)
+	if _, err := collection.DeleteMany(ctx, bson.M{"rev": bson.M{"$lte": rev}}); err != nil {
+		log.Error("Error while trimming app changes: ", err)
+	}
+}
+
+// trimmedRevision returns the revision up to which changes have been removed (0 if none has been removed)
+func (dao *MongoApplicationDao) trimmedRevision() (int64, error) {
+	collection := dao.client.Database(dao.db).Collection(tableCounters)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var row bson.M
+	err := collection.FindOne(ctx, bson.M{"_id": tableApps}).Decode(&row)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	rev, _ := utils.ToInt64(row["trimmed"])
+	return rev, nil
+}
+
+func (dao *MongoApplicationDao) LastRevision() (int64, error) {
+	collection := dao.client.Database(dao.db).Collection(tableCounters)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dbResult := collection.FindOne(ctx, bson.M{"_id": tableApps})
+	if dbResult.Err() != nil {
+		return 0, dbResult.Err()
+	}
+	var row bson.M
+	err := dbResult.Decode(&row)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	rev, _ := utils.ToInt64(row["seq"])
+	return rev, nil
+}
+
+func (dao *MongoApplicationDao) Changes(sinceRev int64, limit int) ([]AppChange, error) {
+	changes, _, err := dao.committedChanges(sinceRev, limit)
+	return changes, err
+}
+
+// committedChanges returns changes with revision greater than sinceRev, up to the first missing revision that may
+// still be recorded; pending is true if reading stopped at such a revision
+func (dao *MongoApplicationDao) committedChanges(sinceRev int64, limit int) (changes []AppChange, pending bool, err error) {
+	trimmed, err := dao.trimmedRevision()
+	if err != nil {
+		return nil, false, err
+	}
+	if sinceRev < trimmed {
+		return nil, false, errRevisionTooOld
+	}
+	collection := dao.client.Database(dao.db).Collection(tableAppChanges)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	opts := options.Find().SetSort(bson.M{"rev": 1})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	cur, err := collection.Find(ctx, bson.M{"rev": bson.M{"$gt": sinceRev}}, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	defer cur.Close(ctx)
+	expected := sinceRev + 1
+	for cur.Next(ctx) {
+		var row AppChange
+		if err := cur.Decode(&row); err != nil {
+			return nil, false, err
+		}
+		if row.Revision != expected && time.Since(row.Time) < changeGapTimeout {
+			dao.recoverRevision(expected)
+			return changes, true, nil
+		}
+		changes = append(changes, row)
+		expected = row.Revision + 1
+	}
+	if err := cur.Err(); err != nil {
+		return nil, false, err
+	}
+	if limit <= 0 || len(changes) < limit {
+		// the latest revisions may be missing with no later change recorded yet
+		if last, err := dao.LastRevision(); err == nil && last >= expected {
+			dao.recoverRevision(expected)
+		}
+	}
+	return changes, false, nil
+}
+
+func (dao *MongoApplicationDao) History(appId string, limit int) ([]AppChange, error) {
+	collection := dao.client.Database(dao.db).Collection(tableAppHistory)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	opts := options.Find().SetSort(bson.M{"rev": -1})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	cur, err := collection.Find(ctx, bson.M{"app_id": appId}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var result []AppChange
+	for cur.Next(ctx) {
+		var row AppChange
+		if err := cur.Decode(&row); err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+	return result, cur.Err()
+}
+
+func (dao *MongoApplicationDao) Watch(ctx context.Context, sinceRev int64) (<-chan AppChange, error) {
+	collection := dao.client.Database(dao.db).Collection(tableAppChanges)
+	// open the change stream before reading the backlog so that no change is missed in between; the stream only
+	// signals new changes, which are then read in revision order
+	pipeline := []bson.M{{"$match": bson.M{"operationType": "insert"}}}
+	stream, err := collection.Watch(ctx, pipeline)
+	if err != nil {
+		log.Warn("Change streams not available, fallback to polling: ", err)
+		stream = nil
+	}
+	if _, _, err := dao.committedChanges(sinceRev, 1); err != nil {
+		if stream != nil {
+			stream.Close(context.Background())
+		}
+		return nil, err
+	}
+	ch := make(chan AppChange)
+	go func() {
+		defer close(ch)
+		if stream != nil {
+			defer stream.Close(context.Background())
+		}
+		lastRev := sinceRev
+		for {
+			changes, pending, err := dao.committedChanges(lastRev, 100)
+			if err != nil {
+				log.Error("Error while reading app changes: ", err)
+				return
+			}
+			for _, change := range changes {
+				select {
+				case ch <- change:
+					lastRev = change.Revision
+				case <-ctx.Done():
+					return
+				}
+			}
+			if len(changes) == 100 {
+				continue
+			}
+			if pending || stream == nil {
+				// without change stream changes are polled for, a missing revision is polled for more frequently
+				interval := time.Second
+				if pending {
+					interval = 200 * time.Millisecond
+				}
+				select {
+				case <-time.After(interval):
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+			if !stream.Next(ctx) {
+				if stream.Err() != nil && ctx.Err() == nil {
+					log.Error("Error while watching app changes: ", stream.Err())
+				}
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
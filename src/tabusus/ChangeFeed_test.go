@@ -0,0 +1,44 @@
+package tabusus
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestChangeLogHistoryRetention(t *testing.T) {
+	testCases := []struct {
+		maxRevisions int
+		expected     int
+	}{
+		{0, 5},
+		{3, 3},
+	}
+	for _, testCase := range testCases {
+		dao := NewChangeLogApplicationDao(newMemoryApplicationDao(), 2, testCase.maxRevisions)
+		app := NewApp("app")
+		dao.Save(NewApp("other"))
+		for i := 0; i < 5; i++ {
+			dao.Save(app.SetDescription("v" + strconv.Itoa(i)))
+		}
+		dao.Save(NewApp("other2"))
+
+		// changes of the app are no longer in the feed...
+		if _, err := dao.Changes(0, 0); err != errRevisionTooOld {
+			t.Errorf("expected feed to be trimmed, got %v", err)
+		}
+		// ...but are kept in its history
+		history, _ := dao.History("app", 0)
+		if len(history) != testCase.expected {
+			t.Fatalf("max %d revisions: expected %d revisions, got %d", testCase.maxRevisions, testCase.expected, len(history))
+		}
+		if history[0].Revision != 6 || NewAppFromJson(history[0].Data).GetDescription() != "v4" {
+			t.Errorf("expected latest revision first, got %+v", history[0])
+		}
+		if history, _ := dao.History("app", 2); len(history) != 2 || history[1].Revision != 5 {
+			t.Errorf("expected 2 latest revisions, got %+v", history)
+		}
+		if history, _ := dao.History("other", 0); len(history) != 1 || history[0].Type != ChangeCreated {
+			t.Errorf("expected creation of other app, got %+v", history)
+		}
+	}
+}
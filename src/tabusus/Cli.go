@@ -0,0 +1,708 @@
+package tabusus
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const cliUsage = `Usage: tabusus [-config <file>] <command> [arguments]
+
+Commands:
+  serve                                  start the web server (default command)
+  app list [-json] [-status <status>] [-selector <label selector>] [-tag <tags>]
+                                         list applications
+  app get <id>                           show an application
+  app create -id <id> -key-file <file> [-desc <text>] [-owner <user>] [-status pending|active|disabled]
+             [-key-expiry <yyyy-mm-dd>] [-labels <k=v,...>] [-tags <tag,...>]
+             [-field <name=value>]...
+  app update <id> [-key-file <file>] [-desc <text>] [-owner <user>] [-key-expiry <yyyy-mm-dd>|-]
+             [-labels <k=v,...>] [-tags <tag,...>] [-field <name=value>]...
+  app delete <id>                        move an application to trash
+  app restore <id>                       restore an application from trash
+  app enable <id>                        activate an application
+  app disable <id>                       disable an application
+  app status <id> <status> [-reason <text>] [-until <yyyy-mm-dd>]
+                                         change status of an application (pending, active, suspended, deprecated,
+                                         disabled, revoked), reason and until are for suspension only
+  key fingerprint [<file>]               print fingerprints of a public key (read from stdin if no file)
+  user create -id <id> [-role admin|developer] [-update]
+                                         create a user (or change password and role of an existing user with
+                                         -update), password is read from stdin
+  export [-format json|yaml|csv] [-out <file>]
+  import [-format json|yaml|csv] [-strategy skip|overwrite|fail] [-dry-run] <file>
+  migrate                                create indexes and backfill data of existing applications
+  bundle [-out <file>] [-jwks]           write the signed bundle of public keys of all apps that can be verified,
+                                         or the key that signs bundles (-jwks), for offline verification
+  signing-key list [-json]               list Tabusus' signing keys (tokens and bundles)
+  signing-key generate                   generate and publish the next signing key
+  signing-key import <file>              import a private key (PEM) as the next signing key
+  signing-key rotate                     activate the next signing key now and retire the active one
+
+Configuration file is taken from -config, or environment APP_CONFIG, or ./config/application.conf
+`
+
+type cliCommand func(args []string) error
+
+// RunCli runs the command-line tool, returns the process's exit code
+func RunCli(args []string) int {
+	fs := flag.NewFlagSet("tabusus", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, cliUsage) }
+	configFile := fs.String("config", "", "configuration file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	args = fs.Args()
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+
+	commands := map[string]cliCommand{
+		"serve":                cliServe,
+		"app list":             cliAppList,
+		"app get":              cliAppGet,
+		"app create":           cliAppCreate,
+		"app update":           cliAppUpdate,
+		"app delete":           cliAppDelete,
+		"app restore":          cliAppRestore,
+		"app enable":           cliAppSetStatus(AppStatusActive),
+		"app disable":          cliAppSetStatus(AppStatusDisabled),
+		"app status":           cliAppStatus,
+		"key fingerprint":      cliKeyFingerprint,
+		"user create":          cliUserCreate,
+		"export":               cliExport,
+		"import":               cliImport,
+		"migrate":              cliMigrate,
+		"bundle":               cliBundle,
+		"signing-key list":     cliSigningKeyList,
+		"signing-key generate": cliSigningKeyAction(func([]string) (*SigningKey, error) { return AppSigningKeys.Generate() }),
+		"signing-key import":   cliSigningKeyAction(cliSigningKeyImport),
+		"signing-key rotate":   cliSigningKeyAction(func([]string) (*SigningKey, error) { return AppSigningKeys.Rotate() }),
+	}
+	cmd, cmdArgs := commands[args[0]], args[1:]
+	if cmd == nil && len(args) > 1 {
+		cmd, cmdArgs = commands[args[0]+" "+args[1]], args[2:]
+	}
+	if cmd == nil {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2
+	}
+	// "key fingerprint" works offline, other commands need configurations and storage
+	if args[0] != "key" {
+		initApp(*configFile)
+	}
+	if err := cmd(cmdArgs); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+func cliPrintJson(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// cliIsFlagSet checks if a flag was explicitly set on the command line
+func cliIsFlagSet(fs *flag.FlagSet, name string) bool {
+	result := false
+	fs.Visit(func(f *flag.Flag) {
+		result = result || f.Name == name
+	})
+	return result
+}
+
+// cliFieldsFlag collects custom field values given as repeated "-field name=value" flags,
+// repeating a list field appends items to it
+type cliFieldsFlag map[string]string
+
+func (f cliFieldsFlag) String() string {
+	return ""
+}
+
+func (f cliFieldsFlag) Set(value string) error {
+	tokens := strings.SplitN(value, "=", 2)
+	if len(tokens) != 2 {
+		return fmt.Errorf("invalid field [%s] (format name=value)", value)
+	}
+	name := strings.TrimSpace(tokens[0])
+	if AppFields.Field(name) == nil {
+		return fmt.Errorf("unknown field [%s]", name)
+	}
+	if prev, ok := f[name]; ok {
+		f[name] = prev + "\n" + tokens[1]
+	} else {
+		f[name] = tokens[1]
+	}
+	return nil
+}
+
+// values validates custom field values against the schema, given values override current values of the app (if not
+// nil) and only them are validated
+func (f cliFieldsFlag) values(app *Application) (map[string]interface{}, error) {
+	formData := map[string]string{}
+	if app != nil {
+		formData = AppFields.FormValues(app)
+	}
+	for name, v := range f {
+		formData[attrCustomFieldPrefix+name] = v
+	}
+	var values map[string]interface{}
+	var errMsg string
+	if app == nil {
+		values, errMsg = AppFields.ParseForm(formData)
+	} else {
+		values, errMsg = AppFields.ParseChanges(app, formData)
+	}
+	if errMsg != "" {
+		return nil, fmt.Errorf("%s", errMsg)
+	}
+	return values, nil
+}
+
+// cliDispatch records a webhook event about an app changed by the command-line tool, the event is delivered by a
+// running server
+func cliDispatch(event string, app *Application) {
+	if AppWebhooks != nil {
+		AppWebhooks.Dispatch(event, app, "cli")
+	}
+}
+
+// cliGetApp loads an app by id, returns error if the app does not exist
+func cliGetApp(args []string) (*Application, error) {
+	if len(args) < 1 {
+		return nil, fmt.Errorf("application id is required")
+	}
+	app, err := AppDao.Get(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if app == nil {
+		return nil, fmt.Errorf("application not found [%s]", args[0])
+	}
+	return app, nil
+}
+
+func cliServe(args []string) error {
+	serve()
+	return nil
+}
+
+func cliAppList(args []string) error {
+	fs := flag.NewFlagSet("app list", flag.ContinueOnError)
+	asJson := fs.Bool("json", false, "output as JSON")
+	statusFilter := fs.String("status", "", "list only applications having this status")
+	selectorStr := fs.String("selector", "", "list only applications matching this label selector, e.g. env=prod,team!=legacy")
+	tagFilter := fs.String("tag", "", "list only applications having all these (comma-separated) tags")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	selector, err := parseLabelSelector(*selectorStr)
+	if err != nil {
+		return err
+	}
+	tags, errMsg := parseTags(*tagFilter)
+	if errMsg != "" {
+		return fmt.Errorf("%s", errMsg)
+	}
+	apps, err := AppDao.Find(selector, tags)
+	if err != nil {
+		return err
+	}
+	if *statusFilter != "" {
+		status, ok := parseAppStatus(*statusFilter)
+		if !ok {
+			return fmt.Errorf("invalid status [%s]", *statusFilter)
+		}
+		apps = filterAppsByStatus(apps, status)
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i].GetId() < apps[j].GetId() })
+	if *asJson {
+		result := make([]map[string]interface{}, 0, len(apps))
+		for i := range apps {
+			result = append(result, apps[i].toApiData())
+		}
+		return cliPrintJson(result)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATUS\tKEY EXPIRY\tKEY FINGERPRINT (SHA-256)\tDESCRIPTION")
+	for i := range apps {
+		app := &apps[i]
+		fp := ""
+		if v := app.GetKeyFingerprints(); v != nil {
+			fp = v.Sha256
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", app.GetId(), app.GetStatusStr(), app.GetKeyExpiryStr(), fp, app.GetDescription())
+	}
+	return w.Flush()
+}
+
+func cliAppGet(args []string) error {
+	app, err := cliGetApp(args)
+	if err != nil {
+		return err
+	}
+	return cliPrintJson(app.toApiData())
+}
+
+func cliAppCreate(args []string) error {
+	fs := flag.NewFlagSet("app create", flag.ContinueOnError)
+	id := fs.String("id", "", "application id")
+	keyFile := fs.String("key-file", "", "file containing the public key (PEM)")
+	desc := fs.String("desc", "", "description")
+	owner := fs.String("owner", "", "id of the developer owning the application")
+	statusStr := fs.String("status", "disabled", "initial status (pending, active or disabled)")
+	keyExpiry := fs.String("key-expiry", "", "key expiry date (yyyy-mm-dd)")
+	labelsStr := fs.String("labels", "", "labels in form key1=value1,key2=value2")
+	tagsStr := fs.String("tags", "", "comma-separated tags")
+	fieldsFlag := cliFieldsFlag{}
+	fs.Var(fieldsFlag, "field", "custom field value in form name=value (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	fields, err := fieldsFlag.values(nil)
+	if err != nil {
+		return err
+	}
+	labels, errMsg := parseLabels(*labelsStr)
+	if errMsg != "" {
+		return fmt.Errorf("%s", errMsg)
+	}
+	tags, errMsg := parseTags(*tagsStr)
+	if errMsg != "" {
+		return fmt.Errorf("%s", errMsg)
+	}
+	pubKey, err := ioutil.ReadFile(*keyFile)
+	if err != nil {
+		return err
+	}
+	appId := strings.ToLower(strings.TrimSpace(*id))
+	status, ok := parseAppStatus(*statusStr)
+	if !ok || !isInitialAppStatus(status) {
+		return fmt.Errorf("invalid initial status [%s]", *statusStr)
+	}
+	if errMsg := validateAppInput(appId, true, string(pubKey), *keyExpiry); errMsg != "" {
+		return fmt.Errorf("%s", errMsg)
+	}
+	expiry, _ := parseKeyExpiry(*keyExpiry)
+	app := NewApp(appId)
+	app.SetStatus(status)
+	app.SetDescription(*desc)
+	app.SetOwner(*owner)
+	app.SetLabels(labels).SetTags(tags)
+	app.SetCustomFields(fields)
+	app.SetRsaPubKey(string(pubKey))
+	app.SetKeyExpiry(expiry)
+	app.SetUpdatedBy("cli")
+	if err := AppDao.Save(app); err != nil {
+		return err
+	}
+	cliDispatch(EventAppCreated, app)
+	fmt.Println("Application [" + appId + "] has been created successfully.")
+	return nil
+}
+
+func cliAppUpdate(args []string) error {
+	app, err := cliGetApp(args)
+	if err != nil {
+		return err
+	}
+	fs := flag.NewFlagSet("app update", flag.ContinueOnError)
+	keyFile := fs.String("key-file", "", "file containing the new public key (PEM)")
+	desc := fs.String("desc", "", "description")
+	owner := fs.String("owner", "", "id of the developer owning the application")
+	keyExpiry := fs.String("key-expiry", "", "key expiry date (yyyy-mm-dd), \"-\" to remove")
+	labelsStr := fs.String("labels", "", "labels in form key1=value1,key2=value2, replacing current labels")
+	tagsStr := fs.String("tags", "", "comma-separated tags, replacing current tags")
+	fieldsFlag := cliFieldsFlag{}
+	fs.Var(fieldsFlag, "field", "custom field value in form name=value (repeatable), empty value to remove")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	fields, err := fieldsFlag.values(app)
+	if err != nil {
+		return err
+	}
+	labels, errMsg := parseLabels(*labelsStr)
+	if errMsg != "" {
+		return fmt.Errorf("%s", errMsg)
+	}
+	tags, errMsg := parseTags(*tagsStr)
+	if errMsg != "" {
+		return fmt.Errorf("%s", errMsg)
+	}
+	pubKey := app.GetRsaPubKey()
+	if cliIsFlagSet(fs, "key-file") {
+		data, err := ioutil.ReadFile(*keyFile)
+		if err != nil {
+			return err
+		}
+		pubKey = string(data)
+	}
+	expiry := app.GetKeyExpiryStr()
+	if cliIsFlagSet(fs, "key-expiry") {
+		expiry = strings.TrimPrefix(*keyExpiry, "-")
+	}
+	if errMsg := validateAppInput(app.GetId(), false, pubKey, expiry); errMsg != "" {
+		return fmt.Errorf("%s", errMsg)
+	}
+	if cliIsFlagSet(fs, "desc") {
+		app.SetDescription(*desc)
+	}
+	if cliIsFlagSet(fs, "owner") {
+		app.SetOwner(*owner)
+	}
+	if cliIsFlagSet(fs, "labels") {
+		app.SetLabels(labels)
+	}
+	if cliIsFlagSet(fs, "tags") {
+		app.SetTags(tags)
+	}
+	app.SetCustomFields(fields)
+	app.SetRsaPubKey(pubKey)
+	if expiry != app.GetKeyExpiryStr() {
+		t, _ := parseKeyExpiry(expiry)
+		app.SetKeyExpiry(t)
+	}
+	app.SetUpdatedBy("cli").SetTimeUpdated(time.Now())
+	if err := AppDao.Save(app); err != nil {
+		return err
+	}
+	cliDispatch(EventAppUpdated, app)
+	fmt.Println("Application [" + app.GetId() + "] has been updated successfully.")
+	return nil
+}
+
+func cliAppDelete(args []string) error {
+	app, err := cliGetApp(args)
+	if err != nil {
+		return err
+	}
+	if app.IsDeleted() {
+		return fmt.Errorf("application [%s] is already in trash", app.GetId())
+	}
+	if err := AppDao.Save(app.MarkDeleted("cli")); err != nil {
+		return err
+	}
+	cliDispatch(EventAppDeleted, app)
+	fmt.Println("Application [" + app.GetId() + "] has been moved to trash.")
+	return nil
+}
+
+func cliAppRestore(args []string) error {
+	app, err := cliGetApp(args)
+	if err != nil {
+		return err
+	}
+	if !app.IsDeleted() {
+		return fmt.Errorf("application [%s] is not in trash", app.GetId())
+	}
+	if err := AppDao.Save(app.Restore().SetUpdatedBy("cli").SetTimeUpdated(time.Now())); err != nil {
+		return err
+	}
+	cliDispatch(EventAppRestored, app)
+	fmt.Println("Application [" + app.GetId() + "] has been restored successfully.")
+	return nil
+}
+
+func cliAppSetStatus(status int32) cliCommand {
+	return func(args []string) error {
+		app, err := cliGetApp(args)
+		if err != nil {
+			return err
+		}
+		return cliTransitApp(app, status, "", nil)
+	}
+}
+
+func cliAppStatus(args []string) error {
+	app, err := cliGetApp(args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("status is required")
+	}
+	status, ok := parseAppStatus(args[1])
+	if !ok {
+		return fmt.Errorf("invalid status [%s]", args[1])
+	}
+	fs := flag.NewFlagSet("app status", flag.ContinueOnError)
+	reason := fs.String("reason", "", "suspension reason")
+	until := fs.String("until", "", "suspension end date (yyyy-mm-dd)")
+	if err := fs.Parse(args[2:]); err != nil {
+		return err
+	}
+	untilTime, err := parseKeyExpiry(*until)
+	if err != nil {
+		return fmt.Errorf("invalid suspension end date [%s]", *until)
+	}
+	return cliTransitApp(app, status, *reason, untilTime)
+}
+
+func cliTransitApp(app *Application, status int32, reason string, until *time.Time) error {
+	wasVerifiable := app.IsVerifiable()
+	if err := app.TransitTo(status, reason, until); err != nil {
+		return err
+	}
+	app.SetUpdatedBy("cli").SetTimeUpdated(time.Now())
+	if err := AppDao.Save(app); err != nil {
+		return err
+	}
+	if wasVerifiable && !app.IsVerifiable() {
+		cliDispatch(EventAppDisabled, app)
+	} else {
+		cliDispatch(EventAppUpdated, app)
+	}
+	fmt.Println("Application [" + app.GetId() + "] is now " + app.GetStatusStr() + ".")
+	return nil
+}
+
+func cliKeyFingerprint(args []string) error {
+	var data []byte
+	var err error
+	if len(args) > 0 {
+		data, err = ioutil.ReadFile(args[0])
+	} else {
+		data, err = ioutil.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return err
+	}
+	pubKey := parsePublicKey(strings.TrimSpace(string(data)))
+	if pubKey == nil {
+		return fmt.Errorf("error parsing public key data")
+	}
+	fp, err := calcKeyFingerprints(pubKey)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Algorithm:", keyAlgorithm(pubKey))
+	fmt.Println("SHA-256  :", fp.Sha256)
+	fmt.Println("SHA-1    :", fp.Sha1)
+	fmt.Println("MD5      :", fp.Md5)
+	return nil
+}
+
+func cliUserCreate(args []string) error {
+	fs := flag.NewFlagSet("user create", flag.ContinueOnError)
+	id := fs.String("id", "", "user id")
+	role := fs.String("role", roleAdmin, "user's role (admin or developer), existing users keep their role if not set")
+	update := fs.Bool("update", false, "set password (and role) of an existing user")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	userId := strings.ToLower(strings.TrimSpace(*id))
+	if userId == "" {
+		return fmt.Errorf("user id is required")
+	}
+	if !validUserId.MatchString(userId) {
+		return fmt.Errorf("invalid user id (must contains only a-z, 0-9, _, -, ., @)")
+	}
+	if *role != roleAdmin && *role != roleDeveloper {
+		return fmt.Errorf("invalid role [%s]", *role)
+	}
+	user, err := AppUserDao.Get(userId)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		user = NewUser(userId, *role)
+	} else if !*update {
+		return fmt.Errorf("user [%s] already exists, use -update to change the password", userId)
+	} else if cliIsFlagSet(fs, "role") {
+		user.Role = *role
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return fmt.Errorf("password must not be empty")
+	}
+	if err := user.SetPassword(password); err != nil {
+		return err
+	}
+	if err := AppUserDao.Save(user); err != nil {
+		return err
+	}
+	fmt.Println("User [" + user.Id + "] has been saved successfully.")
+	return nil
+}
+
+func cliExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", formatJson, "output format: json, yaml or csv")
+	out := fs.String("out", "", "output file (default: stdout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	f := normalizeFormat(*format)
+	if f == "" {
+		return fmt.Errorf("unsupported format [%s]", *format)
+	}
+	data, err := exportApps(AppDao.List(), f)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(*out, data, 0600)
+}
+
+func cliBundle(args []string) error {
+	fs := flag.NewFlagSet("bundle", flag.ContinueOnError)
+	out := fs.String("out", "", "output file (default: stdout)")
+	jwks := fs.Bool("jwks", false, "write the key that signs bundles (JWK set) instead of the bundle")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var v interface{}
+	if *jwks {
+		if AppBundleSigner == nil {
+			return errBundleSigningKeyMissing
+		}
+		v = AppBundleSigner.Jwks()
+	} else {
+		bundle, _, err := currentKeyBundle()
+		if err != nil {
+			return err
+		}
+		v = bundle
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		fmt.Println(string(data))
+		return nil
+	}
+	return ioutil.WriteFile(*out, append(data, '\n'), 0644)
+}
+
+func cliSigningKeyList(args []string) error {
+	fs := flag.NewFlagSet("signing-key list", flag.ContinueOnError)
+	asJson := fs.Bool("json", false, "output as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if AppSigningKeys == nil {
+		return errSigningKeysMissing
+	}
+	keys := sortedByStatus(AppSigningKeys.List())
+	if *asJson {
+		return cliPrintJson(keys)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KID\tSTATUS\tALG\tCREATED\tACTIVATED\tPUBLISHED UNTIL")
+	for _, k := range keys {
+		activated, until := "", ""
+		if k.TimeActivated != nil {
+			activated = k.TimeActivated.Format(time.RFC3339)
+		}
+		if k.PublishUntil != nil {
+			until = k.PublishUntil.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", k.Id, k.Status, k.Alg, k.TimeCreated.Format(time.RFC3339), activated, until)
+	}
+	return w.Flush()
+}
+
+func cliSigningKeyImport(args []string) (*SigningKey, error) {
+	if len(args) != 1 {
+		return nil, errors.New("key file is required")
+	}
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return AppSigningKeys.Import(data)
+}
+
+// cliSigningKeyAction runs an action on signing keys and prints the affected key
+func cliSigningKeyAction(action func(args []string) (*SigningKey, error)) cliCommand {
+	return func(args []string) error {
+		if AppSigningKeys == nil {
+			return errSigningKeysMissing
+		}
+		k, err := action(args)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Signing key [" + k.Id + "] is " + k.Status)
+		return nil
+	}
+}
+
+func cliImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := fs.String("format", "", "input format: json, yaml or csv (default: detected from file extension)")
+	strategy := fs.String("strategy", conflictFail, "what to do if an application already exists: skip, overwrite or fail")
+	dryRun := fs.Bool("dry-run", false, "validate only, do not import")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return fmt.Errorf("file to import is required")
+	}
+	file := fs.Arg(0)
+	f := normalizeFormat(*format)
+	if *format == "" {
+		f = formatFromFilename(file)
+	}
+	if f == "" {
+		return fmt.Errorf("unsupported format, please specify -format")
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	records, err := parseAppRecords(data, f)
+	if err != nil {
+		return err
+	}
+	results, err := importApps(records, *strategy, *dryRun, false, "cli")
+	if err != nil {
+		return err
+	}
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tID\tACTION\tERROR")
+	for _, r := range results {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", r.Index, r.Id, r.Action, r.Error)
+		if r.Action == importFailed {
+			failed++
+		}
+	}
+	w.Flush()
+	if failed > 0 {
+		return fmt.Errorf("%d record(s) failed", failed)
+	}
+	return nil
+}
+
+func cliMigrate(args []string) error {
+	// indexes are created when DAOs are initialized
+	fmt.Println("Backfilling key fingerprints...")
+	backfillKeyFingerprints(AppDao)
+	fmt.Println("Migration completed.")
+	return nil
+}
@@ -19,9 +19,23 @@ func getSession(c echo.Context) *sessions.Session {
 	return sess
 }
 
+// currentUser returns id of the logged-in user
+func currentUser(c echo.Context) string {
+	uid, _ := getSession(c).Values["uid"].(string)
+	return uid
+}
+
+// dispatchAppEvent notifies webhook subscribers about an app event
+func dispatchAppEvent(c echo.Context, event string, app *Application) {
+	if AppWebhooks != nil {
+		AppWebhooks.Dispatch(event, app, currentUser(c))
+	}
+}
+
 func actionLogout(c echo.Context) error {
 	sess := getSession(c)
 	delete(sess.Values, "uid")
+	delete(sess.Values, sessionRole)
 	sess.Save(c.Request(), c.Response())
 	return c.Redirect(http.StatusFound, c.Echo().Reverse("home"))
 }
@@ -35,22 +49,62 @@ func actionLoginSubmit(c echo.Context) error {
 	id := c.FormValue("user")
 	pwd := c.FormValue("password")
 
-	//TODO
-	if id != "admin" || pwd != "secret" {
+	user := authenticate(id, pwd)
+	if user == nil {
 		return c.Render(http.StatusOK, "login", map[string]interface{}{
 			"error": "Login failed!",
 		})
 	}
 
 	sess := getSession(c)
-	sess.Values["uid"] = id
+	sess.Values["uid"] = user.Id
+	delete(sess.Values, sessionRole)
 	sess.Save(c.Request(), c.Response())
 	return c.Redirect(http.StatusFound, c.Echo().Reverse("home"))
 }
 
+func actionSearchKey(c echo.Context) error {
+	query := strings.TrimSpace(c.QueryParam("fp"))
+	var error string
+	var app *Application
+	if query != "" {
+		fp := normalizeFingerprint(query)
+		if fp == "" {
+			error = "Invalid key fingerprint [" + query + "]!"
+		} else if v, err := AppDao.GetByFingerprint(fp); err != nil {
+			error = "Error while searching for key [" + query + "]: " + err.Error()
+		} else if v == nil {
+			error = "No application found owning key [" + query + "]!"
+		} else {
+			app = v
+		}
+	}
+	return c.Render(http.StatusOK, "layout:search_key", map[string]interface{}{
+		"active": "apps",
+		"query":  query,
+		"error":  error,
+		"app":    app,
+	})
+}
+
+func actionCompliance(c echo.Context) error {
+	return c.Render(http.StatusOK, "layout:compliance", map[string]interface{}{
+		"active":     "compliance",
+		"policy":     AppKeyPolicy,
+		"violations": AppKeyPolicy.CheckCompliance(AppDao.List()),
+	})
+}
+
 func actionHome(c echo.Context) error {
-	return c.Render(http.StatusOK, "layout:home", map[string]interface{}{
+	var error string
+	usage, err := buildUsageReport(AppUsageDao, "", 24)
+	if err != nil {
+		error = "Error while getting usage statistics: " + err.Error()
+	}
+	return c.Render(http.StatusOK, "layout:home:usage_chart", map[string]interface{}{
 		"active": "home",
+		"usage":  usage,
+		"error":  error,
 	})
 }
 
@@ -71,6 +125,19 @@ func transformFormData(c echo.Context) map[string]string {
 }
 
 func parseRsaPublicKey(keyDataBase64 string) *rsa.PublicKey {
+	if pubkey, ok := parsePublicKey(keyDataBase64).(*rsa.PublicKey); ok {
+		return pubkey
+	}
+	return nil
+}
+
+// parsePublicKey parses PEM/Base64-encoded public key data, returns nil if the key is invalid or its algorithm is not supported
+func parsePublicKey(keyDataBase64 string) interface{} {
+	return parsePublicKeyCached(keyDataBase64)
+}
+
+// parsePublicKeyData parses the public key data without caching
+func parsePublicKeyData(keyDataBase64 string) interface{} {
 	if !strings.HasPrefix(keyDataBase64, "-----BEGIN PUBLIC KEY-----") && !strings.HasSuffix(keyDataBase64, "-----END PUBLIC KEY-----") {
 		keyDataBase64 = "-----BEGIN PUBLIC KEY-----\n" + keyDataBase64 + "\n-----END PUBLIC KEY-----"
 	}
@@ -79,75 +146,214 @@ func parseRsaPublicKey(keyDataBase64 string) *rsa.PublicKey {
 		return nil
 	}
 	if pubkey, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
-		switch pubkey.(type) {
-		case *rsa.PublicKey:
-			return pubkey.(*rsa.PublicKey)
+		if keyAlgorithm(pubkey) != "" {
+			return pubkey
 		}
 	}
 	return nil
 }
 
+// validatePublicKey parses the public key data and evaluates it against key policy, returns error message if key is invalid
+func validatePublicKey(keyData string) (interface{}, string) {
+	pubKey := parsePublicKey(keyData)
+	if pubKey == nil {
+		return nil, "Error parsing Public Key data!"
+	}
+	if violations := AppKeyPolicy.Evaluate(pubKey, nil); len(violations) > 0 {
+		return nil, strings.Join(violations, "; ") + "!"
+	}
+	return pubKey, ""
+}
+
+// checkKeyOwnership returns error message if the key is already registered to an app other than appId
+func checkKeyOwnership(appId string, pubKey interface{}) string {
+	fp, err := calcKeyFingerprints(pubKey)
+	if err != nil {
+		return "Error calculating key fingerprint: " + err.Error()
+	}
+	owner, err := AppDao.GetByFingerprint(fp.Sha256)
+	if err != nil {
+		return "Error while checking key fingerprint: " + err.Error()
+	}
+	if owner != nil && owner.GetId() != appId {
+		return "Public key is already registered to application [" + owner.GetId() + "]!"
+	}
+	return ""
+}
+
+// filterAppsByStatus returns apps having the specified status, apps whose suspension has ended are active
+func filterAppsByStatus(apps []Application, status int32) []Application {
+	result := make([]Application, 0, len(apps))
+	for _, app := range apps {
+		if app.GetEffectiveStatus() == status {
+			result = append(result, app)
+		}
+	}
+	return result
+}
+
 func actionAppList(c echo.Context) error {
+	var error string
+	selector, err := parseLabelSelector(c.QueryParam("selector"))
+	if err != nil {
+		error = err.Error()
+	}
+	tags, errMsg := parseTags(c.QueryParam("tag"))
+	if error == "" {
+		error = errMsg
+	}
+	// an invalid filter lists no application rather than all of them
+	apps := []Application{}
+	if error == "" {
+		if apps, err = AppDao.Find(selector, tags); err != nil {
+			error = "Error while listing applications: " + err.Error()
+		}
+	}
+	statusKey := c.QueryParam("status")
+	if status, ok := parseAppStatus(statusKey); ok && statusKey != "" {
+		apps = filterAppsByStatus(apps, status)
+		statusKey = appStatusKeys[status]
+	} else {
+		statusKey = ""
+	}
 	return c.Render(http.StatusOK, "layout:apps", map[string]interface{}{
-		"active": "apps",
-		"apps":   AppDao.List(),
+		"active":        "apps",
+		"apps":          apps,
+		"status":        statusKey,
+		"statusOptions": appStatusOptions(appStatusOrder),
+		"selector":      c.QueryParam("selector"),
+		"tag":           c.QueryParam("tag"),
+		"error":         error,
+		// keys expiring within this number of days are highlighted
+		"expiryWarnDays": int(AppConfig.Conf.GetInt32("key_expiry.notify_before_days", 14)),
 	})
 }
 
 func actionCreateApp(c echo.Context) error {
 	formData := transformFormData(c)
-	return c.Render(http.StatusOK, "layout:create_edit_app", map[string]interface{}{
-		"active": "apps",
-		"form":   formData,
+	return c.Render(http.StatusOK, "layout:create_edit_app:custom_fields:usage_chart:key_proof", map[string]interface{}{
+		"active":        "apps",
+		"form":          formData,
+		"statusOptions": appStatusOptions(initialAppStatuses()),
 	})
 }
 
-var validAppId = regexp.MustCompile(`^[a-z0-9_-]+$`)
+// parseStatusInput parses app's status and suspension info submitted via UI, returns error message if data is invalid
+func parseStatusInput(formData map[string]string) (int32, string, *time.Time, string) {
+	status, ok := parseAppStatus(formData["status"])
+	if !ok {
+		return 0, "", nil, "Invalid application status!"
+	}
+	until, err := parseKeyExpiry(formData["suspend_until"])
+	if err != nil {
+		return 0, "", nil, "Invalid suspension end date (format yyyy-mm-dd)!"
+	}
+	return status, formData["suspend_reason"], until, ""
+}
 
-func actionCreateAppSubmit(c echo.Context) error {
-	formData := transformFormData(c)
-	var error string
+// parseLabelsInput parses app's labels and tags submitted via UI, returns error message if data is invalid
+func parseLabelsInput(formData map[string]string) (map[string]string, []string, string) {
+	labels, errMsg := parseLabels(formData["labels"])
+	if errMsg != "" {
+		return nil, nil, errMsg
+	}
+	tags, errMsg := parseTags(formData["tags"])
+	return labels, tags, errMsg
+}
 
-	appId := strings.ToLower(strings.TrimSpace(formData["id"]))
-	rsaPubKey := parseRsaPublicKey(formData["pubkey"])
-	if !validAppId.MatchString(appId) {
-		error = "Invalid application id (must contains only a-z, 0-9, _, -)"
-	} else if rsaPubKey == nil {
-		error = "Error parsing RSA Public Key data!"
-	} else if rsaPubKey.Size() < 1024/8 {
-		keySize := strconv.Itoa(rsaPubKey.Size() * 8)
-		error = "Key size (" + keySize + ") is less than 1024 bits!"
-	} else {
+var validAppId = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// validateAppInput validates app's data submitted via UI, API or import, returns error message if data is invalid.
+// If isNew is true, app id must be valid and must not exist yet.
+func validateAppInput(appId string, isNew bool, pubKeyData, keyExpiry string) string {
+	if isNew && !validAppId.MatchString(appId) {
+		return "Invalid application id (must contains only a-z, 0-9, _, -)"
+	}
+	pubKey, keyError := validatePublicKey(pubKeyData)
+	if keyError != "" {
+		return keyError
+	}
+	if _, err := parseKeyExpiry(keyExpiry); err != nil {
+		return "Invalid key expiry date (format yyyy-mm-dd)!"
+	}
+	if isNew {
 		app, err := AppDao.Get(appId)
 		if err != nil {
-			error = "Error while checking app [" + appId + "]: " + err.Error() + "!"
+			return "Error while checking app [" + appId + "]: " + err.Error() + "!"
+		} else if app != nil && app.IsDeleted() {
+			return "App [" + appId + "] already existed (in trash)!"
 		} else if app != nil {
-			error = "App [" + appId + "] already existed!"
+			return "App [" + appId + "] already existed!"
 		}
 	}
+	return checkKeyOwnership(appId, pubKey)
+}
+
+func actionCreateAppSubmit(c echo.Context) error {
+	formData := transformFormData(c)
+	appId := strings.ToLower(strings.TrimSpace(formData["id"]))
+	error := validateAppInput(appId, true, formData["pubkey"], formData["key_expiry"])
+	status, _, _, statusError := parseStatusInput(formData)
+	labels, tags, labelsError := parseLabelsInput(formData)
+	fields, fieldsError := AppFields.ParseForm(formData)
+	constraints, constraintsError := parseConstraintsInput(formData)
+	rateLimit, rateLimitError := parseRateLimitInput(formData)
+	if error == "" && statusError != "" {
+		error = statusError
+	} else if error == "" && labelsError != "" {
+		error = labelsError
+	} else if error == "" && fieldsError != "" {
+		error = fieldsError
+	} else if error == "" && constraintsError != "" {
+		error = constraintsError
+	} else if error == "" && rateLimitError != "" {
+		error = rateLimitError
+	} else if error == "" && !isInitialAppStatus(status) {
+		error = "Application cannot be created with status [" + appStatusNames[status] + "]!"
+	}
+	var keyProven *time.Time
 	if error == "" {
+		keyProven, error = checkKeyProof(appId, formData["pubkey"], formData["key_challenge"], formData["key_proof"])
+	}
+	if error == "" {
+		keyExpiry, _ := parseKeyExpiry(formData["key_expiry"])
 		app := NewApp(appId)
-		if formData["enabled"] != "" {
-			app.SetStatus(1)
-		} else {
-			app.SetStatus(0)
-		}
+		app.SetStatus(status)
+		app.SetOwner(formData["owner"])
 		app.SetDescription(formData["desc"])
-		app.SetRsaPubKey(formData["pubkey"])
+		app.SetLabels(labels).SetTags(tags)
+		app.SetCustomFields(fields)
+		app.SetConstraints(constraints)
+		app.SetRateLimit(rateLimit)
+		app.SetRsaPubKey(formData["pubkey"]).SetKeyProven(keyProven)
+		app.SetKeyExpiry(keyExpiry)
+		app.SetUpdatedBy(currentUser(c))
 		err := AppDao.Save(app)
 		if err != nil {
-			error = "Error while saving application [" + appId + "]: " + error
+			error = "Error while saving application [" + appId + "]: " + err.Error()
+		} else {
+			dispatchAppEvent(c, EventAppCreated, app)
+			if status == AppStatusPending && isApprovalRequired() {
+				if err := AppApprovals.RequestCreate(app, currentUser(c)); err != nil {
+					error = "Error while requesting approval for application [" + appId + "]: " + err.Error()
+				}
+			}
 		}
 	}
 	if error != "" {
-		return c.Render(http.StatusOK, "layout:create_edit_app", map[string]interface{}{
-			"active": "apps",
-			"form":   formData,
-			"error":  error,
+		return c.Render(http.StatusOK, "layout:create_edit_app:custom_fields:usage_chart:key_proof", map[string]interface{}{
+			"active":        "apps",
+			"form":          formData,
+			"error":         error,
+			"statusOptions": appStatusOptions(initialAppStatuses()),
 		})
 	} else {
 		sess := getSession(c)
-		sess.AddFlash("Application [" + appId + "] has been created successfully.")
+		if status == AppStatusPending && isApprovalRequired() {
+			sess.AddFlash("Application [" + appId + "] has been created and is waiting for approval.")
+		} else {
+			sess.AddFlash("Application [" + appId + "] has been created successfully.")
+		}
 		sess.Save(c.Request(), c.Response())
 		return c.Redirect(http.StatusFound, c.Echo().Reverse("apps"))
 	}
@@ -161,19 +367,66 @@ func actionEditApp(c echo.Context) error {
 		error = "Error while getting application info [" + appId + "]!"
 	} else if app == nil {
 		error = "Application not found [" + appId + "]!"
+	} else if app.IsDeleted() {
+		error = "Application [" + appId + "] is in trash!"
 	}
 	formData := transformFormData(c)
-	if app.GetStatus() == 1 {
-		formData["enabled"] = "1"
+	if app == nil {
+		return c.Render(http.StatusOK, "layout:create_edit_app:custom_fields:usage_chart:key_proof", map[string]interface{}{
+			"active":   "apps",
+			"form":     formData,
+			"error":    error,
+			"editMode": true,
+		})
 	}
+	formData["status"] = app.GetStatusKey()
+	formData["suspend_reason"] = app.GetSuspendReason()
+	formData["suspend_until"] = app.GetSuspendUntilStr()
 	formData["id"] = app.GetId()
 	formData["desc"] = app.GetDescription()
+	formData["owner"] = app.GetOwner()
+	formData["labels"] = strings.Replace(app.GetLabelsStr(), ",", "\n", -1)
+	formData["tags"] = app.GetTagsStr()
+	for k, v := range AppFields.FormValues(app) {
+		formData[k] = v
+	}
+	constraintsFormData(app.GetConstraints(), formData)
+	if limit := app.GetRateLimit(); !limit.IsUnlimited() {
+		formData[attrRateLimitRpm] = strconv.Itoa(limit.PerMinute)
+		if limit.Burst > 0 {
+			formData[attrRateLimitBurst] = strconv.Itoa(limit.Burst)
+		}
+	}
 	formData["pubkey"] = app.GetRsaPubKey()
-	return c.Render(http.StatusOK, "layout:create_edit_app", map[string]interface{}{
-		"active":   "apps",
-		"form":     formData,
-		"error":    error,
-		"editMode": true,
+	formData["key_expiry"] = app.GetKeyExpiryStr()
+	if fp := app.GetKeyFingerprints(); fp != nil {
+		formData["fp_sha256"] = fp.Sha256
+		formData["fp_sha1"] = fp.Sha1
+		formData["fp_md5"] = fp.Md5
+	}
+	if t := app.GetKeyProven(); t != nil {
+		formData["key_proven"] = t.Format("2006-01-02 15:04:05")
+	}
+	history, err := appHistory(app.GetId())
+	if err != nil && error == "" {
+		error = "Error while getting history of application [" + appId + "]: " + err.Error()
+	}
+	usage, err := buildUsageReport(AppUsageDao, app.GetId(), 48)
+	if err != nil && error == "" {
+		error = "Error while getting usage of application [" + appId + "]: " + err.Error()
+	}
+	return c.Render(http.StatusOK, "layout:create_edit_app:custom_fields:usage_chart:key_proof", map[string]interface{}{
+		"active":           "apps",
+		"form":             formData,
+		"error":            error,
+		"editMode":         true,
+		"history":          history,
+		"currentRev":       app.GetRevision(),
+		"canRollback":      isSessionAdmin(c) && !app.IsDeleted(),
+		"statusOptions":    app.NextStatuses(),
+		"pendingKeyChange": AppApprovals.PendingKeyChange(app.GetId()),
+		"authAudit":        AuthAuditLog.List(app.GetId(), 20),
+		"usage":            usage,
 	})
 }
 
@@ -185,42 +438,106 @@ func actionEditAppSubmit(c echo.Context) error {
 		error = "Error while getting application info [" + appId + "]!"
 	} else if app == nil {
 		error = "Application not found [" + appId + "]!"
+	} else if app.IsDeleted() {
+		error = "Application [" + appId + "] is in trash!"
 	}
 
 	formData := transformFormData(c)
+	formData["id"] = appId
+	if error == "" {
+		error = validateAppInput(app.GetId(), false, formData["pubkey"], formData["key_expiry"])
+	}
+	labels, tags, labelsError := parseLabelsInput(formData)
 	if error == "" {
-		rsaPubKey := parseRsaPublicKey(formData["pubkey"])
-		if rsaPubKey == nil {
-			error = "Error parsing RSA Public Key data!"
-		} else if rsaPubKey.Size() < 1024/8 {
-			keySize := strconv.Itoa(rsaPubKey.Size() * 8)
-			error = "Key size (" + keySize + ") is less than 1024 bits!"
+		error = labelsError
+	}
+	var fields map[string]interface{}
+	if error == "" {
+		fields, error = AppFields.ParseChanges(app, formData)
+	}
+	constraints, constraintsError := parseConstraintsInput(formData)
+	if error == "" {
+		error = constraintsError
+	}
+	rateLimit, rateLimitError := parseRateLimitInput(formData)
+	if error == "" {
+		error = rateLimitError
+	}
+	var wasVerifiable bool
+	if error == "" {
+		wasVerifiable = app.IsVerifiable()
+		status, reason, until, statusError := parseStatusInput(formData)
+		// unchanged status is kept as is: revoked apps can still be edited, ended suspensions are not re-validated
+		statusChanged := status != app.GetStatus() || (status == AppStatusSuspended &&
+			(strings.TrimSpace(reason) != app.GetSuspendReason() || formData["suspend_until"] != app.GetSuspendUntilStr()))
+		if statusError != "" {
+			error = statusError
+		} else if statusChanged {
+			if err := app.TransitTo(status, reason, until); err != nil {
+				error = "Error while changing status of application [" + appId + "]: " + err.Error()
+			}
 		}
 	}
+	var keyProven *time.Time
+	keyChanged := error == "" && strings.TrimSpace(formData["pubkey"]) != app.GetRsaPubKey()
+	if keyChanged {
+		keyProven, error = checkKeyProof(app.GetId(), formData["pubkey"], formData["key_challenge"], formData["key_proof"])
+	}
+	// with approval required, a new key takes effect only after being approved
+	keyChangeRequested := false
 	if error == "" {
-		if formData["enabled"] != "" {
-			app.SetStatus(1)
+		keyExpiry, _ := parseKeyExpiry(formData["key_expiry"])
+		app.SetDescription(formData["desc"])
+		app.SetOwner(formData["owner"])
+		app.SetLabels(labels).SetTags(tags)
+		app.SetCustomFields(fields)
+		app.SetConstraints(constraints)
+		app.SetRateLimit(rateLimit)
+		if keyChanged && isApprovalRequired() {
+			keyChangeRequested = true
 		} else {
-			app.SetStatus(0)
+			app.SetRsaPubKey(formData["pubkey"])
+			if keyChanged {
+				app.SetKeyProven(keyProven)
+			}
+			if app.GetKeyExpiryStr() != formData["key_expiry"] {
+				app.SetKeyExpiry(keyExpiry)
+			}
 		}
-		app.SetDescription(formData["desc"])
-		app.SetRsaPubKey(formData["pubkey"])
-		app.SetTimeUpdated(time.Now())
+		app.SetUpdatedBy(currentUser(c)).SetTimeUpdated(time.Now())
 		err := AppDao.Save(app)
 		if err != nil {
-			error = "Error while saving application [" + appId + "]: " + error
+			error = "Error while saving application [" + appId + "]: " + err.Error()
+		} else if wasVerifiable && !app.IsVerifiable() {
+			dispatchAppEvent(c, EventAppDisabled, app)
+		} else {
+			dispatchAppEvent(c, EventAppUpdated, app)
+		}
+		if err == nil && keyChangeRequested {
+			if err := AppApprovals.RequestKeyChange(app, formData["pubkey"], formData["key_expiry"], keyProven, currentUser(c)); err != nil {
+				error = "Error while requesting approval for key change of application [" + appId + "]: " + err.Error()
+			}
 		}
 	}
 	if error != "" {
-		return c.Render(http.StatusOK, "layout:create_edit_app", map[string]interface{}{
-			"active":   "apps",
-			"form":     formData,
-			"error":    error,
-			"editMode": true,
+		var statusOptions []AppStatusOption
+		if app != nil {
+			statusOptions = app.NextStatuses()
+		}
+		return c.Render(http.StatusOK, "layout:create_edit_app:custom_fields:usage_chart:key_proof", map[string]interface{}{
+			"active":        "apps",
+			"form":          formData,
+			"error":         error,
+			"editMode":      true,
+			"statusOptions": statusOptions,
 		})
 	} else {
 		sess := getSession(c)
-		sess.AddFlash("Application [" + appId + "] has been updated successfully.")
+		if keyChangeRequested {
+			sess.AddFlash("Application [" + appId + "] has been updated, its new public key is waiting for approval.")
+		} else {
+			sess.AddFlash("Application [" + appId + "] has been updated successfully.")
+		}
 		sess.Save(c.Request(), c.Response())
 		return c.Redirect(http.StatusFound, c.Echo().Reverse("apps"))
 	}
@@ -234,6 +551,9 @@ func actionDeleteApp(c echo.Context) error {
 		error = "Error while getting application info [" + appId + "]!"
 	} else if app == nil {
 		error = "Application not found [" + appId + "]!"
+	} else if app.IsDeleted() {
+		error = "Application [" + appId + "] is already in trash!"
+		app = nil
 	}
 	return c.Render(http.StatusOK, "layout:delete_app", map[string]interface{}{
 		"active": "apps",
@@ -250,11 +570,16 @@ func actionDeleteAppSubmit(c echo.Context) error {
 		error = "Error while getting application info [" + appId + "]: " + err.Error()
 	} else if app == nil {
 		error = "Application not found [" + appId + "]!"
+	} else if app.IsDeleted() {
+		error = "Application [" + appId + "] is already in trash!"
 	}
 	if error == "" {
-		err := AppDao.Delete(app)
+		app.MarkDeleted(currentUser(c))
+		err := AppDao.Save(app)
 		if err != nil {
 			error = "Error while deleting application [" + appId + "]: " + err.Error()
+		} else {
+			dispatchAppEvent(c, EventAppDeleted, app)
 		}
 	}
 	if error != "" {
@@ -265,8 +590,64 @@ func actionDeleteAppSubmit(c echo.Context) error {
 		})
 	} else {
 		sess := getSession(c)
-		sess.AddFlash("Application [" + appId + "] has been deleted successfully.")
+		sess.AddFlash("Application [" + appId + "] has been moved to trash.")
 		sess.Save(c.Request(), c.Response())
 		return c.Redirect(http.StatusFound, c.Echo().Reverse("apps"))
 	}
 }
+
+func actionTrash(c echo.Context) error {
+	return c.Render(http.StatusOK, "layout:trash", map[string]interface{}{
+		"active":         "trash",
+		"apps":           AppDao.ListDeleted(),
+		"purgeAfterDays": int(AppConfig.Conf.GetInt32("trash.purge_after_days", 30)),
+	})
+}
+
+func actionRestoreAppSubmit(c echo.Context) error {
+	appId := c.Param("id")
+	app, err := AppDao.Get(appId)
+	sess := getSession(c)
+	if err != nil {
+		sess.AddFlash("Error while getting application info [" + appId + "]: " + err.Error())
+	} else if app == nil || !app.IsDeleted() {
+		sess.AddFlash("Application not found in trash [" + appId + "]!")
+	} else if fp := app.GetKeyFingerprints(); fp != nil && checkKeyOwnership(appId, parsePublicKey(app.GetRsaPubKey())) != "" {
+		// the key may have been registered to another app while this one was in trash
+		sess.AddFlash("Application [" + appId + "] cannot be restored, its public key is now registered to another application!")
+	} else if err := AppDao.Save(app.Restore().SetUpdatedBy(currentUser(c)).SetTimeUpdated(time.Now())); err != nil {
+		sess.AddFlash("Error while restoring application [" + appId + "]: " + err.Error())
+	} else {
+		dispatchAppEvent(c, EventAppRestored, app)
+		sess.AddFlash("Application [" + appId + "] has been restored successfully.")
+	}
+	sess.Save(c.Request(), c.Response())
+	return c.Redirect(http.StatusFound, c.Echo().Reverse("trash"))
+}
+
+func actionRollbackAppSubmit(c echo.Context) error {
+	appId := c.Param("id")
+	rev, _ := strconv.ParseInt(c.Param("rev"), 10, 64)
+	app, err := AppDao.Get(appId)
+	sess := getSession(c)
+	if !isSessionAdmin(c) {
+		sess.AddFlash("Only admins can roll back applications!")
+	} else if err != nil {
+		sess.AddFlash("Error while getting application info [" + appId + "]: " + err.Error())
+	} else if app == nil || app.IsDeleted() {
+		sess.AddFlash("Application not found [" + appId + "]!")
+	} else if keyChangeRequested, err := rollbackApp(app, rev, currentUser(c)); err != nil && !keyChangeRequested {
+		sess.AddFlash("Error while rolling back application [" + appId + "]: " + err.Error())
+	} else {
+		dispatchAppEvent(c, EventAppUpdated, app)
+		if err != nil {
+			sess.AddFlash("Application [" + appId + "] has been rolled back to revision " + c.Param("rev") + ", but error while requesting approval for its key change: " + err.Error())
+		} else if keyChangeRequested {
+			sess.AddFlash("Application [" + appId + "] has been rolled back to revision " + c.Param("rev") + ", its public key is waiting for approval.")
+		} else {
+			sess.AddFlash("Application [" + appId + "] has been rolled back to revision " + c.Param("rev") + ".")
+		}
+	}
+	sess.Save(c.Request(), c.Response())
+	return c.Redirect(http.StatusFound, c.Echo().Reverse("apps"))
+}
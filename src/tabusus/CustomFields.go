@@ -0,0 +1,319 @@
+package tabusus
+
+import (
+	"fmt"
+	"github.com/labstack/gommon/log"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"tabusus/utils"
+)
+
+const (
+	fieldTypeString = "string"
+	fieldTypeText   = "text"
+	fieldTypeInt    = "int"
+	fieldTypeBool   = "bool"
+	fieldTypeEmail  = "email"
+	fieldTypeUrl    = "url"
+	fieldTypeEnum   = "enum"
+	fieldTypeList   = "list" // list of strings, one per line in forms
+
+	// custom fields are stored in app's data as "cf_<name>"
+	attrCustomFieldPrefix = "cf_"
+)
+
+var validFieldName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// CustomField describes an extra application attribute defined by configurations at "custom_fields"
+type CustomField struct {
+	Name     string         `json:"name"`
+	Label    string         `json:"label"`
+	Type     string         `json:"type"`
+	Required bool           `json:"required"`
+	Pattern  string         `json:"pattern,omitempty"` // regular expression that (each item of) the value must match
+	Values   []string       `json:"values,omitempty"`  // allowed values of enum fields
+	Help     string         `json:"help,omitempty"`
+	Order    int            `json:"order"`
+	regex    *regexp.Regexp `json:"-"`
+}
+
+// CustomFieldSchema is the list of custom fields, in display order
+type CustomFieldSchema []*CustomField
+
+// loadCustomFieldSchema builds custom field schema from configurations at "custom_fields"
+func loadCustomFieldSchema(appConfig *HoconConfig) CustomFieldSchema {
+	schema := CustomFieldSchema{}
+	conf := appConfig.Conf.GetConfig("custom_fields")
+	if conf == nil || conf.IsEmpty() {
+		return schema
+	}
+	for _, name := range conf.Root().GetObject().GetKeys() {
+		field := &CustomField{
+			Name:     name,
+			Label:    conf.GetString(name+".label", name),
+			Type:     strings.ToLower(conf.GetString(name+".type", fieldTypeString)),
+			Required: conf.GetBoolean(name+".required", false),
+			Pattern:  conf.GetString(name+".regex", ""),
+			Values:   conf.GetStringList(name + ".values"),
+			Help:     conf.GetString(name+".help", ""),
+			Order:    int(conf.GetInt32(name+".order", 0)),
+		}
+		if !validFieldName.MatchString(name) {
+			log.Error("Custom field [", name, "] has invalid name (a-z, 0-9 and _, starting with a letter), ignored")
+			continue
+		}
+		switch field.Type {
+		case fieldTypeString, fieldTypeText, fieldTypeInt, fieldTypeBool, fieldTypeEmail, fieldTypeUrl, fieldTypeList:
+		case fieldTypeEnum:
+			if len(field.Values) == 0 {
+				log.Error("Custom field [", name, "] is of type enum but has no values, ignored")
+				continue
+			}
+		default:
+			log.Error("Custom field [", name, "] has unsupported type [", field.Type, "], ignored")
+			continue
+		}
+		if field.Pattern != "" {
+			regex, err := regexp.Compile(field.Pattern)
+			if err != nil {
+				log.Error("Custom field [", name, "] has invalid regex: ", err, ", ignored")
+				continue
+			}
+			field.regex = regex
+		}
+		schema = append(schema, field)
+	}
+	sort.SliceStable(schema, func(i, j int) bool {
+		if schema[i].Order != schema[j].Order {
+			return schema[i].Order < schema[j].Order
+		}
+		return schema[i].Name < schema[j].Name
+	})
+	return schema
+}
+
+// Field returns the custom field with the specified name, or nil if not defined
+func (s CustomFieldSchema) Field(name string) *CustomField {
+	for _, f := range s {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// FormName returns name of the form input of the field
+func (f *CustomField) FormName() string {
+	return attrCustomFieldPrefix + f.Name
+}
+
+// Parse parses and validates the field's value from its string form (as submitted via forms or CSV),
+// returns nil value if input is empty, or error message if input is invalid
+func (f *CustomField) Parse(input string) (interface{}, string) {
+	input = strings.TrimSpace(input)
+	if f.Type == fieldTypeList {
+		var items []string
+		for _, item := range strings.Split(input, "\n") {
+			if item = strings.TrimSpace(item); item != "" {
+				if f.regex != nil && !f.regex.MatchString(item) {
+					return nil, "Invalid value [" + item + "] of field [" + f.Label + "]!"
+				}
+				items = append(items, item)
+			}
+		}
+		if len(items) == 0 {
+			return nil, f.checkRequired()
+		}
+		return items, ""
+	}
+	if input == "" {
+		return nil, f.checkRequired()
+	}
+	if f.regex != nil && !f.regex.MatchString(input) {
+		return nil, "Invalid value [" + input + "] of field [" + f.Label + "]!"
+	}
+	switch f.Type {
+	case fieldTypeInt:
+		v, err := strconv.ParseInt(input, 10, 64)
+		if err != nil {
+			return nil, "Field [" + f.Label + "] must be an integer!"
+		}
+		return v, ""
+	case fieldTypeBool:
+		v, err := strconv.ParseBool(input)
+		if err != nil {
+			return nil, "Field [" + f.Label + "] must be true or false!"
+		}
+		if !v {
+			return nil, f.checkRequired()
+		}
+		return v, ""
+	case fieldTypeEmail:
+		if addr, err := mail.ParseAddress(input); err != nil || addr.Address != input {
+			return nil, "Field [" + f.Label + "] must be an email address!"
+		}
+	case fieldTypeUrl:
+		if u, err := url.Parse(input); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, "Field [" + f.Label + "] must be an absolute URL!"
+		}
+	case fieldTypeEnum:
+		for _, v := range f.Values {
+			if v == input {
+				return input, ""
+			}
+		}
+		return nil, "Field [" + f.Label + "] must be one of: " + strings.Join(f.Values, ", ") + "!"
+	}
+	return input, ""
+}
+
+func (f *CustomField) checkRequired() string {
+	if f.Required {
+		return "Field [" + f.Label + "] is required!"
+	}
+	return ""
+}
+
+// formatValue converts a field's value to its string form, the reverse of Parse
+func (f *CustomField) formatValue(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	if f.Type == fieldTypeList {
+		if items, ok := utils.ToStringSlice(value); ok {
+			return strings.Join(items, "\n")
+		}
+	}
+	return fmt.Sprint(value)
+}
+
+// ValueStr returns string form of the field's value of an app
+func (f *CustomField) ValueStr(app *Application) string {
+	return f.formatValue(app.GetCustomField(f.Name))
+}
+
+// ParseForm parses and validates values of all custom fields from submitted form data
+func (s CustomFieldSchema) ParseForm(formData map[string]string) (map[string]interface{}, string) {
+	values := map[string]interface{}{}
+	for _, f := range s {
+		v, errMsg := f.Parse(formData[f.FormName()])
+		if errMsg != "" {
+			return nil, errMsg
+		}
+		if v != nil {
+			values[f.Name] = v
+		}
+	}
+	return values, ""
+}
+
+// ParseChanges parses and validates values of custom fields submitted for an existing app: only values that differ
+// from the app's current values are validated, other values are kept as they are, including values of fields that
+// are no longer defined (so that changes of the schema do not prevent unrelated changes of apps)
+func (s CustomFieldSchema) ParseChanges(app *Application, formData map[string]string) (map[string]interface{}, string) {
+	values := app.GetCustomFields()
+	for _, f := range s {
+		input := formData[f.FormName()]
+		if normalizeFieldInput(input) == normalizeFieldInput(f.ValueStr(app)) {
+			continue
+		}
+		v, errMsg := f.Parse(input)
+		if errMsg != "" {
+			return nil, errMsg
+		}
+		if v != nil {
+			values[f.Name] = v
+		} else {
+			delete(values, f.Name)
+		}
+	}
+	return values, ""
+}
+
+// normalizeFieldInput normalizes line breaks and surrounding spaces of a field's string form
+func normalizeFieldInput(input string) string {
+	return strings.TrimSpace(strings.Replace(input, "\r\n", "\n", -1))
+}
+
+// Validate validates values of custom fields submitted via API or import (e.g. decoded from JSON/YAML),
+// returns the normalized values or error message if any value is invalid or field is not defined
+func (s CustomFieldSchema) Validate(values map[string]interface{}) (map[string]interface{}, string) {
+	for name := range values {
+		if s.Field(name) == nil {
+			return nil, "Unknown field [" + name + "]!"
+		}
+	}
+	result := map[string]interface{}{}
+	for _, f := range s {
+		v, errMsg := f.Parse(f.formatValue(values[f.Name]))
+		if errMsg != "" {
+			return nil, errMsg
+		}
+		if v != nil {
+			result[f.Name] = v
+		}
+	}
+	return result, ""
+}
+
+// FormValues returns string form of an app's custom field values, keyed by form input name
+func (s CustomFieldSchema) FormValues(app *Application) map[string]string {
+	result := map[string]string{}
+	for _, f := range s {
+		result[f.FormName()] = f.ValueStr(app)
+	}
+	return result
+}
+
+/*----------------------------------------------------------------------*/
+
+func (app *Application) GetCustomField(name string) interface{} {
+	return app.Data[attrCustomFieldPrefix+name]
+}
+
+func (app *Application) GetCustomFieldStr(name string) string {
+	v, _ := utils.ToString(app.GetCustomField(name))
+	return v
+}
+
+func (app *Application) GetCustomFieldInt(name string) (int64, bool) {
+	return utils.ToInt64(app.GetCustomField(name))
+}
+
+func (app *Application) GetCustomFieldBool(name string) bool {
+	v, _ := app.GetCustomField(name).(bool)
+	return v
+}
+
+func (app *Application) GetCustomFieldList(name string) []string {
+	v, _ := utils.ToStringSlice(app.GetCustomField(name))
+	return v
+}
+
+// GetCustomFields returns all custom field values of the app, keyed by field name
+func (app *Application) GetCustomFields() map[string]interface{} {
+	result := map[string]interface{}{}
+	for k, v := range app.Data {
+		if strings.HasPrefix(k, attrCustomFieldPrefix) {
+			result[strings.TrimPrefix(k, attrCustomFieldPrefix)] = v
+		}
+	}
+	return result
+}
+
+// SetCustomFields replaces all custom field values of the app, values must have been validated against the schema
+func (app *Application) SetCustomFields(values map[string]interface{}) *Application {
+	for k := range app.Data {
+		if strings.HasPrefix(k, attrCustomFieldPrefix) {
+			delete(app.Data, k)
+		}
+	}
+	for k, v := range values {
+		app.Data[attrCustomFieldPrefix+k] = v
+	}
+	return app
+}
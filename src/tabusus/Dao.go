@@ -5,7 +5,10 @@ import (
 	"github.com/labstack/gommon/log"
 	"github.com/mongodb/mongo-go-driver/bson"
 	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/options"
+	"regexp"
 	"strings"
+	"sync"
 	"tabusus/utils"
 	"time"
 )
@@ -25,6 +28,8 @@ func NewApp(id string) *Application {
 }
 
 func NewAppFromJson(json bson.M) *Application {
+	delete(json, attrChangeRev)
+	delete(json, attrChangeType)
 	return &Application{Data: json}
 }
 
@@ -33,6 +38,17 @@ const (
 	attrStatus      = "status"
 	attrDesc        = "description"
 	attrRsaPubKey   = "rsa_pubkey"
+	attrFpSha256    = "fp_sha256"
+	attrFpSha1      = "fp_sha1"
+	attrFpMd5       = "fp_md5"
+	attrKeyTime     = "key_tc"
+	attrKeyExpiry   = "key_exp"
+	attrKeyNotified = "key_exp_notified"
+	attrRevision    = "rev"
+	attrDeletedAt   = "deleted_at"
+	attrDeletedBy   = "deleted_by"
+	attrUpdatedBy   = "updated_by"
+	attrOwner       = "owner"
 	attrTimeCreated = "tc"
 	attrTimeUpdated = "tu"
 	tableApps       = "apps"
@@ -64,11 +80,96 @@ func (app *Application) GetRsaPubKey() string {
 	return app.Data[attrRsaPubKey].(string)
 }
 
+// SetRsaPubKey sets app's public key (despite the name, keys of any supported algorithm are accepted),
+// also (re)calculates the key's fingerprints and records the time the key was changed (a new key is
+// neither proven nor notified about yet)
 func (app *Application) SetRsaPubKey(value string) *Application {
-	app.Data[attrRsaPubKey] = strings.TrimSpace(value)
+	value = strings.TrimSpace(value)
+	if oldValue, _ := utils.ToString(app.Data[attrRsaPubKey]); oldValue != value {
+		app.Data[attrKeyTime] = time.Now().UnixNano() / 1000000
+		delete(app.Data, attrKeyProven)
+		delete(app.Data, attrKeyNotified)
+	}
+	app.Data[attrRsaPubKey] = value
+	delete(app.Data, attrFpSha256)
+	delete(app.Data, attrFpSha1)
+	delete(app.Data, attrFpMd5)
+	if pubKey := parsePublicKey(value); pubKey != nil {
+		if fp, err := calcKeyFingerprints(pubKey); err == nil {
+			app.Data[attrFpSha256] = fp.Sha256
+			app.Data[attrFpSha1] = fp.Sha1
+			app.Data[attrFpMd5] = fp.Md5
+		}
+	}
 	return app
 }
 
+// GetKeyTime returns the time app's public key was registered (fallback to app's creation time)
+func (app *Application) GetKeyTime() *time.Time {
+	if v, ok := utils.ToInt64(app.Data[attrKeyTime]); ok {
+		t := time.Unix(0, v*int64(time.Millisecond))
+		return &t
+	}
+	return app.GetTimeCreated()
+}
+
+// GetKeyExpiry returns expiry time of app's public key (nil if the key never expires)
+func (app *Application) GetKeyExpiry() *time.Time {
+	if v, ok := utils.ToInt64(app.Data[attrKeyExpiry]); ok {
+		t := time.Unix(0, v*int64(time.Millisecond))
+		return &t
+	}
+	return nil
+}
+
+// SetKeyExpiry sets expiry time of app's public key (nil: key never expires)
+func (app *Application) SetKeyExpiry(value *time.Time) *Application {
+	delete(app.Data, attrKeyNotified)
+	if value == nil {
+		delete(app.Data, attrKeyExpiry)
+	} else {
+		app.Data[attrKeyExpiry] = value.UnixNano() / 1000000
+	}
+	return app
+}
+
+// GetKeyExpiryStr returns key's expiry date in format yyyy-mm-dd (empty if the key never expires)
+func (app *Application) GetKeyExpiryStr() string {
+	if t := app.GetKeyExpiry(); t != nil {
+		return t.UTC().Format(keyExpiryLayout)
+	}
+	return ""
+}
+
+// IsKeyExpired checks if app's public key has expired
+func (app *Application) IsKeyExpired() bool {
+	t := app.GetKeyExpiry()
+	return t != nil && !t.After(time.Now())
+}
+
+// IsKeyExpiringWithin checks if app's public key is going to expire within the next number of days
+func (app *Application) IsKeyExpiringWithin(days int) bool {
+	t := app.GetKeyExpiry()
+	return t != nil && t.Before(time.Now().Add(time.Duration(days)*24*time.Hour))
+}
+
+// IsKeyValid checks if app's public key is usable for verification: it must be parsable and not expired,
+// and the app must not be in trash and be in a status that accepts verification
+func (app *Application) IsKeyValid() bool {
+	return parsePublicKey(app.GetRsaPubKey()) != nil && !app.IsKeyExpired() && !app.IsDeleted() && app.IsVerifiable()
+}
+
+// GetKeyFingerprints returns fingerprints of app's public key (nil if not available)
+func (app *Application) GetKeyFingerprints() *KeyFingerprints {
+	sha256, _ := utils.ToString(app.Data[attrFpSha256])
+	sha1, _ := utils.ToString(app.Data[attrFpSha1])
+	md5, _ := utils.ToString(app.Data[attrFpMd5])
+	if sha256 == "" {
+		return nil
+	}
+	return &KeyFingerprints{Sha256: sha256, Sha1: sha1, Md5: md5}
+}
+
 func (app *Application) GetStatus() int32 {
 	v, ok := utils.ToInt32(app.Data[attrStatus])
 	if ok {
@@ -79,14 +180,15 @@ func (app *Application) GetStatus() int32 {
 }
 
 func (app *Application) GetStatusStr() string {
-	switch app.GetStatus() {
-	case 0:
-		return "Disabled"
-	case 1:
-		return "Enabled"
-	default:
-		return "Unknown"
+	if name, ok := appStatusNames[app.GetStatus()]; ok {
+		return name
 	}
+	return "Unknown"
+}
+
+// GetStatusKey returns short name of app's status (e.g. "active")
+func (app *Application) GetStatusKey() string {
+	return appStatusKeys[app.GetStatus()]
 }
 
 func (app *Application) SetStatus(value int32) *Application {
@@ -143,6 +245,75 @@ func (app *Application) SetTimeUpdated(value time.Time) *Application {
 	return app
 }
 
+// GetRevision returns revision of the registry's change that last modified the app
+func (app *Application) GetRevision() int64 {
+	v, _ := utils.ToInt64(app.Data[attrRevision])
+	return v
+}
+
+// GetOwner returns id of the developer owning the app (empty if the app is managed by admins only)
+func (app *Application) GetOwner() string {
+	v, _ := utils.ToString(app.Data[attrOwner])
+	return v
+}
+
+func (app *Application) SetOwner(user string) *Application {
+	user = strings.ToLower(strings.TrimSpace(user))
+	if user == "" {
+		delete(app.Data, attrOwner)
+	} else {
+		app.Data[attrOwner] = user
+	}
+	return app
+}
+
+// GetUpdatedBy returns id of the user who last modified the app
+func (app *Application) GetUpdatedBy() string {
+	v, _ := utils.ToString(app.Data[attrUpdatedBy])
+	return v
+}
+
+func (app *Application) SetUpdatedBy(user string) *Application {
+	app.Data[attrUpdatedBy] = user
+	return app
+}
+
+// IsDeleted checks if the app has been (soft) deleted, i.e. it is in trash
+func (app *Application) IsDeleted() bool {
+	_, ok := app.Data[attrDeletedAt]
+	return ok
+}
+
+// GetDeletedAt returns the time the app was moved to trash (nil if the app is not deleted)
+func (app *Application) GetDeletedAt() *time.Time {
+	if v, ok := utils.ToInt64(app.Data[attrDeletedAt]); ok {
+		t := time.Unix(0, v*int64(time.Millisecond))
+		return &t
+	}
+	return nil
+}
+
+// GetDeletedBy returns id of the user who moved the app to trash
+func (app *Application) GetDeletedBy() string {
+	v, _ := utils.ToString(app.Data[attrDeletedBy])
+	return v
+}
+
+// MarkDeleted moves the app to trash
+func (app *Application) MarkDeleted(user string) *Application {
+	app.Data[attrDeletedAt] = time.Now().UnixNano() / 1000000
+	app.Data[attrDeletedBy] = user
+	app.Data[attrUpdatedBy] = user
+	return app
+}
+
+// Restore takes the app out of trash
+func (app *Application) Restore() *Application {
+	delete(app.Data, attrDeletedAt)
+	delete(app.Data, attrDeletedBy)
+	return app
+}
+
 func (app *Application) UrlEdit() string {
 	return "/editApp/" + app.GetId()
 }
@@ -151,39 +322,175 @@ func (app *Application) UrlDelete() string {
 	return "/deleteApp/" + app.GetId()
 }
 
+func (app *Application) UrlRestore() string {
+	return "/restoreApp/" + app.GetId()
+}
+
+// toApiData converts app's data to a map suitable to be returned by API endpoints
+func (app *Application) toApiData() map[string]interface{} {
+	data := map[string]interface{}{
+		"id":          app.GetId(),
+		"status":      app.GetStatus(),
+		"status_str":  app.GetStatusStr(),
+		"status_key":  app.GetStatusKey(),
+		"description": app.GetDescription(),
+		"public_key":  app.GetRsaPubKey(),
+	}
+	if owner := app.GetOwner(); owner != "" {
+		data["owner"] = owner
+	}
+	if labels := app.GetLabels(); len(labels) > 0 {
+		data["labels"] = labels
+	}
+	if tags := app.GetTags(); len(tags) > 0 {
+		data["tags"] = tags
+	}
+	if fields := app.GetCustomFields(); len(fields) > 0 {
+		data["fields"] = fields
+	}
+	if constraints := app.GetConstraints(); !constraints.IsEmpty() {
+		data["constraints"] = constraints
+	}
+	if limit := app.GetRateLimit(); !limit.IsUnlimited() {
+		data["rate_limit"] = limit
+	}
+	if fp := app.GetKeyFingerprints(); fp != nil {
+		data["fingerprints"] = fp
+	}
+	if t := app.GetTimeCreated(); t != nil {
+		data["time_created"] = *t
+	}
+	if t := app.GetTimeUpdated(); t != nil {
+		data["time_updated"] = *t
+	}
+	if t := app.GetKeyExpiry(); t != nil {
+		data["key_expiry"] = *t
+	}
+	if t := app.GetKeyProven(); t != nil {
+		data["key_proven"] = *t
+	}
+	data["key_valid"] = app.IsKeyValid()
+	if app.GetStatus() == AppStatusSuspended {
+		data["suspend_reason"] = app.GetSuspendReason()
+		if t := app.GetSuspendUntil(); t != nil {
+			data["suspend_until"] = *t
+		}
+	}
+	if t := app.GetDeletedAt(); t != nil {
+		data["deleted_at"] = *t
+		data["deleted_by"] = app.GetDeletedBy()
+	}
+	return data
+}
+
 /*----------------------------------------------------------------------*/
 
 type ApplicationDao interface {
-	List() []Application
-	Delete(app *Application) error
+	List() []Application           // lists apps that are not in trash
+	ListDeleted() []Application    // lists apps in trash
+	Delete(app *Application) error // deletes the app permanently
 	Get(string) (*Application, error)
+	GetByFingerprint(fp string) (*Application, error) // looks up the app (not in trash) owning the key with given fingerprint
 	Save(app *Application) error
+	// MarkKeyNotified records that expiry of app's key has been notified, leaving other data (and revision) untouched
+	MarkKeyNotified(app *Application) error
+	// Find lists apps that are not in trash, having labels matching selector and all specified tags
+	Find(selector LabelSelector, tags []string) ([]Application, error)
 }
 
-type MongoApplicationDao struct {
-	url    string        // connection url
-	db     string        // database name
-	client *mongo.Client // client instance
-}
+var (
+	mongoClients      = map[string]*mongo.Client{}
+	mongoClientsMutex sync.Mutex
+)
 
-func NewMongoApplicationDao(url, db string) ApplicationDao {
-	m := &MongoApplicationDao{
-		url: url,
-		db:  db,
+// mongoConnect returns a client connected to MongoDB server at url, clients are shared between DAOs. Panics if error.
+func mongoConnect(url string) *mongo.Client {
+	mongoClientsMutex.Lock()
+	defer mongoClientsMutex.Unlock()
+	if c, ok := mongoClients[url]; ok {
+		return c
 	}
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 	c, err := mongo.Connect(ctx, url)
 	if err != nil {
 		panic(err)
 	}
-	m.client = c
+	mongoClients[url] = c
+	return c
+}
+
+type MongoApplicationDao struct {
+	url        string        // connection url
+	db         string        // database name
+	client     *mongo.Client // client instance
+	maxChanges   int64         // max number of entries retained in the change feed (0: no limit)
+	maxRevisions int64         // max number of revisions retained in history of each app (0: no limit)
+}
+
+// NewMongoApplicationDao creates the DAO, its change feed retains at most maxChanges entries and history of each app
+// at most maxRevisions revisions (0: no limit)
+func NewMongoApplicationDao(url, db string, maxChanges, maxRevisions int) ApplicationDao {
+	m := &MongoApplicationDao{
+		url:          url,
+		db:           db,
+		maxChanges:   int64(maxChanges),
+		maxRevisions: int64(maxRevisions),
+	}
+	m.client = mongoConnect(url)
+	m.ensureIndexes()
+	m.ensureChangeFeedIndexes()
 	return m
 }
 
+func (dao *MongoApplicationDao) ensureIndexes() {
+	collection := dao.client.Database(dao.db).Collection(tableApps)
+	for _, field := range []string{attrFpSha256, attrFpSha1, attrFpMd5, attrLabels, attrTags, attrChangeRev} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.M{field: 1},
+			Options: options.Index().SetSparse(true),
+		})
+		cancel()
+		if err != nil {
+			log.Error("Error while creating index on [", tableApps, ".", field, "]: ", err)
+		}
+	}
+}
+
 func (dao *MongoApplicationDao) List() []Application {
+	return dao.find(bson.M{attrDeletedAt: bson.M{"$exists": false}})
+}
+
+func (dao *MongoApplicationDao) ListDeleted() []Application {
+	return dao.find(bson.M{attrDeletedAt: bson.M{"$exists": true}})
+}
+
+func (dao *MongoApplicationDao) Find(selector LabelSelector, tags []string) ([]Application, error) {
+	conditions := []bson.M{{attrDeletedAt: bson.M{"$exists": false}}}
+	for _, r := range selector {
+		keyPattern := bson.M{"$elemMatch": bson.M{"$regex": "^" + regexp.QuoteMeta(r.Key) + "="}}
+		switch r.Op {
+		case selectorEquals:
+			conditions = append(conditions, bson.M{attrLabels: r.Key + "=" + r.Value})
+		case selectorNotEquals:
+			conditions = append(conditions, bson.M{attrLabels: bson.M{"$ne": r.Key + "=" + r.Value}})
+		case selectorExists:
+			conditions = append(conditions, bson.M{attrLabels: keyPattern})
+		case selectorNotExists:
+			conditions = append(conditions, bson.M{attrLabels: bson.M{"$not": keyPattern}})
+		}
+	}
+	if len(tags) > 0 {
+		conditions = append(conditions, bson.M{attrTags: bson.M{"$all": tags}})
+	}
+	return dao.find(bson.M{"$and": conditions}), nil
+}
+
+func (dao *MongoApplicationDao) find(filter bson.M) []Application {
 	collection := dao.client.Database(dao.db).Collection(tableApps)
 	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-	cur, err := collection.Find(ctx, bson.M{})
+	cur, err := collection.Find(ctx, filter)
 	defer cur.Close(ctx)
 	if err != nil {
 		log.Warn(err)
@@ -203,9 +510,19 @@ func (dao *MongoApplicationDao) List() []Application {
 }
 
 func (dao *MongoApplicationDao) Delete(app *Application) error {
+	rev, err := dao.nextRevision()
+	if err != nil {
+		return err
+	}
+	// recorded before the app is removed, so that the removal is never missing from the change feed; if removing
+	// fails, the app stays in trash, whose apps are deleted for consumers of the feed already
+	if err := dao.recordChange(rev, ChangeDeleted, app.GetId(), nil); err != nil {
+		return err
+	}
 	collection := dao.client.Database(dao.db).Collection(tableApps)
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-	_, err := collection.DeleteOne(ctx, bson.M{attrId: app.GetId()})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = collection.DeleteOne(ctx, bson.M{attrId: app.GetId()})
 	return err
 }
 
@@ -229,7 +546,55 @@ func (dao *MongoApplicationDao) Get(id string) (*Application, error) {
 	return NewAppFromJson(row), nil
 }
 
+func (dao *MongoApplicationDao) GetByFingerprint(fp string) (*Application, error) {
+	fp = normalizeFingerprint(fp)
+	if fp == "" {
+		return nil, nil
+	}
+	collection := dao.client.Database(dao.db).Collection(tableApps)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// keys of apps in trash are free to be registered again, see actionRestoreAppSubmit
+	filter := bson.M{
+		"$or":         []bson.M{{attrFpSha256: fp}, {attrFpSha1: fp}, {attrFpMd5: fp}},
+		attrDeletedAt: bson.M{"$exists": false},
+	}
+	dbResult := collection.FindOne(ctx, filter)
+	if dbResult.Err() != nil {
+		log.Error(dbResult.Err())
+		return nil, dbResult.Err()
+	}
+	var row bson.M
+	err := dbResult.Decode(&row)
+	if err != nil && err != mongo.ErrNoDocuments {
+		log.Error(err)
+		return nil, err
+	}
+	if err != nil && err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return NewAppFromJson(row), nil
+}
+
+func (dao *MongoApplicationDao) MarkKeyNotified(app *Application) error {
+	collection := dao.client.Database(dao.db).Collection(tableApps)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// the flag is not set if the key's expiry has been changed meanwhile
+	filter := bson.M{attrId: app.GetId(), attrKeyExpiry: app.Data[attrKeyExpiry]}
+	_, err := collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{attrKeyNotified: app.Data[attrKeyExpiry]}})
+	if err == nil {
+		app.Data[attrKeyNotified] = app.Data[attrKeyExpiry]
+	}
+	return err
+}
+
 func (dao *MongoApplicationDao) Save(app *Application) error {
+	rev, err := dao.nextRevision()
+	if err != nil {
+		return err
+	}
+	app.Data[attrRevision] = rev
 	json, err := app.ToJson()
 	if err != nil {
 		return err
@@ -239,8 +604,42 @@ func (dao *MongoApplicationDao) Save(app *Application) error {
 	if err != nil {
 		return err
 	}
+	data := bson.M{}
+	for k, v := range m {
+		data[k] = v
+	}
+	// the change is kept in the app document, written atomically with it, until it is recorded (see recoverChange)
+	m[attrChangeRev] = rev
+	if app.IsDeleted() {
+		m[attrChangeType] = ChangeDeleted
+	}
 	collection := dao.client.Database(dao.db).Collection(tableApps)
 	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-	_ = collection.FindOneAndReplace(ctx, bson.M{attrId: app.GetId()}, m)
+	opts := options.FindOneAndReplace().SetUpsert(true)
+	var old bson.M
+	changeType := ChangeUpdated
+	if err := collection.FindOneAndReplace(ctx, bson.M{attrId: app.GetId()}, m, opts).Decode(&old); err == mongo.ErrNoDocuments {
+		changeType = ChangeCreated
+	} else if err != nil {
+		return err
+	} else if _, wasDeleted := old[attrDeletedAt]; wasDeleted {
+		// app restored from trash
+		changeType = ChangeCreated
+	}
+	if _, ok := old[attrChangeRev]; ok {
+		// the previous change has not been recorded yet, it would be lost with the replaced document
+		if err := dao.recoverChange(old); err != nil {
+			log.Error("Error while recording previous change of application [", app.GetId(), "]: ", err)
+		}
+	}
+	if app.IsDeleted() {
+		changeType = ChangeDeleted
+	}
+	if err := dao.recordChange(rev, changeType, app.GetId(), data); err != nil {
+		// the app is saved: its change is recorded by readers of the change feed from the app document
+		log.Error("Error while recording change [", rev, "] of application [", app.GetId(), "], it is recovered from the app: ", err)
+		return nil
+	}
+	dao.clearChange(app.GetId(), rev)
 	return nil
 }
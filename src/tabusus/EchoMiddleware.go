@@ -1,17 +1,21 @@
 package tabusus
 
 import (
+	"crypto/subtle"
 	"github.com/labstack/echo"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 type Stats struct {
-	Uptime       time.Time      `json:"uptime"`
-	RequestCount uint64         `json:"requestCount"`
-	Statuses     map[string]int `json:"statuses"`
+	Uptime       time.Time            `json:"uptime"`
+	RequestCount uint64               `json:"requestCount"`
+	Statuses     map[string]int       `json:"statuses"`
+	RateLimit    *RateLimitCounters   `json:"rateLimit,omitempty"` // requests allowed/rejected by rate limits
+	Caches       map[string]*LruCache `json:"caches,omitempty"`    // hit/miss metrics of caches
 	mutex        sync.RWMutex
 }
 
@@ -54,3 +58,34 @@ func RequiredAuthMiddleWare(next echo.HandlerFunc) echo.HandlerFunc {
 		return next(c)
 	}
 }
+
+// RequiredAdminMiddleWare protects admin console pages, it must be used after RequiredAuthMiddleWare.
+// Users who are not admins are redirected to the developer portal.
+func RequiredAdminMiddleWare(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !isSessionAdmin(c) {
+			return c.Redirect(http.StatusFound, c.Echo().Reverse("portal"))
+		}
+		return next(c)
+	}
+}
+
+// RequiredApiAuthMiddleWare protects API endpoints: caller must either be logged in as an admin or
+// provide one of the configured access tokens via header "Authorization: Bearer <token>"
+func RequiredApiAuthMiddleWare(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if isSessionAdmin(c) {
+			return next(c)
+		}
+		auth := c.Request().Header.Get(echo.HeaderAuthorization)
+		if strings.HasPrefix(auth, "Bearer ") {
+			token := []byte(strings.TrimSpace(auth[len("Bearer "):]))
+			for _, v := range AppConfig.Conf.GetStringList("api.access_tokens") {
+				if v != "" && subtle.ConstantTimeCompare(token, []byte(v)) == 1 {
+					return next(c)
+				}
+			}
+		}
+		return apiResponse(c, http.StatusUnauthorized, "Authentication required!", nil)
+	}
+}
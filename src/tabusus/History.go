@@ -0,0 +1,152 @@
+package tabusus
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// FieldChange is a change of an app's field between two revisions
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// AppRevision is a snapshot of an app at a revision, together with changes made since the previous revision
+type AppRevision struct {
+	Revision int64         `json:"revision"`
+	Type     string        `json:"type"`
+	Time     time.Time     `json:"time"`
+	User     string        `json:"user"`
+	App      *Application  `json:"-"`
+	Changes  []FieldChange `json:"changes"`
+}
+
+func (r *AppRevision) UrlRollback() string {
+	return "/rollbackApp/" + r.App.GetId() + "/" + strconv.FormatInt(r.Revision, 10)
+}
+
+// appFieldValues returns values of an app's fields that are tracked by version history
+func appFieldValues(app *Application) [][2]string {
+	fp := ""
+	if v := app.GetKeyFingerprints(); v != nil {
+		fp = v.Sha256
+	}
+	values := [][2]string{
+		{"Status", app.GetStatusStr()},
+		{"Description", app.GetDescription()},
+		{"Key fingerprint", fp},
+		{"Key expiry", app.GetKeyExpiryStr()},
+		{"Labels", app.GetLabelsStr()},
+		{"Tags", app.GetTagsStr()},
+		{"Constraints", app.GetConstraints().String()},
+		{"Rate limit", app.GetRateLimit().String()},
+	}
+	for _, f := range AppFields {
+		values = append(values, [2]string{f.Label, f.ValueStr(app)})
+	}
+	return values
+}
+
+// diffApps returns field-level changes from old to new (old is nil if the app has just been created)
+func diffApps(old, new *Application) []FieldChange {
+	var result []FieldChange
+	newValues := appFieldValues(new)
+	for i, v := range newValues {
+		oldValue := ""
+		if old != nil {
+			oldValue = appFieldValues(old)[i][1]
+		}
+		if oldValue != v[1] {
+			result = append(result, FieldChange{Field: v[0], Old: oldValue, New: v[1]})
+		}
+	}
+	return result
+}
+
+// appHistory returns revisions of an app, latest first
+func appHistory(appId string) ([]AppRevision, error) {
+	changes, err := AppChanges.History(appId, 0)
+	if err != nil {
+		return nil, err
+	}
+	var result []AppRevision
+	for i, change := range changes {
+		if change.Data == nil {
+			// permanent deletion, no snapshot
+			continue
+		}
+		rev := AppRevision{Revision: change.Revision, Type: change.Type, Time: change.Time, App: NewAppFromJson(change.Data)}
+		rev.User = rev.App.GetUpdatedBy()
+		var prev *Application
+		if i+1 < len(changes) && changes[i+1].Data != nil {
+			prev = NewAppFromJson(changes[i+1].Data)
+		}
+		rev.Changes = diffApps(prev, rev.App)
+		result = append(result, rev)
+	}
+	return result, nil
+}
+
+// rollbackApp reverts an app's data to a previous revision, the rollback is recorded as a new revision.
+// A key differing from the current one is subject to the same rules as a new key: it must have been proven if proof
+// of possession is required, and takes effect only after being approved if approval is required (keyChangeRequested
+// is true in that case).
+func rollbackApp(app *Application, rev int64, user string) (keyChangeRequested bool, err error) {
+	history, err := appHistory(app.GetId())
+	if err != nil {
+		return false, err
+	}
+	var target *Application
+	for _, v := range history {
+		if v.Revision == rev {
+			target = v.App
+		}
+	}
+	if target == nil {
+		return false, errors.New("revision [" + strconv.FormatInt(rev, 10) + "] of application [" + app.GetId() + "] not found")
+	}
+	if errMsg := validateAppInput(app.GetId(), false, target.GetRsaPubKey(), target.GetKeyExpiryStr()); errMsg != "" {
+		return false, errors.New(errMsg)
+	}
+	if !canTransitApp(app.GetStatus(), target.GetStatus()) {
+		return false, errors.New("application status cannot be changed from [" + app.GetStatusStr() + "] to [" + target.GetStatusStr() + "]")
+	}
+	keyChanged := target.GetRsaPubKey() != app.GetRsaPubKey()
+	if keyChanged && AppKeyProof.Required && target.GetKeyProven() == nil {
+		return false, errors.New("possession of the private key of revision " + strconv.FormatInt(rev, 10) + " has not been proven")
+	}
+	app.SetStatus(target.GetStatus())
+	for _, attr := range []string{attrSuspendReason, attrSuspendUntil} {
+		if v, ok := target.Data[attr]; ok {
+			app.Data[attr] = v
+		} else {
+			delete(app.Data, attr)
+		}
+	}
+	app.SetDescription(target.GetDescription())
+	app.SetLabels(target.GetLabels()).SetTags(target.GetTags())
+	app.SetCustomFields(target.GetCustomFields())
+	app.SetConstraints(target.GetConstraints())
+	app.SetRateLimit(target.GetRateLimit())
+	if keyChanged && isApprovalRequired() {
+		keyChangeRequested = true
+	} else {
+		app.SetRsaPubKey(target.GetRsaPubKey())
+		if keyChanged {
+			app.SetKeyProven(target.GetKeyProven())
+		}
+		if app.GetKeyExpiryStr() != target.GetKeyExpiryStr() {
+			app.SetKeyExpiry(target.GetKeyExpiry())
+		}
+	}
+	app.SetUpdatedBy(user).SetTimeUpdated(time.Now())
+	if err := AppDao.Save(app); err != nil {
+		return false, err
+	}
+	if keyChangeRequested {
+		return true, AppApprovals.RequestKeyChange(app, target.GetRsaPubKey(), target.GetKeyExpiryStr(), target.GetKeyProven(), user)
+	}
+	return false, nil
+}
@@ -0,0 +1,386 @@
+package tabusus
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"gopkg.in/yaml.v2"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	formatJson = "json"
+	formatYaml = "yaml"
+	formatCsv  = "csv"
+
+	conflictSkip      = "skip"      // existing apps are left untouched
+	conflictOverwrite = "overwrite" // existing apps are updated with imported data
+	conflictFail      = "fail"      // the whole import is aborted if any app already exists or any record is invalid
+
+	importCreated   = "created"
+	importUpdated   = "updated"
+	importSkipped   = "skipped"
+	importFailed    = "failed"
+	importUnchanged = "not imported" // record is valid but import was aborted
+	importPending   = "pending approval"
+)
+
+// appRecord is the portable form of an application used by import/export
+type appRecord struct {
+	Id          string                 `json:"id" yaml:"id"`
+	Status      int32                  `json:"status" yaml:"status"`
+	Description string                 `json:"description" yaml:"description"`
+	PublicKey   string                 `json:"public_key" yaml:"public_key"`
+	KeyExpiry   string                 `json:"key_expiry,omitempty" yaml:"key_expiry,omitempty"` // yyyy-mm-dd
+	Owner       string                 `json:"owner,omitempty" yaml:"owner,omitempty"`
+	Labels      map[string]string      `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Tags        []string               `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Fields      map[string]interface{} `json:"fields,omitempty" yaml:"fields,omitempty"`           // custom fields
+	Constraints *AppConstraints        `json:"constraints,omitempty" yaml:"constraints,omitempty"` // JSON/YAML only
+	RateLimit   *RateLimit             `json:"rate_limit,omitempty" yaml:"rate_limit,omitempty"`   // JSON/YAML only
+
+	keyProven *time.Time // set if possession of the key has been proven (API only)
+}
+
+var csvHeader = []string{"id", "status", "description", "public_key", "key_expiry", "owner", "labels", "tags"}
+
+// csvColumns returns CSV columns, each custom field is a column named "cf_<name>"
+func csvColumns() []string {
+	columns := append([]string{}, csvHeader...)
+	for _, f := range AppFields {
+		columns = append(columns, f.FormName())
+	}
+	return columns
+}
+
+// ImportResult reports the outcome of importing one record
+type ImportResult struct {
+	Index  int    `json:"index"` // 1-based position of the record in the imported data
+	Id     string `json:"id"`
+	Action string `json:"action"`
+	Error  string `json:"error,omitempty"`
+}
+
+func appToRecord(app *Application) appRecord {
+	// values of fields no longer defined in the schema are not exported
+	fields := map[string]interface{}{}
+	for _, f := range AppFields {
+		if v := app.GetCustomField(f.Name); v != nil {
+			fields[f.Name] = v
+		}
+	}
+	var constraints *AppConstraints
+	if c := app.GetConstraints(); !c.IsEmpty() {
+		constraints = &c
+	}
+	var rateLimit *RateLimit
+	if l := app.GetRateLimit(); !l.IsUnlimited() {
+		rateLimit = &l
+	}
+	return appRecord{
+		Id:          app.GetId(),
+		Status:      app.GetStatus(),
+		Description: app.GetDescription(),
+		PublicKey:   app.GetRsaPubKey(),
+		KeyExpiry:   app.GetKeyExpiryStr(),
+		Owner:       app.GetOwner(),
+		Labels:      app.GetLabels(),
+		Tags:        app.GetTags(),
+		Fields:      fields,
+		Constraints: constraints,
+		RateLimit:   rateLimit,
+	}
+}
+
+// normalizeFormat returns a supported format name, or empty string if format is not supported
+func normalizeFormat(format string) string {
+	switch strings.ToLower(strings.TrimPrefix(format, ".")) {
+	case "json":
+		return formatJson
+	case "yaml", "yml":
+		return formatYaml
+	case "csv":
+		return formatCsv
+	}
+	return ""
+}
+
+// formatFromFilename detects format from file's extension
+func formatFromFilename(filename string) string {
+	return normalizeFormat(path.Ext(filename))
+}
+
+func contentTypeOfFormat(format string) string {
+	switch format {
+	case formatJson:
+		return "application/json"
+	case formatYaml:
+		return "application/x-yaml"
+	case formatCsv:
+		return "text/csv"
+	}
+	return "application/octet-stream"
+}
+
+// exportApps serializes apps in the specified format
+func exportApps(apps []Application, format string) ([]byte, error) {
+	records := make([]appRecord, 0, len(apps))
+	for i := range apps {
+		records = append(records, appToRecord(&apps[i]))
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Id < records[j].Id })
+	switch format {
+	case formatJson:
+		return json.MarshalIndent(records, "", "  ")
+	case formatYaml:
+		return yaml.Marshal(records)
+	case formatCsv:
+		buf := &bytes.Buffer{}
+		w := csv.NewWriter(buf)
+		w.Write(csvColumns())
+		for _, r := range records {
+			row := []string{r.Id, strconv.Itoa(int(r.Status)), r.Description, r.PublicKey, r.KeyExpiry, r.Owner,
+				formatLabels(r.Labels), strings.Join(r.Tags, ",")}
+			for _, f := range AppFields {
+				row = append(row, f.formatValue(r.Fields[f.Name]))
+			}
+			w.Write(row)
+		}
+		w.Flush()
+		return buf.Bytes(), w.Error()
+	}
+	return nil, errors.New("unsupported format [" + format + "]")
+}
+
+// parseAppRecords deserializes app records from data in the specified format
+func parseAppRecords(data []byte, format string) ([]appRecord, error) {
+	var records []appRecord
+	switch format {
+	case formatJson:
+		err := json.Unmarshal(data, &records)
+		return records, err
+	case formatYaml:
+		err := yaml.Unmarshal(data, &records)
+		return records, err
+	case formatCsv:
+		rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == 0 {
+			return records, nil
+		}
+		columns := map[string]int{}
+		for i, name := range rows[0] {
+			columns[strings.ToLower(strings.TrimSpace(name))] = i
+		}
+		if _, ok := columns["id"]; !ok {
+			return nil, errors.New("CSV header must contain column [id]")
+		}
+		get := func(row []string, name string) string {
+			if i, ok := columns[name]; ok && i < len(row) {
+				return row[i]
+			}
+			return ""
+		}
+		for i, row := range rows[1:] {
+			status, err := strconv.Atoi(strings.TrimSpace(get(row, "status")))
+			if err != nil && get(row, "status") != "" {
+				return nil, errors.New("invalid status at line " + strconv.Itoa(i+2))
+			}
+			labels, errMsg := parseLabels(get(row, "labels"))
+			if errMsg != "" {
+				return nil, errors.New(errMsg + " at line " + strconv.Itoa(i+2))
+			}
+			tags, errMsg := parseTags(get(row, "tags"))
+			if errMsg != "" {
+				return nil, errors.New(errMsg + " at line " + strconv.Itoa(i+2))
+			}
+			fields := map[string]interface{}{}
+			for _, f := range AppFields {
+				if v := get(row, f.FormName()); v != "" {
+					fields[f.Name] = v
+				}
+			}
+			records = append(records, appRecord{
+				Id:          get(row, "id"),
+				Status:      int32(status),
+				Description: get(row, "description"),
+				PublicKey:   get(row, "public_key"),
+				KeyExpiry:   get(row, "key_expiry"),
+				Owner:       get(row, "owner"),
+				Labels:      labels,
+				Tags:        tags,
+				Fields:      fields,
+			})
+		}
+		return records, nil
+	}
+	return nil, errors.New("unsupported format [" + format + "]")
+}
+
+// validateRecordMetadata validates labels, tags, custom fields and constraints of a record
+func validateRecordMetadata(r appRecord) string {
+	for k, v := range r.Labels {
+		if errMsg := validateLabel(k, v); errMsg != "" {
+			return errMsg
+		}
+	}
+	if _, errMsg := parseTags(strings.Join(r.Tags, ",")); errMsg != "" {
+		return errMsg
+	}
+	if _, errMsg := AppFields.Validate(r.Fields); errMsg != "" {
+		return errMsg
+	}
+	if r.RateLimit != nil && (r.RateLimit.PerMinute < 0 || r.RateLimit.Burst < 0) {
+		return "Rate limit must not be negative!"
+	}
+	if r.Constraints != nil {
+		return r.Constraints.Validate()
+	}
+	return ""
+}
+
+// importApps validates records with the same rules as creating/editing apps via UI, then imports them (unless dryRun).
+// Records that are invalid are reported as failed; existing apps are handled according to the conflict strategy.
+// If requireProof is true, records setting a new key fail unless possession of the key has been proven.
+func importApps(records []appRecord, strategy string, dryRun, requireProof bool, user string) ([]ImportResult, error) {
+	switch strategy {
+	case conflictSkip, conflictOverwrite, conflictFail:
+	default:
+		return nil, errors.New("unsupported conflict strategy [" + strategy + "]")
+	}
+
+	results := make([]ImportResult, len(records))
+	existingApps := make([]*Application, len(records))
+	seenIds := map[string]int{}
+	seenKeys := map[string]string{}
+	hasFailure := false
+	for i, r := range records {
+		appId := strings.ToLower(strings.TrimSpace(r.Id))
+		result := &results[i]
+		result.Index, result.Id = i+1, appId
+		existing, err := AppDao.Get(appId)
+		if err != nil {
+			result.Action, result.Error = importFailed, "Error while checking app ["+appId+"]: "+err.Error()
+		} else if prev, ok := seenIds[appId]; ok {
+			result.Action, result.Error = importFailed, "Duplicated app id, see record #"+strconv.Itoa(prev)
+		} else if existing != nil && existing.IsDeleted() {
+			result.Action, result.Error = importFailed, "App ["+appId+"] is in trash, restore it before importing!"
+		} else if existing != nil && strategy == conflictSkip {
+			result.Action = importSkipped
+		} else if existing != nil && strategy == conflictFail {
+			result.Action, result.Error = importFailed, "App ["+appId+"] already existed!"
+		} else if !isValidAppStatus(r.Status) {
+			result.Action, result.Error = importFailed, "Invalid status ["+strconv.Itoa(int(r.Status))+"]!"
+		} else if existing == nil && !isInitialAppStatus(r.Status) && r.Status != AppStatusActive {
+			result.Action, result.Error = importFailed, "App cannot be created with status ["+appStatusNames[r.Status]+"]!"
+		} else if existing != nil && !canTransitApp(existing.GetStatus(), r.Status) {
+			result.Action, result.Error = importFailed, "Status of app ["+appId+"] cannot be changed from ["+existing.GetStatusStr()+"] to ["+appStatusNames[r.Status]+"]!"
+		} else if errMsg := validateRecordMetadata(r); errMsg != "" {
+			result.Action, result.Error = importFailed, errMsg
+		} else if errMsg := validateAppInput(appId, existing == nil, r.PublicKey, r.KeyExpiry); errMsg != "" {
+			result.Action, result.Error = importFailed, errMsg
+		} else if requireProof && r.keyProven == nil && strings.TrimSpace(r.PublicKey) != "" && (existing == nil || existing.GetRsaPubKey() != strings.TrimSpace(r.PublicKey)) {
+			result.Action, result.Error = importFailed, "Proof of possession is required for new keys: set the key of app ["+appId+"] via UI, portal or API with a signed challenge!"
+		} else if fp := NewApp(appId).SetRsaPubKey(r.PublicKey).GetKeyFingerprints(); fp != nil && seenKeys[fp.Sha256] != "" {
+			result.Action, result.Error = importFailed, "Public key is also used by app ["+seenKeys[fp.Sha256]+"] in the imported data!"
+		} else {
+			if fp != nil {
+				seenKeys[fp.Sha256] = appId
+			}
+			if existing == nil {
+				result.Action = importCreated
+			} else {
+				result.Action = importUpdated
+			}
+			existingApps[i] = existing
+		}
+		if _, ok := seenIds[appId]; !ok {
+			seenIds[appId] = i + 1
+		}
+		hasFailure = hasFailure || result.Action == importFailed
+	}
+
+	if strategy == conflictFail && hasFailure {
+		for i := range results {
+			if results[i].Action != importFailed {
+				results[i].Action = importUnchanged
+			}
+		}
+		return results, nil
+	}
+	if dryRun {
+		return results, nil
+	}
+	for i, r := range records {
+		result := &results[i]
+		if result.Action != importCreated && result.Action != importUpdated {
+			continue
+		}
+		app := existingApps[i]
+		event := EventAppUpdated
+		if app == nil {
+			app = NewApp(result.Id)
+			event = EventAppCreated
+		} else {
+			app.SetTimeUpdated(time.Now())
+		}
+		keyExpiry, _ := parseKeyExpiry(r.KeyExpiry)
+		app.SetStatus(r.Status)
+		app.SetDescription(r.Description)
+		app.SetOwner(r.Owner)
+		app.SetLabels(r.Labels)
+		tags, _ := parseTags(strings.Join(r.Tags, ","))
+		app.SetTags(tags)
+		fields, _ := AppFields.Validate(r.Fields)
+		app.SetCustomFields(fields)
+		if r.Constraints != nil {
+			// CSV does not carry constraints, existing ones are kept
+			app.SetConstraints(*r.Constraints)
+		}
+		if r.RateLimit != nil {
+			app.SetRateLimit(*r.RateLimit)
+		}
+		app.SetUpdatedBy(user)
+		// with approval required, new apps are created as pending and key changes take effect only after being approved
+		requestCreate := event == EventAppCreated && (r.Status == AppStatusActive || r.Status == AppStatusPending) && isApprovalRequired()
+		requestKeyChange := event == EventAppUpdated && strings.TrimSpace(r.PublicKey) != app.GetRsaPubKey() && isApprovalRequired()
+		if requestCreate {
+			app.SetStatus(AppStatusPending)
+		}
+		if !requestKeyChange {
+			app.SetRsaPubKey(r.PublicKey)
+			if r.keyProven != nil {
+				app.SetKeyProven(r.keyProven)
+			}
+			if app.GetKeyExpiryStr() != r.KeyExpiry {
+				app.SetKeyExpiry(keyExpiry)
+			}
+		}
+		if err := AppDao.Save(app); err != nil {
+			result.Action, result.Error = importFailed, "Error while saving application ["+result.Id+"]: "+err.Error()
+			continue
+		}
+		if AppWebhooks != nil {
+			AppWebhooks.Dispatch(event, app, user)
+		}
+		var err error
+		if requestCreate {
+			err = AppApprovals.RequestCreate(app, user)
+			result.Action = importPending
+		} else if requestKeyChange {
+			err = AppApprovals.RequestKeyChange(app, r.PublicKey, r.KeyExpiry, r.keyProven, user)
+			result.Action = importPending
+		}
+		if err != nil {
+			result.Action, result.Error = importFailed, "Error while requesting approval for application ["+result.Id+"]: "+err.Error()
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,70 @@
+package tabusus
+
+import (
+	"github.com/labstack/echo"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+func actionImportExport(c echo.Context) error {
+	return c.Render(http.StatusOK, "layout:import_export", map[string]interface{}{
+		"active":   "importExport",
+		"strategy": conflictSkip,
+		"dryRun":   true,
+	})
+}
+
+// writeExport sends all apps in the specified format as a downloadable file
+func writeExport(c echo.Context, format string) error {
+	data, err := exportApps(AppDao.List(), format)
+	if err != nil {
+		return err
+	}
+	filename := "tabusus-apps-" + time.Now().Format("20060102-150405") + "." + format
+	c.Response().Header().Set(echo.HeaderContentDisposition, "attachment; filename=\""+filename+"\"")
+	return c.Blob(http.StatusOK, contentTypeOfFormat(format), data)
+}
+
+func actionExportApps(c echo.Context) error {
+	format := normalizeFormat(c.QueryParam("format"))
+	if format == "" {
+		format = formatJson
+	}
+	return writeExport(c, format)
+}
+
+func actionImportAppsSubmit(c echo.Context) error {
+	strategy := c.FormValue("strategy")
+	dryRun := c.FormValue("dry_run") != ""
+	var error string
+	var results []ImportResult
+	file, err := c.FormFile("file")
+	if err != nil {
+		error = "Please select a file to import!"
+	} else if format := formatFromFilename(file.Filename); format == "" {
+		error = "Unsupported file type [" + file.Filename + "] (supported: .json, .yaml, .yml, .csv)!"
+	} else if f, err := file.Open(); err != nil {
+		error = "Error while reading uploaded file: " + err.Error()
+	} else {
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		var records []appRecord
+		if err == nil {
+			records, err = parseAppRecords(data, format)
+		}
+		if err == nil {
+			results, err = importApps(records, strategy, dryRun, AppKeyProof.Required, currentUser(c))
+		}
+		if err != nil {
+			error = "Error while importing file [" + file.Filename + "]: " + err.Error()
+		}
+	}
+	return c.Render(http.StatusOK, "layout:import_export", map[string]interface{}{
+		"active":   "importExport",
+		"error":    error,
+		"strategy": strategy,
+		"dryRun":   dryRun,
+		"results":  results,
+	})
+}
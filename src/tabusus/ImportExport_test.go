@@ -0,0 +1,356 @@
+package tabusus
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryApplicationDao keeps apps in memory, apps are copied in and out so that callers cannot change stored data
+type memoryApplicationDao struct {
+	mutex sync.Mutex
+	apps  map[string]bson.M
+}
+
+func newMemoryApplicationDao(apps ...*Application) *memoryApplicationDao {
+	dao := &memoryApplicationDao{apps: map[string]bson.M{}}
+	for _, app := range apps {
+		dao.Save(app)
+	}
+	return dao
+}
+
+func copyAppData(data bson.M) bson.M {
+	result := bson.M{}
+	for k, v := range data {
+		result[k] = v
+	}
+	return result
+}
+
+func (dao *memoryApplicationDao) list(deleted bool) []Application {
+	dao.mutex.Lock()
+	defer dao.mutex.Unlock()
+	result := []Application{}
+	for _, data := range dao.apps {
+		app := Application{Data: copyAppData(data)}
+		if app.IsDeleted() == deleted {
+			result = append(result, app)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].GetId() < result[j].GetId() })
+	return result
+}
+
+func (dao *memoryApplicationDao) List() []Application {
+	return dao.list(false)
+}
+
+func (dao *memoryApplicationDao) ListDeleted() []Application {
+	return dao.list(true)
+}
+
+func (dao *memoryApplicationDao) Delete(app *Application) error {
+	dao.mutex.Lock()
+	defer dao.mutex.Unlock()
+	delete(dao.apps, app.GetId())
+	return nil
+}
+
+func (dao *memoryApplicationDao) Get(id string) (*Application, error) {
+	dao.mutex.Lock()
+	defer dao.mutex.Unlock()
+	if data, ok := dao.apps[id]; ok {
+		return &Application{Data: copyAppData(data)}, nil
+	}
+	return nil, nil
+}
+
+func (dao *memoryApplicationDao) GetByFingerprint(fp string) (*Application, error) {
+	for _, app := range dao.List() {
+		if f := app.GetKeyFingerprints(); f != nil && (f.Sha256 == fp || f.Sha1 == fp || f.Md5 == fp) {
+			return &app, nil
+		}
+	}
+	return nil, nil
+}
+
+func (dao *memoryApplicationDao) Save(app *Application) error {
+	dao.mutex.Lock()
+	defer dao.mutex.Unlock()
+	dao.apps[app.GetId()] = copyAppData(app.Data)
+	return nil
+}
+
+func (dao *memoryApplicationDao) MarkKeyNotified(app *Application) error {
+	dao.mutex.Lock()
+	defer dao.mutex.Unlock()
+	if data, ok := dao.apps[app.GetId()]; ok {
+		data[attrKeyNotified] = app.Data[attrKeyNotified]
+	}
+	return nil
+}
+
+func (dao *memoryApplicationDao) Find(selector LabelSelector, tags []string) ([]Application, error) {
+	var result []Application
+	for _, app := range dao.List() {
+		if selector.Matches(app.GetLabels()) && (len(tags) == 0 || len(app.GetTags()) > 0 && firstNotIn(tags, app.GetTags()) == "") {
+			result = append(result, app)
+		}
+	}
+	return result, nil
+}
+
+// testPublicKey returns a new RSA public key in PEM format
+func testPublicKey(t *testing.T) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// setupImportTest replaces the globals used by import/export, restored when the test ends
+func setupImportTest(t *testing.T, apps ...*Application) *memoryApplicationDao {
+	dao, policy, fields, approvals, webhooks := AppDao, AppKeyPolicy, AppFields, AppApprovals, AppWebhooks
+	t.Cleanup(func() {
+		AppDao, AppKeyPolicy, AppFields, AppApprovals, AppWebhooks = dao, policy, fields, approvals, webhooks
+	})
+	AppKeyPolicy = &KeyPolicy{MinRsaBits: 2048, MinRsaExponent: 3, AllowedAlgorithms: []string{keyAlgRsa}}
+	AppFields = CustomFieldSchema{{Name: "team", Label: "Team", Type: fieldTypeString}}
+	AppApprovals, AppWebhooks = nil, nil
+	memory := newMemoryApplicationDao()
+	AppDao = memory
+	for _, app := range apps {
+		memory.Save(app)
+	}
+	return memory
+}
+
+func testImportApp(t *testing.T, id, description string) *Application {
+	app := NewApp(id).SetDescription(description).SetRsaPubKey(testPublicKey(t))
+	app.SetStatus(AppStatusActive)
+	return app
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	for _, format := range []string{formatJson, formatYaml, formatCsv} {
+		t.Run(format, func(t *testing.T) {
+			expiry := time.Date(2030, 1, 31, 0, 0, 0, 0, time.UTC)
+			full := testImportApp(t, "billing", "Billing, \"v2\"").SetKeyExpiry(&expiry).SetOwner("alice").
+				SetLabels(map[string]string{"env": "prod", "team": "payments"}).SetTags([]string{"pci", "tier1"}).
+				SetCustomFields(map[string]interface{}{"team": "payments"}).
+				SetConstraints(AppConstraints{AllowedCidrs: []string{"10.0.0.0/8"}, TimeWindows: []string{"Mon-Fri 08:00-18:00"}}).
+				SetRateLimit(RateLimit{PerMinute: 60, Burst: 10})
+			minimal := testImportApp(t, "audit", "")
+			minimal.SetStatus(AppStatusDisabled)
+			src := setupImportTest(t, full, minimal)
+
+			data, err := exportApps(src.List(), format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			records, err := parseAppRecords(data, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 2 || records[0].Id != "audit" || records[1].Id != "billing" {
+				t.Fatalf("unexpected records: %+v", records)
+			}
+
+			dst := newMemoryApplicationDao()
+			AppDao = dst
+			results, err := importApps(records, conflictFail, false, false, "admin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range results {
+				if r.Action != importCreated {
+					t.Errorf("record #%d [%s]: expected [%s], got [%s] %s", r.Index, r.Id, importCreated, r.Action, r.Error)
+				}
+			}
+			again, err := exportApps(dst.List(), format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, again) {
+				t.Errorf("export of imported apps differs:\n%s\n---\n%s", data, again)
+			}
+			app, _ := dst.Get("billing")
+			if format == formatCsv {
+				// CSV does not carry constraints and rate limits
+				if !app.GetConstraints().IsEmpty() || !app.GetRateLimit().IsUnlimited() {
+					t.Errorf("expected no constraints/rate limit from CSV, got %+v / %+v", app.GetConstraints(), app.GetRateLimit())
+				}
+			} else if app.GetConstraints().String() != full.GetConstraints().String() || app.GetRateLimit() != full.GetRateLimit() {
+				t.Errorf("expected constraints %+v and rate limit %+v, got %+v and %+v", full.GetConstraints(), full.GetRateLimit(), app.GetConstraints(), app.GetRateLimit())
+			}
+			if app.GetOwner() != "alice" || app.GetUpdatedBy() != "admin" {
+				t.Errorf("expected owner [alice] updated by [admin], got [%s] / [%s]", app.GetOwner(), app.GetUpdatedBy())
+			}
+		})
+	}
+}
+
+func TestParseAppRecordsInvalid(t *testing.T) {
+	setupImportTest(t)
+	testCases := []struct {
+		name   string
+		data   string
+		format string
+	}{
+		{"JSON syntax", `[{"id": "a"`, formatJson},
+		{"YAML syntax", "- id: [a", formatYaml},
+		{"CSV without id column", "status,description\n1,x\n", formatCsv},
+		{"CSV invalid status", "id,status\na,active\n", formatCsv},
+		{"CSV invalid label", "id,labels\na,env\n", formatCsv},
+		{"unsupported format", "id: a", "xml"},
+	}
+	for _, testCase := range testCases {
+		if records, err := parseAppRecords([]byte(testCase.data), testCase.format); err == nil {
+			t.Errorf("%s: expected error, got %+v", testCase.name, records)
+		}
+	}
+	if _, err := importApps(nil, "merge", false, false, "admin"); err == nil {
+		t.Errorf("expected unsupported conflict strategy to fail")
+	}
+}
+
+func TestImportConflictStrategies(t *testing.T) {
+	testCases := []struct {
+		strategy string
+		expected []string // actions of records [existing, new, invalid]
+		created  bool     // whether the new app is saved
+		updated  bool     // whether the existing app is changed
+	}{
+		{conflictSkip, []string{importSkipped, importCreated, importFailed}, true, false},
+		{conflictOverwrite, []string{importUpdated, importCreated, importFailed}, true, true},
+		{conflictFail, []string{importFailed, importUnchanged, importFailed}, false, false},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.strategy, func(t *testing.T) {
+			existing := testImportApp(t, "existing", "old")
+			dao := setupImportTest(t, existing)
+			records := []appRecord{
+				{Id: "existing", Status: AppStatusActive, Description: "new", PublicKey: existing.GetRsaPubKey()},
+				{Id: "New-App", Status: AppStatusActive, Description: "created", PublicKey: testPublicKey(t)},
+				{Id: "invalid", Status: AppStatusActive, PublicKey: "not a key"},
+			}
+			results, err := importApps(records, testCase.strategy, false, false, "admin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, r := range results {
+				if r.Action != testCase.expected[i] {
+					t.Errorf("record #%d [%s]: expected [%s], got [%s] %s", r.Index, r.Id, testCase.expected[i], r.Action, r.Error)
+				}
+			}
+			if results[1].Id != "new-app" {
+				t.Errorf("expected id to be normalized, got [%s]", results[1].Id)
+			}
+			if app, _ := dao.Get("new-app"); (app != nil) != testCase.created {
+				t.Errorf("expected new app saved: %v, got %v", testCase.created, app != nil)
+			}
+			if app, _ := dao.Get("existing"); (app.GetDescription() == "new") != testCase.updated {
+				t.Errorf("expected existing app updated: %v, got description [%s]", testCase.updated, app.GetDescription())
+			}
+			if app, _ := dao.Get("invalid"); app != nil {
+				t.Errorf("expected invalid record not to be imported")
+			}
+		})
+	}
+}
+
+func TestImportValidation(t *testing.T) {
+	existing := testImportApp(t, "existing", "")
+	deleted := testImportApp(t, "deleted", "")
+	deleted.MarkDeleted("admin")
+	setupImportTest(t, existing, deleted)
+	sharedKey := testPublicKey(t)
+	records := []appRecord{
+		{Id: "dup", Status: AppStatusActive, PublicKey: testPublicKey(t)},
+		{Id: "dup", Status: AppStatusActive, PublicKey: testPublicKey(t)},
+		{Id: "deleted", Status: AppStatusActive, PublicKey: deleted.GetRsaPubKey()},
+		{Id: "revoked", Status: AppStatusRevoked, PublicKey: testPublicKey(t)},
+		{Id: "unknown-status", Status: 99, PublicKey: testPublicKey(t)},
+		{Id: "stolen", Status: AppStatusActive, PublicKey: existing.GetRsaPubKey()},
+		{Id: "shared1", Status: AppStatusActive, PublicKey: sharedKey},
+		{Id: "shared2", Status: AppStatusActive, PublicKey: sharedKey},
+		{Id: "bad field", Status: AppStatusActive, PublicKey: testPublicKey(t)},
+		{Id: "unknown-field", Status: AppStatusActive, PublicKey: testPublicKey(t), Fields: map[string]interface{}{"nope": "x"}},
+		{Id: "bad-cidr", Status: AppStatusActive, PublicKey: testPublicKey(t), Constraints: &AppConstraints{AllowedCidrs: []string{"10.0.0.0/33"}}},
+		{Id: "bad-limit", Status: AppStatusActive, PublicKey: testPublicKey(t), RateLimit: &RateLimit{PerMinute: -1}},
+		{Id: "bad-expiry", Status: AppStatusActive, PublicKey: testPublicKey(t), KeyExpiry: "31/01/2030"},
+	}
+	expected := []string{importCreated, importFailed, importFailed, importFailed, importFailed, importFailed, importCreated,
+		importFailed, importFailed, importFailed, importFailed, importFailed, importFailed}
+	results, err := importApps(records, conflictSkip, true, false, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range results {
+		if r.Action != expected[i] {
+			t.Errorf("record #%d [%s]: expected [%s], got [%s] %s", r.Index, r.Id, expected[i], r.Action, r.Error)
+		}
+		if (r.Action == importFailed) != (r.Error != "") {
+			t.Errorf("record #%d [%s]: unexpected error [%s] for action [%s]", r.Index, r.Id, r.Error, r.Action)
+		}
+	}
+}
+
+// TestImportDryRun covers the validation pass saveApiAppRecord runs before checking the proof of a new key
+func TestImportDryRun(t *testing.T) {
+	existing := testImportApp(t, "existing", "old")
+	dao := setupImportTest(t, existing)
+	newKey := testPublicKey(t)
+	records := []appRecord{
+		{Id: "existing", Status: AppStatusActive, Description: "new", PublicKey: newKey},
+		{Id: "created", Status: AppStatusActive, PublicKey: testPublicKey(t)},
+	}
+	for _, strategy := range []string{conflictSkip, conflictOverwrite, conflictFail} {
+		if _, err := importApps(records, strategy, true, false, "admin"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	results, _ := importApps(records, conflictOverwrite, true, false, "admin")
+	if results[0].Action != importUpdated || results[1].Action != importCreated {
+		t.Errorf("expected [%s, %s], got %+v", importUpdated, importCreated, results)
+	}
+	if app, _ := dao.Get("existing"); app.GetDescription() != "old" || app.GetRsaPubKey() != existing.GetRsaPubKey() {
+		t.Errorf("expected dry run not to change existing app, got %+v", app.Data)
+	}
+	if app, _ := dao.Get("created"); app != nil {
+		t.Errorf("expected dry run not to create app")
+	}
+
+	// new keys require a proof, unchanged keys do not
+	results, _ = importApps(records, conflictOverwrite, true, true, "admin")
+	if results[0].Action != importFailed || results[1].Action != importFailed {
+		t.Errorf("expected records with unproven new keys to fail, got %+v", results)
+	}
+	unchanged := []appRecord{{Id: "existing", Status: AppStatusActive, Description: "new", PublicKey: existing.GetRsaPubKey()}}
+	if results, _ = importApps(unchanged, conflictOverwrite, true, true, "admin"); results[0].Action != importUpdated {
+		t.Errorf("expected record with unchanged key to be accepted, got %+v", results)
+	}
+	proven := time.Now().Truncate(time.Millisecond)
+	records[0].keyProven = &proven
+	results, _ = importApps(records[:1], conflictOverwrite, false, true, "admin")
+	if results[0].Action != importUpdated {
+		t.Fatalf("expected record with proven key to be imported, got %+v", results)
+	}
+	if app, _ := dao.Get("existing"); app.GetRsaPubKey() != strings.TrimSpace(newKey) || app.GetKeyProven() == nil || !app.GetKeyProven().Equal(proven) {
+		t.Errorf("expected new key proven at %v, got key proven at %v", proven, app.GetKeyProven())
+	}
+}
@@ -0,0 +1,93 @@
+package tabusus
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/labstack/gommon/log"
+	"regexp"
+	"strings"
+)
+
+// KeyFingerprints holds fingerprints of a public key, calculated over its DER-encoded (PKIX) form.
+// Fingerprints are lower-case hex strings without separators.
+type KeyFingerprints struct {
+	Sha256 string `json:"sha256"`
+	Sha1   string `json:"sha1"` // legacy
+	Md5    string `json:"md5"`  // legacy
+}
+
+// calcKeyFingerprints calculates SHA-256, SHA-1 and MD5 fingerprints of a public key
+func calcKeyFingerprints(pubKey interface{}) (*KeyFingerprints, error) {
+	der, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	sha256sum := sha256.Sum256(der)
+	sha1sum := sha1.Sum(der)
+	md5sum := md5.Sum(der)
+	return &KeyFingerprints{
+		Sha256: hex.EncodeToString(sha256sum[:]),
+		Sha1:   hex.EncodeToString(sha1sum[:]),
+		Md5:    hex.EncodeToString(md5sum[:]),
+	}, nil
+}
+
+var hexFingerprint = regexp.MustCompile(`^[0-9a-f]+$`)
+
+// fingerprintHexLengths maps fingerprint prefixes to the length of their digest in hex
+var fingerprintHexLengths = map[string]int{"md5:": 2 * md5.Size, "sha1:": 2 * sha1.Size, "sha256:": 2 * sha256.Size}
+
+// normalizeFingerprint converts a user-supplied fingerprint to the stored form (lower-case hex, no separators).
+//
+// Accepted inputs: hex strings with or without ':' separators (MD5: 32 chars, SHA-1: 40 chars, SHA-256: 64 chars),
+// optionally prefixed with "MD5:", "SHA1:" or "SHA256:" (the digest must then have the prefix's length); and
+// "SHA256:<base64>", the Base64-encoded SHA-256 digest. All fingerprints are calculated over the DER-encoded (PKIX) key,
+// so they do not match fingerprints of SSH keys as printed by ssh-keygen.
+// Empty string is returned if the input is not a valid fingerprint.
+func normalizeFingerprint(fp string) string {
+	fp = strings.TrimSpace(fp)
+	prefix := ""
+	for p := range fingerprintHexLengths {
+		if strings.HasPrefix(strings.ToLower(fp), p) {
+			prefix = p
+			fp = fp[len(p):]
+			break
+		}
+	}
+	if v := strings.ToLower(strings.Replace(fp, ":", "", -1)); hexFingerprint.MatchString(v) {
+		if prefix != "" && len(v) != fingerprintHexLengths[prefix] {
+			return ""
+		}
+		switch len(v) {
+		case 32, 40, 64:
+			return v
+		}
+	}
+	if prefix == "sha256:" {
+		if data, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(fp, "=")); err == nil && len(data) == sha256.Size {
+			return hex.EncodeToString(data)
+		}
+	}
+	return ""
+}
+
+// backfillKeyFingerprints calculates and stores fingerprints for apps saved before fingerprints were introduced
+func backfillKeyFingerprints(dao ApplicationDao) {
+	for _, app := range dao.List() {
+		if app.GetKeyFingerprints() != nil {
+			continue
+		}
+		app.SetRsaPubKey(app.GetRsaPubKey())
+		if app.GetKeyFingerprints() == nil {
+			log.Warn("Cannot calculate key fingerprints for app [", app.GetId(), "]")
+			continue
+		}
+		if err := dao.Save(&app); err != nil {
+			log.Error("Error while saving key fingerprints for app [", app.GetId(), "]: ", err)
+		}
+	}
+}
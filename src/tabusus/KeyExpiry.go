@@ -0,0 +1,96 @@
+package tabusus
+
+import (
+	"github.com/labstack/gommon/log"
+	"strconv"
+	"time"
+)
+
+const keyExpiryLayout = "2006-01-02"
+
+// parseKeyExpiry parses key expiry date in format yyyy-mm-dd (empty string: key never expires)
+func parseKeyExpiry(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(keyExpiryLayout, value)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// KeyExpiryScheduler periodically looks for keys that are going to expire and notifies about them, through the
+// notification channels and as "app.key_expiring" webhook events
+type KeyExpiryScheduler struct {
+	dao        ApplicationDao
+	notifier   Notifier // nil if no notification channel is configured
+	webhooks   *WebhookDispatcher
+	beforeDays int           // notify this number of days before keys expire
+	interval   time.Duration // interval between checks
+}
+
+// startKeyExpiryScheduler starts the scheduler in background if a notification channel is configured or a webhook
+// subscriber is interested in expiring keys
+func startKeyExpiryScheduler(appConfig *HoconConfig, dao ApplicationDao, webhooks *WebhookDispatcher) {
+	notifier := loadNotifier(appConfig, "key_expiry.notification")
+	if webhooks != nil && !webhooks.accepts(EventAppKeyExpiring) {
+		webhooks = nil
+	}
+	if notifier == nil && webhooks == nil {
+		log.Info("No notification channel nor webhook subscriber configured for key expiry, scheduler is disabled")
+		return
+	}
+	s := &KeyExpiryScheduler{
+		dao:        dao,
+		notifier:   notifier,
+		webhooks:   webhooks,
+		beforeDays: int(appConfig.Conf.GetInt32("key_expiry.notify_before_days", 14)),
+		interval:   time.Duration(appConfig.Conf.GetInt32("key_expiry.check_interval_minutes", 60)) * time.Minute,
+	}
+	go s.run()
+}
+
+func (s *KeyExpiryScheduler) run() {
+	for {
+		s.check()
+		time.Sleep(s.interval)
+	}
+}
+
+// check sends one notification per (app, key expiry): the expiry value notified about is recorded on the app
+func (s *KeyExpiryScheduler) check() {
+	for _, app := range s.dao.List() {
+		expiry := app.GetKeyExpiry()
+		if expiry == nil || !app.IsKeyExpiringWithin(s.beforeDays) {
+			continue
+		}
+		if notified, ok := app.Data[attrKeyNotified]; ok && notified == app.Data[attrKeyExpiry] {
+			continue
+		}
+		subject := "Key of application [" + app.GetId() + "] is going to expire"
+		if app.IsKeyExpired() {
+			subject = "Key of application [" + app.GetId() + "] has expired"
+		}
+		days := int(time.Until(*expiry).Hours() / 24)
+		if s.notifier != nil {
+			err := s.notifier.Notify(&Notification{
+				Event:   "key.expiring",
+				Subject: subject,
+				Message: subject + " (expiry: " + app.GetKeyExpiryStr() + ", days left: " + strconv.Itoa(days) + ").",
+				Data:    app.toApiData(),
+				Time:    time.Now(),
+			})
+			if err != nil {
+				log.Error("Error while sending key expiry notification for app [", app.GetId(), "]: ", err)
+				continue
+			}
+		}
+		if s.webhooks != nil {
+			s.webhooks.Dispatch(EventAppKeyExpiring, &app, "")
+		}
+		if err := s.dao.MarkKeyNotified(&app); err != nil {
+			log.Error("Error while recording key expiry notification for app [", app.GetId(), "]: ", err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package tabusus
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	keyAlgRsa     = "RSA"
+	keyAlgEcdsa   = "ECDSA"
+	keyAlgEd25519 = "Ed25519"
+)
+
+// KeyPolicy defines rules that app's public keys must comply with
+type KeyPolicy struct {
+	MinRsaBits            int      `json:"min_rsa_bits"`           // minimum RSA modulus size in bits
+	MinRsaExponent        int      `json:"min_rsa_exponent"`       // minimum RSA public exponent (forbids small exponents such as 3)
+	AllowedAlgorithms     []string `json:"allowed_algorithms"`     // allowed key algorithms (RSA, ECDSA, Ed25519)
+	MaxKeyAgeDays         int      `json:"max_key_age_days"`       // maximum key age in days, 0 means no limit
+	ForbidRoca            bool     `json:"forbid_roca"`            // forbid RSA keys vulnerable to ROCA (CVE-2017-15361)
+	ForbiddenFingerprints []string `json:"forbidden_fingerprints"` // fingerprints of known-weak/compromised keys
+}
+
+// KeyPolicyViolation lists policy violations of an app
+type KeyPolicyViolation struct {
+	App        *Application `json:"-"`
+	AppId      string       `json:"id"`
+	Violations []string     `json:"violations"`
+}
+
+// loadKeyPolicy builds key policy from configurations at "key_policy"
+func loadKeyPolicy(appConfig *HoconConfig) *KeyPolicy {
+	conf := appConfig.Conf
+	policy := &KeyPolicy{
+		MinRsaBits:        int(conf.GetInt32("key_policy.min_rsa_bits", 1024)),
+		MinRsaExponent:    int(conf.GetInt32("key_policy.min_rsa_exponent", 3)),
+		AllowedAlgorithms: conf.GetStringList("key_policy.allowed_algorithms"),
+		MaxKeyAgeDays:     int(conf.GetInt32("key_policy.max_key_age_days", 0)),
+		ForbidRoca:        conf.GetBoolean("key_policy.forbid_roca", false),
+	}
+	if len(policy.AllowedAlgorithms) == 0 {
+		policy.AllowedAlgorithms = []string{keyAlgRsa}
+	}
+	for _, fp := range conf.GetStringList("key_policy.forbidden_fingerprints") {
+		if fp = normalizeFingerprint(fp); fp != "" {
+			policy.ForbiddenFingerprints = append(policy.ForbiddenFingerprints, fp)
+		}
+	}
+	return policy
+}
+
+// keyAlgorithm returns algorithm name of a public key
+func keyAlgorithm(pubKey interface{}) string {
+	switch pubKey.(type) {
+	case *rsa.PublicKey:
+		return keyAlgRsa
+	case *ecdsa.PublicKey:
+		return keyAlgEcdsa
+	case ed25519.PublicKey:
+		return keyAlgEd25519
+	}
+	return ""
+}
+
+// Evaluate checks a public key against the policy and returns list of violations (empty if key complies with policy).
+// keyTime is the time the key was registered (nil to skip key age check).
+func (p *KeyPolicy) Evaluate(pubKey interface{}, keyTime *time.Time) []string {
+	var violations []string
+	alg := keyAlgorithm(pubKey)
+	allowed := false
+	for _, v := range p.AllowedAlgorithms {
+		allowed = allowed || strings.EqualFold(v, alg)
+	}
+	if !allowed {
+		violations = append(violations, "Key algorithm ["+alg+"] is not allowed (allowed: "+strings.Join(p.AllowedAlgorithms, ", ")+")")
+	}
+	if rsaPubKey, ok := pubKey.(*rsa.PublicKey); ok {
+		if keyBits := rsaPubKey.N.BitLen(); keyBits < p.MinRsaBits {
+			violations = append(violations, "Key size ("+strconv.Itoa(keyBits)+") is less than "+strconv.Itoa(p.MinRsaBits)+" bits")
+		}
+		if rsaPubKey.E < p.MinRsaExponent {
+			violations = append(violations, "Public exponent ("+strconv.Itoa(rsaPubKey.E)+") is less than "+strconv.Itoa(p.MinRsaExponent))
+		}
+		if p.ForbidRoca && isRocaVulnerable(rsaPubKey.N) {
+			violations = append(violations, "Key is vulnerable to ROCA (CVE-2017-15361)")
+		}
+	}
+	if len(p.ForbiddenFingerprints) > 0 {
+		if fp, err := calcKeyFingerprints(pubKey); err == nil {
+			for _, v := range p.ForbiddenFingerprints {
+				if v == fp.Sha256 || v == fp.Sha1 || v == fp.Md5 {
+					violations = append(violations, "Key is in the list of forbidden keys")
+					break
+				}
+			}
+		}
+	}
+	if p.MaxKeyAgeDays > 0 && keyTime != nil {
+		maxAge := time.Duration(p.MaxKeyAgeDays) * 24 * time.Hour
+		if time.Since(*keyTime) > maxAge {
+			violations = append(violations, "Key is older than "+strconv.Itoa(p.MaxKeyAgeDays)+" days")
+		}
+	}
+	return violations
+}
+
+// EvaluateApp checks app's current public key against the policy
+func (p *KeyPolicy) EvaluateApp(app *Application) []string {
+	pubKey := parsePublicKey(app.GetRsaPubKey())
+	if pubKey == nil {
+		return []string{"Error parsing Public Key data"}
+	}
+	return p.Evaluate(pubKey, app.GetKeyTime())
+}
+
+// CheckCompliance re-evaluates all apps against the policy and returns the violators
+func (p *KeyPolicy) CheckCompliance(apps []Application) []KeyPolicyViolation {
+	var result []KeyPolicyViolation
+	for i := range apps {
+		app := &apps[i]
+		if violations := p.EvaluateApp(app); len(violations) > 0 {
+			result = append(result, KeyPolicyViolation{App: app, AppId: app.GetId(), Violations: violations})
+		}
+	}
+	return result
+}
+
+/*----------------------------------------------------------------------*/
+
+// ROCA detection, ref: https://github.com/crocs-muni/roca
+// Moduli generated by the vulnerable library have the form k*M + (65537^a mod M) where M is a primorial,
+// hence modulo each small prime p the modulus falls into the subgroup generated by 65537.
+var rocaPrimes = []int64{3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37, 41, 43, 47, 53, 59, 61, 67, 71, 73, 79, 83, 89, 97,
+	101, 103, 107, 109, 113, 127, 131, 137, 139, 149, 151, 157, 163, 167}
+
+var rocaSubgroups = func() []map[int64]bool {
+	result := make([]map[int64]bool, len(rocaPrimes))
+	for i, p := range rocaPrimes {
+		result[i] = map[int64]bool{}
+		for v := int64(1); !result[i][v]; v = (v * 65537) % p {
+			result[i][v] = true
+		}
+	}
+	return result
+}()
+
+// isRocaVulnerable checks if an RSA modulus has the ROCA fingerprint
+func isRocaVulnerable(n *big.Int) bool {
+	mod := new(big.Int)
+	for i, p := range rocaPrimes {
+		if !rocaSubgroups[i][mod.Mod(n, big.NewInt(p)).Int64()] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,114 @@
+package tabusus
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rocaModulus builds a modulus with the structure of keys generated by the vulnerable library: both factors are
+// k*M + (65537^a mod M), M being the product of the small primes the fingerprint is checked against
+func rocaModulus() *big.Int {
+	m := big.NewInt(1)
+	for _, p := range rocaPrimes {
+		m.Mul(m, big.NewInt(p))
+	}
+	factor := func(k, a int64) *big.Int {
+		kk := new(big.Int).Lsh(big.NewInt(k), 800)
+		f := new(big.Int).Exp(big.NewInt(65537), big.NewInt(a), m)
+		return f.Add(f, kk.Mul(kk, m))
+	}
+	return new(big.Int).Mul(factor(12345, 1234), factor(67891, 4321))
+}
+
+func TestIsRocaVulnerable(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		n    *big.Int
+		want bool
+	}{
+		{"ROCA structure", rocaModulus(), true},
+		{"generated key", rsaKey.N, false},
+		{"ROCA structure doubled", new(big.Int).Mul(big.NewInt(2), rocaModulus()), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isRocaVulnerable(test.n); got != test.want {
+				t.Fatalf("isRocaVulnerable() = %v, expected %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestKeyPolicyEvaluate(t *testing.T) {
+	rsa2048, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsa1024, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	forbiddenKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	edPubKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	fp, err := calcKeyFingerprints(&forbiddenKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := &KeyPolicy{
+		MinRsaBits:            2048,
+		MinRsaExponent:        65537,
+		AllowedAlgorithms:     []string{keyAlgRsa, keyAlgEcdsa},
+		MaxKeyAgeDays:         30,
+		ForbidRoca:            true,
+		ForbiddenFingerprints: []string{normalizeFingerprint("MD5:" + strings.ToUpper(fp.Md5))},
+	}
+	recent, old := time.Now().Add(-24*time.Hour), time.Now().Add(-31*24*time.Hour)
+	tests := []struct {
+		name    string
+		pubKey  interface{}
+		keyTime *time.Time
+		want    string // expected violation, empty if the key complies
+	}{
+		{"RSA 2048", &rsa2048.PublicKey, &recent, ""},
+		{"ECDSA P-256", &ecKey.PublicKey, nil, ""},
+		{"RSA 1024", &rsa1024.PublicKey, nil, "Key size (1024) is less than 2048 bits"},
+		{"small exponent", &rsa.PublicKey{N: rsa2048.N, E: 3}, nil, "Public exponent (3) is less than 65537"},
+		{"ROCA", &rsa.PublicKey{N: rocaModulus(), E: 65537}, nil, "ROCA"},
+		{"forbidden fingerprint", &forbiddenKey.PublicKey, nil, "forbidden keys"},
+		{"algorithm not allowed", edPubKey, nil, "Key algorithm [Ed25519] is not allowed"},
+		{"too old", &ecKey.PublicKey, &old, "older than 30 days"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			violations := policy.Evaluate(test.pubKey, test.keyTime)
+			if test.want == "" {
+				if len(violations) > 0 {
+					t.Fatalf("unexpected violations: %v", violations)
+				}
+				return
+			}
+			if len(violations) != 1 || !strings.Contains(violations[0], test.want) {
+				t.Fatalf("expected violation [%s], got %v", test.want, violations)
+			}
+		})
+	}
+
+	// ROCA keys are accepted unless forbidden
+	lenient := *policy
+	lenient.ForbidRoca = false
+	if violations := lenient.Evaluate(&rsa.PublicKey{N: rocaModulus(), E: 65537}, nil); len(violations) > 0 {
+		t.Fatalf("unexpected violations: %v", violations)
+	}
+}
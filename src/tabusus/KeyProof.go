@@ -0,0 +1,244 @@
+package tabusus
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo/options"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"tabusus/utils"
+	"time"
+)
+
+const (
+	attrKeyProven = "key_proven" // time possession of the private key of app's current public key was proven
+
+	keyChallengePrefix = "tabusus-key-challenge"
+
+	envKeyProofSecret = "TABUSUS_KEY_PROOF_SECRET"
+	tableSecrets      = "secrets"
+	secretKeyProof    = "key_proof"
+)
+
+// KeyProof issues challenges and verifies proofs of possession of private keys: the owner of a new public key signs a
+// challenge issued for the app with the private key, which shows that the key is under their control. Challenges are
+// stateless (protected by HMAC), bound to an app id, expire after Ttl and are accepted for one proof only.
+type KeyProof struct {
+	Required bool          // new keys submitted via UI, portal and API must come with a proof
+	Ttl      time.Duration // validity of challenges
+	secret   []byte
+}
+
+// KeyChallenge is a challenge to be signed with the private key of an app's new public key
+type KeyChallenge struct {
+	Challenge string    `json:"challenge"`
+	AppId     string    `json:"app_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+	nonce     string
+}
+
+// loadKeyProof builds proof of possession settings from configurations at "key_policy.proof_of_possession". The secret
+// protecting challenges is taken from env TABUSUS_KEY_PROOF_SECRET or "secret"; if neither is set, a random secret is
+// generated and stored in MongoDB the first time, so that all instances share it.
+func loadKeyProof(appConfig *HoconConfig) (*KeyProof, error) {
+	conf := appConfig.Conf
+	secret := os.Getenv(envKeyProofSecret)
+	if secret == "" {
+		secret = conf.GetString("key_policy.proof_of_possession.secret", "")
+	}
+	if secret == "" {
+		var err error
+		secret, err = mongoSecret(conf.GetString("db.mongo.url"), conf.GetString("db.mongo.db"), secretKeyProof)
+		if err != nil {
+			return nil, errors.New("no secret is configured and none can be stored: " + err.Error())
+		}
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(keyChallengePrefix))
+	return &KeyProof{
+		Required: conf.GetBoolean("key_policy.proof_of_possession.required", false),
+		Ttl:      time.Duration(conf.GetInt32("key_policy.proof_of_possession.challenge_ttl_seconds", 600)) * time.Second,
+		secret:   mac.Sum(nil),
+	}, nil
+}
+
+// mongoSecret returns the secret stored under name in collection "secrets", a random one is generated and stored if
+// there is none yet (the first instance to store it wins)
+func mongoSecret(url, db, name string) (string, error) {
+	collection := mongoConnect(url).Database(db).Collection(tableSecrets)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		dbResult := collection.FindOneAndUpdate(ctx, bson.M{"_id": name}, bson.M{"$setOnInsert": bson.M{"value": utils.RandomHex(32)}}, opts)
+		if err = dbResult.Err(); err != nil {
+			// inserted concurrently (duplicate _id), read it on the next attempt
+			continue
+		}
+		var row struct {
+			Value string `bson:"value"`
+		}
+		if err = dbResult.Decode(&row); err != nil {
+			return "", err
+		}
+		if row.Value == "" {
+			return "", errors.New("secret [" + name + "] is empty")
+		}
+		return row.Value, nil
+	}
+	return "", err
+}
+
+func (p *KeyProof) mac(payload string) string {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue issues a challenge for an app, the app does not need to exist yet
+func (p *KeyProof) Issue(appId string, now time.Time) *KeyChallenge {
+	c := &KeyChallenge{AppId: appId, ExpiresAt: time.Unix(now.Add(p.Ttl).Unix(), 0), nonce: utils.RandomHex(16)}
+	payload := keyChallengePrefix + "." + appId + "." + strconv.FormatInt(c.ExpiresAt.Unix(), 10) + "." + c.nonce
+	c.Challenge = payload + "." + p.mac(payload)
+	return c
+}
+
+// parse parses a challenge issued by Issue
+func (p *KeyProof) parse(challenge string) (*KeyChallenge, error) {
+	tokens := strings.Split(challenge, ".")
+	if len(tokens) != 5 || tokens[0] != keyChallengePrefix {
+		return nil, errors.New("malformed challenge")
+	}
+	payload := strings.Join(tokens[:4], ".")
+	if !hmac.Equal([]byte(tokens[4]), []byte(p.mac(payload))) {
+		return nil, errors.New("challenge was not issued by this server")
+	}
+	exp, err := strconv.ParseInt(tokens[2], 10, 64)
+	if err != nil {
+		return nil, errors.New("malformed challenge")
+	}
+	return &KeyChallenge{Challenge: challenge, AppId: tokens[1], ExpiresAt: time.Unix(exp, 0), nonce: tokens[3]}, nil
+}
+
+// Verify verifies a proof (Base64-encoded signature of the challenge) against the public key submitted for an app.
+// The challenge is used up if the proof is valid.
+func (p *KeyProof) Verify(appId string, pubKey interface{}, challenge, proof string, now time.Time) error {
+	c, err := p.parse(challenge)
+	if err != nil {
+		return err
+	}
+	if c.AppId != appId {
+		return errors.New("challenge was issued for application [" + c.AppId + "]")
+	}
+	if !now.Before(c.ExpiresAt) {
+		return errors.New("challenge has expired, request a new one")
+	}
+	signature, err := decodeKeyProof(proof)
+	if err != nil {
+		return err
+	}
+	if !verifyKeyProofSignature(pubKey, []byte(challenge), signature) {
+		return errors.New("signature does not match the public key")
+	}
+	if AppReplay != nil && !AppReplay.use("key_challenge", appId, c.nonce, c.ExpiresAt) {
+		return errors.New("challenge has already been used, request a new one")
+	}
+	return nil
+}
+
+// decodeKeyProof decodes a signature in standard or URL-safe Base64, padded or not, line breaks are ignored
+func decodeKeyProof(proof string) ([]byte, error) {
+	proof = strings.Join(strings.Fields(proof), "")
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if signature, err := enc.DecodeString(proof); err == nil {
+			return signature, nil
+		}
+	}
+	return nil, errors.New("proof is not a valid Base64-encoded signature")
+}
+
+// verifyKeyProofSignature verifies a signature of the message with what common tools produce: RSA PKCS#1 v1.5 or PSS
+// and ECDSA (ASN.1 or r||s) with SHA-256/384/512, Ed25519 over the message itself
+func verifyKeyProofSignature(pubKey interface{}, message, signature []byte) bool {
+	if key, ok := pubKey.(ed25519.PublicKey); ok {
+		return ed25519.Verify(key, message, signature)
+	}
+	sum256, sum384, sum512 := sha256.Sum256(message), sha512.Sum384(message), sha512.Sum512(message)
+	digests := map[crypto.Hash][]byte{crypto.SHA256: sum256[:], crypto.SHA384: sum384[:], crypto.SHA512: sum512[:]}
+	for hash, digest := range digests {
+		switch key := pubKey.(type) {
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil || rsa.VerifyPSS(key, hash, digest, signature, nil) == nil {
+				return true
+			}
+		case *ecdsa.PublicKey:
+			var sig struct{ R, S *big.Int }
+			size := (key.Curve.Params().BitSize + 7) / 8
+			if len(signature) == 2*size {
+				sig.R, sig.S = new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+			} else if rest, err := asn1.Unmarshal(signature, &sig); err != nil || len(rest) > 0 {
+				return false
+			}
+			if ecdsa.Verify(key, digest, sig.R, sig.S) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkKeyProof verifies the proof of possession submitted with a new public key of an app. Returns the time the key
+// has been proven (nil if no proof was submitted), or error message if the proof is invalid or required but missing.
+func checkKeyProof(appId, pubKeyData, challenge, proof string) (*time.Time, string) {
+	challenge, proof = strings.TrimSpace(challenge), strings.TrimSpace(proof)
+	if proof == "" {
+		if AppKeyProof.Required {
+			return nil, "Proof of possession is required: sign a challenge with the private key and submit the signature!"
+		}
+		return nil, ""
+	}
+	if challenge == "" {
+		return nil, "Challenge of the proof of possession is missing!"
+	}
+	pubKey := parsePublicKey(pubKeyData)
+	if pubKey == nil {
+		return nil, "Error parsing Public Key data!"
+	}
+	now := time.Now()
+	if err := AppKeyProof.Verify(appId, pubKey, challenge, proof, now); err != nil {
+		return nil, "Invalid proof of possession: " + err.Error() + "!"
+	}
+	return &now, ""
+}
+
+// GetKeyProven returns the time possession of app's current key was proven (nil if it has not been proven)
+func (app *Application) GetKeyProven() *time.Time {
+	if v, ok := utils.ToInt64(app.Data[attrKeyProven]); ok {
+		t := time.Unix(0, v*int64(time.Millisecond))
+		return &t
+	}
+	return nil
+}
+
+// SetKeyProven records the time possession of app's current key was proven (nil: not proven)
+func (app *Application) SetKeyProven(value *time.Time) *Application {
+	if value == nil {
+		delete(app.Data, attrKeyProven)
+	} else {
+		app.Data[attrKeyProven] = value.UnixNano() / 1000000
+	}
+	return app
+}
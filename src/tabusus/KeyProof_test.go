@@ -0,0 +1,100 @@
+package tabusus
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"tabusus/httpsig"
+	"testing"
+	"time"
+)
+
+func signKeyProof(t *testing.T, signer crypto.Signer, challenge string) string {
+	var signature []byte
+	var err error
+	if _, ok := signer.(ed25519.PrivateKey); ok {
+		signature, err = signer.Sign(rand.Reader, []byte(challenge), crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256([]byte(challenge))
+		signature, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(signature)
+}
+
+func TestKeyProofVerify(t *testing.T) {
+	defer func(r *ReplayProtection) { AppReplay = r }(AppReplay)
+	AppReplay = &ReplayProtection{store: httpsig.NewMemoryReplayStore()}
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	p := &KeyProof{Ttl: 10 * time.Minute, secret: []byte("test-secret")}
+	other := &KeyProof{Ttl: 10 * time.Minute, secret: []byte("other-secret")}
+	now := time.Now()
+
+	reused := p.Issue("my-app", now).Challenge
+	tests := []struct {
+		name      string
+		appId     string
+		signer    crypto.Signer
+		pubKey    crypto.PublicKey // default: signer's public key
+		challenge string           // default: a new challenge for my-app
+		proof     func(challenge string) string
+		now       time.Time
+		wantErr   string
+	}{
+		{name: "RSA", signer: rsaKey},
+		{name: "ECDSA", signer: ecKey},
+		{name: "Ed25519", signer: edKey},
+		{name: "URL-safe Base64 with line breaks", signer: rsaKey, proof: func(challenge string) string {
+			proof := strings.TrimRight(strings.NewReplacer("+", "-", "/", "_").Replace(signKeyProof(t, rsaKey, challenge)), "=")
+			return proof[:40] + "\n" + proof[40:]
+		}},
+		{name: "other app", appId: "other-app", signer: rsaKey, wantErr: "issued for application [my-app]"},
+		{name: "expired", signer: rsaKey, now: now.Add(11 * time.Minute), wantErr: "expired"},
+		{name: "other key", signer: rsaKey, pubKey: ecKey.Public(), wantErr: "does not match"},
+		{name: "not issued by this server", signer: rsaKey, challenge: other.Issue("my-app", now).Challenge, wantErr: "not issued by this server"},
+		{name: "tampered", signer: rsaKey, challenge: strings.Replace(p.Issue("my-app", now).Challenge, "my-app", "my-apq", 1), wantErr: "not issued by this server"},
+		{name: "malformed", signer: rsaKey, challenge: "abc", wantErr: "malformed"},
+		{name: "not Base64", signer: rsaKey, proof: func(string) string { return "%%%" }, wantErr: "Base64"},
+		{name: "first use", signer: edKey, challenge: reused},
+		{name: "reused", signer: edKey, challenge: reused, wantErr: "already been used"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			appId, pubKey, challenge, at := test.appId, test.pubKey, test.challenge, test.now
+			if appId == "" {
+				appId = "my-app"
+			}
+			if pubKey == nil {
+				pubKey = test.signer.Public()
+			}
+			if challenge == "" {
+				challenge = p.Issue("my-app", now).Challenge
+			}
+			if at.IsZero() {
+				at = now
+			}
+			proof := signKeyProof(t, test.signer, challenge)
+			if test.proof != nil {
+				proof = test.proof(challenge)
+			}
+			err := p.Verify(appId, pubKey, challenge, proof, at)
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("expected error containing [%s], got [%v]", test.wantErr, err)
+			}
+		})
+	}
+}
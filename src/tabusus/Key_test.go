@@ -0,0 +1,38 @@
+package tabusus
+
+import "testing"
+
+func TestNormalizeFingerprint(t *testing.T) {
+	const sha256Hex = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	const sha1Hex = "a94a8fe5ccb19ba61c4c0873d391e987982fbbd3"
+	const md5Hex = "098f6bcd4621d373cade4e832627b4f6"
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"sha-256 hex", sha256Hex, sha256Hex},
+		{"sha-1 hex", sha1Hex, sha1Hex},
+		{"md5 hex", md5Hex, md5Hex},
+		{"upper case with separators", "09:8F:6B:CD:46:21:D3:73:CA:DE:4E:83:26:27:B4:F6", md5Hex},
+		{"surrounding spaces", "  " + sha1Hex + "\n", sha1Hex},
+		{"SHA256 prefix", "SHA256:" + sha256Hex, sha256Hex},
+		{"sha1 prefix", "sha1:" + sha1Hex, sha1Hex},
+		{"MD5 prefix", "MD5:" + md5Hex, md5Hex},
+		{"SHA256 Base64", "SHA256:n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg", sha256Hex},
+		{"SHA256 Base64 padded", "SHA256:n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg=", sha256Hex},
+		{"prefix of another length", "SHA256:" + sha1Hex, ""},
+		{"MD5 prefix with SHA-1", "MD5:" + sha1Hex, ""},
+		{"wrong length", sha1Hex[:38], ""},
+		{"not hex", "zz" + md5Hex[2:], ""},
+		{"Base64 without prefix", "n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg", ""},
+		{"empty", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := normalizeFingerprint(test.input); got != test.want {
+				t.Fatalf("normalizeFingerprint(%q) = %q, expected %q", test.input, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package tabusus
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"tabusus/utils"
+)
+
+// Labels are key/value pairs (e.g. env=prod) attached to apps, stored as a list of "key=value" strings so that
+// storage backends can index them; tags are free-form strings.
+
+const (
+	attrLabels = "labels"
+	attrTags   = "tags"
+
+	maxLabelLength = 63
+	maxTagLength   = 64
+)
+
+var (
+	// label keys: optional DNS-like prefix followed by "/", then a name of alphanumerics, '-', '_' and '.'
+	validLabelKey   = regexp.MustCompile(`^([a-z0-9]([-a-z0-9.]*[a-z0-9])?/)?[a-zA-Z0-9]([-a-zA-Z0-9_.]*[a-zA-Z0-9])?$`)
+	validLabelValue = regexp.MustCompile(`^([a-zA-Z0-9]([-a-zA-Z0-9_.]*[a-zA-Z0-9])?)?$`)
+)
+
+// validateLabel returns error message if a label is invalid
+func validateLabel(key, value string) string {
+	name := key[strings.LastIndex(key, "/")+1:]
+	if !validLabelKey.MatchString(key) || len(name) > maxLabelLength {
+		return "Invalid label key [" + key + "] (alphanumerics, '-', '_' and '.', optionally prefixed by a domain and '/')!"
+	}
+	if !validLabelValue.MatchString(value) || len(value) > maxLabelLength {
+		return "Invalid value [" + value + "] of label [" + key + "]!"
+	}
+	return ""
+}
+
+// parseLabels parses labels in form "key1=value1,key2=value2" (commas and new lines are both accepted as separators)
+func parseLabels(input string) (map[string]string, string) {
+	labels := map[string]string{}
+	for _, item := range strings.FieldsFunc(input, func(r rune) bool { return r == ',' || r == '\n' || r == '\r' }) {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		tokens := strings.SplitN(item, "=", 2)
+		if len(tokens) != 2 {
+			return nil, "Invalid label [" + item + "] (format key=value)!"
+		}
+		key, value := strings.TrimSpace(tokens[0]), strings.TrimSpace(tokens[1])
+		if errMsg := validateLabel(key, value); errMsg != "" {
+			return nil, errMsg
+		}
+		labels[key] = value
+	}
+	return labels, ""
+}
+
+// parseTags parses comma-separated tags, duplicates are removed
+func parseTags(input string) ([]string, string) {
+	var tags []string
+	seen := map[string]bool{}
+	for _, tag := range strings.Split(input, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len(tag) > maxTagLength {
+			return nil, "Tag [" + tag + "] is too long!"
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags, ""
+}
+
+// formatLabels formats labels in form "key1=value1,key2=value2", sorted by key
+func formatLabels(labels map[string]string) string {
+	items := make([]string, 0, len(labels))
+	for k, v := range labels {
+		items = append(items, k+"="+v)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+func (app *Application) GetLabels() map[string]string {
+	labels := map[string]string{}
+	items, _ := utils.ToStringSlice(app.Data[attrLabels])
+	for _, item := range items {
+		if tokens := strings.SplitN(item, "=", 2); len(tokens) == 2 {
+			labels[tokens[0]] = tokens[1]
+		}
+	}
+	return labels
+}
+
+// GetLabelsStr returns app's labels in form "key1=value1,key2=value2"
+func (app *Application) GetLabelsStr() string {
+	return formatLabels(app.GetLabels())
+}
+
+func (app *Application) SetLabels(labels map[string]string) *Application {
+	if len(labels) == 0 {
+		delete(app.Data, attrLabels)
+		return app
+	}
+	app.Data[attrLabels] = strings.Split(formatLabels(labels), ",")
+	return app
+}
+
+func (app *Application) GetTags() []string {
+	tags, _ := utils.ToStringSlice(app.Data[attrTags])
+	return tags
+}
+
+// GetTagsStr returns app's tags, comma-separated
+func (app *Application) GetTagsStr() string {
+	return strings.Join(app.GetTags(), ",")
+}
+
+func (app *Application) SetTags(tags []string) *Application {
+	if len(tags) == 0 {
+		delete(app.Data, attrTags)
+	} else {
+		app.Data[attrTags] = tags
+	}
+	return app
+}
+
+// HasTags checks if the app has all the specified tags
+func (app *Application) HasTags(tags []string) bool {
+	appTags := map[string]bool{}
+	for _, tag := range app.GetTags() {
+		appTags[tag] = true
+	}
+	for _, tag := range tags {
+		if !appTags[tag] {
+			return false
+		}
+	}
+	return true
+}
+
+/*----------------------------------------------------------------------*/
+
+const (
+	selectorEquals    = "="
+	selectorNotEquals = "!="
+	selectorExists    = "exists"
+	selectorNotExists = "!exists"
+)
+
+// LabelRequirement is a condition on an app's label
+type LabelRequirement struct {
+	Key   string
+	Op    string
+	Value string
+}
+
+// LabelSelector selects apps whose labels satisfy all requirements
+type LabelSelector []LabelRequirement
+
+// parseLabelSelector parses selector such as "env=prod,team!=legacy,tier,!deprecated":
+// "key=value" and "key==value" (label equals), "key!=value" (label is missing or differs),
+// "key" (label exists) and "!key" (label does not exist)
+func parseLabelSelector(input string) (LabelSelector, error) {
+	var selector LabelSelector
+	for _, item := range strings.Split(input, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		var r LabelRequirement
+		switch {
+		case strings.Contains(item, "!="):
+			tokens := strings.SplitN(item, "!=", 2)
+			r = LabelRequirement{Key: strings.TrimSpace(tokens[0]), Op: selectorNotEquals, Value: strings.TrimSpace(tokens[1])}
+		case strings.Contains(item, "="):
+			tokens := strings.SplitN(item, "=", 2)
+			value := strings.TrimSpace(strings.TrimPrefix(tokens[1], "="))
+			r = LabelRequirement{Key: strings.TrimSpace(tokens[0]), Op: selectorEquals, Value: value}
+		case strings.HasPrefix(item, "!"):
+			r = LabelRequirement{Key: strings.TrimSpace(item[1:]), Op: selectorNotExists}
+		default:
+			r = LabelRequirement{Key: item, Op: selectorExists}
+		}
+		if errMsg := validateLabel(r.Key, r.Value); errMsg != "" {
+			return nil, errors.New("invalid label selector [" + item + "]")
+		}
+		selector = append(selector, r)
+	}
+	return selector, nil
+}
+
+// Matches checks if labels satisfy the selector
+func (s LabelSelector) Matches(labels map[string]string) bool {
+	for _, r := range s {
+		value, exists := labels[r.Key]
+		switch r.Op {
+		case selectorEquals:
+			if !exists || value != r.Value {
+				return false
+			}
+		case selectorNotEquals:
+			if exists && value == r.Value {
+				return false
+			}
+		case selectorExists:
+			if !exists {
+				return false
+			}
+		case selectorNotExists:
+			if exists {
+				return false
+			}
+		}
+	}
+	return true
+}
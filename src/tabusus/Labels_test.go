@@ -0,0 +1,69 @@
+package tabusus
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLabelSelector(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    LabelSelector
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"env=prod", LabelSelector{{"env", selectorEquals, "prod"}}, false},
+		{"env==prod", LabelSelector{{"env", selectorEquals, "prod"}}, false},
+		{" env = prod , team!=legacy ", LabelSelector{{"env", selectorEquals, "prod"}, {"team", selectorNotEquals, "legacy"}}, false},
+		{"tier,!deprecated", LabelSelector{{"tier", selectorExists, ""}, {"deprecated", selectorNotExists, ""}}, false},
+		{"example.com/owner=ops", LabelSelector{{"example.com/owner", selectorEquals, "ops"}}, false},
+		{"env=", LabelSelector{{"env", selectorEquals, ""}}, false},
+		{",,env=prod,", LabelSelector{{"env", selectorEquals, "prod"}}, false},
+		{"=prod", nil, true},
+		{"env=pro d", nil, true},
+		{"bad key=x", nil, true},
+		{"!", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			got, err := parseLabelSelector(test.input)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("expected error: %v, got [%v]", test.wantErr, err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("parseLabelSelector(%q) = %+v, expected %+v", test.input, got, test.want)
+			}
+		})
+	}
+}
+
+func TestLabelSelectorMatches(t *testing.T) {
+	labels := map[string]string{"env": "prod", "team": "core"}
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{"", true},
+		{"env=prod", true},
+		{"env=dev", false},
+		{"team!=legacy", true},
+		{"team!=core", false},
+		{"missing!=x", true},
+		{"env,team", true},
+		{"tier", false},
+		{"!tier", true},
+		{"!env", false},
+		{"env=prod,team=core,!tier", true},
+	}
+	for _, test := range tests {
+		t.Run(test.selector, func(t *testing.T) {
+			selector, err := parseLabelSelector(test.selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := selector.Matches(labels); got != test.want {
+				t.Fatalf("%q matches: %v, expected %v", test.selector, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package tabusus
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notification is a message sent to operators/subscribers
+type Notification struct {
+	Event   string                 `json:"event"`
+	Subject string                 `json:"subject"`
+	Message string                 `json:"message"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+	Time    time.Time              `json:"time"`
+}
+
+// Notifier delivers notifications
+type Notifier interface {
+	Notify(n *Notification) error
+}
+
+// MultiNotifier delivers notifications through all its notifiers
+type MultiNotifier []Notifier
+
+func (m MultiNotifier) Notify(n *Notification) error {
+	var errs []string
+	for _, notifier := range m {
+		if err := notifier.Notify(n); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// WebhookNotifier POSTs notifications as JSON to a URL
+type WebhookNotifier struct {
+	Url    string
+	client *http.Client
+}
+
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{Url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (w *WebhookNotifier) Notify(n *Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Post(w.Url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New("webhook [" + w.Url + "] responded with status " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
+
+// SmtpNotifier sends notifications as plain-text emails
+type SmtpNotifier struct {
+	Addr     string // SMTP server address, host:port
+	From     string
+	To       []string
+	Username string // leave empty if SMTP server does not require authentication
+	Password string
+}
+
+func (s *SmtpNotifier) Notify(n *Notification) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		host := s.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	msg := "From: " + s.From + "\r\n" +
+		"To: " + strings.Join(s.To, ", ") + "\r\n" +
+		"Subject: " + n.Subject + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + n.Message + "\r\n"
+	return smtp.SendMail(s.Addr, auth, s.From, s.To, []byte(msg))
+}
+
+// loadNotifier builds notifier from configurations at the specified path, returns nil if no notification channel is configured
+func loadNotifier(appConfig *HoconConfig, path string) Notifier {
+	conf := appConfig.Conf
+	var result MultiNotifier
+	if url := conf.GetString(path+".webhook_url", ""); url != "" {
+		result = append(result, NewWebhookNotifier(url))
+	}
+	if addr := conf.GetString(path+".smtp.addr", ""); addr != "" {
+		if to := conf.GetStringList(path + ".smtp.to"); len(to) > 0 {
+			result = append(result, &SmtpNotifier{
+				Addr:     addr,
+				From:     conf.GetString(path+".smtp.from", "tabusus@localhost"),
+				To:       to,
+				Username: conf.GetString(path+".smtp.username", ""),
+				Password: conf.GetString(path+".smtp.password", ""),
+			})
+		}
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
@@ -0,0 +1,300 @@
+package tabusus
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/labstack/echo"
+	"gopkg.in/yaml.v2"
+	"net/http"
+	"sort"
+	"strings"
+	"tabusus/httpsig"
+	"time"
+)
+
+// Developer portal: self-service area where developers manage the apps they own
+
+const (
+	snippetJson = "json"
+	snippetYaml = "yaml"
+	snippetEnv  = "env"
+)
+
+// portalApp loads an app owned by the current user
+func portalApp(c echo.Context) (*Application, error) {
+	appId := c.Param("id")
+	app, err := AppDao.Get(appId)
+	if err != nil {
+		return nil, errors.New("Error while getting application info [" + appId + "]!")
+	}
+	if app == nil || app.IsDeleted() || app.GetOwner() != currentUser(c) {
+		return nil, errors.New("Application not found [" + appId + "]!")
+	}
+	return app, nil
+}
+
+// registryUrl returns the public base URL of the registry, used in client configuration snippets
+func registryUrl(c echo.Context) string {
+	if url := AppConfig.Conf.GetString("portal.public_url", ""); url != "" {
+		return strings.TrimSuffix(url, "/")
+	}
+	return c.Scheme() + "://" + c.Request().Host
+}
+
+// clientConfig builds the configuration a client of the app needs to sign requests and look up its key
+func clientConfig(c echo.Context, app *Application) map[string]interface{} {
+	baseUrl := registryUrl(c)
+	config := map[string]interface{}{
+		"app_id":           app.GetId(),
+		"registry_url":     baseUrl,
+		"private_key_file": "/path/to/" + app.GetId() + ".pem",
+		"verify_url":       baseUrl + c.Echo().Reverse("authVerify"),
+		"whoami_url":       baseUrl + c.Echo().Reverse("authWhoami"),
+	}
+	if fp := app.GetKeyFingerprints(); fp != nil {
+		config["key_fingerprint"] = fp.Sha256
+		config["signature_key_id"] = httpsig.AppKeyId(app.GetId(), fp.Sha256)
+		config["key_lookup_url"] = baseUrl + c.Echo().Reverse("apiGetKeyOwner", fp.Sha256)
+	}
+	if expiry := app.GetKeyExpiryStr(); expiry != "" {
+		config["key_expiry"] = expiry
+	}
+	return config
+}
+
+// clientConfigSnippet renders client configuration in the specified format
+func clientConfigSnippet(config map[string]interface{}, format string) (string, error) {
+	switch format {
+	case snippetJson:
+		data, err := json.MarshalIndent(config, "", "  ")
+		return string(data), err
+	case snippetYaml:
+		data, err := yaml.Marshal(config)
+		return string(data), err
+	case snippetEnv:
+		var keys []string
+		for k := range config {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var lines []string
+		for _, k := range keys {
+			v, _ := config[k].(string)
+			lines = append(lines, "TABUSUS_"+strings.ToUpper(k)+"="+v)
+		}
+		return strings.Join(lines, "\n") + "\n", nil
+	}
+	return "", errors.New("unsupported format [" + format + "]")
+}
+
+func actionPortalHome(c echo.Context) error {
+	var apps []Application
+	for _, app := range AppDao.List() {
+		if app.GetOwner() == currentUser(c) {
+			apps = append(apps, app)
+		}
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i].GetId() < apps[j].GetId() })
+	return c.Render(http.StatusOK, "portal_layout:portal_apps", map[string]interface{}{
+		"active":         "apps",
+		"user":           currentUser(c),
+		"apps":           apps,
+		"expiryWarnDays": int(AppConfig.Conf.GetInt32("key_expiry.notify_before_days", 14)),
+	})
+}
+
+func actionPortalCreateApp(c echo.Context) error {
+	return c.Render(http.StatusOK, "portal_layout:portal_create_app:custom_fields:key_proof", map[string]interface{}{
+		"active": "createApp",
+		"user":   currentUser(c),
+		"form":   transformFormData(c),
+	})
+}
+
+// actionPortalCreateAppSubmit registers a new app owned by the current user, the app is pending until approved by an admin
+func actionPortalCreateAppSubmit(c echo.Context) error {
+	formData := transformFormData(c)
+	appId := strings.ToLower(strings.TrimSpace(formData["id"]))
+	user := currentUser(c)
+	error := validateAppInput(appId, true, formData["pubkey"], formData["key_expiry"])
+	fields, fieldsError := AppFields.ParseForm(formData)
+	if error == "" {
+		error = fieldsError
+	}
+	var keyProven *time.Time
+	if error == "" {
+		keyProven, error = checkKeyProof(appId, formData["pubkey"], formData["key_challenge"], formData["key_proof"])
+	}
+	if error == "" {
+		keyExpiry, _ := parseKeyExpiry(formData["key_expiry"])
+		app := NewApp(appId).SetStatus(AppStatusPending).SetOwner(user)
+		app.SetDescription(formData["desc"])
+		app.SetCustomFields(fields)
+		app.SetRsaPubKey(formData["pubkey"]).SetKeyProven(keyProven)
+		app.SetKeyExpiry(keyExpiry)
+		app.SetUpdatedBy(user)
+		if err := AppDao.Save(app); err != nil {
+			error = "Error while saving application [" + appId + "]: " + err.Error()
+		} else {
+			dispatchAppEvent(c, EventAppCreated, app)
+			if isApprovalRequired() {
+				if err := AppApprovals.RequestCreate(app, user); err != nil {
+					error = "Error while requesting approval for application [" + appId + "]: " + err.Error()
+				}
+			}
+		}
+	}
+	if error != "" {
+		return c.Render(http.StatusOK, "portal_layout:portal_create_app:custom_fields:key_proof", map[string]interface{}{
+			"active": "createApp",
+			"user":   user,
+			"form":   formData,
+			"error":  error,
+		})
+	}
+	sess := getSession(c)
+	if isApprovalRequired() {
+		sess.AddFlash("Application [" + appId + "] has been registered and is waiting for approval.")
+	} else {
+		sess.AddFlash("Application [" + appId + "] has been registered and is waiting for activation by an admin.")
+	}
+	sess.Save(c.Request(), c.Response())
+	return c.Redirect(http.StatusFound, c.Echo().Reverse("portalApp", appId))
+}
+
+func actionPortalApp(c echo.Context) error {
+	app, err := portalApp(c)
+	if err != nil {
+		return c.Render(http.StatusOK, "portal_layout:portal_app:usage_chart:key_proof", map[string]interface{}{
+			"active": "apps",
+			"user":   currentUser(c),
+			"error":  err.Error(),
+		})
+	}
+	config := clientConfig(c, app)
+	snippets := map[string]string{}
+	for _, format := range []string{snippetJson, snippetYaml, snippetEnv} {
+		snippets[format], _ = clientConfigSnippet(config, format)
+	}
+	var pendingKeyChange *ApprovalRequest
+	if isApprovalRequired() {
+		pendingKeyChange = AppApprovals.PendingKeyChange(app.GetId())
+	}
+	usage, err := buildUsageReport(AppUsageDao, app.GetId(), 48)
+	var error string
+	if err != nil {
+		error = "Error while getting usage of application [" + app.GetId() + "]: " + err.Error()
+	}
+	return c.Render(http.StatusOK, "portal_layout:portal_app:usage_chart:key_proof", map[string]interface{}{
+		"active":           "apps",
+		"user":             currentUser(c),
+		"error":            error,
+		"usage":            usage,
+		"app":              app,
+		"snippets":         snippets,
+		"pendingKeyChange": pendingKeyChange,
+		"form":             transformFormData(c),
+	})
+}
+
+// rotateAppKey replaces app's public key, or requests approval for the new key if approval is required.
+// The proof of possession (challenge and signature) is checked if submitted, or if it is required.
+// Returns true if the key change is pending approval, or error message if the key cannot be changed.
+func rotateAppKey(app *Application, pubKeyData, keyExpiry, challenge, proof, user string) (bool, string) {
+	if app.GetStatus() == AppStatusRevoked {
+		return false, "Application [" + app.GetId() + "] has been revoked!"
+	} else if strings.TrimSpace(pubKeyData) == app.GetRsaPubKey() {
+		return false, "The new public key is the same as the current one!"
+	} else if error := validateAppInput(app.GetId(), false, pubKeyData, keyExpiry); error != "" {
+		return false, error
+	}
+	keyProven, error := checkKeyProof(app.GetId(), pubKeyData, challenge, proof)
+	if error != "" {
+		return false, error
+	}
+	if isApprovalRequired() {
+		if err := AppApprovals.RequestKeyChange(app, pubKeyData, keyExpiry, keyProven, user); err != nil {
+			return false, "Error while requesting approval for key change: " + err.Error()
+		}
+		return true, ""
+	}
+	expiry, _ := parseKeyExpiry(keyExpiry)
+	app.SetRsaPubKey(pubKeyData).SetKeyProven(keyProven).SetKeyExpiry(expiry)
+	app.SetUpdatedBy(user).SetTimeUpdated(time.Now())
+	if err := AppDao.Save(app); err != nil {
+		return false, "Error while saving application [" + app.GetId() + "]: " + err.Error()
+	}
+	if AppWebhooks != nil {
+		AppWebhooks.Dispatch(EventAppUpdated, app, user)
+	}
+	return false, ""
+}
+
+// actionPortalRotateKeySubmit replaces the app's public key, subject to approval if the approval workflow is enabled
+func actionPortalRotateKeySubmit(c echo.Context) error {
+	app, err := portalApp(c)
+	if err != nil {
+		return actionPortalApp(c)
+	}
+	formData := transformFormData(c)
+	pending, error := rotateAppKey(app, formData["pubkey"], formData["key_expiry"], formData["key_challenge"], formData["key_proof"], currentUser(c))
+	sess := getSession(c)
+	if error != "" {
+		sess.AddFlash(error)
+	} else if pending {
+		sess.AddFlash("The new public key of application [" + app.GetId() + "] is waiting for approval.")
+	} else {
+		sess.AddFlash("Public key of application [" + app.GetId() + "] has been rotated successfully.")
+	}
+	sess.Save(c.Request(), c.Response())
+	return c.Redirect(http.StatusFound, c.Echo().Reverse("portalApp", app.GetId()))
+}
+
+// actionPortalKeyChallenge issues a challenge for proving possession of a new key of an app owned by the current user
+func actionPortalKeyChallenge(c echo.Context) error {
+	app, err := portalApp(c)
+	if err != nil {
+		return apiResponse(c, http.StatusNotFound, err.Error(), nil)
+	}
+	return apiResponse(c, http.StatusOK, "Ok", AppKeyProof.Issue(app.GetId(), time.Now()))
+}
+
+// actionPortalNewAppKeyChallenge issues a challenge for proving possession of the key of an app to be registered, the
+// app must not exist (also not in trash)
+func actionPortalNewAppKeyChallenge(c echo.Context) error {
+	appId := strings.ToLower(strings.TrimSpace(c.Param("id")))
+	if !validAppId.MatchString(appId) {
+		return apiResponse(c, http.StatusBadRequest, "Invalid application id (must contains only a-z, 0-9, _, -)", nil)
+	}
+	app, err := AppDao.Get(appId)
+	if err != nil {
+		return apiResponse(c, http.StatusInternalServerError, "Error while getting application info ["+appId+"]!", nil)
+	}
+	if app != nil {
+		return apiResponse(c, http.StatusConflict, "Application ["+appId+"] already exists!", nil)
+	}
+	return apiResponse(c, http.StatusOK, "Ok", AppKeyProof.Issue(appId, time.Now()))
+}
+
+// actionPortalDownloadConfig downloads client configuration of an app, format is specified by query parameter "format"
+func actionPortalDownloadConfig(c echo.Context) error {
+	app, err := portalApp(c)
+	if err != nil {
+		return c.String(http.StatusNotFound, err.Error())
+	}
+	format := c.QueryParam("format")
+	if format == "" {
+		format = snippetJson
+	}
+	snippet, err := clientConfigSnippet(clientConfig(c, app), format)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	filename := app.GetId() + "." + format
+	contentType := "text/plain"
+	if format != snippetEnv {
+		contentType = contentTypeOfFormat(format)
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, "attachment; filename=\""+filename+"\"")
+	return c.Blob(http.StatusOK, contentType, []byte(snippet))
+}
@@ -0,0 +1,346 @@
+package tabusus
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/options"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"tabusus/utils"
+	"time"
+)
+
+const (
+	// per-app overrides of the default rate limit, 0 or missing: use default
+	attrRateLimitRpm   = "rate_limit_rpm"
+	attrRateLimitBurst = "rate_limit_burst"
+
+	rateLimitBackendMemory = "memory"
+	rateLimitBackendMongo  = "mongo"
+
+	tableRateLimits = "rate_limits"
+)
+
+// RateLimit defines a token bucket: it holds at most Burst tokens and is refilled at PerMinute tokens per minute,
+// each request takes one token
+type RateLimit struct {
+	PerMinute int `json:"per_minute"`
+	Burst     int `json:"burst"`
+}
+
+// String summarizes the limit, empty if unlimited
+func (l RateLimit) String() string {
+	if l.IsUnlimited() {
+		return ""
+	}
+	return strconv.Itoa(l.PerMinute) + "/min, burst " + strconv.Itoa(int(l.burst()))
+}
+
+// IsUnlimited checks if the limit does not restrict anything
+func (l RateLimit) IsUnlimited() bool {
+	return l.PerMinute <= 0
+}
+
+func (l RateLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return float64(l.PerMinute)
+}
+
+// take refills a bucket having the specified tokens since the last refill and takes one token if available.
+// Returns the remaining tokens, whether a token was taken and, if not, how long until a token is available.
+func (l RateLimit) take(tokens float64, elapsed time.Duration) (float64, bool, time.Duration) {
+	ratePerSecond := float64(l.PerMinute) / 60
+	tokens = math.Min(l.burst(), tokens+elapsed.Seconds()*ratePerSecond)
+	if tokens >= 1 {
+		return tokens - 1, true, 0
+	}
+	wait := time.Duration((1 - tokens) / ratePerSecond * float64(time.Second))
+	return tokens, false, wait
+}
+
+func (app *Application) GetRateLimit() RateLimit {
+	rpm, _ := utils.ToInt64(app.Data[attrRateLimitRpm])
+	burst, _ := utils.ToInt64(app.Data[attrRateLimitBurst])
+	return RateLimit{PerMinute: int(rpm), Burst: int(burst)}
+}
+
+// SetRateLimit sets app's own rate limit, zero PerMinute removes the override
+func (app *Application) SetRateLimit(l RateLimit) *Application {
+	if l.PerMinute <= 0 {
+		delete(app.Data, attrRateLimitRpm)
+		delete(app.Data, attrRateLimitBurst)
+		return app
+	}
+	app.Data[attrRateLimitRpm] = int64(l.PerMinute)
+	if l.Burst > 0 {
+		app.Data[attrRateLimitBurst] = int64(l.Burst)
+	} else {
+		delete(app.Data, attrRateLimitBurst)
+	}
+	return app
+}
+
+// parseRateLimitInput parses app's rate limit override submitted via UI, returns error message if data is invalid
+func parseRateLimitInput(formData map[string]string) (RateLimit, string) {
+	var l RateLimit
+	var err error
+	if v := formData[attrRateLimitRpm]; v != "" {
+		if l.PerMinute, err = strconv.Atoi(v); err != nil || l.PerMinute < 0 {
+			return l, "Rate limit must be a non-negative number of requests per minute!"
+		}
+	}
+	if v := formData[attrRateLimitBurst]; v != "" {
+		if l.Burst, err = strconv.Atoi(v); err != nil || l.Burst < 0 {
+			return l, "Burst must be a non-negative number of requests!"
+		}
+	}
+	return l, ""
+}
+
+/*----------------------------------------------------------------------*/
+
+// RateLimiter keeps token buckets identified by keys
+type RateLimiter interface {
+	// Allow takes a token from the bucket of the key, returns false and the time to wait if the bucket is empty
+	Allow(key string, limit RateLimit) (bool, time.Duration, error)
+}
+
+type memoryBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// MemoryRateLimiter keeps buckets in memory, limits are applied per server instance
+type MemoryRateLimiter struct {
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+	mutex     sync.Mutex
+}
+
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{buckets: map[string]*memoryBucket{}, lastSweep: time.Now()}
+}
+
+func (l *MemoryRateLimiter) Allow(key string, limit RateLimit) (bool, time.Duration, error) {
+	now := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.sweep(now)
+	b := l.buckets[key]
+	if b == nil {
+		b = &memoryBucket{tokens: limit.burst(), last: now}
+		l.buckets[key] = b
+	}
+	tokens, ok, wait := limit.take(b.tokens, now.Sub(b.last))
+	b.tokens, b.last = tokens, now
+	return ok, wait, nil
+}
+
+// sweep removes buckets idle for a while (they would be full anyway), at most once per minute
+func (l *MemoryRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for k, b := range l.buckets {
+		if now.Sub(b.last) > 10*time.Minute {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+type mongoBucket struct {
+	Key      string    `bson:"key"`
+	Tokens   float64   `bson:"tokens"`
+	Last     int64     `bson:"last"` // UnixNano of last refill, also used for optimistic locking
+	ExpireAt time.Time `bson:"expire_at"`
+}
+
+// MongoRateLimiter keeps buckets in MongoDB so that limits are shared among server instances.
+// Buckets are updated with optimistic locking and idle buckets are removed by a TTL index.
+type MongoRateLimiter struct {
+	url    string        // connection url
+	db     string        // database name
+	client *mongo.Client // client instance
+}
+
+func NewMongoRateLimiter(url, db string) RateLimiter {
+	m := &MongoRateLimiter{
+		url:    url,
+		db:     db,
+		client: mongoConnect(url),
+	}
+	collection := m.client.Database(db).Collection(tableRateLimits)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, index := range []mongo.IndexModel{
+		{Keys: bson.M{"key": 1}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.M{"expire_at": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+	} {
+		if _, err := collection.Indexes().CreateOne(ctx, index); err != nil {
+			log.Error("Error while creating index on [", tableRateLimits, "]: ", err)
+		}
+	}
+	return m
+}
+
+func (l *MongoRateLimiter) Allow(key string, limit RateLimit) (bool, time.Duration, error) {
+	collection := l.client.Database(l.db).Collection(tableRateLimits)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for attempt := 0; attempt < 5; attempt++ {
+		now := time.Now()
+		var b mongoBucket
+		dbResult := collection.FindOne(ctx, bson.M{"key": key})
+		if dbResult.Err() != nil {
+			return false, 0, dbResult.Err()
+		}
+		err := dbResult.Decode(&b)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return false, 0, err
+		}
+		exists := err == nil
+		if !exists {
+			b = mongoBucket{Key: key, Tokens: limit.burst(), Last: now.UnixNano()}
+		}
+		tokens, ok, wait := limit.take(b.Tokens, now.Sub(time.Unix(0, b.Last)))
+		if !ok {
+			return false, wait, nil
+		}
+		// bucket refills completely after (burst / rate), it can be dropped afterwards
+		expireAt := now.Add(time.Duration(limit.burst()/float64(limit.PerMinute)*60)*time.Second + time.Minute)
+		if !exists {
+			b.Tokens, b.ExpireAt = tokens, expireAt
+			if _, err := collection.InsertOne(ctx, b); err == nil {
+				return true, 0, nil
+			}
+			// bucket has been created concurrently, try again
+			continue
+		}
+		result, err := collection.UpdateOne(ctx, bson.M{"key": key, "last": b.Last},
+			bson.M{"$set": bson.M{"tokens": tokens, "last": now.UnixNano(), "expire_at": expireAt}})
+		if err != nil {
+			return false, 0, err
+		}
+		if result.MatchedCount > 0 {
+			return true, 0, nil
+		}
+	}
+	// too much contention on the bucket, reject rather than let requests through unaccounted
+	return false, time.Second, nil
+}
+
+/*----------------------------------------------------------------------*/
+
+// RateLimitCounters counts requests allowed/rejected by rate limits, by kind of key ("ip" or "app")
+type RateLimitCounters struct {
+	allowed  map[string]uint64
+	rejected map[string]uint64
+	mutex    sync.Mutex
+}
+
+func (c *RateLimitCounters) add(kind string, allowed bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if allowed {
+		c.allowed[kind]++
+	} else {
+		c.rejected[kind]++
+	}
+}
+
+func (c *RateLimitCounters) MarshalJSON() ([]byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return json.Marshal(map[string]interface{}{"allowed": c.allowed, "rejected": c.rejected})
+}
+
+// RateLimits applies the configured rate limits to authentication endpoints: per client IP on every request and
+// per app once the app has been authenticated (so that other clients cannot exhaust an app's budget)
+type RateLimits struct {
+	Enabled  bool
+	PerIp    RateLimit
+	PerApp   RateLimit
+	limiter  RateLimiter
+	Counters *RateLimitCounters
+}
+
+// newRateLimits builds rate limits from configurations at "rate_limit"
+func newRateLimits(appConfig *HoconConfig) *RateLimits {
+	conf := appConfig.Conf
+	r := &RateLimits{
+		Enabled: conf.GetBoolean("rate_limit.enabled", true),
+		PerIp: RateLimit{
+			PerMinute: int(conf.GetInt32("rate_limit.per_ip.requests_per_minute", 120)),
+			Burst:     int(conf.GetInt32("rate_limit.per_ip.burst", 40)),
+		},
+		PerApp: RateLimit{
+			PerMinute: int(conf.GetInt32("rate_limit.per_app.requests_per_minute", 60)),
+			Burst:     int(conf.GetInt32("rate_limit.per_app.burst", 20)),
+		},
+		Counters: &RateLimitCounters{allowed: map[string]uint64{}, rejected: map[string]uint64{}},
+	}
+	switch backend := conf.GetString("rate_limit.backend", rateLimitBackendMemory); backend {
+	case rateLimitBackendMongo:
+		r.limiter = NewMongoRateLimiter(conf.GetString("db.mongo.url"), conf.GetString("db.mongo.db"))
+	default:
+		if backend != rateLimitBackendMemory {
+			log.Warn("Unknown rate limit backend [", backend, "], fallback to [", rateLimitBackendMemory, "]")
+		}
+		r.limiter = NewMemoryRateLimiter()
+	}
+	return r
+}
+
+// allow checks a bucket, errors of the backend are logged and the request is let through
+func (r *RateLimits) allow(kind, key string, limit RateLimit) (bool, time.Duration) {
+	if !r.Enabled || limit.IsUnlimited() {
+		return true, 0
+	}
+	ok, wait, err := r.limiter.Allow(kind+":"+key, limit)
+	if err != nil {
+		log.Error("Error while checking rate limit of [", kind, ":", key, "]: ", err)
+		return true, 0
+	}
+	r.Counters.add(kind, ok)
+	return ok, wait
+}
+
+// AllowApp checks rate limit of an authenticated app, app's own limit takes precedence over the default one
+func (r *RateLimits) AllowApp(app *Application) (bool, time.Duration) {
+	limit := app.GetRateLimit()
+	if limit.IsUnlimited() {
+		limit = r.PerApp
+	}
+	return r.allow("app", app.GetId(), limit)
+}
+
+// retryAfter returns the value of header Retry-After: wait in whole seconds, rounded up
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
+
+// rateLimitedResponse responds with 429 and header Retry-After
+func rateLimitedResponse(c echo.Context, wait time.Duration, message string) error {
+	c.Response().Header().Set("Retry-After", retryAfter(wait))
+	return apiResponse(c, http.StatusTooManyRequests, message, map[string]interface{}{"error": authErrRateLimited})
+}
+
+// Middleware limits requests per client IP
+func (r *RateLimits) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ip := authClientIp(c)
+		if ok, wait := r.allow("ip", ip.String(), r.PerIp); !ok {
+			return rateLimitedResponse(c, wait, "Too many requests from ["+ip.String()+"], retry later!")
+		}
+		return next(c)
+	}
+}
@@ -0,0 +1,141 @@
+package tabusus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimitTake(t *testing.T) {
+	limit := RateLimit{PerMinute: 60, Burst: 3}
+
+	// a full bucket allows a burst, then is empty
+	tokens := limit.burst()
+	for i := 0; i < 3; i++ {
+		var ok bool
+		if tokens, ok, _ = limit.take(tokens, 0); !ok {
+			t.Fatalf("request #%d: expected to be allowed within burst", i+1)
+		}
+	}
+	tokens, ok, wait := limit.take(tokens, 0)
+	if ok || wait != time.Second {
+		t.Errorf("expected burst to be exhausted with a wait of 1s, got %v / %v", ok, wait)
+	}
+
+	// refilled at 1 token per second
+	if _, ok, wait = limit.take(tokens, 400*time.Millisecond); ok || wait != 600*time.Millisecond {
+		t.Errorf("expected a wait of 600ms after 400ms, got %v / %v", ok, wait)
+	}
+	if tokens, ok, _ = limit.take(tokens, time.Second); !ok || tokens != 0 {
+		t.Errorf("expected a token after 1s, got %v with %v left", ok, tokens)
+	}
+	if tokens, ok, _ = limit.take(0, 2500*time.Millisecond); !ok || tokens != 1.5 {
+		t.Errorf("expected 1.5 tokens left after 2.5s, got %v with %v left", ok, tokens)
+	}
+
+	// refill is capped by burst
+	if tokens, _, _ = limit.take(0, time.Hour); tokens != 2 {
+		t.Errorf("expected bucket capped at burst, got %v tokens left", tokens)
+	}
+	// burst defaults to the rate
+	if tokens, _, _ = (RateLimit{PerMinute: 10}).take(0, time.Hour); tokens != 9 {
+		t.Errorf("expected burst to default to the rate, got %v tokens left", tokens)
+	}
+}
+
+func TestMemoryRateLimiterAllow(t *testing.T) {
+	limiter := NewMemoryRateLimiter()
+	limit := RateLimit{PerMinute: 6, Burst: 2}
+	for i := 0; i < 2; i++ {
+		if ok, _, _ := limiter.Allow("a", limit); !ok {
+			t.Fatalf("request #%d: expected to be allowed within burst", i+1)
+		}
+	}
+	ok, wait, err := limiter.Allow("a", limit)
+	if ok || err != nil || wait <= 9*time.Second || wait > 10*time.Second {
+		t.Errorf("expected burst to be exhausted with a wait of about 10s, got %v / %v / %v", ok, wait, err)
+	}
+	if ok, _, _ := limiter.Allow("b", limit); !ok {
+		t.Errorf("expected buckets to be independent")
+	}
+
+	// refill, simulated by moving the bucket back in time
+	limiter.buckets["a"].last = limiter.buckets["a"].last.Add(-10 * time.Second)
+	if ok, _, _ := limiter.Allow("a", limit); !ok {
+		t.Errorf("expected a token after 10s")
+	}
+	if ok, _, _ := limiter.Allow("a", limit); ok {
+		t.Errorf("expected only one token after 10s")
+	}
+
+	// idle buckets are swept
+	limiter.lastSweep = time.Now().Add(-time.Hour)
+	limiter.buckets["b"].last = time.Now().Add(-time.Hour)
+	limiter.Allow("a", limit)
+	if _, ok := limiter.buckets["b"]; ok {
+		t.Errorf("expected idle bucket to be swept")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	testCases := []struct {
+		wait     time.Duration
+		expected string
+	}{
+		{time.Millisecond, "1"},
+		{999 * time.Millisecond, "1"},
+		{time.Second, "1"},
+		{time.Second + time.Nanosecond, "2"},
+		{90 * time.Second, "90"},
+	}
+	for _, testCase := range testCases {
+		if got := retryAfter(testCase.wait); got != testCase.expected {
+			t.Errorf("%v: expected %s, got %s", testCase.wait, testCase.expected, got)
+		}
+	}
+}
+
+func TestRateLimitsAllowApp(t *testing.T) {
+	newTestRateLimits := func(enabled bool, perApp RateLimit) *RateLimits {
+		return &RateLimits{Enabled: enabled, PerApp: perApp, limiter: NewMemoryRateLimiter(),
+			Counters: &RateLimitCounters{allowed: map[string]uint64{}, rejected: map[string]uint64{}}}
+	}
+	allowed := func(r *RateLimits, app *Application) int {
+		n := 0
+		for i := 0; i < 10; i++ {
+			if ok, _ := r.AllowApp(app); ok {
+				n++
+			}
+		}
+		return n
+	}
+	defaultLimit := RateLimit{PerMinute: 1, Burst: 2}
+	testCases := []struct {
+		name     string
+		enabled  bool
+		perApp   RateLimit
+		app      RateLimit
+		expected int
+	}{
+		{"default limit", true, defaultLimit, RateLimit{}, 2},
+		{"app's own limit", true, defaultLimit, RateLimit{PerMinute: 1, Burst: 5}, 5},
+		{"app's own lower limit", true, defaultLimit, RateLimit{PerMinute: 1}, 1},
+		{"app's own limit without default", true, RateLimit{}, RateLimit{PerMinute: 1, Burst: 3}, 3},
+		{"unlimited", true, RateLimit{}, RateLimit{}, 10},
+		{"disabled", false, defaultLimit, RateLimit{PerMinute: 1}, 10},
+	}
+	for _, testCase := range testCases {
+		r := newTestRateLimits(testCase.enabled, testCase.perApp)
+		app := NewApp("app").SetRateLimit(testCase.app)
+		if got := allowed(r, app); got != testCase.expected {
+			t.Errorf("%s: expected %d requests allowed, got %d", testCase.name, testCase.expected, got)
+		}
+	}
+
+	// apps have their own buckets, counted by kind
+	r := newTestRateLimits(true, defaultLimit)
+	allowed(r, NewApp("a"))
+	allowed(r, NewApp("b"))
+	if r.Counters.allowed["app"] != 4 || r.Counters.rejected["app"] != 16 {
+		t.Errorf("expected 4 allowed and 16 rejected, got %v / %v", r.Counters.allowed, r.Counters.rejected)
+	}
+}
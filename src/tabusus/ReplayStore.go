@@ -0,0 +1,224 @@
+package tabusus
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/labstack/gommon/log"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/options"
+	"regexp"
+	"strconv"
+	"tabusus/httpsig"
+	"time"
+)
+
+const (
+	replayBackendMemory = "memory"
+	replayBackendMongo  = "mongo"
+	replayBackendSql    = "sql"
+
+	tableReplayNonces = "replay_nonces"
+)
+
+// ReplayStore remembers nonces of signed requests and JWT IDs of assertions until they expire, so that a signature
+// or assertion can be used only once; stores in memory (httpsig.MemoryReplayStore) detect replays per server instance
+// only
+type ReplayStore = httpsig.ReplayStore
+
+type mongoNonce struct {
+	Nonce    string    `bson:"nonce"`
+	ExpireAt time.Time `bson:"expire_at"`
+}
+
+// MongoReplayStore keeps nonces in MongoDB so that replays are detected among server instances.
+// Expired nonces are removed by a TTL index.
+type MongoReplayStore struct {
+	url    string        // connection url
+	db     string        // database name
+	client *mongo.Client // client instance
+}
+
+func NewMongoReplayStore(url, db string) ReplayStore {
+	m := &MongoReplayStore{
+		url:    url,
+		db:     db,
+		client: mongoConnect(url),
+	}
+	collection := m.client.Database(db).Collection(tableReplayNonces)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, index := range []mongo.IndexModel{
+		{Keys: bson.M{"nonce": 1}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.M{"expire_at": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+	} {
+		if _, err := collection.Indexes().CreateOne(ctx, index); err != nil {
+			log.Error("Error while creating index on [", tableReplayNonces, "]: ", err)
+		}
+	}
+	return m
+}
+
+func (s *MongoReplayStore) Use(nonce string, expireAt time.Time) (bool, error) {
+	collection := s.client.Database(s.db).Collection(tableReplayNonces)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		// the TTL monitor runs once a minute, expired nonces may still be there
+		var result *mongo.UpdateResult
+		result, err = collection.UpdateOne(ctx, bson.M{"nonce": nonce, "expire_at": bson.M{"$lte": time.Now()}},
+			bson.M{"$set": bson.M{"expire_at": expireAt}})
+		if err != nil {
+			return false, err
+		}
+		if result.MatchedCount > 0 {
+			return true, nil
+		}
+		result, err = collection.UpdateOne(ctx, bson.M{"nonce": nonce},
+			bson.M{"$setOnInsert": mongoNonce{Nonce: nonce, ExpireAt: expireAt}}, options.Update().SetUpsert(true))
+		if err == nil {
+			return result.UpsertedID != nil, nil
+		}
+		// nonce has been inserted concurrently (unique index violated), try again
+	}
+	return false, err
+}
+
+// SqlReplayStore keeps nonces in a SQL database so that replays are detected among server instances. Expired nonces
+// are removed periodically.
+//
+// No driver is bundled: the driver named by "replay.sql.driver" must be registered by blank-importing it into the
+// server binary, e.g. _ "github.com/lib/pq" (driver "postgres"), _ "github.com/jackc/pgx/v4/stdlib" (driver "pgx") or
+// _ "github.com/go-sql-driver/mysql" (driver "mysql"). Placeholders are $n for "postgres" and "pgx", ? otherwise.
+type SqlReplayStore struct {
+	db    *sql.DB
+	table string
+	// queries, with placeholders of the driver
+	qDeleteExpired, qInsert, qExists, qSweep string
+}
+
+var sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+var errInvalidSqlTable = errors.New("invalid table name of SQL replay store")
+
+// sqlDriverRegistered returns true if a database/sql driver is registered under name
+func sqlDriverRegistered(name string) bool {
+	for _, d := range sql.Drivers() {
+		if d == name {
+			return true
+		}
+	}
+	return false
+}
+
+// NewSqlReplayStore opens the database, creates the table if needed and starts sweeping expired nonces
+func NewSqlReplayStore(driver, dsn, table string, sweepInterval time.Duration) (*SqlReplayStore, error) {
+	if !sqlIdentifier.MatchString(table) {
+		return nil, errInvalidSqlTable
+	}
+	if !sqlDriverRegistered(driver) {
+		return nil, errors.New("SQL driver [" + driver + "] is not registered, it must be blank-imported into the server binary")
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+table+" (nonce VARCHAR(255) NOT NULL PRIMARY KEY, expire_at BIGINT NOT NULL)"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	p := func(i int) string {
+		if driver == "postgres" || driver == "pgx" {
+			return "$" + strconv.Itoa(i)
+		}
+		return "?"
+	}
+	s := &SqlReplayStore{
+		db:             db,
+		table:          table,
+		qDeleteExpired: "DELETE FROM " + table + " WHERE nonce=" + p(1) + " AND expire_at<=" + p(2),
+		qInsert:        "INSERT INTO " + table + " (nonce, expire_at) VALUES (" + p(1) + ", " + p(2) + ")",
+		qExists:        "SELECT COUNT(*) FROM " + table + " WHERE nonce=" + p(1),
+		qSweep:         "DELETE FROM " + table + " WHERE expire_at<=" + p(1),
+	}
+	go s.sweepLoop(sweepInterval)
+	return s, nil
+}
+
+func (s *SqlReplayStore) Use(nonce string, expireAt time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s.db.ExecContext(ctx, s.qDeleteExpired, nonce, time.Now().UnixNano()); err != nil {
+		return false, err
+	}
+	_, err := s.db.ExecContext(ctx, s.qInsert, nonce, expireAt.UnixNano())
+	if err == nil {
+		return true, nil
+	}
+	// primary key violated if the nonce has been used, otherwise the insert failed for another reason
+	var count int
+	if s.db.QueryRowContext(ctx, s.qExists, nonce).Scan(&count) == nil && count > 0 {
+		return false, nil
+	}
+	return false, err
+}
+
+func (s *SqlReplayStore) sweepLoop(interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	for range time.Tick(interval) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if _, err := s.db.ExecContext(ctx, s.qSweep, time.Now().UnixNano()); err != nil {
+			log.Error("Error while removing expired nonces from [", s.table, "]: ", err)
+		}
+		cancel()
+	}
+}
+
+/*----------------------------------------------------------------------*/
+
+// ReplayProtection applies the configured replay store to verification of signed requests and assertions
+type ReplayProtection struct {
+	store ReplayStore
+	// FailOpen lets requests through if the store cannot be reached (errors are logged), otherwise they are rejected
+	FailOpen bool
+}
+
+// newReplayProtection builds replay protection from configurations at "replay"; fails if the configured backend is
+// unknown or cannot be opened, rather than protecting less than configured
+func newReplayProtection(appConfig *HoconConfig) (*ReplayProtection, error) {
+	conf := appConfig.Conf
+	r := &ReplayProtection{FailOpen: conf.GetBoolean("replay.fail_open", false)}
+	switch backend := conf.GetString("replay.backend", replayBackendMemory); backend {
+	case replayBackendMemory:
+		r.store = httpsig.NewMemoryReplayStore()
+	case replayBackendMongo:
+		r.store = NewMongoReplayStore(conf.GetString("db.mongo.url"), conf.GetString("db.mongo.db"))
+	case replayBackendSql:
+		store, err := NewSqlReplayStore(conf.GetString("replay.sql.driver"), conf.GetString("replay.sql.dsn"),
+			conf.GetString("replay.sql.table", tableReplayNonces),
+			time.Duration(conf.GetInt32("replay.sql.sweep_interval_seconds", 60))*time.Second)
+		if err != nil {
+			return nil, errors.New("cannot open SQL replay store: " + err.Error())
+		}
+		r.store = store
+	default:
+		return nil, errors.New("unknown replay store backend [" + backend + "]")
+	}
+	return r, nil
+}
+
+// use records a nonce of an app (kind distinguishes signature nonces from assertion ids), returns false if it is a replay
+func (r *ReplayProtection) use(kind, appId, nonce string, expireAt time.Time) bool {
+	ok, err := r.store.Use(kind+":"+appId+":"+nonce, expireAt)
+	if err != nil {
+		log.Error("Error while checking ", kind, " of app [", appId, "] for replay: ", err)
+		return r.FailOpen
+	}
+	return ok
+}
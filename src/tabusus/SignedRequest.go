@@ -0,0 +1,143 @@
+package tabusus
+
+import (
+	"crypto"
+	"errors"
+	"github.com/labstack/echo"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"tabusus/httpsig"
+	"time"
+)
+
+// Apps can sign individual requests with their private key as HTTP message signatures (RFC 9421). The keyid of a
+// signature is the app id, optionally followed by ":" and the SHA-256 fingerprint of the key the request is signed
+// with (see Application.GetKeyId).
+
+// signatureRequiredComponents returns the components signatures must cover ("auth.signatures.required_components"),
+// content-digest is also required for requests with a body
+func signatureRequiredComponents() []string {
+	components := AppConfig.Conf.GetStringList("auth.signatures.required_components")
+	if len(components) == 0 {
+		components = []string{"@method", "@path", "date"}
+	}
+	return components
+}
+
+// signedRequestView returns the request as the app signed it: scheme and host are taken from X-Forwarded-Proto and
+// X-Forwarded-Host if "auth.trust_proxy_headers" is enabled
+func signedRequestView(r *http.Request) *http.Request {
+	if !AppConfig.Conf.GetBoolean("auth.trust_proxy_headers", false) {
+		return r
+	}
+	proto, host := r.Header.Get("X-Forwarded-Proto"), r.Header.Get("X-Forwarded-Host")
+	if proto == "" && host == "" {
+		return r
+	}
+	view := r.WithContext(r.Context())
+	view.URL = new(url.URL)
+	*view.URL = *r.URL
+	if proto != "" {
+		view.URL.Scheme = strings.TrimSpace(strings.Split(proto, ",")[0])
+	}
+	if host != "" {
+		view.Host = strings.TrimSpace(strings.Split(host, ",")[0])
+	}
+	return view
+}
+
+// verifySignedRequest authenticates an app by the signature of a request and checks the attempt against app's
+// constraints; allowed CIDRs are not checked if ignoreIp is true. Returns the app and the signature if authentication
+// succeeds; the app is also returned (if identified) on failure.
+func verifySignedRequest(r *http.Request, clientIp net.IP, ignoreIp bool, now time.Time) (*Application, *httpsig.Signature, *AuthError) {
+	var app *Application
+	verifier := &httpsig.Verifier{
+		RequiredComponents: signatureRequiredComponents(),
+		MaxSkew:            time.Duration(AppConfig.Conf.GetInt32("auth.clock_skew_seconds", 60)) * time.Second,
+		MaxAge:             time.Duration(AppConfig.Conf.GetInt32("auth.signatures.max_age_seconds", 300)) * time.Second,
+		MaxBodySize:        AppConfig.Conf.GetInt64("auth.signatures.max_body_bytes", httpsig.DefaultMaxBodySize),
+		Keys: func(r *http.Request, s *httpsig.Signature) (crypto.PublicKey, error) {
+			appId, kid := httpsig.SplitAppKeyId(s.KeyId)
+			if appId == "" {
+				return nil, &AuthError{authErrInvalidSignature, "Signature has no keyid"}
+			}
+			a, err := AppDao.Get(appId)
+			if err != nil {
+				return nil, &AuthError{authErrUnknownApp, "Error while getting application [" + appId + "]: " + err.Error()}
+			}
+			if a == nil || a.IsDeleted() {
+				return nil, &AuthError{authErrUnknownApp, "Application [" + appId + "] not found"}
+			}
+			app = a
+			if !app.IsKeyValid() {
+				return nil, &AuthError{authErrAppNotVerifiable, "Application [" + app.GetId() + "] cannot be verified (status: " + app.GetStatusStr() + ", key valid: no)"}
+			}
+			if kid != "" && kid != app.GetKeyId() {
+				return nil, &AuthError{authErrAppNotVerifiable, "Key [" + kid + "] is not the current key of application [" + app.GetId() + "]"}
+			}
+			pubKey := parsePublicKey(app.GetRsaPubKey())
+			if pubKey == nil {
+				return nil, &AuthError{authErrAppNotVerifiable, "Public key of application [" + app.GetId() + "] is invalid"}
+			}
+			return pubKey, nil
+		},
+	}
+	s, err := verifier.Verify(r)
+	if err != nil {
+		var authErr *AuthError
+		var sigErr *httpsig.Error
+		switch {
+		case errors.As(err, &authErr):
+			return app, nil, authErr
+		case errors.As(err, &sigErr) && sigErr.Kind == httpsig.ErrMissingSignature:
+			return app, nil, &AuthError{authErrMissingSignature, "Request is not signed: " + sigErr.Reason}
+		case errors.As(err, &sigErr) && sigErr.Kind == httpsig.ErrExpired:
+			return app, nil, &AuthError{authErrSignatureExpired, "Signature has expired: " + sigErr.Reason}
+		case errors.As(err, &sigErr) && sigErr.Kind == httpsig.ErrReplayed:
+			return app, nil, &AuthError{authErrReplayed, "Signature has been replayed: " + sigErr.Reason}
+		}
+		return app, nil, &AuthError{authErrInvalidSignature, "Invalid signature: " + err.Error()}
+	}
+	requireNonce := AppConfig.Conf.GetBoolean("auth.signatures.require_nonce", true)
+	if requireNonce && s.Nonce == "" {
+		return app, s, &AuthError{authErrInvalidSignature, "Invalid signature: signature must have a nonce parameter"}
+	}
+	if violation := app.CheckConstraints(AuthRequest{ClientIp: clientIp, IgnoreIp: ignoreIp, Time: now}); violation != nil {
+		return app, s, &AuthError{violation.Code, violation.Reason}
+	}
+	// recorded last, so that only accepted signatures use up their nonce; nonces are remembered as long as signatures
+	// are accepted (see httpsig.Verifier)
+	if requireNonce && !AppReplay.use("nonce", app.GetId(), s.Nonce, now.Add(verifier.MaxAge+2*verifier.MaxSkew)) {
+		return app, s, &AuthError{authErrReplayed, "Signature has been replayed: nonce [" + s.Nonce + "] has already been used"}
+	}
+	return app, s, nil
+}
+
+// authenticateSignedRequest verifies a signed request sent from clientIp (allowed CIDRs are not checked if ignoreIp is
+// true), applies app's rate limit and records the attempt in the audit log. If authentication fails, the rejection is
+// sent and the returned app is nil (the error is the one of sending).
+func authenticateSignedRequest(c echo.Context, r *http.Request, clientIp net.IP, ignoreIp bool, endpoint string) (*Application, *httpsig.Signature, error) {
+	now := time.Now()
+	app, s, authErr := verifySignedRequest(r, clientIp, ignoreIp, now)
+	entry := &AuthAuditEntry{Time: now, Endpoint: endpoint, Success: authErr == nil}
+	if clientIp != nil {
+		entry.ClientIp = clientIp.String()
+	}
+	if app != nil {
+		entry.AppId = app.GetId()
+	}
+	if authErr != nil {
+		entry.Code, entry.Reason = authErr.Code, authErr.Reason
+		recordAuthAttempt(entry)
+		return nil, nil, apiResponse(c, authErrorStatus(authErr), authErr.Reason, map[string]interface{}{"error": authErr.Code})
+	}
+	if ok, wait := AppRateLimits.AllowApp(app); !ok {
+		entry.Success, entry.Code, entry.Reason = false, authErrRateLimited, "Rate limit of application ["+app.GetId()+"] exceeded"
+		recordAuthAttempt(entry)
+		return nil, nil, rateLimitedResponse(c, wait, entry.Reason+", retry later!")
+	}
+	recordAuthAttempt(entry)
+	return app, s, nil
+}
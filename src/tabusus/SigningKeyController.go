@@ -0,0 +1,74 @@
+package tabusus
+
+import (
+	"github.com/labstack/echo"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// GET /.well-known/jwks.json: published signing keys of Tabusus, to verify access tokens and key bundles
+func actionJwks(c echo.Context) error {
+	jwks := map[string]interface{}{"keys": []interface{}{}}
+	if AppSigningKeys != nil {
+		jwks = AppSigningKeys.Jwks()
+	}
+	c.Response().Header().Set("Cache-Control", "public, max-age=300")
+	return c.JSON(http.StatusOK, jwks)
+}
+
+func actionSigningKeyList(c echo.Context) error {
+	data := map[string]interface{}{
+		"active":     "signingKeys",
+		"configured": AppSigningKeys != nil,
+		"now":        time.Now(),
+	}
+	if AppSigningKeys != nil {
+		data["keys"] = sortedByStatus(AppSigningKeys.List())
+		data["rotationDays"] = int64(AppSigningKeys.rotateEvery / (24 * time.Hour))
+		data["prepublishHours"] = int64(AppSigningKeys.prepublish / time.Hour)
+		data["retainHours"] = int64(AppSigningKeys.retain / time.Hour)
+	}
+	return c.Render(http.StatusOK, "layout:signing_keys", data)
+}
+
+// signingKeyAction runs an action on signing keys, flashing its outcome
+func signingKeyAction(c echo.Context, action func() (*SigningKey, error), success string) error {
+	sess := getSession(c)
+	if AppSigningKeys == nil {
+		sess.AddFlash(errSigningKeysMissing.Error())
+	} else if k, err := action(); err != nil {
+		sess.AddFlash("Error: " + err.Error())
+	} else {
+		sess.AddFlash("Signing key [" + k.Id + "] " + success)
+	}
+	sess.Save(c.Request(), c.Response())
+	return c.Redirect(http.StatusFound, c.Echo().Reverse("signingKeys"))
+}
+
+func actionSigningKeyGenerate(c echo.Context) error {
+	return signingKeyAction(c, func() (*SigningKey, error) {
+		return AppSigningKeys.Generate()
+	}, "has been generated and published, it will be activated on schedule.")
+}
+
+func actionSigningKeyImport(c echo.Context) error {
+	return signingKeyAction(c, func() (*SigningKey, error) {
+		data := []byte(c.FormValue("private_key"))
+		if file, err := c.FormFile("private_key_file"); err == nil {
+			src, err := file.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer src.Close()
+			if data, err = ioutil.ReadAll(src); err != nil {
+				return nil, err
+			}
+		}
+		return AppSigningKeys.Import(data)
+	}, "has been imported and published, it will be activated on schedule.")
+}
+
+func actionSigningKeyRotate(c echo.Context) error {
+	return signingKeyAction(c, AppSigningKeys.Rotate, "is now active.")
+}
@@ -0,0 +1,502 @@
+package tabusus
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"github.com/labstack/gommon/log"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/options"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"tabusus/jws"
+	"time"
+)
+
+// Tabusus' own signing keys sign access tokens and key bundles. A key is created as "next" and published (in JWKS)
+// for a while before it becomes "active", so that verifiers caching JWKS know it before it is used. When replaced,
+// the active key is "retired": it signs nothing but stays published until everything it signed has expired.
+const (
+	tableSigningKeys = "signing_keys"
+
+	signingKeyStatusNext    = "next"
+	signingKeyStatusActive  = "active"
+	signingKeyStatusRetired = "retired"
+
+	// envMasterKey overrides "signing_keys.master_key"
+	envMasterKey = "TABUSUS_MASTER_KEY"
+)
+
+// SigningKey is a signing key of Tabusus, the private key is encrypted with the master key
+type SigningKey struct {
+	Id            string     `bson:"id" json:"kid"` // SHA-256 fingerprint of the public key
+	Alg           string     `bson:"alg" json:"alg"`
+	Status        string     `bson:"status" json:"status"`
+	PublicKey     string     `bson:"public_key" json:"public_key"` // PEM
+	PrivateKey    string     `bson:"private_key" json:"-"`         // AES-GCM encrypted PKCS#8, Base64
+	MasterKeyId   string     `bson:"master_key_id" json:"master_key_id"`
+	Imported      bool       `bson:"imported" json:"imported"`
+	TimeCreated   time.Time  `bson:"tc" json:"time_created"`
+	TimeActivated *time.Time `bson:"ta,omitempty" json:"time_activated,omitempty"`
+	TimeRetired   *time.Time `bson:"tr,omitempty" json:"time_retired,omitempty"`
+	PublishUntil  *time.Time `bson:"publish_until,omitempty" json:"publish_until,omitempty"` // retired keys only
+}
+
+// IsPublished checks if the key is listed in JWKS at a time
+func (k SigningKey) IsPublished(now time.Time) bool {
+	return k.Status != signingKeyStatusRetired || (k.PublishUntil != nil && now.Before(*k.PublishUntil))
+}
+
+/*----------------------------------------------------------------------*/
+
+type SigningKeyDao interface {
+	List() ([]SigningKey, error)
+	Save(k *SigningKey) error
+	Delete(id string) error
+}
+
+type MongoSigningKeyDao struct {
+	url    string        // connection url
+	db     string        // database name
+	client *mongo.Client // client instance
+}
+
+func NewMongoSigningKeyDao(url, db string) SigningKeyDao {
+	m := &MongoSigningKeyDao{
+		url:    url,
+		db:     db,
+		client: mongoConnect(url),
+	}
+	collection := m.client.Database(db).Collection(tableSigningKeys)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"id": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Error("Error while creating index on [", tableSigningKeys, "]: ", err)
+	}
+	return m
+}
+
+func (dao *MongoSigningKeyDao) List() ([]SigningKey, error) {
+	collection := dao.client.Database(dao.db).Collection(tableSigningKeys)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cur, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"tc": -1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var result []SigningKey
+	for cur.Next(ctx) {
+		var row SigningKey
+		if err := cur.Decode(&row); err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+	return result, cur.Err()
+}
+
+func (dao *MongoSigningKeyDao) Save(k *SigningKey) error {
+	collection := dao.client.Database(dao.db).Collection(tableSigningKeys)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := collection.ReplaceOne(ctx, bson.M{"id": k.Id}, k, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (dao *MongoSigningKeyDao) Delete(id string) error {
+	collection := dao.client.Database(dao.db).Collection(tableSigningKeys)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := collection.DeleteOne(ctx, bson.M{"id": id})
+	return err
+}
+
+/*----------------------------------------------------------------------*/
+
+// keyCrypter encrypts private keys at rest with AES-256-GCM, the key id is authenticated as additional data so that
+// encrypted keys cannot be swapped
+type keyCrypter struct {
+	aead cipher.AEAD
+	id   string // identifies the master key, to detect keys encrypted with another master key
+}
+
+func newKeyCrypter(masterKey string) (*keyCrypter, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(masterKey))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("master key must be 32 bytes, Base64-encoded")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(append([]byte("tabusus-master-key:"), key...))
+	return &keyCrypter{aead: aead, id: hex.EncodeToString(sum[:8])}, nil
+}
+
+func (c *keyCrypter) encrypt(kid string, plaintext []byte) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(c.aead.Seal(nonce, nonce, plaintext, []byte(kid))), nil
+}
+
+func (c *keyCrypter) decrypt(kid, ciphertext string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil || len(data) < c.aead.NonceSize() {
+		return nil, errors.New("invalid encrypted key")
+	}
+	return c.aead.Open(nil, data[:c.aead.NonceSize()], data[c.aead.NonceSize():], []byte(kid))
+}
+
+/*----------------------------------------------------------------------*/
+
+// generatePrivateKey generates a key for a JWS algorithm: ES256, ES384, RS256 (3072 bits) or EdDSA
+func generatePrivateKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case "ES256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ES384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "RS256":
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case "EdDSA":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, errors.New("unsupported signing key algorithm [" + alg + "]")
+}
+
+// SigningKeyManager keeps Tabusus' signing keys: it creates and activates keys on schedule and keeps retired keys
+// published until tokens and bundles they signed have expired
+type SigningKeyManager struct {
+	dao         SigningKeyDao
+	crypter     *keyCrypter
+	alg         string        // algorithm of generated keys
+	rotateEvery time.Duration // age of the active key when it is replaced
+	prepublish  time.Duration // how long a new key is published before it is activated
+	retain      time.Duration // how long a retired key stays published
+
+	keys    []SigningKey
+	signers map[string]crypto.Signer // decrypted private keys, by key id
+	mutex   sync.RWMutex
+}
+
+// AppSigningKeys is nil if signing keys are not configured
+var AppSigningKeys *SigningKeyManager
+
+var errSigningKeysMissing = errors.New("signing keys are not configured (signing_keys.master_key)")
+
+// loadSigningKeyManager creates the manager from configurations at "signing_keys", returns nil if no master key is
+// configured (error is logged)
+func loadSigningKeyManager(appConfig *HoconConfig, dao SigningKeyDao) *SigningKeyManager {
+	conf := appConfig.Conf
+	if !conf.GetBoolean("signing_keys.enabled", true) {
+		return nil
+	}
+	masterKey := os.Getenv(envMasterKey)
+	if masterKey == "" {
+		masterKey = conf.GetString("signing_keys.master_key", "")
+	}
+	if masterKey == "" {
+		log.Warn("No master key configured (", envMasterKey, " or signing_keys.master_key), tokens cannot be issued")
+		return nil
+	}
+	crypter, err := newKeyCrypter(masterKey)
+	if err != nil {
+		log.Error("Invalid master key, tokens cannot be issued: ", err)
+		return nil
+	}
+	m := &SigningKeyManager{
+		dao:         dao,
+		crypter:     crypter,
+		alg:         conf.GetString("signing_keys.algorithm", "ES256"),
+		rotateEvery: time.Duration(conf.GetInt32("signing_keys.rotation_days", 90)) * 24 * time.Hour,
+		prepublish:  time.Duration(conf.GetInt32("signing_keys.prepublish_hours", 24)) * time.Hour,
+		retain:      time.Duration(conf.GetInt32("signing_keys.retain_hours", 48)) * time.Hour,
+		signers:     map[string]crypto.Signer{},
+	}
+	// retired keys must stay published as long as tokens and bundles they signed are valid
+	minRetain := time.Duration(conf.GetInt32("tokens.ttl_seconds", 3600))*time.Second + time.Duration(conf.GetInt32("auth.clock_skew_seconds", 60))*time.Second
+	if bundleMaxAge := time.Duration(conf.GetInt32("bundle.max_age_hours", 24)) * time.Hour; bundleMaxAge > minRetain {
+		minRetain = bundleMaxAge
+	}
+	if m.retain < minRetain {
+		log.Warn("signing_keys.retain_hours is shorter than the lifetime of tokens/bundles, using ", minRetain)
+		m.retain = minRetain
+	}
+	if err := m.reload(); err != nil {
+		log.Error("Error while loading signing keys: ", err)
+	}
+	return m
+}
+
+// reload reads keys from storage
+func (m *SigningKeyManager) reload() error {
+	keys, err := m.dao.List()
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.keys = keys
+	return nil
+}
+
+// List returns all keys, newest first
+func (m *SigningKeyManager) List() []SigningKey {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return append([]SigningKey{}, m.keys...)
+}
+
+// signer decrypts the private key of a key
+func (m *SigningKeyManager) signer(k *SigningKey) (crypto.Signer, error) {
+	m.mutex.RLock()
+	s := m.signers[k.Id]
+	m.mutex.RUnlock()
+	if s != nil {
+		return s, nil
+	}
+	if k.MasterKeyId != m.crypter.id {
+		return nil, errors.New("signing key [" + k.Id + "] is encrypted with another master key")
+	}
+	der, err := m.crypter.decrypt(k.Id, k.PrivateKey)
+	if err != nil {
+		return nil, errors.New("cannot decrypt signing key [" + k.Id + "]: " + err.Error())
+	}
+	s, err = parsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		return nil, err
+	}
+	m.mutex.Lock()
+	m.signers[k.Id] = s
+	m.mutex.Unlock()
+	return s, nil
+}
+
+// Active returns the active key and its private key
+func (m *SigningKeyManager) Active() (*SigningKey, crypto.Signer, error) {
+	m.mutex.RLock()
+	var active *SigningKey
+	for i := range m.keys {
+		if m.keys[i].Status == signingKeyStatusActive {
+			k := m.keys[i]
+			active = &k
+			break
+		}
+	}
+	m.mutex.RUnlock()
+	if active == nil {
+		return nil, nil, errors.New("no active signing key")
+	}
+	s, err := m.signer(active)
+	return active, s, err
+}
+
+// Jwks returns published keys (next, active and retired ones not expired yet) as a JWK set
+func (m *SigningKeyManager) Jwks() map[string]interface{} {
+	now := time.Now()
+	keys := []interface{}{}
+	for _, k := range m.List() {
+		if !k.IsPublished(now) {
+			continue
+		}
+		if pubKey := parsePublicKey(k.PublicKey); pubKey != nil {
+			keys = append(keys, jws.NewJwk(pubKey, k.Id))
+		}
+	}
+	return map[string]interface{}{"keys": keys}
+}
+
+// add encrypts and stores a new key as next key
+func (m *SigningKeyManager) add(signer crypto.Signer, imported bool) (*SigningKey, error) {
+	alg := jws.Algorithm(signer.Public())
+	if alg == "" {
+		return nil, errors.New("unsupported signing key type")
+	}
+	fp, err := calcKeyFingerprints(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	pubDer, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range m.List() {
+		if k.Id == fp.Sha256 {
+			return nil, errors.New("signing key [" + k.Id + "] already exists")
+		}
+	}
+	k := &SigningKey{
+		Id:          fp.Sha256,
+		Alg:         alg,
+		Status:      signingKeyStatusNext,
+		PublicKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDer})),
+		MasterKeyId: m.crypter.id,
+		Imported:    imported,
+		TimeCreated: time.Now(),
+	}
+	if k.PrivateKey, err = m.crypter.encrypt(k.Id, der); err != nil {
+		return nil, err
+	}
+	// replaces the current next key, if any
+	for _, old := range m.List() {
+		if old.Status == signingKeyStatusNext {
+			if err := m.dao.Delete(old.Id); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := m.dao.Save(k); err != nil {
+		return nil, err
+	}
+	return k, m.reload()
+}
+
+// Generate creates a new key as next key, which is activated on schedule (or by Rotate)
+func (m *SigningKeyManager) Generate() (*SigningKey, error) {
+	signer, err := generatePrivateKey(m.alg)
+	if err != nil {
+		return nil, err
+	}
+	return m.add(signer, false)
+}
+
+// Import stores a PEM-encoded private key as next key
+func (m *SigningKeyManager) Import(pemData []byte) (*SigningKey, error) {
+	signer, err := parsePrivateKey(pemData)
+	if err != nil {
+		return nil, err
+	}
+	return m.add(signer, true)
+}
+
+// Rotate activates the next key (generating one if there is none) and retires the active key.
+// Note that a key activated without being published beforehand cannot be verified by verifiers caching old JWKS.
+func (m *SigningKeyManager) Rotate() (*SigningKey, error) {
+	if err := m.reload(); err != nil {
+		return nil, err
+	}
+	var next *SigningKey
+	for _, k := range m.List() {
+		if k.Status == signingKeyStatusNext {
+			k := k
+			next = &k
+		}
+	}
+	if next == nil {
+		var err error
+		if next, err = m.Generate(); err != nil {
+			return nil, err
+		}
+	}
+	now := time.Now()
+	for _, k := range m.List() {
+		if k.Status == signingKeyStatusActive {
+			k := k
+			publishUntil := now.Add(m.retain)
+			k.Status, k.TimeRetired, k.PublishUntil = signingKeyStatusRetired, &now, &publishUntil
+			if err := m.dao.Save(&k); err != nil {
+				return nil, err
+			}
+		}
+	}
+	next.Status, next.TimeActivated = signingKeyStatusActive, &now
+	if err := m.dao.Save(next); err != nil {
+		return nil, err
+	}
+	log.Info("Signing key [", next.Id, "] has been activated")
+	return next, m.reload()
+}
+
+// maintain rotates keys on schedule: creates the first key, publishes the next key ahead of rotation, rotates when
+// the active key is due and removes retired keys no longer published
+func (m *SigningKeyManager) maintain(now time.Time) error {
+	if err := m.reload(); err != nil {
+		return err
+	}
+	var active, next *SigningKey
+	for _, k := range m.List() {
+		k := k
+		switch {
+		case k.Status == signingKeyStatusActive && active == nil:
+			active = &k
+		case k.Status == signingKeyStatusNext && next == nil:
+			next = &k
+		case k.Status == signingKeyStatusRetired && !k.IsPublished(now):
+			if err := m.dao.Delete(k.Id); err != nil {
+				return err
+			}
+			log.Info("Retired signing key [", k.Id, "] has been removed")
+		}
+	}
+	if active == nil {
+		// first key: nothing to publish ahead of. Instances starting at the same time may each create one, the
+		// latest activated wins and the others are retired (but published) at the next rotation.
+		_, err := m.Rotate()
+		return err
+	}
+	if m.rotateEvery <= 0 {
+		return nil
+	}
+	due := active.TimeActivated != nil && !now.Before(active.TimeActivated.Add(m.rotateEvery))
+	if next == nil && active.TimeActivated != nil && !now.Before(active.TimeActivated.Add(m.rotateEvery-m.prepublish)) {
+		k, err := m.Generate()
+		if err != nil {
+			return err
+		}
+		log.Info("Signing key [", k.Id, "] has been published, to be activated at ", active.TimeActivated.Add(m.rotateEvery))
+		return nil
+	}
+	if due && next != nil && !now.Before(next.TimeCreated.Add(m.prepublish)) {
+		_, err := m.Rotate()
+		return err
+	}
+	return m.reload()
+}
+
+// run maintains keys periodically, also picking up changes made by other instances
+func (m *SigningKeyManager) run(interval time.Duration) {
+	for {
+		if err := m.maintain(time.Now()); err != nil {
+			log.Error("Error while maintaining signing keys: ", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// sortedByStatus returns keys ordered for display: next, active, then retired (newest first)
+func sortedByStatus(keys []SigningKey) []SigningKey {
+	rank := map[string]int{signingKeyStatusNext: 0, signingKeyStatusActive: 1, signingKeyStatusRetired: 2}
+	sort.SliceStable(keys, func(i, j int) bool { return rank[keys[i].Status] < rank[keys[j].Status] })
+	return keys
+}
@@ -0,0 +1,211 @@
+package tabusus
+
+import (
+	"crypto"
+	"crypto/rand"
+	"encoding/base64"
+	"sort"
+	"strings"
+	"sync"
+	"tabusus/jws"
+	"testing"
+	"time"
+)
+
+// memorySigningKeyDao keeps keys in memory, listed newest first as by the Mongo implementation
+type memorySigningKeyDao struct {
+	mutex sync.Mutex
+	keys  map[string]SigningKey
+}
+
+func newMemorySigningKeyDao() *memorySigningKeyDao {
+	return &memorySigningKeyDao{keys: map[string]SigningKey{}}
+}
+
+func (dao *memorySigningKeyDao) List() ([]SigningKey, error) {
+	dao.mutex.Lock()
+	defer dao.mutex.Unlock()
+	var result []SigningKey
+	for _, k := range dao.keys {
+		result = append(result, k)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].TimeCreated.After(result[j].TimeCreated) })
+	return result, nil
+}
+
+func (dao *memorySigningKeyDao) Save(k *SigningKey) error {
+	dao.mutex.Lock()
+	defer dao.mutex.Unlock()
+	dao.keys[k.Id] = *k
+	return nil
+}
+
+func (dao *memorySigningKeyDao) Delete(id string) error {
+	dao.mutex.Lock()
+	defer dao.mutex.Unlock()
+	delete(dao.keys, id)
+	return nil
+}
+
+func testMasterKey(t *testing.T) string {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func newTestSigningKeyManager(t *testing.T, dao SigningKeyDao, masterKey string) *SigningKeyManager {
+	crypter, err := newKeyCrypter(masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &SigningKeyManager{dao: dao, crypter: crypter, alg: "ES256", rotateEvery: 90 * 24 * time.Hour,
+		prepublish: 24 * time.Hour, retain: 48 * time.Hour, signers: map[string]crypto.Signer{}}
+}
+
+func TestKeyCrypter(t *testing.T) {
+	c, err := newKeyCrypter(testMasterKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := []byte("private key")
+	ciphertext, err := c.encrypt("kid1", plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(ciphertext, base64.StdEncoding.EncodeToString(plaintext)) {
+		t.Errorf("expected key to be encrypted")
+	}
+	if again, _ := c.encrypt("kid1", plaintext); again == ciphertext {
+		t.Errorf("expected a new nonce for each encryption")
+	}
+	if decrypted, err := c.decrypt("kid1", ciphertext); err != nil || string(decrypted) != string(plaintext) {
+		t.Errorf("expected round trip, got [%s] / %v", decrypted, err)
+	}
+	if _, err := c.decrypt("kid2", ciphertext); err == nil {
+		t.Errorf("expected key encrypted for another key id to be rejected")
+	}
+	for _, invalid := range []string{"", "not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := c.decrypt("kid1", invalid); err == nil {
+			t.Errorf("expected invalid ciphertext [%s] to be rejected", invalid)
+		}
+	}
+
+	other, _ := newKeyCrypter(testMasterKey(t))
+	if other.id == c.id {
+		t.Errorf("expected master keys to have different ids")
+	}
+	if _, err := other.decrypt("kid1", ciphertext); err == nil {
+		t.Errorf("expected wrong master key to be rejected")
+	}
+
+	for _, invalid := range []string{"", "not base64!", base64.StdEncoding.EncodeToString(make([]byte, 16))} {
+		if _, err := newKeyCrypter(invalid); err == nil {
+			t.Errorf("expected invalid master key [%s] to be rejected", invalid)
+		}
+	}
+}
+
+func TestSigningKeyWrongMasterKey(t *testing.T) {
+	dao := newMemorySigningKeyDao()
+	m := newTestSigningKeyManager(t, dao, testMasterKey(t))
+	if _, err := m.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := m.Active(); err != nil {
+		t.Fatal(err)
+	}
+
+	other := newTestSigningKeyManager(t, dao, testMasterKey(t))
+	other.reload()
+	if _, _, err := other.Active(); err == nil || !strings.Contains(err.Error(), "another master key") {
+		t.Errorf("expected key encrypted with another master key to be rejected, got %v", err)
+	}
+	// a key claiming to be encrypted with the master key is still rejected if it is not
+	keys, _ := dao.List()
+	keys[0].MasterKeyId = other.crypter.id
+	dao.Save(&keys[0])
+	other.reload()
+	if _, _, err := other.Active(); err == nil || !strings.Contains(err.Error(), "cannot decrypt") {
+		t.Errorf("expected key not to be decrypted with wrong master key, got %v", err)
+	}
+}
+
+// jwksKids returns ids of keys published in JWKS
+func jwksKids(m *SigningKeyManager) []string {
+	var kids []string
+	for _, k := range m.Jwks()["keys"].([]interface{}) {
+		kids = append(kids, k.(jws.Jwk).Kid)
+	}
+	sort.Strings(kids)
+	return kids
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	dao := newMemorySigningKeyDao()
+	m := newTestSigningKeyManager(t, dao, testMasterKey(t))
+	if err := m.maintain(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	first, signer, err := m.Active()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kids := jwksKids(m); len(kids) != 1 || kids[0] != first.Id {
+		t.Fatalf("expected first key to be published, got %v", kids)
+	}
+	token, err := jws.Sign(signer, map[string]interface{}{"alg": first.Alg, "kid": first.Id}, []byte(`{"sub":"app"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the next key is published ahead of rotation
+	if err := m.maintain(first.TimeActivated.Add(m.rotateEvery - m.prepublish)); err != nil {
+		t.Fatal(err)
+	}
+	if kids := jwksKids(m); len(kids) != 2 {
+		t.Fatalf("expected next key to be published, got %v", kids)
+	}
+	if active, _, _ := m.Active(); active.Id != first.Id {
+		t.Errorf("expected first key still active before rotation")
+	}
+
+	// the retired key stays published until PublishUntil
+	if err := m.maintain(first.TimeActivated.Add(m.rotateEvery)); err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := m.Active()
+	if err != nil || second.Id == first.Id {
+		t.Fatalf("expected next key to be activated, got %v / %v", second, err)
+	}
+	var retired SigningKey
+	for _, k := range m.List() {
+		if k.Id == first.Id {
+			retired = k
+		}
+	}
+	if retired.Status != signingKeyStatusRetired || retired.PublishUntil == nil || retired.PublishUntil.Sub(*retired.TimeRetired) != m.retain {
+		t.Fatalf("expected first key retired and published for %v, got %+v", m.retain, retired)
+	}
+	if kids := jwksKids(m); len(kids) != 2 {
+		t.Errorf("expected retired key to stay published, got %v", kids)
+	}
+	// tokens signed by the retired key can still be verified with the published key
+	parts := strings.Split(token, ".")
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	if err := jws.Verify(retired.Alg, parsePublicKey(retired.PublicKey), []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		t.Errorf("expected token to be verified with retired key: %v", err)
+	}
+	if !retired.IsPublished(retired.PublishUntil.Add(-time.Second)) || retired.IsPublished(*retired.PublishUntil) {
+		t.Errorf("expected retired key published until %v only", retired.PublishUntil)
+	}
+
+	// then it is removed
+	if err := m.maintain(retired.PublishUntil.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := dao.List(); len(keys) != 1 || keys[0].Id != second.Id {
+		t.Errorf("expected only the active key to be kept, got %d keys", len(keys))
+	}
+}
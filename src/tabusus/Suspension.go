@@ -0,0 +1,47 @@
+package tabusus
+
+import (
+	"github.com/labstack/gommon/log"
+	"time"
+)
+
+const suspensionSchedulerUser = "scheduler"
+
+// startSuspensionScheduler starts a background job that reactivates apps whose suspension has ended. Such apps are
+// treated as active as soon as the end date has passed (see GetEffectiveStatus), the job records the change and
+// notifies webhook subscribers about it.
+func startSuspensionScheduler(appConfig *HoconConfig, dao ApplicationDao, webhooks *WebhookDispatcher) {
+	interval := time.Duration(appConfig.Conf.GetInt32("status.suspension_check_interval_minutes", 10)) * time.Minute
+	if interval <= 0 {
+		log.Info("Reactivating apps after suspension is disabled")
+		return
+	}
+	go func() {
+		for {
+			endSuspensions(dao, webhooks)
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// endSuspensions reactivates suspended apps whose suspension end date has passed
+func endSuspensions(dao ApplicationDao, webhooks *WebhookDispatcher) {
+	for _, app := range dao.List() {
+		if app.GetStatus() != AppStatusSuspended || app.GetEffectiveStatus() != AppStatusActive {
+			continue
+		}
+		if err := app.TransitTo(AppStatusActive, "", nil); err != nil {
+			log.Error("Error while reactivating app [", app.GetId(), "]: ", err)
+			continue
+		}
+		app.SetUpdatedBy(suspensionSchedulerUser).SetTimeUpdated(time.Now())
+		if err := dao.Save(&app); err != nil {
+			log.Error("Error while reactivating app [", app.GetId(), "]: ", err)
+			continue
+		}
+		log.Info("Suspension of app [", app.GetId(), "] has ended, app is active again")
+		if webhooks != nil {
+			webhooks.Dispatch(EventAppUpdated, &app, suspensionSchedulerUser)
+		}
+	}
+}
@@ -35,6 +35,8 @@ func (t *TemplateRenderer) Render(w io.Writer, name string, data interface{}, c
 		viewContext["reverse"] = c.Echo().Reverse
 		viewContext["static"] = staticPath
 		viewContext["appInfo"] = AppConfig.Conf.GetConfig("app")
+		viewContext["customFields"] = AppFields
+		viewContext["keyProof"] = AppKeyProof
 		if len(flash) > 0 {
 			viewContext["flash"] = flash[0].(string)
 		}
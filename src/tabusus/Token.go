@@ -0,0 +1,58 @@
+package tabusus
+
+import (
+	"encoding/json"
+	"github.com/labstack/echo"
+	"strings"
+	"tabusus/jws"
+	"tabusus/utils"
+	"time"
+)
+
+// accessTokenType is the JWS "typ" of access tokens issued by Tabusus (RFC 9068)
+const accessTokenType = "at+jwt"
+
+// tokenIssuer returns the "iss" claim of access tokens: "tokens.issuer", or the public URL of the registry
+func tokenIssuer(c echo.Context) string {
+	if iss := AppConfig.Conf.GetString("tokens.issuer", ""); iss != "" {
+		return iss
+	}
+	return registryUrl(c)
+}
+
+// issueAccessToken issues a token to an authenticated app, signed with the active signing key. The token lives for
+// "tokens.ttl_seconds", capped by app's maximum token lifetime.
+func issueAccessToken(app *Application, assertion *jws.Assertion, issuer string, now time.Time) (string, time.Time, error) {
+	if AppSigningKeys == nil {
+		return "", time.Time{}, errSigningKeysMissing
+	}
+	key, signer, err := AppSigningKeys.Active()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	ttl := time.Duration(AppConfig.Conf.GetInt32("tokens.ttl_seconds", 3600)) * time.Second
+	if max := time.Duration(app.GetConstraints().MaxTokenTtl) * time.Second; max > 0 && ttl > max {
+		ttl = max
+	}
+	expiresAt := now.Add(ttl).Truncate(time.Second)
+	claims := map[string]interface{}{
+		"iss":       issuer,
+		"sub":       app.GetId(),
+		"client_id": app.GetId(),
+		"iat":       now.Unix(),
+		"exp":       expiresAt.Unix(),
+		"jti":       utils.RandomHex(16),
+	}
+	if len(assertion.Audiences) > 0 {
+		claims["aud"] = assertion.Audiences
+	}
+	if len(assertion.Scopes) > 0 {
+		claims["scope"] = strings.Join(assertion.Scopes, " ")
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	token, err := jws.Sign(signer, map[string]interface{}{"alg": key.Alg, "kid": key.Id, "typ": accessTokenType}, payload)
+	return token, expiresAt, err
+}
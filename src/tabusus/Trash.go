@@ -0,0 +1,36 @@
+package tabusus
+
+import (
+	"github.com/labstack/gommon/log"
+	"time"
+)
+
+// startTrashPurgeScheduler starts a background job that permanently deletes apps which have been in trash
+// for longer than the configured number of days ("trash.purge_after_days", 0 disables the job)
+func startTrashPurgeScheduler(appConfig *HoconConfig, dao ApplicationDao) {
+	days := int(appConfig.Conf.GetInt32("trash.purge_after_days", 30))
+	if days <= 0 {
+		log.Info("Purging trash is disabled")
+		return
+	}
+	interval := time.Duration(appConfig.Conf.GetInt32("trash.purge_interval_minutes", 60)) * time.Minute
+	go func() {
+		for {
+			purgeTrash(dao, time.Duration(days)*24*time.Hour)
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// purgeTrash permanently deletes apps that have been in trash for longer than retention
+func purgeTrash(dao ApplicationDao, retention time.Duration) {
+	for _, app := range dao.ListDeleted() {
+		if t := app.GetDeletedAt(); t != nil && time.Since(*t) > retention {
+			if err := dao.Delete(&app); err != nil {
+				log.Error("Error while purging app [", app.GetId(), "]: ", err)
+			} else {
+				log.Info("App [", app.GetId(), "] has been purged from trash")
+			}
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package tabusus
+
+import (
+	"context"
+	"github.com/labstack/gommon/log"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/options"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	tableUsage = "usage"
+
+	endpointToken = "token"
+)
+
+// UsageBucket aggregates usage of an app at authentication endpoints during an hour
+type UsageBucket struct {
+	AppId         string    `bson:"app" json:"app,omitempty"`
+	Hour          time.Time `bson:"hour" json:"hour"`
+	VerifySuccess int64     `bson:"verify_success" json:"verify_success"`
+	VerifyFailure int64     `bson:"verify_failure" json:"verify_failure"`
+	TokenSuccess  int64     `bson:"token_success" json:"token_success"`
+	TokenFailure  int64     `bson:"token_failure" json:"token_failure"`
+	LastSeen      time.Time `bson:"last_seen" json:"last_seen"`
+	LastIp        string    `bson:"last_ip" json:"last_ip"`
+}
+
+func (b *UsageBucket) Successes() int64 {
+	return b.VerifySuccess + b.TokenSuccess
+}
+
+func (b *UsageBucket) Failures() int64 {
+	return b.VerifyFailure + b.TokenFailure
+}
+
+func (b *UsageBucket) Total() int64 {
+	return b.Successes() + b.Failures()
+}
+
+// merge adds counters of another bucket, last seen info is taken from the most recent one
+func (b *UsageBucket) merge(other *UsageBucket) {
+	b.VerifySuccess += other.VerifySuccess
+	b.VerifyFailure += other.VerifyFailure
+	b.TokenSuccess += other.TokenSuccess
+	b.TokenFailure += other.TokenFailure
+	if other.LastSeen.After(b.LastSeen) {
+		b.LastSeen, b.LastIp = other.LastSeen, other.LastIp
+	}
+}
+
+func (b *UsageBucket) count(endpoint string, success bool) {
+	// signed requests are verifications too
+	isVerify := endpoint == endpointVerify || endpoint == endpointVerifyRequest || endpoint == endpointWhoami
+	switch {
+	case isVerify && success:
+		b.VerifySuccess++
+	case isVerify:
+		b.VerifyFailure++
+	case endpoint == endpointToken && success:
+		b.TokenSuccess++
+	case endpoint == endpointToken:
+		b.TokenFailure++
+	}
+}
+
+/*----------------------------------------------------------------------*/
+
+// UsageRecorder counts usage in memory and periodically flushes the counters to storage,
+// so that authentication requests do not wait for a storage round-trip
+type UsageRecorder struct {
+	dao     UsageDao
+	pending map[string]*UsageBucket // key: app id + hour
+	mutex   sync.Mutex
+}
+
+// newUsageRecorder builds the recorder from configurations at "usage" and starts its flush loop
+func newUsageRecorder(appConfig *HoconConfig, dao UsageDao) *UsageRecorder {
+	r := &UsageRecorder{dao: dao, pending: map[string]*UsageBucket{}}
+	interval := time.Duration(appConfig.Conf.GetInt32("usage.flush_interval_seconds", 10)) * time.Second
+	go func() {
+		for range time.Tick(interval) {
+			r.Flush()
+		}
+	}()
+	return r
+}
+
+// Record counts an authentication attempt of an app
+func (r *UsageRecorder) Record(appId, endpoint string, success bool, clientIp string, t time.Time) {
+	hour := t.UTC().Truncate(time.Hour)
+	key := appId + "@" + hour.Format(time.RFC3339)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	b := r.pending[key]
+	if b == nil {
+		b = &UsageBucket{AppId: appId, Hour: hour}
+		r.pending[key] = b
+	}
+	b.count(endpoint, success)
+	if !t.Before(b.LastSeen) {
+		b.LastSeen, b.LastIp = t, clientIp
+	}
+}
+
+// Flush writes pending counters to storage, counters failed to be written are kept for the next flush
+func (r *UsageRecorder) Flush() {
+	r.mutex.Lock()
+	pending := r.pending
+	r.pending = map[string]*UsageBucket{}
+	r.mutex.Unlock()
+	for key, b := range pending {
+		if err := r.dao.Add(b); err != nil {
+			log.Error("Error while saving usage of app [", b.AppId, "]: ", err)
+			r.mutex.Lock()
+			if current := r.pending[key]; current != nil {
+				current.merge(b)
+			} else {
+				r.pending[key] = b
+			}
+			r.mutex.Unlock()
+		}
+	}
+}
+
+/*----------------------------------------------------------------------*/
+
+// UsageReport summarizes usage of an app (or all apps) over a period, hour by hour
+type UsageReport struct {
+	AppId  string         `json:"app,omitempty"`
+	From   time.Time      `json:"from"`
+	To     time.Time      `json:"to"`
+	Totals UsageBucket    `json:"totals"`         // including last seen time and client IP
+	Hours  []*UsageBucket `json:"hours"`          // one bucket per hour, hours without usage included
+	Apps   []*UsageBucket `json:"apps,omitempty"` // totals per app, most used first (report of all apps only)
+}
+
+// ChartLabels returns labels of the hourly chart
+func (r *UsageReport) ChartLabels() []string {
+	result := make([]string, len(r.Hours))
+	for i, b := range r.Hours {
+		result[i] = b.Hour.Format("01-02 15:00")
+	}
+	return result
+}
+
+// ChartSeries returns hourly counts of successes and failures
+func (r *UsageReport) ChartSeries() map[string][]int64 {
+	successes, failures := make([]int64, len(r.Hours)), make([]int64, len(r.Hours))
+	for i, b := range r.Hours {
+		successes[i], failures[i] = b.Successes(), b.Failures()
+	}
+	return map[string][]int64{"successes": successes, "failures": failures}
+}
+
+// buildUsageReport builds usage report of an app (all apps if appId is empty) for the last number of hours
+func buildUsageReport(dao UsageDao, appId string, hours int) (*UsageReport, error) {
+	to := time.Now().UTC().Truncate(time.Hour)
+	from := to.Add(-time.Duration(hours-1) * time.Hour)
+	buckets, err := dao.List(appId, from, to)
+	if err != nil {
+		return nil, err
+	}
+	report := &UsageReport{AppId: appId, From: from, To: to.Add(time.Hour)}
+	byHour := map[int64]*UsageBucket{}
+	for t := from; !t.After(to); t = t.Add(time.Hour) {
+		b := &UsageBucket{Hour: t}
+		report.Hours = append(report.Hours, b)
+		byHour[t.Unix()] = b
+	}
+	byApp := map[string]*UsageBucket{}
+	for i := range buckets {
+		b := &buckets[i]
+		if h := byHour[b.Hour.UTC().Unix()]; h != nil {
+			h.merge(b)
+		}
+		report.Totals.merge(b)
+		if appId == "" {
+			if byApp[b.AppId] == nil {
+				byApp[b.AppId] = &UsageBucket{AppId: b.AppId}
+				report.Apps = append(report.Apps, byApp[b.AppId])
+			}
+			byApp[b.AppId].merge(b)
+		}
+	}
+	sort.Slice(report.Apps, func(i, j int) bool { return report.Apps[i].Total() > report.Apps[j].Total() })
+	return report, nil
+}
+
+/*----------------------------------------------------------------------*/
+
+type UsageDao interface {
+	Add(b *UsageBucket) error                                     // adds counters to the bucket of (app, hour)
+	List(appId string, from, to time.Time) ([]UsageBucket, error) // lists buckets in [from, to], of all apps if appId is empty
+}
+
+type MongoUsageDao struct {
+	url    string        // connection url
+	db     string        // database name
+	client *mongo.Client // client instance
+}
+
+// NewMongoUsageDao creates the DAO, buckets older than retentionDays are removed by a TTL index (0: kept forever)
+func NewMongoUsageDao(url, db string, retentionDays int) UsageDao {
+	m := &MongoUsageDao{
+		url:    url,
+		db:     db,
+		client: mongoConnect(url),
+	}
+	collection := m.client.Database(db).Collection(tableUsage)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	indexes := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "app", Value: 1}, {Key: "hour", Value: 1}}, Options: options.Index().SetUnique(true)},
+	}
+	if retentionDays > 0 {
+		indexes = append(indexes, mongo.IndexModel{
+			Keys:    bson.M{"hour": 1},
+			Options: options.Index().SetExpireAfterSeconds(int32(retentionDays * 24 * 3600)),
+		})
+	}
+	for _, index := range indexes {
+		if _, err := collection.Indexes().CreateOne(ctx, index); err != nil {
+			log.Error("Error while creating index on [", tableUsage, "]: ", err)
+		}
+	}
+	return m
+}
+
+func (dao *MongoUsageDao) Add(b *UsageBucket) error {
+	collection := dao.client.Database(dao.db).Collection(tableUsage)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// time and client IP of the last access are stored as one sub-document, updated together by a single $max
+	// (sub-documents are compared field by field in order: time first)
+	update := bson.M{
+		"$inc": bson.M{
+			"verify_success": b.VerifySuccess,
+			"verify_failure": b.VerifyFailure,
+			"token_success":  b.TokenSuccess,
+			"token_failure":  b.TokenFailure,
+		},
+		"$max": bson.M{"last": bson.D{{Key: "seen", Value: b.LastSeen}, {Key: "ip", Value: b.LastIp}}},
+	}
+	_, err := collection.UpdateOne(ctx, bson.M{"app": b.AppId, "hour": b.Hour}, update, options.Update().SetUpsert(true))
+	return err
+}
+
+func (dao *MongoUsageDao) List(appId string, from, to time.Time) ([]UsageBucket, error) {
+	collection := dao.client.Database(dao.db).Collection(tableUsage)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	filter := bson.M{"hour": bson.M{"$gte": from, "$lte": to}}
+	if appId != "" {
+		filter["app"] = appId
+	}
+	cur, err := collection.Find(ctx, filter, options.Find().SetSort(bson.M{"hour": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var result []UsageBucket
+	for cur.Next(ctx) {
+		var row struct {
+			UsageBucket `bson:",inline"`
+			Last        struct {
+				Seen time.Time `bson:"seen"`
+				Ip   string    `bson:"ip"`
+			} `bson:"last"`
+		}
+		if err := cur.Decode(&row); err != nil {
+			log.Error(err)
+		} else {
+			// buckets written before the last access was stored as one sub-document have last_seen and last_ip
+			if row.Last.Seen.After(row.LastSeen) {
+				row.LastSeen, row.LastIp = row.Last.Seen, row.Last.Ip
+			}
+			result = append(result, row.UsageBucket)
+		}
+	}
+	return result, cur.Err()
+}
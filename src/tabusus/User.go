@@ -0,0 +1,199 @@
+package tabusus
+
+import (
+	"context"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	tableUsers = "users"
+
+	roleAdmin     = "admin"
+	roleDeveloper = "developer" // can only access the developer portal
+
+	// built-in account, accepted only while there is no user in storage
+	builtinAdminUser     = "admin"
+	builtinAdminPassword = "secret"
+)
+
+var validUserId = regexp.MustCompile(`^[a-z0-9_.@-]+$`)
+
+// User is an account that can log in to Tabusus
+type User struct {
+	Id           string    `bson:"id" json:"id"`
+	PasswordHash string    `bson:"password" json:"-"` // bcrypt hash
+	Role         string    `bson:"role" json:"role"`
+	TimeCreated  time.Time `bson:"tc" json:"time_created"`
+}
+
+func NewUser(id, role string) *User {
+	return &User{Id: strings.ToLower(strings.TrimSpace(id)), Role: role, TimeCreated: time.Now()}
+}
+
+func (u *User) SetPassword(password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = string(hash)
+	return nil
+}
+
+func (u *User) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+}
+
+// authenticate checks user's credentials, returns the user if credentials are valid
+func authenticate(id, password string) *User {
+	id = strings.ToLower(strings.TrimSpace(id))
+	user, err := AppUserDao.Get(id)
+	if err != nil {
+		return nil
+	}
+	if user != nil {
+		if user.CheckPassword(password) {
+			return user
+		}
+		return nil
+	}
+	if id == builtinAdminUser && password == builtinAdminPassword && len(AppUserDao.List()) == 0 {
+		return NewUser(builtinAdminUser, roleAdmin)
+	}
+	return nil
+}
+
+// isAdmin checks if a user has the admin role
+func isAdmin(id string) bool {
+	user, err := AppUserDao.Get(id)
+	if err != nil {
+		return false
+	}
+	if user == nil {
+		// built-in account
+		return id == builtinAdminUser && len(AppUserDao.List()) == 0
+	}
+	return user.Role == roleAdmin
+}
+
+const (
+	sessionRole        = "role"
+	sessionRoleChecked = "role_checked"
+
+	// roleCacheTtl is how long the role of the logged-in user is cached in the session
+	roleCacheTtl = time.Minute
+)
+
+// isSessionAdmin checks if the logged-in user is an admin. The role is cached in the session, so that role changes
+// take effect after at most roleCacheTtl.
+func isSessionAdmin(c echo.Context) bool {
+	uid := currentUser(c)
+	if uid == "" {
+		return false
+	}
+	sess := getSession(c)
+	role, _ := sess.Values[sessionRole].(string)
+	checked, _ := sess.Values[sessionRoleChecked].(int64)
+	if role != "" && time.Since(time.Unix(checked, 0)) < roleCacheTtl {
+		return role == roleAdmin
+	}
+	role = roleDeveloper
+	if isAdmin(uid) {
+		role = roleAdmin
+	}
+	sess.Values[sessionRole] = role
+	sess.Values[sessionRoleChecked] = time.Now().Unix()
+	sess.Save(c.Request(), c.Response())
+	return role == roleAdmin
+}
+
+/*----------------------------------------------------------------------*/
+
+type UserDao interface {
+	List() []User
+	Get(id string) (*User, error)
+	Save(u *User) error
+}
+
+type MongoUserDao struct {
+	url    string        // connection url
+	db     string        // database name
+	client *mongo.Client // client instance
+}
+
+func NewMongoUserDao(url, db string) UserDao {
+	m := &MongoUserDao{
+		url:    url,
+		db:     db,
+		client: mongoConnect(url),
+	}
+	collection := m.client.Database(db).Collection(tableUsers)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"id": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Error("Error while creating index on [", tableUsers, "]: ", err)
+	}
+	return m
+}
+
+func (dao *MongoUserDao) List() []User {
+	collection := dao.client.Database(dao.db).Collection(tableUsers)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cur, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		log.Warn(err)
+		return nil
+	}
+	defer cur.Close(ctx)
+	var result []User
+	for cur.Next(ctx) {
+		var row User
+		if err := cur.Decode(&row); err != nil {
+			log.Error(err)
+		} else {
+			result = append(result, row)
+		}
+	}
+	return result
+}
+
+func (dao *MongoUserDao) Get(id string) (*User, error) {
+	collection := dao.client.Database(dao.db).Collection(tableUsers)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dbResult := collection.FindOne(ctx, bson.M{"id": strings.ToLower(strings.TrimSpace(id))})
+	if dbResult.Err() != nil {
+		log.Error(dbResult.Err())
+		return nil, dbResult.Err()
+	}
+	var row User
+	err := dbResult.Decode(&row)
+	if err != nil && err != mongo.ErrNoDocuments {
+		log.Error(err)
+		return nil, err
+	}
+	if err != nil && err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return &row, nil
+}
+
+func (dao *MongoUserDao) Save(u *User) error {
+	collection := dao.client.Database(dao.db).Collection(tableUsers)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := collection.ReplaceOne(ctx, bson.M{"id": u.Id}, u, options.Replace().SetUpsert(true))
+	return err
+}
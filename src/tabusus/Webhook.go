@@ -0,0 +1,339 @@
+package tabusus
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/labstack/gommon/log"
+	"net/http"
+	"strconv"
+	"sync"
+	"tabusus/utils"
+	"time"
+)
+
+const (
+	EventAppCreated  = "app.created"
+	EventAppUpdated  = "app.updated"
+	EventAppDisabled = "app.disabled"
+	EventAppDeleted  = "app.deleted"
+	EventAppRestored = "app.restored"
+
+	EventAppKeyExpiring = "app.key_expiring"
+)
+
+const (
+	headerWebhookEvent     = "X-Tabusus-Event"
+	headerWebhookDelivery  = "X-Tabusus-Delivery"
+	headerWebhookSignature = "X-Tabusus-Signature" // "sha256=" + hex(HMAC-SHA256(secret, body))
+)
+
+// WebhookSubscriber is a URL subscribing to registry events
+type WebhookSubscriber struct {
+	Id     string   `json:"id"`
+	Url    string   `json:"url"`
+	Secret string   `json:"-"`
+	Events []string `json:"events"` // empty or "*": all events
+}
+
+func (s *WebhookSubscriber) accepts(event string) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, v := range s.Events {
+		if v == "*" || v == event {
+			return true
+		}
+	}
+	return false
+}
+
+// sign calculates signature of a payload
+func (s *WebhookSubscriber) sign(payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(s.Secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookDispatcher delivers registry events to webhook subscribers asynchronously,
+// failed deliveries are retried with exponential backoff.
+//
+// Deliveries are persisted as pending before being queued: a delivery that does not fit in the queue, is scheduled
+// for retry or has been created by another process (e.g. the command-line tool) is picked up by the sweeper of a
+// running server. Each attempt is claimed in storage first so that server instances do not deliver it twice.
+type WebhookDispatcher struct {
+	Subscribers    []*WebhookSubscriber
+	dao            WebhookDeliveryDao
+	queue          chan *WebhookDelivery
+	client         *http.Client
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	pollInterval   time.Duration
+	started        bool
+	mutex          sync.Mutex
+	queued         map[string]bool // ids of deliveries in the queue or being attempted
+}
+
+// webhookClaimLease is how long a claimed delivery is reserved for the claiming instance
+const webhookClaimLease = time.Minute
+
+// newWebhookDispatcher builds the dispatcher from configurations at "webhooks", deliveries are only persisted until
+// start is called
+func newWebhookDispatcher(appConfig *HoconConfig, dao WebhookDeliveryDao) *WebhookDispatcher {
+	conf := appConfig.Conf
+	d := &WebhookDispatcher{
+		dao:            dao,
+		queue:          make(chan *WebhookDelivery, 1024),
+		client:         &http.Client{Timeout: 10 * time.Second},
+		maxAttempts:    int(conf.GetInt32("webhooks.max_attempts", 8)),
+		initialBackoff: time.Duration(conf.GetInt32("webhooks.initial_backoff_seconds", 5)) * time.Second,
+		maxBackoff:     time.Duration(conf.GetInt32("webhooks.max_backoff_seconds", 3600)) * time.Second,
+		pollInterval:   time.Duration(conf.GetInt32("webhooks.poll_interval_seconds", 5)) * time.Second,
+		queued:         map[string]bool{},
+	}
+	if d.pollInterval <= 0 {
+		d.pollInterval = 5 * time.Second
+	}
+	if d.maxBackoff <= 0 {
+		d.maxBackoff = time.Hour
+	}
+	if subConf := conf.GetConfig("webhooks.subscribers"); subConf != nil && !subConf.IsEmpty() {
+		for _, id := range subConf.Root().GetObject().GetKeys() {
+			sub := &WebhookSubscriber{
+				Id:     id,
+				Url:    subConf.GetString(id+".url", ""),
+				Secret: subConf.GetString(id+".secret", ""),
+				Events: subConf.GetStringList(id + ".events"),
+			}
+			if sub.Url == "" {
+				log.Warn("Webhook subscriber [", id, "] has no url, ignored")
+				continue
+			}
+			d.Subscribers = append(d.Subscribers, sub)
+		}
+	}
+	return d
+}
+
+// start starts delivery workers and the sweeper, which also resumes deliveries interrupted by previous shutdown
+func (d *WebhookDispatcher) start(workers int) {
+	d.mutex.Lock()
+	d.started = true
+	d.mutex.Unlock()
+	for i := 0; i < workers; i++ {
+		go d.worker()
+	}
+	go func() {
+		for {
+			d.sweep()
+			time.Sleep(d.pollInterval)
+		}
+	}()
+}
+
+// sweep queues pending deliveries that are due
+func (d *WebhookDispatcher) sweep() {
+	now := time.Now()
+	for _, delivery := range d.dao.List(webhookStatusPending, 0) {
+		if delivery.NextAttempt.After(now) || d.isQueued(delivery.Id) {
+			continue
+		}
+		v := delivery
+		if !d.dao.Claim(&v, now.Add(webhookClaimLease)) {
+			// claimed by another instance
+			continue
+		}
+		if !d.enqueue(&v) {
+			// queue is full, remaining deliveries are picked up by next sweeps
+			return
+		}
+	}
+}
+
+// accepts checks if any subscriber is interested in an event
+func (d *WebhookDispatcher) accepts(event string) bool {
+	for _, sub := range d.Subscribers {
+		if sub.accepts(event) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *WebhookDispatcher) isStarted() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.started
+}
+
+func (d *WebhookDispatcher) isQueued(id string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.queued[id]
+}
+
+// enqueue queues a delivery without blocking, returns false if the delivery has not been queued (dispatcher not
+// started or queue full): it stays pending in storage and is picked up by the sweeper
+func (d *WebhookDispatcher) enqueue(delivery *WebhookDelivery) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if !d.started {
+		return false
+	}
+	if d.queued[delivery.Id] {
+		return true
+	}
+	select {
+	case d.queue <- delivery:
+		d.queued[delivery.Id] = true
+		return true
+	default:
+		log.Warn("Webhook queue is full, delivery [", delivery.Id, "] stays pending")
+		return false
+	}
+}
+
+func (d *WebhookDispatcher) subscriber(id string) *WebhookSubscriber {
+	for _, sub := range d.Subscribers {
+		if sub.Id == id {
+			return sub
+		}
+	}
+	return nil
+}
+
+// Dispatch queues an app event for delivery to all subscribers interested in the event
+func (d *WebhookDispatcher) Dispatch(event string, app *Application, user string) {
+	now := time.Now()
+	payload, err := json.Marshal(map[string]interface{}{
+		"event": event,
+		"time":  now,
+		"user":  user,
+		"data":  app.toApiData(),
+	})
+	if err != nil {
+		log.Error("Error while building payload for event [", event, "]: ", err)
+		return
+	}
+	for _, sub := range d.Subscribers {
+		if !sub.accepts(event) {
+			continue
+		}
+		delivery := &WebhookDelivery{
+			Id:           utils.RandomHex(16),
+			Event:        event,
+			SubscriberId: sub.Id,
+			Url:          sub.Url,
+			Payload:      string(payload),
+			Status:       webhookStatusPending,
+			TimeCreated:  now,
+			TimeUpdated:  now,
+		}
+		if d.isStarted() {
+			// reserved for this instance, the sweeper retries it if it cannot be queued
+			delivery.NextAttempt = now.Add(webhookClaimLease)
+		}
+		if err := d.dao.Save(delivery); err != nil {
+			log.Error("Error while saving webhook delivery [", delivery.Id, "]: ", err)
+		}
+		d.enqueue(delivery)
+	}
+}
+
+// Redeliver resets a delivered or failed delivery and queues it again (pending deliveries are already scheduled)
+func (d *WebhookDispatcher) Redeliver(id string) error {
+	delivery, err := d.dao.Get(id)
+	if err != nil {
+		return err
+	}
+	if delivery == nil {
+		return errors.New("webhook delivery [" + id + "] not found")
+	}
+	if delivery.Status == webhookStatusPending || d.isQueued(id) {
+		return errors.New("webhook delivery [" + id + "] is already pending")
+	}
+	now := time.Now()
+	delivery.Status = webhookStatusPending
+	delivery.Attempts = 0
+	delivery.NextAttempt = now.Add(webhookClaimLease)
+	delivery.TimeUpdated = now
+	if err := d.dao.Save(delivery); err != nil {
+		return err
+	}
+	d.enqueue(delivery)
+	return nil
+}
+
+func (d *WebhookDispatcher) worker() {
+	for delivery := range d.queue {
+		d.attempt(delivery)
+		d.mutex.Lock()
+		delete(d.queued, delivery.Id)
+		d.mutex.Unlock()
+	}
+}
+
+func (d *WebhookDispatcher) attempt(delivery *WebhookDelivery) {
+	delivery.Attempts++
+	delivery.LastStatusCode, delivery.LastError = 0, ""
+	if err := d.post(delivery); err != nil {
+		delivery.LastError = err.Error()
+		if delivery.Attempts >= d.maxAttempts {
+			delivery.Status = webhookStatusFailed
+		} else {
+			// picked up by the sweeper once due
+			delivery.NextAttempt = time.Now().Add(d.backoff(delivery.Attempts))
+		}
+	} else {
+		delivery.Status = webhookStatusDelivered
+	}
+	delivery.TimeUpdated = time.Now()
+	if err := d.dao.Save(delivery); err != nil {
+		log.Error("Error while saving webhook delivery [", delivery.Id, "]: ", err)
+	}
+}
+
+// backoff returns the delay before retrying a delivery that failed the given number of attempts: initialBackoff,
+// doubled after each failed attempt and capped at maxBackoff
+func (d *WebhookDispatcher) backoff(attempts int) time.Duration {
+	delay := d.initialBackoff
+	for i := 1; i < attempts && delay > 0 && delay < d.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > d.maxBackoff {
+		delay = d.maxBackoff
+	}
+	return delay
+}
+
+func (d *WebhookDispatcher) post(delivery *WebhookDelivery) error {
+	sub := d.subscriber(delivery.SubscriberId)
+	if sub == nil {
+		return errors.New("webhook subscriber [" + delivery.SubscriberId + "] no longer exists")
+	}
+	payload := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, sub.Url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(headerWebhookEvent, delivery.Event)
+	req.Header.Set(headerWebhookDelivery, delivery.Id)
+	if sub.Secret != "" {
+		req.Header.Set(headerWebhookSignature, sub.sign(payload))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	delivery.LastStatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New("subscriber responded with status " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package tabusus
+
+import (
+	"github.com/labstack/echo"
+	"net/http"
+)
+
+func actionWebhookList(c echo.Context) error {
+	return c.Render(http.StatusOK, "layout:webhooks", map[string]interface{}{
+		"active":      "webhooks",
+		"status":      c.QueryParam("status"),
+		"subscribers": AppWebhooks.Subscribers,
+		"deliveries":  WebhookDao.List(c.QueryParam("status"), 500),
+	})
+}
+
+func actionWebhookRedeliver(c echo.Context) error {
+	id := c.Param("id")
+	sess := getSession(c)
+	if err := AppWebhooks.Redeliver(id); err != nil {
+		sess.AddFlash("Error while redelivering webhook event [" + id + "]: " + err.Error())
+	} else {
+		sess.AddFlash("Webhook event [" + id + "] has been queued for redelivery.")
+	}
+	sess.Save(c.Request(), c.Response())
+	return c.Redirect(http.StatusFound, c.Echo().Reverse("webhooks"))
+}
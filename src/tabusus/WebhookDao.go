@@ -0,0 +1,155 @@
+package tabusus
+
+import (
+	"context"
+	"github.com/labstack/gommon/log"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/options"
+	"time"
+)
+
+const (
+	tableWebhookDeliveries = "webhook_deliveries"
+
+	webhookStatusPending   = "pending"
+	webhookStatusDelivered = "delivered"
+	webhookStatusFailed    = "failed"
+)
+
+// WebhookDelivery records delivery of an event to a webhook subscriber
+type WebhookDelivery struct {
+	Id             string    `bson:"id" json:"id"`
+	Event          string    `bson:"event" json:"event"`
+	SubscriberId   string    `bson:"subscriber" json:"subscriber"`
+	Url            string    `bson:"url" json:"url"`
+	Payload        string    `bson:"payload" json:"payload"` // JSON-encoded payload, signed as-is
+	Status         string    `bson:"status" json:"status"`
+	Attempts       int       `bson:"attempts" json:"attempts"`
+	LastStatusCode int       `bson:"last_status_code" json:"last_status_code"`
+	LastError      string    `bson:"last_error" json:"last_error"`
+	NextAttempt    time.Time `bson:"next_attempt" json:"next_attempt"` // pending deliveries: not attempted before
+	TimeCreated    time.Time `bson:"tc" json:"time_created"`
+	TimeUpdated    time.Time `bson:"tu" json:"time_updated"`
+}
+
+func (d *WebhookDelivery) UrlRedeliver() string {
+	return "/webhooks/" + d.Id + "/redeliver"
+}
+
+/*----------------------------------------------------------------------*/
+
+type WebhookDeliveryDao interface {
+	List(status string, limit int) []WebhookDelivery // lists latest deliveries, optionally filtered by status
+	Get(id string) (*WebhookDelivery, error)
+	Save(d *WebhookDelivery) error
+	// Claim atomically moves next attempt of a pending delivery (still scheduled at d.NextAttempt) to until, returns
+	// false if the delivery has been claimed by someone else
+	Claim(d *WebhookDelivery, until time.Time) bool
+}
+
+type MongoWebhookDeliveryDao struct {
+	url    string        // connection url
+	db     string        // database name
+	client *mongo.Client // client instance
+}
+
+func NewMongoWebhookDeliveryDao(url, db string) WebhookDeliveryDao {
+	m := &MongoWebhookDeliveryDao{
+		url:    url,
+		db:     db,
+		client: mongoConnect(url),
+	}
+	collection := m.client.Database(db).Collection(tableWebhookDeliveries)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"id": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Error("Error while creating index on [", tableWebhookDeliveries, "]: ", err)
+	}
+	return m
+}
+
+func (dao *MongoWebhookDeliveryDao) List(status string, limit int) []WebhookDelivery {
+	collection := dao.client.Database(dao.db).Collection(tableWebhookDeliveries)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	filter := bson.M{}
+	if status != "" {
+		filter["status"] = status
+	}
+	opts := options.Find().SetSort(bson.M{"tc": -1})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	cur, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		log.Warn(err)
+		return nil
+	}
+	defer cur.Close(ctx)
+	var result []WebhookDelivery
+	for cur.Next(ctx) {
+		var row WebhookDelivery
+		if err := cur.Decode(&row); err != nil {
+			log.Error(err)
+		} else {
+			result = append(result, row)
+		}
+	}
+	return result
+}
+
+func (dao *MongoWebhookDeliveryDao) Get(id string) (*WebhookDelivery, error) {
+	collection := dao.client.Database(dao.db).Collection(tableWebhookDeliveries)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dbResult := collection.FindOne(ctx, bson.M{"id": id})
+	if dbResult.Err() != nil {
+		log.Error(dbResult.Err())
+		return nil, dbResult.Err()
+	}
+	var row WebhookDelivery
+	err := dbResult.Decode(&row)
+	if err != nil && err != mongo.ErrNoDocuments {
+		log.Error(err)
+		return nil, err
+	}
+	if err != nil && err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return &row, nil
+}
+
+func (dao *MongoWebhookDeliveryDao) Save(d *WebhookDelivery) error {
+	collection := dao.client.Database(dao.db).Collection(tableWebhookDeliveries)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := collection.ReplaceOne(ctx, bson.M{"id": d.Id}, d, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (dao *MongoWebhookDeliveryDao) Claim(d *WebhookDelivery, until time.Time) bool {
+	collection := dao.client.Database(dao.db).Collection(tableWebhookDeliveries)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	filter := bson.M{"id": d.Id, "status": webhookStatusPending, "next_attempt": d.NextAttempt}
+	if d.NextAttempt.IsZero() {
+		// deliveries recorded before next attempts were scheduled
+		delete(filter, "next_attempt")
+		filter["$or"] = []bson.M{{"next_attempt": bson.M{"$exists": false}}, {"next_attempt": d.NextAttempt}}
+	}
+	result, err := collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"next_attempt": until}})
+	if err != nil {
+		log.Error("Error while claiming webhook delivery [", d.Id, "]: ", err)
+		return false
+	}
+	if result.ModifiedCount == 0 {
+		return false
+	}
+	d.NextAttempt = until
+	return true
+}
@@ -0,0 +1,162 @@
+package tabusus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryWebhookDao keeps deliveries in memory, Claim has the semantics of the Mongo implementation
+type memoryWebhookDao struct {
+	deliveries map[string]WebhookDelivery
+	mutex      sync.Mutex
+}
+
+func newMemoryWebhookDao() *memoryWebhookDao {
+	return &memoryWebhookDao{deliveries: map[string]WebhookDelivery{}}
+}
+
+func (dao *memoryWebhookDao) List(status string, limit int) []WebhookDelivery {
+	dao.mutex.Lock()
+	defer dao.mutex.Unlock()
+	var result []WebhookDelivery
+	for _, d := range dao.deliveries {
+		if status == "" || d.Status == status {
+			result = append(result, d)
+		}
+	}
+	return result
+}
+
+func (dao *memoryWebhookDao) Get(id string) (*WebhookDelivery, error) {
+	dao.mutex.Lock()
+	defer dao.mutex.Unlock()
+	if d, ok := dao.deliveries[id]; ok {
+		return &d, nil
+	}
+	return nil, nil
+}
+
+func (dao *memoryWebhookDao) Save(d *WebhookDelivery) error {
+	dao.mutex.Lock()
+	defer dao.mutex.Unlock()
+	dao.deliveries[d.Id] = *d
+	return nil
+}
+
+func (dao *memoryWebhookDao) Claim(d *WebhookDelivery, until time.Time) bool {
+	dao.mutex.Lock()
+	defer dao.mutex.Unlock()
+	stored, ok := dao.deliveries[d.Id]
+	if !ok || stored.Status != webhookStatusPending || !stored.NextAttempt.Equal(d.NextAttempt) {
+		return false
+	}
+	stored.NextAttempt = until
+	dao.deliveries[d.Id] = stored
+	d.NextAttempt = until
+	return true
+}
+
+func newTestWebhookDispatcher(dao WebhookDeliveryDao, subscribers ...*WebhookSubscriber) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		Subscribers:    subscribers,
+		dao:            dao,
+		queue:          make(chan *WebhookDelivery, 16),
+		client:         &http.Client{Timeout: 5 * time.Second},
+		maxAttempts:    3,
+		initialBackoff: 5 * time.Second,
+		maxBackoff:     time.Hour,
+		started:        true,
+		queued:         map[string]bool{},
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	sub := &WebhookSubscriber{Id: "test", Secret: "change-me"}
+	want := "sha256=7851be1ed4d642235cffc25a36acddcdadd82edeb10543d53abb913c9d3b991d"
+	if got := sub.sign([]byte(`{"event":"app.created"}`)); got != want {
+		t.Fatalf("sign() = %s, expected %s", got, want)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	d := newTestWebhookDispatcher(nil)
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 5 * time.Second},
+		{2, 10 * time.Second},
+		{3, 20 * time.Second},
+		{10, 2560 * time.Second},
+		{11, time.Hour},
+		{64, time.Hour},
+		{1000, time.Hour},
+		{1 << 30, time.Hour},
+	}
+	for _, test := range tests {
+		if got := d.backoff(test.attempts); got != test.want {
+			t.Errorf("backoff(%d) = %s, expected %s", test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestWebhookAttempt(t *testing.T) {
+	sub := &WebhookSubscriber{Id: "test", Secret: "change-me"}
+	var signatures []string
+	status := http.StatusInternalServerError
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signatures = append(signatures, r.Header.Get(headerWebhookSignature))
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	sub.Url = srv.URL
+	dao := newMemoryWebhookDao()
+	d := newTestWebhookDispatcher(dao, sub)
+	delivery := &WebhookDelivery{Id: "d1", Event: EventAppCreated, SubscriberId: sub.Id, Payload: `{"event":"app.created"}`, Status: webhookStatusPending}
+
+	d.attempt(delivery)
+	if delivery.Status != webhookStatusPending || delivery.LastStatusCode != status {
+		t.Fatalf("failed delivery must stay pending: %+v", delivery)
+	}
+	if wait := time.Until(delivery.NextAttempt); wait < 4*time.Second || wait > 5*time.Second {
+		t.Fatalf("next attempt in %s, expected the initial backoff", wait)
+	}
+	status = http.StatusNoContent
+	d.attempt(delivery)
+	if delivery.Status != webhookStatusDelivered || delivery.Attempts != 2 {
+		t.Fatalf("unexpected delivery %+v", delivery)
+	}
+	if len(signatures) != 2 || signatures[1] != sub.sign([]byte(delivery.Payload)) {
+		t.Fatalf("unexpected signatures %v", signatures)
+	}
+	if stored, _ := dao.Get("d1"); stored == nil || stored.Status != webhookStatusDelivered {
+		t.Fatalf("delivery is not saved: %+v", stored)
+	}
+}
+
+func TestWebhookSweepClaim(t *testing.T) {
+	dao := newMemoryWebhookDao()
+	due := time.Now().Add(-time.Second)
+	dao.Save(&WebhookDelivery{Id: "due", Status: webhookStatusPending, NextAttempt: due})
+	dao.Save(&WebhookDelivery{Id: "later", Status: webhookStatusPending, NextAttempt: time.Now().Add(time.Hour)})
+	dao.Save(&WebhookDelivery{Id: "delivered", Status: webhookStatusDelivered})
+	// two server instances sharing storage
+	d1, d2 := newTestWebhookDispatcher(dao), newTestWebhookDispatcher(dao)
+	d1.sweep()
+	d2.sweep()
+	d1.sweep()
+	if len(d1.queue) != 1 || len(d2.queue) != 0 {
+		t.Fatalf("delivery queued %d times by the first instance and %d times by the second", len(d1.queue), len(d2.queue))
+	}
+	if v := <-d1.queue; v.Id != "due" || !v.NextAttempt.After(time.Now()) {
+		t.Fatalf("unexpected delivery %+v", v)
+	}
+	// the lease has not expired, the second instance still leaves the delivery alone
+	d2.sweep()
+	if len(d2.queue) != 0 {
+		t.Fatal("claimed delivery is queued by another instance")
+	}
+}
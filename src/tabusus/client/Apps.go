@@ -0,0 +1,175 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Application statuses
+const (
+	StatusDisabled   int32 = 0
+	StatusActive     int32 = 1
+	StatusPending    int32 = 2 // waiting for approval
+	StatusSuspended  int32 = 3 // temporarily blocked, optionally until a date
+	StatusDeprecated int32 = 4 // still usable for verification but no new tokens are issued
+	StatusRevoked    int32 = 5 // permanently blocked, final
+)
+
+// Constraints restrict how an app may authenticate
+type Constraints struct {
+	AllowedCidrs     []string `json:"allowed_cidrs,omitempty"`     // client IP ranges, e.g. 10.0.0.0/8
+	TimeWindows      []string `json:"time_windows,omitempty"`      // UTC time windows, e.g. "Mon-Fri 08:00-18:00"
+	MaxTokenTtl      int64    `json:"max_token_ttl,omitempty"`     // maximum token lifetime in seconds
+	AllowedAudiences []string `json:"allowed_audiences,omitempty"` // audiences the app may request tokens for
+	AllowedScopes    []string `json:"allowed_scopes,omitempty"`    // scopes the app may request
+}
+
+// RateLimit of an app at authentication endpoints
+type RateLimit struct {
+	PerMinute int `json:"per_minute"`
+	Burst     int `json:"burst"`
+}
+
+// Fingerprints of a public key (lower-case hex)
+type Fingerprints struct {
+	Sha256 string `json:"sha256"`
+	Sha1   string `json:"sha1"`
+	Md5    string `json:"md5"`
+}
+
+// App is an application registered in Tabusus
+type App struct {
+	Id            string                 `json:"id"`
+	Status        int32                  `json:"status"`
+	StatusStr     string                 `json:"status_str"`
+	StatusKey     string                 `json:"status_key"` // e.g. "active"
+	Description   string                 `json:"description"`
+	PublicKey     string                 `json:"public_key"`
+	Owner         string                 `json:"owner,omitempty"`
+	Labels        map[string]string      `json:"labels,omitempty"`
+	Tags          []string               `json:"tags,omitempty"`
+	Fields        map[string]interface{} `json:"fields,omitempty"` // custom fields
+	Constraints   *Constraints           `json:"constraints,omitempty"`
+	RateLimit     *RateLimit             `json:"rate_limit,omitempty"`
+	Fingerprints  *Fingerprints          `json:"fingerprints,omitempty"`
+	TimeCreated   *time.Time             `json:"time_created,omitempty"`
+	TimeUpdated   *time.Time             `json:"time_updated,omitempty"`
+	KeyExpiry     *time.Time             `json:"key_expiry,omitempty"`
+	KeyValid      bool                   `json:"key_valid"` // key can currently be used for verification
+	SuspendReason string                 `json:"suspend_reason,omitempty"`
+	SuspendUntil  *time.Time             `json:"suspend_until,omitempty"`
+	KeyProven     *time.Time             `json:"key_proven,omitempty"` // time possession of the private key was proven
+}
+
+// AppInput is the data to create or update an app with, in the same format as records of exported apps
+type AppInput struct {
+	Id          string                 `json:"id"`
+	Status      int32                  `json:"status"`
+	Description string                 `json:"description"`
+	PublicKey   string                 `json:"public_key"`           // PEM or Base64-encoded DER
+	KeyExpiry   string                 `json:"key_expiry,omitempty"` // yyyy-mm-dd
+	Owner       string                 `json:"owner,omitempty"`
+	Labels      map[string]string      `json:"labels,omitempty"`
+	Tags        []string               `json:"tags,omitempty"`
+	Fields      map[string]interface{} `json:"fields,omitempty"`
+	Constraints *Constraints           `json:"constraints,omitempty"` // nil: keep current constraints
+	RateLimit   *RateLimit             `json:"rate_limit,omitempty"`  // nil: keep current rate limit
+
+	// Proof of possession of the private key of a new public key: a challenge (see Client.KeyChallenge) and its
+	// signature (see ProveKey), ignored if the public key does not change
+	KeyChallenge string `json:"key_challenge,omitempty"`
+	KeyProof     string `json:"key_proof,omitempty"`
+}
+
+// Input returns app's data as input to update the app with
+func (app *App) Input() AppInput {
+	in := AppInput{
+		Id:          app.Id,
+		Status:      app.Status,
+		Description: app.Description,
+		PublicKey:   app.PublicKey,
+		Owner:       app.Owner,
+		Labels:      app.Labels,
+		Tags:        app.Tags,
+		Fields:      app.Fields,
+		Constraints: app.Constraints,
+		RateLimit:   app.RateLimit,
+	}
+	if app.KeyExpiry != nil {
+		in.KeyExpiry = app.KeyExpiry.UTC().Format("2006-01-02")
+	}
+	return in
+}
+
+// ListApps lists apps matching a label selector (e.g. "env=prod,team!=legacy", empty: all apps) and having all tags
+func (c *Client) ListApps(ctx context.Context, selector string, tags []string) ([]App, error) {
+	query := url.Values{}
+	if selector != "" {
+		query.Set("selector", selector)
+	}
+	if len(tags) > 0 {
+		query.Set("tag", strings.Join(tags, ","))
+	}
+	var apps []App
+	_, err := c.call(ctx, request{method: http.MethodGet, path: "/api/v1/apps", query: query, retryOk: true}, &apps)
+	return apps, err
+}
+
+// GetApp returns an app, IsNotFound(err) is true if the app does not exist (or is in trash)
+func (c *Client) GetApp(ctx context.Context, id string) (*App, error) {
+	app := &App{}
+	if _, err := c.call(ctx, request{method: http.MethodGet, path: "/api/v1/apps/" + url.PathEscape(id), retryOk: true}, app); err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+// CreateApp creates an app, returns the app and true if it is waiting for approval
+func (c *Client) CreateApp(ctx context.Context, in AppInput) (*App, bool, error) {
+	app := &App{}
+	status, err := c.call(ctx, request{method: http.MethodPost, path: "/api/v1/apps", body: in}, app)
+	if err != nil {
+		return nil, false, err
+	}
+	return app, status == http.StatusAccepted, nil
+}
+
+// UpdateApp replaces an app's data, returns the app and true if its new public key is waiting for approval
+func (c *Client) UpdateApp(ctx context.Context, id string, in AppInput) (*App, bool, error) {
+	app := &App{}
+	status, err := c.call(ctx, request{method: http.MethodPut, path: "/api/v1/apps/" + url.PathEscape(id), body: in, retryOk: true}, app)
+	if err != nil {
+		return nil, false, err
+	}
+	return app, status == http.StatusAccepted, nil
+}
+
+// DeleteApp moves an app to trash
+func (c *Client) DeleteApp(ctx context.Context, id string) error {
+	_, err := c.call(ctx, request{method: http.MethodDelete, path: "/api/v1/apps/" + url.PathEscape(id), retryOk: true}, nil)
+	return err
+}
+
+// RotateKey replaces an app's public key (keyExpiry: yyyy-mm-dd, empty if the key never expires),
+// returns the app and true if the new key is waiting for approval
+func (c *Client) RotateKey(ctx context.Context, id, publicKey, keyExpiry string) (*App, bool, error) {
+	return c.RotateKeyWithProof(ctx, id, publicKey, keyExpiry, "", "")
+}
+
+// RotateKeyWithProof is RotateKey with a proof of possession of the new key's private key: a challenge (see
+// KeyChallenge) and its signature (see ProveKey), required if the server is configured so
+func (c *Client) RotateKeyWithProof(ctx context.Context, id, publicKey, keyExpiry, challenge, proof string) (*App, bool, error) {
+	app := &App{}
+	body := map[string]string{"public_key": publicKey, "key_expiry": keyExpiry}
+	if proof != "" {
+		body["key_challenge"], body["key_proof"] = challenge, proof
+	}
+	status, err := c.call(ctx, request{method: http.MethodPut, path: "/api/v1/apps/" + url.PathEscape(id) + "/key", body: body, retryOk: true}, app)
+	if err != nil {
+		return nil, false, err
+	}
+	return app, status == http.StatusAccepted, nil
+}
@@ -0,0 +1,171 @@
+// Package client is the Go client of Tabusus.
+//
+// It wraps the management API (applications and their keys, authenticated by an API access token) and the runtime
+// API (verification of app assertions, signed key bundles for offline verification). Package clienttest provides an
+// in-memory fake server to unit test integrations.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client calls a Tabusus server, it is safe for concurrent use
+type Client struct {
+	BaseUrl     string       // base URL of the server, e.g. https://tabusus.example.com
+	AccessToken string       // API access token (configured at api.access_tokens), required by the management API
+	HttpClient  *http.Client // HTTP client to use
+
+	// Failed requests (network errors, 429, 502, 503 and 504) are retried up to MaxRetries times (0: no retry)
+	// with exponential backoff between MinBackoff and MaxBackoff; Retry-After sent by the server is honoured.
+	// Requests that are not idempotent are retried only if the server rejected them without processing (429, 503).
+	MaxRetries int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// New creates a client with default settings
+func New(baseUrl, accessToken string) *Client {
+	return &Client{
+		BaseUrl:     strings.TrimSuffix(baseUrl, "/"),
+		AccessToken: accessToken,
+		HttpClient:  &http.Client{Timeout: 30 * time.Second},
+		MaxRetries:  3,
+		MinBackoff:  200 * time.Millisecond,
+		MaxBackoff:  5 * time.Second,
+	}
+}
+
+// apiResponse is the common format of API responses
+type apiResponse struct {
+	Status  int             `json:"status"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// request describes a request to send
+type request struct {
+	method  string
+	path    string
+	query   url.Values
+	body    interface{} // marshalled as JSON if not nil
+	header  http.Header
+	retryOk bool // request is idempotent and can be retried after any retriable failure
+}
+
+// backoff returns the delay before the given retry (starting from 0)
+func (c *Client) backoff(retry int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return retryAfter
+	}
+	d := c.MinBackoff << uint(retry)
+	if d <= 0 || d > c.MaxBackoff {
+		d = c.MaxBackoff
+	}
+	// full jitter, so that clients failing at the same time do not retry at the same time
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// send sends a request and returns the response with its body, retrying failed attempts
+func (c *Client) send(ctx context.Context, r request) (*http.Response, []byte, error) {
+	var body []byte
+	if r.body != nil {
+		var err error
+		if body, err = json.Marshal(r.body); err != nil {
+			return nil, nil, err
+		}
+	}
+	u := c.BaseUrl + r.path
+	if len(r.query) > 0 {
+		u += "?" + r.query.Encode()
+	}
+	httpClient := c.HttpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	for retry := 0; ; retry++ {
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+		req, err := http.NewRequest(r.method, u, reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		req = req.WithContext(ctx)
+		for k, v := range r.header {
+			req.Header[k] = v
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if c.AccessToken != "" {
+			req.Header.Set("Authorization", "Bearer "+c.AccessToken)
+		}
+		req.Header.Set("Accept", "application/json")
+
+		var respBody []byte
+		var retryAfter time.Duration
+		retriable := false
+		resp, err := httpClient.Do(req)
+		if err == nil {
+			respBody, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+			retriable = r.retryOk
+		} else {
+			switch resp.StatusCode {
+			case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+				retriable = true
+				if secs, e := strconv.Atoi(resp.Header.Get("Retry-After")); e == nil && secs > 0 {
+					retryAfter = time.Duration(secs) * time.Second
+				}
+			case http.StatusBadGateway, http.StatusGatewayTimeout:
+				retriable = r.retryOk
+			}
+		}
+		if !retriable || retry >= c.MaxRetries {
+			return resp, respBody, err
+		}
+		select {
+		case <-time.After(c.backoff(retry, retryAfter)):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// call sends a request to an endpoint responding in the common API format, decodes response's data into out (if
+// not nil) and returns the response's HTTP status. Returns *Error if the server rejected the request.
+func (c *Client) call(ctx context.Context, r request, out interface{}) (int, error) {
+	resp, body, err := c.send(ctx, r)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, newError(resp, body)
+	}
+	var result apiResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return resp.StatusCode, &Error{StatusCode: resp.StatusCode, Message: "invalid response: " + err.Error()}
+	}
+	if out != nil && len(result.Data) > 0 {
+		if err := json.Unmarshal(result.Data, out); err != nil {
+			return resp.StatusCode, &Error{StatusCode: resp.StatusCode, Message: "invalid response data: " + err.Error()}
+		}
+	}
+	return resp.StatusCode, nil
+}
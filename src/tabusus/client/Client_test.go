@@ -0,0 +1,199 @@
+package client_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+	"time"
+
+	"tabusus/client"
+	"tabusus/client/clienttest"
+)
+
+func testSigner(t *testing.T, alg string) crypto.Signer {
+	var signer crypto.Signer
+	var err error
+	switch alg {
+	case "RS256":
+		signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ES384":
+		signer, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "ES512":
+		signer, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case "EdDSA":
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func publicKeyPem(t *testing.T, pubKey crypto.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestAssertion(t *testing.T) {
+	srv := clienttest.NewServer()
+	defer srv.Close()
+	c := srv.Client()
+	ctx := context.Background()
+	for _, alg := range []string{"RS256", "ES256", "ES384", "ES512", "EdDSA"} {
+		t.Run(alg, func(t *testing.T) {
+			signer := testSigner(t, alg)
+			if got := client.Algorithm(signer.Public()); got != alg {
+				t.Fatalf("Algorithm() = %s, expected %s", got, alg)
+			}
+			appId := "app-" + alg
+			srv.AddApp(client.AppInput{Id: appId, Status: client.StatusActive, PublicKey: publicKeyPem(t, signer.Public())})
+			assertion, err := client.SignAssertion(signer, client.Assertion{AppId: appId, Audiences: []string{"orders"}, Scopes: []string{"read", "write"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// offline
+			keyOf := func(id, kid string) (crypto.PublicKey, error) {
+				if id != appId {
+					return nil, errors.New("unknown app")
+				}
+				return signer.Public(), nil
+			}
+			a, err := client.VerifyAssertion(assertion, keyOf, time.Now(), time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.AppId != appId || a.Alg != alg || len(a.Audiences) != 1 || len(a.Scopes) != 2 || a.Jti == "" {
+				t.Fatalf("unexpected assertion %+v", a)
+			}
+			if _, err := client.VerifyAssertion(assertion, keyOf, time.Now().Add(time.Hour), time.Minute); err == nil {
+				t.Fatal("expired assertion is accepted")
+			}
+			otherKey := func(string, string) (crypto.PublicKey, error) { return testSigner(t, "EdDSA").Public(), nil }
+			if _, err := client.VerifyAssertion(assertion, otherKey, time.Now(), time.Minute); err == nil {
+				t.Fatal("assertion is accepted with another key")
+			}
+
+			// at the server, then exchanged for an access token
+			v, err := c.Verify(ctx, assertion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.AppId != appId {
+				t.Fatalf("unexpected verification %+v", v)
+			}
+			assertion, _ = client.SignAssertion(signer, client.Assertion{AppId: appId, Audiences: []string{"orders"}})
+			token, err := c.Token(ctx, assertion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jwks, err := c.FetchJwks(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			at, err := client.VerifyAccessToken(token.AccessToken, jwks, time.Now(), time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if at.AppId != appId || !at.HasAudience("orders") || at.HasAudience("billing") {
+				t.Fatalf("unexpected access token %+v", at)
+			}
+		})
+	}
+}
+
+func TestFetchBundleKey(t *testing.T) {
+	srv := clienttest.NewServer()
+	defer srv.Close()
+	signer := testSigner(t, "EdDSA")
+	pubKey := publicKeyPem(t, signer.Public())
+	srv.AddApp(client.AppInput{Id: "active-app", Status: client.StatusActive, PublicKey: pubKey})
+	srv.AddApp(client.AppInput{Id: "disabled-app", Status: client.StatusDisabled, PublicKey: pubKey})
+	// bundle keys are public: no access token
+	c := client.New(srv.URL, "")
+	kid, _ := client.KeyFingerprint(signer.Public())
+	tests := []struct {
+		id       string
+		notFound bool
+	}{
+		{"active-app", false},
+		{"disabled-app", true},
+		{"unknown-app", true},
+	}
+	for _, test := range tests {
+		t.Run(test.id, func(t *testing.T) {
+			key, err := c.FetchBundleKey(context.Background(), test.id)
+			if test.notFound {
+				if !client.IsNotFound(err) {
+					t.Fatalf("expected not found, got [%v]", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key.AppId != test.id || key.Kid != kid || !key.IsValidAt(time.Now()) {
+				t.Fatalf("unexpected key %+v", key)
+			}
+		})
+	}
+}
+
+func TestToken(t *testing.T) {
+	srv := clienttest.NewServer()
+	defer srv.Close()
+	c := srv.Client()
+	signer := testSigner(t, "EdDSA")
+	pubKey := publicKeyPem(t, signer.Public())
+	srv.AddApp(client.AppInput{Id: "active-app", Status: client.StatusActive, PublicKey: pubKey})
+	srv.AddApp(client.AppInput{Id: "deprecated-app", Status: client.StatusDeprecated, PublicKey: pubKey})
+	used, _ := client.SignAssertion(signer, client.Assertion{AppId: "active-app"})
+	if _, err := c.Token(context.Background(), used); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		assertion string
+		code      string
+	}{
+		{"active app", signAssertion(t, signer, "active-app"), ""},
+		{"replayed assertion", used, client.CodeReplayed},
+		{"deprecated app", signAssertion(t, signer, "deprecated-app"), client.CodeTokensNotAllowed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := c.Token(context.Background(), test.assertion)
+			if test.code == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var e *client.Error
+			if !errors.As(err, &e) || e.Code != test.code {
+				t.Fatalf("expected error code [%s], got [%v]", test.code, err)
+			}
+		})
+	}
+}
+
+func signAssertion(t *testing.T, signer crypto.Signer, appId string) string {
+	assertion, err := client.SignAssertion(signer, client.Assertion{AppId: appId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return assertion
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrNotModified is returned when a conditionally fetched resource has not changed
+var ErrNotModified = errors.New("not modified")
+
+// Authentication failure codes returned by the runtime API (Error.Code)
+const (
+	CodeInvalidAssertion      = "invalid_assertion"
+	CodeUnknownApp            = "unknown_app"
+	CodeAppNotVerifiable      = "app_not_verifiable"
+	CodeInvalidSignature      = "invalid_signature"
+	CodeAssertionExpired      = "assertion_expired"
+	CodeRateLimited           = "rate_limited"
+	CodeIpNotAllowed          = "ip_not_allowed"
+	CodeOutsideTimeWindow     = "outside_time_window"
+	CodeTokenLifetimeExceeded = "token_lifetime_exceeded"
+	CodeAudienceNotAllowed    = "audience_not_allowed"
+	CodeScopeNotAllowed       = "scope_not_allowed"
+	CodeMissingSignature      = "missing_signature"
+	CodeSignatureExpired      = "signature_expired"
+	CodeReplayed              = "replayed"
+	CodeTokensNotAllowed      = "tokens_not_allowed"
+)
+
+// Error is returned when the server rejects a request
+type Error struct {
+	StatusCode int           // HTTP status
+	Message    string        // human readable message from the server
+	Code       string        // machine-readable code of authentication failures, e.g. "ip_not_allowed"
+	RetryAfter time.Duration // time to wait before retrying, if the server asked so
+}
+
+func (e *Error) Error() string {
+	msg := "tabusus: " + strconv.Itoa(e.StatusCode) + " " + e.Message
+	if e.Code != "" {
+		msg += " (" + e.Code + ")"
+	}
+	return msg
+}
+
+func newError(resp *http.Response, body []byte) *Error {
+	var result struct {
+		Message string `json:"message"`
+		Data    struct {
+			Error string `json:"error"`
+		} `json:"data"`
+	}
+	e := &Error{StatusCode: resp.StatusCode}
+	if json.Unmarshal(body, &result) == nil && result.Message != "" {
+		e.Message, e.Code = result.Message, result.Data.Error
+	} else {
+		e.Message = http.StatusText(resp.StatusCode)
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		e.RetryAfter = time.Duration(secs) * time.Second
+	}
+	return e
+}
+
+func hasStatus(err error, status int) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode == status
+}
+
+// IsNotFound checks if err reports that the requested resource does not exist
+func IsNotFound(err error) bool {
+	return hasStatus(err, http.StatusNotFound)
+}
+
+// IsUnauthorized checks if err reports that the client (or the app) failed to authenticate
+func IsUnauthorized(err error) bool {
+	return hasStatus(err, http.StatusUnauthorized)
+}
+
+// IsForbidden checks if err reports that an authenticated app is not allowed, e.g. by its usage constraints
+func IsForbidden(err error) bool {
+	return hasStatus(err, http.StatusForbidden)
+}
+
+// IsInvalid checks if err reports that submitted data is invalid
+func IsInvalid(err error) bool {
+	return hasStatus(err, http.StatusBadRequest) || hasStatus(err, http.StatusUnprocessableEntity)
+}
+
+// IsRateLimited checks if err reports that a rate limit has been exceeded
+func IsRateLimited(err error) bool {
+	return hasStatus(err, http.StatusTooManyRequests)
+}
+
+// IsUnavailable checks if err reports that the requested feature is not available on the server
+func IsUnavailable(err error) bool {
+	return hasStatus(err, http.StatusServiceUnavailable)
+}
@@ -0,0 +1,192 @@
+package client
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"tabusus/jws"
+	"time"
+)
+
+// Jwk is a public key in JWK format (RFC 7517)
+type Jwk = jws.Jwk
+
+// Jwks is a JWK set
+type Jwks = jws.Jwks
+
+// Assertion is a JWT signed by an app with its private key to prove its identity
+type Assertion = jws.Assertion
+
+// Algorithm returns the JWS algorithm used to sign with a key: RS256 for RSA, ES256/ES384/ES512 for ECDSA
+// (depending on the curve) and EdDSA for Ed25519
+func Algorithm(pubKey crypto.PublicKey) string {
+	return jws.Algorithm(pubKey)
+}
+
+// NewJwk converts a public key to JWK format
+func NewJwk(pubKey crypto.PublicKey, kid string) Jwk {
+	return jws.NewJwk(pubKey, kid)
+}
+
+// ParsePublicKey parses a PEM or Base64-encoded (DER, PKIX) public key
+func ParsePublicKey(data string) (crypto.PublicKey, error) {
+	data = strings.TrimSpace(data)
+	if !strings.HasPrefix(data, "-----BEGIN") {
+		data = "-----BEGIN PUBLIC KEY-----\n" + data + "\n-----END PUBLIC KEY-----"
+	}
+	block, _ := pem.Decode([]byte(data))
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("invalid public key data")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if Algorithm(key) == "" {
+		return nil, errors.New("unsupported public key type")
+	}
+	return key, nil
+}
+
+// KeyFingerprint returns the SHA-256 fingerprint of a public key (lower-case hex), which Tabusus uses as key id
+func KeyFingerprint(pubKey crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return "", err
+	}
+	sum := crypto.SHA256.New()
+	sum.Write(der)
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// SignAssertion signs an assertion with app's private key; IssuedAt, ExpiresAt (1 minute later) and Jti (random) are
+// filled in if not set
+func SignAssertion(signer crypto.Signer, a Assertion) (string, error) {
+	alg := Algorithm(signer.Public())
+	if alg == "" {
+		return "", errors.New("unsupported key type")
+	}
+	if a.IssuedAt.IsZero() {
+		a.IssuedAt = time.Now()
+	}
+	if a.ExpiresAt.IsZero() {
+		a.ExpiresAt = a.IssuedAt.Add(time.Minute)
+	}
+	if a.Jti == "" {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return "", err
+		}
+		a.Jti = hex.EncodeToString(id)
+	}
+	payload, err := json.Marshal(a.Claims())
+	if err != nil {
+		return "", err
+	}
+	header := map[string]interface{}{"alg": alg, "typ": "JWT"}
+	if a.Kid != "" {
+		header["kid"] = a.Kid
+	}
+	return jws.Sign(signer, header, payload)
+}
+
+// VerifyAssertion verifies an assertion offline: its signature against the public key returned by keyOf for the app
+// it claims to be from, and its validity period (with tolerated clock skew). Returns the verified assertion.
+func VerifyAssertion(token string, keyOf func(appId, kid string) (crypto.PublicKey, error), now time.Time, skew time.Duration) (*Assertion, error) {
+	a, signingInput, signature, err := jws.ParseAssertion(token)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, err := keyOf(a.AppId, a.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := jws.Verify(a.Alg, pubKey, signingInput, signature); err != nil {
+		return nil, err
+	}
+	if err := a.CheckTimes(now, skew); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+/*----------------------------------------------------------------------*/
+
+// TokenType is the JWS "typ" of access tokens issued by Tabusus (RFC 9068)
+const TokenType = "at+jwt"
+
+// AccessToken is a token issued by Tabusus to an app: a JWT signed with one of Tabusus' keys (see Jwks)
+type AccessToken struct {
+	Kid       string    // id of Tabusus' signing key
+	Issuer    string    // claim "iss"
+	AppId     string    // claim "sub" (also "client_id")
+	Audiences []string  // claim "aud"
+	Scopes    []string  // claim "scope" (space-separated)
+	IssuedAt  time.Time // claim "iat"
+	ExpiresAt time.Time // claim "exp"
+	Jti       string    // claim "jti"
+}
+
+// VerifyAccessToken verifies a token issued by Tabusus offline: its signature against Tabusus' keys and its validity
+// period (with tolerated clock skew). Issuer and audiences are not checked, callers should check them.
+func VerifyAccessToken(token string, keys *Jwks, now time.Time, skew time.Duration) (*AccessToken, error) {
+	header, payload, signingInput, signature, err := jws.Split(token)
+	if err != nil {
+		return nil, err
+	}
+	if header.Typ != TokenType {
+		return nil, errors.New("not an access token (typ: " + header.Typ + ")")
+	}
+	pubKey := keys.Key(header.Kid)
+	if pubKey == nil {
+		return nil, errors.New("unknown signing key [" + header.Kid + "]")
+	}
+	if err := jws.Verify(header.Alg, pubKey, signingInput, signature); err != nil {
+		return nil, err
+	}
+	var claims jws.Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.New("invalid token claims")
+	}
+	t := &AccessToken{Kid: header.Kid, Issuer: claims.Iss, AppId: claims.Sub, Scopes: strings.Fields(claims.Scope), Jti: claims.Jti}
+	if t.AppId == "" || claims.Exp == 0 {
+		return nil, errors.New("claims sub and exp are required")
+	}
+	t.ExpiresAt, t.IssuedAt = time.Unix(claims.Exp, 0), time.Unix(claims.Iat, 0)
+	if t.Audiences, err = claims.Audiences(); err != nil {
+		return nil, err
+	}
+	if now.After(t.ExpiresAt.Add(skew)) {
+		return nil, errors.New("token has expired")
+	}
+	if now.Add(skew).Before(t.IssuedAt) {
+		return nil, errors.New("token is issued in the future")
+	}
+	return t, nil
+}
+
+// SignAccessToken signs a token (used by fake servers in tests), Issuer, AppId and ExpiresAt are required
+func SignAccessToken(t *AccessToken, signer crypto.Signer, kid string) (string, error) {
+	claims := &jws.Claims{Iss: t.Issuer, Sub: t.AppId, ClientId: t.AppId, Scope: strings.Join(t.Scopes, " "), Iat: t.IssuedAt.Unix(), Exp: t.ExpiresAt.Unix(), Jti: t.Jti}
+	claims.SetAudiences(t.Audiences)
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	return jws.Sign(signer, map[string]interface{}{"alg": Algorithm(signer.Public()), "kid": kid, "typ": TokenType}, payload)
+}
+
+// HasAudience checks if the token is intended for an audience
+func (t *AccessToken) HasAudience(aud string) bool {
+	for _, a := range t.Audiences {
+		if a == aud {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// KeyChallenge is a challenge to prove possession of the private key of an app's new public key, see ProveKey
+type KeyChallenge struct {
+	Challenge string    `json:"challenge"`
+	AppId     string    `json:"app_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// KeyChallenge requests a challenge for proving possession of the private key of a new public key of an app (which
+// does not need to exist yet). Challenges can be used for one proof only.
+func (c *Client) KeyChallenge(ctx context.Context, id string) (*KeyChallenge, error) {
+	challenge := &KeyChallenge{}
+	if _, err := c.call(ctx, request{method: http.MethodGet, path: "/api/v1/apps/" + url.PathEscape(id) + "/key/challenge", retryOk: true}, challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// ProveKey signs a challenge with the private key, returns the proof (Base64-encoded signature) to submit with the
+// public key, see AppInput.KeyProof and RotateKeyWithProof. RSA keys sign with PKCS#1 v1.5 and ECDSA keys with ASN.1
+// signatures, both over SHA-256, Ed25519 keys sign the challenge itself: the same as
+// "openssl dgst -sha256 -sign" (or "openssl pkeyutl -sign -rawin" for Ed25519) does.
+func ProveKey(challenge string, signer crypto.Signer) (string, error) {
+	var signature []byte
+	var err error
+	switch signer.Public().(type) {
+	case ed25519.PublicKey:
+		signature, err = signer.Sign(rand.Reader, []byte(challenge), crypto.Hash(0))
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		digest := sha256.Sum256([]byte(challenge))
+		signature, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	default:
+		return "", errors.New("unsupported key type")
+	}
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// VerifyKeyProof verifies a proof created by ProveKey (RSA PSS and fixed-size r||s ECDSA signatures over SHA-256 are
+// also accepted) against the public key
+func VerifyKeyProof(pubKey crypto.PublicKey, challenge, proof string) error {
+	proof = strings.TrimRight(strings.Join(strings.Fields(proof), ""), "=")
+	signature, err := base64.RawStdEncoding.DecodeString(proof)
+	if err != nil {
+		if signature, err = base64.RawURLEncoding.DecodeString(proof); err != nil {
+			return errors.New("proof is not a valid Base64-encoded signature")
+		}
+	}
+	digest := sha256.Sum256([]byte(challenge))
+	ok := false
+	switch key := pubKey.(type) {
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(key, []byte(challenge), signature)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil ||
+			rsa.VerifyPSS(key, crypto.SHA256, digest[:], signature, nil) == nil
+	case *ecdsa.PublicKey:
+		var sig struct{ R, S *big.Int }
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) == 2*size {
+			sig.R, sig.S = new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+			ok = ecdsa.Verify(key, digest[:], sig.R, sig.S)
+		} else if rest, err := asn1.Unmarshal(signature, &sig); err == nil && len(rest) == 0 {
+			ok = ecdsa.Verify(key, digest[:], sig.R, sig.S)
+		}
+	default:
+		return errors.New("unsupported key type")
+	}
+	if !ok {
+		return errors.New("signature does not match the public key")
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"tabusus/jws"
+	"time"
+)
+
+// Verification is the result of a successful verification of an app assertion
+type Verification struct {
+	AppId     string    `json:"app"`
+	Audiences []string  `json:"audience"`
+	Scopes    []string  `json:"scope"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Verify verifies an app assertion (see SignAssertion) at the server, which also checks the app's status, usage
+// constraints and rate limit. Rejections are returned as *Error with Code set, e.g. CodeIpNotAllowed.
+// Note that the client IP checked against the app's constraints is the IP of the caller of this method.
+func (c *Client) Verify(ctx context.Context, assertion string) (*Verification, error) {
+	v := &Verification{}
+	if _, err := c.call(ctx, request{method: http.MethodPost, path: "/auth/verify", body: map[string]string{"assertion": assertion}}, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Token is an access token issued by the server, see Client.Token
+type Token struct {
+	AccessToken string    `json:"access_token"`
+	TokenType   string    `json:"token_type"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Audiences   []string  `json:"audience"`
+	Scopes      []string  `json:"scope"`
+}
+
+// Token exchanges an app assertion (see SignAssertion) for an access token signed by the server, for the audiences and
+// scopes of the assertion. Services verify tokens offline with the server's keys, see FetchJwks and VerifyAccessToken.
+// Each assertion can be exchanged once (CodeReplayed), only active apps get tokens (CodeTokensNotAllowed).
+func (c *Client) Token(ctx context.Context, assertion string) (*Token, error) {
+	t := &Token{}
+	if _, err := c.call(ctx, request{method: http.MethodPost, path: "/auth/token", body: map[string]string{"assertion": assertion}}, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// FetchJwks downloads the keys that sign access tokens (/.well-known/jwks.json), including keys about to be used and
+// retired keys whose tokens may still be valid
+func (c *Client) FetchJwks(ctx context.Context) (*Jwks, error) {
+	resp, body, err := c.send(ctx, request{method: http.MethodGet, path: "/.well-known/jwks.json", retryOk: true})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newError(resp, body)
+	}
+	jwks := &Jwks{}
+	if err := json.Unmarshal(body, jwks); err != nil {
+		return nil, errors.New("invalid JWK set: " + err.Error())
+	}
+	return jwks, nil
+}
+
+// RequestVerification is the result of a successful verification of a signed request
+type RequestVerification struct {
+	AppId      string     `json:"app"`
+	Kid        string     `json:"kid"`
+	Components []string   `json:"components"` // components covered by the signature
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+}
+
+// maxForwardedBody is the maximum body size the server accepts in VerifyRequest
+const maxForwardedBody = 1 << 20
+
+// VerifyRequest verifies the HTTP message signature of a request received from an app at the server, which also
+// checks nonces against replays and the app's allowed CIDRs against the request's RemoteAddr (not checked if
+// RemoteAddr is not an IP address). The request's body is read and restored. Rejections are returned as *Error with
+// Code set, e.g. CodeReplayed.
+func (c *Client) VerifyRequest(ctx context.Context, r *http.Request) (*RequestVerification, error) {
+	target := *r.URL
+	if !target.IsAbs() {
+		target.Scheme, target.Host = "http", r.Host
+		if r.TLS != nil {
+			target.Scheme = "https"
+		}
+	}
+	in := map[string]interface{}{"method": r.Method, "url": target.String()}
+	headers := map[string]string{}
+	for k, v := range r.Header {
+		headers[k] = strings.Join(v, ", ")
+	}
+	in["headers"] = headers
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil && net.ParseIP(host) != nil {
+		in["client_ip"] = host
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxForwardedBody+1))
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if len(body) > maxForwardedBody {
+			return nil, errors.New("request body is too large to be verified")
+		}
+		in["body"] = body
+	}
+	v := &RequestVerification{}
+	if _, err := c.call(ctx, request{method: http.MethodPost, path: "/auth/verify-request", body: in}, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+/*----------------------------------------------------------------------*/
+
+// BundleKey is the public key of an app that can currently be verified
+type BundleKey struct {
+	AppId     string     `json:"app"`
+	Kid       string     `json:"kid"` // SHA-256 fingerprint of the key
+	Alg       string     `json:"alg"` // key algorithm: RSA, ECDSA or Ed25519
+	PublicKey string     `json:"public_key"`
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+}
+
+// IsValidAt checks if the key is valid at a time
+func (k *BundleKey) IsValidAt(t time.Time) bool {
+	return (k.NotBefore == nil || !t.Before(*k.NotBefore)) && (k.NotAfter == nil || t.Before(*k.NotAfter))
+}
+
+// KeyBundle lists public keys of all apps that can be verified, for offline verification
+type KeyBundle struct {
+	Format    int         `json:"format"`
+	Version   int64       `json:"version"` // revision of the application registry the bundle was built from
+	IssuedAt  time.Time   `json:"iat"`
+	ExpiresAt time.Time   `json:"exp"` // the bundle must not be trusted after this time
+	Keys      []BundleKey `json:"keys"`
+}
+
+// Key returns the key of an app (nil if the app cannot be verified), kid is checked if not empty
+func (b *KeyBundle) Key(appId, kid string) *BundleKey {
+	for i := range b.Keys {
+		if b.Keys[i].AppId == appId && (kid == "" || b.Keys[i].Kid == kid) {
+			return &b.Keys[i]
+		}
+	}
+	return nil
+}
+
+// VerifyAssertion verifies an app assertion offline against the bundle's keys, see also VerifyAssertion
+func (b *KeyBundle) VerifyAssertion(token string, now time.Time, skew time.Duration) (*Assertion, error) {
+	if now.After(b.ExpiresAt) {
+		return nil, errors.New("key bundle has expired")
+	}
+	return VerifyAssertion(token, func(appId, kid string) (crypto.PublicKey, error) {
+		key := b.Key(appId, kid)
+		if key == nil || !key.IsValidAt(now) {
+			return nil, errors.New("application [" + appId + "] cannot be verified")
+		}
+		return ParsePublicKey(key.PublicKey)
+	}, now, skew)
+}
+
+// SignedKeyBundle is a KeyBundle signed by Tabusus, in JWS flattened JSON serialization (RFC 7515)
+type SignedKeyBundle struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// supportedBundleFormat is the latest bundle format this client understands
+const supportedBundleFormat = 1
+
+// Verify checks the bundle's signature with the server's signing keys (see FetchBundleJwks) and its validity,
+// returns the bundle's content
+func (s *SignedKeyBundle) Verify(keys *Jwks, now time.Time) (*KeyBundle, error) {
+	header, payload, signingInput, signature, err := jws.Split(s.Protected + "." + s.Payload + "." + s.Signature)
+	if err != nil {
+		return nil, err
+	}
+	pubKey := keys.Key(header.Kid)
+	if pubKey == nil {
+		return nil, errors.New("unknown bundle signing key [" + header.Kid + "]")
+	}
+	if err := jws.Verify(header.Alg, pubKey, signingInput, signature); err != nil {
+		return nil, errors.New("invalid bundle signature: " + err.Error())
+	}
+	bundle := &KeyBundle{}
+	if err := json.Unmarshal(payload, bundle); err != nil {
+		return nil, errors.New("invalid bundle content: " + err.Error())
+	}
+	if bundle.Format > supportedBundleFormat {
+		return nil, errors.New("unsupported bundle format")
+	}
+	if now.After(bundle.ExpiresAt) {
+		return nil, errors.New("key bundle has expired")
+	}
+	return bundle, nil
+}
+
+// SignKeyBundle signs a bundle (used by servers, and by fake servers in tests)
+func SignKeyBundle(bundle *KeyBundle, signer crypto.Signer, kid string) (*SignedKeyBundle, error) {
+	payload, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, err
+	}
+	token, err := jws.Sign(signer, map[string]interface{}{"alg": Algorithm(signer.Public()), "kid": kid, "typ": "tabusus-bundle+jws"}, payload)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(token, ".")
+	return &SignedKeyBundle{Protected: parts[0], Payload: parts[1], Signature: parts[2]}, nil
+}
+
+// FetchKeyBundle downloads the signed key bundle (no access token needed). If etag (returned by a previous call) is not empty and the bundle
+// has not changed since, ErrNotModified is returned. Returns the bundle and its ETag.
+func (c *Client) FetchKeyBundle(ctx context.Context, etag string) (*SignedKeyBundle, string, error) {
+	r := request{method: http.MethodGet, path: "/api/v1/bundle", retryOk: true}
+	if etag != "" {
+		r.header = http.Header{"If-None-Match": []string{etag}}
+	}
+	resp, body, err := c.send(ctx, r)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, etag, ErrNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", newError(resp, body)
+	}
+	bundle := &SignedKeyBundle{}
+	if err := json.Unmarshal(body, bundle); err != nil {
+		return nil, "", errors.New("invalid key bundle: " + err.Error())
+	}
+	return bundle, resp.Header.Get("ETag"), nil
+}
+
+// FetchBundleKey downloads the current key of an app as listed in key bundles (no access token needed). Returns an
+// error for which IsNotFound is true if the app does not exist or cannot currently be verified.
+func (c *Client) FetchBundleKey(ctx context.Context, id string) (*BundleKey, error) {
+	key := &BundleKey{}
+	if _, err := c.call(ctx, request{method: http.MethodGet, path: "/api/v1/bundle/keys/" + url.PathEscape(id), retryOk: true}, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// FetchBundleJwks downloads the keys that sign key bundles (no access token needed). Verifiers should pin these keys (e.g. in configuration)
+// rather than trusting keys downloaded along with bundles.
+func (c *Client) FetchBundleJwks(ctx context.Context) (*Jwks, error) {
+	resp, body, err := c.send(ctx, request{method: http.MethodGet, path: "/api/v1/bundle/jwks", retryOk: true})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newError(resp, body)
+	}
+	jwks := &Jwks{}
+	if err := json.Unmarshal(body, jwks); err != nil {
+		return nil, errors.New("invalid JWK set: " + err.Error())
+	}
+	return jwks, nil
+}
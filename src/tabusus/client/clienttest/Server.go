@@ -0,0 +1,622 @@
+// Package clienttest provides an in-memory fake Tabusus server, so that integrations using package client can be
+// unit tested without a real server:
+//
+//	srv := clienttest.NewServer()
+//	defer srv.Close()
+//	srv.AddApp(client.AppInput{Id: "my-app", Status: client.StatusActive, PublicKey: pubKeyPem})
+//	c := srv.Client()
+//
+// The fake implements the management API, verification of assertions and signed requests (signature, validity and
+// nonces only, constraints and rate limits are not enforced), access tokens (for active apps only, in exchange for
+// single-use assertions), signed key bundles and proofs of possession of new keys (challenges do not expire). Tokens
+// and bundles are signed with the same key (see Jwks). Failures can be injected with FailNext.
+package clienttest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"tabusus/client"
+	"tabusus/httpsig"
+	"time"
+)
+
+// AccessToken is the API access token accepted by fake servers
+const AccessToken = "clienttest-token"
+
+var statusKeys = map[int32]string{
+	client.StatusDisabled:   "disabled",
+	client.StatusActive:     "active",
+	client.StatusPending:    "pending",
+	client.StatusSuspended:  "suspended",
+	client.StatusDeprecated: "deprecated",
+	client.StatusRevoked:    "revoked",
+}
+
+var statusNames = map[int32]string{
+	client.StatusDisabled:   "Disabled",
+	client.StatusActive:     "Active",
+	client.StatusPending:    "Pending Approval",
+	client.StatusSuspended:  "Suspended",
+	client.StatusDeprecated: "Deprecated",
+	client.StatusRevoked:    "Revoked",
+}
+
+// Server is a fake Tabusus server backed by httptest.Server
+type Server struct {
+	URL string // base URL of the server
+
+	// RequireKeyProof makes the management API reject new keys without proof of possession
+	RequireKeyProof bool
+
+	server     *httptest.Server
+	apps       map[string]*client.App
+	revision   int64
+	signer     ed25519.PrivateKey
+	kid        string
+	failures   []int
+	nonces     *httpsig.MemoryReplayStore
+	challenges map[string]string // unused key challenges -> app id
+	mutex      sync.Mutex
+}
+
+// NewServer starts a fake server, which must be closed when done
+func NewServer() *Server {
+	_, signer, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	kid, _ := client.KeyFingerprint(signer.Public())
+	s := &Server{apps: map[string]*client.App{}, signer: signer, kid: kid, nonces: httpsig.NewMemoryReplayStore(), challenges: map[string]string{}}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.server.URL
+	return s
+}
+
+// Close shuts down the server
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Client returns a client of the server, with short backoff between retries
+func (s *Server) Client() *client.Client {
+	c := client.New(s.URL, AccessToken)
+	c.MinBackoff, c.MaxBackoff = time.Millisecond, 10*time.Millisecond
+	return c
+}
+
+// Jwks returns the keys that sign the server's key bundles
+func (s *Server) Jwks() *client.Jwks {
+	return &client.Jwks{Keys: []client.Jwk{client.NewJwk(s.signer.Public(), s.kid)}}
+}
+
+// FailNext makes the server respond to the next requests with the given HTTP statuses, one per request
+func (s *Server) FailNext(statuses ...int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failures = append(s.failures, statuses...)
+}
+
+// AddApp registers an app directly, bypassing validation of the management API
+func (s *Server) AddApp(in client.AppInput) *client.App {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	app := s.save(nil, in)
+	return copyApp(app)
+}
+
+// App returns a registered app, nil if not found
+func (s *Server) App(id string) *client.App {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if app := s.apps[id]; app != nil {
+		return copyApp(app)
+	}
+	return nil
+}
+
+func copyApp(app *client.App) *client.App {
+	v := *app
+	return &v
+}
+
+// save creates/updates an app from input, must be called with mutex held
+func (s *Server) save(app *client.App, in client.AppInput) *client.App {
+	now := time.Now().UTC()
+	if app == nil {
+		app = &client.App{Id: in.Id, TimeCreated: &now}
+	}
+	app.Status, app.StatusKey = in.Status, statusKeys[in.Status]
+	app.StatusStr = statusNames[in.Status]
+	app.Description, app.Owner, app.Labels, app.Tags, app.Fields = in.Description, in.Owner, in.Labels, in.Tags, in.Fields
+	if in.Constraints != nil {
+		app.Constraints = in.Constraints
+	}
+	if in.RateLimit != nil {
+		app.RateLimit = in.RateLimit
+	}
+	app.PublicKey, app.Fingerprints, app.KeyExpiry = strings.TrimSpace(in.PublicKey), nil, nil
+	if pubKey, err := client.ParsePublicKey(app.PublicKey); err == nil {
+		fp, _ := client.KeyFingerprint(pubKey)
+		app.Fingerprints = &client.Fingerprints{Sha256: fp}
+	}
+	if t, err := time.Parse("2006-01-02", in.KeyExpiry); err == nil {
+		app.KeyExpiry = &t
+	}
+	app.TimeUpdated = &now
+	app.KeyValid = isKeyValid(app, now)
+	s.apps[app.Id] = app
+	s.revision++
+	return app
+}
+
+func isKeyValid(app *client.App, now time.Time) bool {
+	return app.Fingerprints != nil && (app.KeyExpiry == nil || now.Before(*app.KeyExpiry)) &&
+		(app.Status == client.StatusActive || app.Status == client.StatusDeprecated)
+}
+
+/*----------------------------------------------------------------------*/
+
+func respond(w http.ResponseWriter, status int, message string, data interface{}) {
+	result := map[string]interface{}{"status": status, "message": message}
+	if data != nil {
+		result["data"] = data
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.failures) > 0 {
+		status := s.failures[0]
+		s.failures = s.failures[1:]
+		if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", "0")
+		}
+		respond(w, status, http.StatusText(status), nil)
+		return
+	}
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	if path == "/auth/verify" && r.Method == http.MethodPost {
+		s.verify(w, r)
+		return
+	}
+	if path == "/auth/token" && r.Method == http.MethodPost {
+		s.token(w, r)
+		return
+	}
+	if path == "/.well-known/jwks.json" && r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Jwks())
+		return
+	}
+	if path == "/auth/verify-request" && r.Method == http.MethodPost {
+		s.verifyRequest(w, r)
+		return
+	}
+	// key bundles are public
+	if path == "/api/v1/bundle" && r.Method == http.MethodGet {
+		s.bundle(w, r)
+		return
+	}
+	if path == "/api/v1/bundle/jwks" && r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Jwks())
+		return
+	}
+	if strings.HasPrefix(path, "/api/v1/bundle/keys/") && r.Method == http.MethodGet {
+		id := strings.TrimPrefix(path, "/api/v1/bundle/keys/")
+		if app := s.apps[id]; app != nil && isKeyValid(app, time.Now()) {
+			respond(w, http.StatusOK, "Ok", bundleKey(app))
+		} else {
+			respond(w, http.StatusNotFound, "Application ["+id+"] cannot be verified!", nil)
+		}
+		return
+	}
+	if !strings.HasPrefix(path, "/api/v1/") {
+		respond(w, http.StatusNotFound, "Not Found", nil)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+AccessToken {
+		respond(w, http.StatusUnauthorized, "Authentication required!", nil)
+		return
+	}
+	segments := strings.Split(strings.TrimPrefix(path, "/api/v1/"), "/")
+	switch {
+	case path == "/api/v1/apps" && r.Method == http.MethodGet:
+		s.listApps(w, r)
+	case path == "/api/v1/apps" && r.Method == http.MethodPost:
+		s.createApp(w, r)
+	case len(segments) == 2 && segments[0] == "apps":
+		s.app(w, r, segments[1])
+	case len(segments) == 3 && segments[0] == "apps" && segments[2] == "key" && r.Method == http.MethodPut:
+		s.rotateKey(w, r, segments[1])
+	case len(segments) == 4 && segments[0] == "apps" && segments[2] == "key" && segments[3] == "challenge" && r.Method == http.MethodGet:
+		s.keyChallenge(w, segments[1])
+	default:
+		respond(w, http.StatusNotFound, "Not Found", nil)
+	}
+}
+
+func (s *Server) listApps(w http.ResponseWriter, r *http.Request) {
+	// only exact matches "key=value" are supported in label selectors
+	var requirements []string
+	if selector := r.URL.Query().Get("selector"); selector != "" {
+		requirements = strings.Split(selector, ",")
+	}
+	var tags []string
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		tags = strings.Split(tag, ",")
+	}
+	result := []*client.App{}
+	for _, app := range s.apps {
+		if matches(app, requirements, tags) {
+			result = append(result, app)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Id < result[j].Id })
+	respond(w, http.StatusOK, "Ok", result)
+}
+
+func matches(app *client.App, requirements, tags []string) bool {
+	for _, req := range requirements {
+		kv := strings.SplitN(strings.TrimSpace(req), "=", 2)
+		if len(kv) != 2 || app.Labels[kv[0]] != kv[1] {
+			return false
+		}
+	}
+	for _, tag := range tags {
+		found := false
+		for _, t := range app.Tags {
+			found = found || t == strings.TrimSpace(tag)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func validateInput(in client.AppInput) string {
+	if in.Id == "" {
+		return "Invalid application id (must contains only a-z, 0-9, _, -)"
+	}
+	if _, err := client.ParsePublicKey(in.PublicKey); err != nil {
+		return "Error parsing Public Key data!"
+	}
+	if _, ok := statusKeys[in.Status]; !ok {
+		return "Invalid status [" + strconv.Itoa(int(in.Status)) + "]!"
+	}
+	if in.KeyExpiry != "" {
+		if _, err := time.Parse("2006-01-02", in.KeyExpiry); err != nil {
+			return "Invalid key expiry date (format yyyy-mm-dd)!"
+		}
+	}
+	return ""
+}
+
+func (s *Server) createApp(w http.ResponseWriter, r *http.Request) {
+	var in client.AppInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		respond(w, http.StatusBadRequest, "Invalid request body: "+err.Error(), nil)
+		return
+	}
+	if s.apps[in.Id] != nil {
+		respond(w, http.StatusUnprocessableEntity, "App ["+in.Id+"] already existed!", nil)
+		return
+	}
+	if msg := validateInput(in); msg != "" {
+		respond(w, http.StatusUnprocessableEntity, msg, nil)
+		return
+	}
+	proven, msg := s.checkKeyProof(in.Id, in.PublicKey, in.KeyChallenge, in.KeyProof)
+	if msg != "" {
+		respond(w, http.StatusUnprocessableEntity, msg, nil)
+		return
+	}
+	app := s.save(nil, in)
+	app.KeyProven = proven
+	respond(w, http.StatusCreated, "created", app)
+}
+
+func (s *Server) app(w http.ResponseWriter, r *http.Request, id string) {
+	app := s.apps[id]
+	if app == nil {
+		respond(w, http.StatusNotFound, "Application not found ["+id+"]!", nil)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		app.KeyValid = isKeyValid(app, time.Now())
+		respond(w, http.StatusOK, "Ok", app)
+	case http.MethodPut:
+		var in client.AppInput
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			respond(w, http.StatusBadRequest, "Invalid request body: "+err.Error(), nil)
+			return
+		}
+		in.Id = id
+		if msg := validateInput(in); msg != "" {
+			respond(w, http.StatusUnprocessableEntity, msg, nil)
+			return
+		}
+		if strings.TrimSpace(in.PublicKey) != app.PublicKey {
+			proven, msg := s.checkKeyProof(id, in.PublicKey, in.KeyChallenge, in.KeyProof)
+			if msg != "" {
+				respond(w, http.StatusUnprocessableEntity, msg, nil)
+				return
+			}
+			app.KeyProven = proven
+		}
+		respond(w, http.StatusOK, "updated", s.save(app, in))
+	case http.MethodDelete:
+		delete(s.apps, id)
+		s.revision++
+		respond(w, http.StatusOK, "Application ["+id+"] has been moved to trash.", nil)
+	default:
+		respond(w, http.StatusMethodNotAllowed, "Method Not Allowed", nil)
+	}
+}
+
+func (s *Server) rotateKey(w http.ResponseWriter, r *http.Request, id string) {
+	app := s.apps[id]
+	if app == nil {
+		respond(w, http.StatusNotFound, "Application not found ["+id+"]!", nil)
+		return
+	}
+	var req struct {
+		PublicKey    string `json:"public_key"`
+		KeyExpiry    string `json:"key_expiry"`
+		KeyChallenge string `json:"key_challenge"`
+		KeyProof     string `json:"key_proof"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respond(w, http.StatusBadRequest, "Invalid request body: "+err.Error(), nil)
+		return
+	}
+	in := app.Input()
+	in.PublicKey, in.KeyExpiry = req.PublicKey, req.KeyExpiry
+	if msg := validateInput(in); msg != "" {
+		respond(w, http.StatusUnprocessableEntity, msg, nil)
+		return
+	}
+	if strings.TrimSpace(req.PublicKey) == app.PublicKey {
+		respond(w, http.StatusUnprocessableEntity, "The new public key is the same as the current one!", nil)
+		return
+	}
+	proven, msg := s.checkKeyProof(id, req.PublicKey, req.KeyChallenge, req.KeyProof)
+	if msg != "" {
+		respond(w, http.StatusUnprocessableEntity, msg, nil)
+		return
+	}
+	app.KeyProven = proven
+	respond(w, http.StatusOK, "Public key of application ["+id+"] has been rotated successfully.", s.save(app, in))
+}
+
+func (s *Server) keyChallenge(w http.ResponseWriter, id string) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		respond(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	challenge := &client.KeyChallenge{
+		Challenge: "clienttest-key-challenge." + id + "." + hex.EncodeToString(nonce),
+		AppId:     id,
+		ExpiresAt: time.Now().Add(10 * time.Minute).UTC(),
+	}
+	s.challenges[challenge.Challenge] = id
+	respond(w, http.StatusOK, "Ok", challenge)
+}
+
+// checkKeyProof verifies the proof of possession of a new key, returns the time it has been proven (nil if no proof
+// was submitted) or error message
+func (s *Server) checkKeyProof(id, publicKey, challenge, proof string) (*time.Time, string) {
+	if proof == "" {
+		if s.RequireKeyProof {
+			return nil, "Proof of possession is required: sign a challenge with the private key and submit the signature!"
+		}
+		return nil, ""
+	}
+	if appId, ok := s.challenges[challenge]; !ok || appId != id {
+		return nil, "Invalid proof of possession: unknown or used challenge!"
+	}
+	pubKey, err := client.ParsePublicKey(publicKey)
+	if err != nil {
+		return nil, "Error parsing Public Key data!"
+	}
+	if err := client.VerifyKeyProof(pubKey, challenge, proof); err != nil {
+		return nil, "Invalid proof of possession: " + err.Error() + "!"
+	}
+	delete(s.challenges, challenge)
+	now := time.Now().UTC()
+	return &now, ""
+}
+
+// assertion verifies the assertion of a request, returns nil if it is rejected (the rejection has been sent)
+func (s *Server) assertion(w http.ResponseWriter, r *http.Request) *client.Assertion {
+	var req struct {
+		Assertion string `json:"assertion"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Assertion == "" {
+		respond(w, http.StatusBadRequest, "Parameter [assertion] is required!", map[string]string{"error": client.CodeInvalidAssertion})
+		return nil
+	}
+	now := time.Now()
+	code := client.CodeInvalidSignature
+	a, err := client.VerifyAssertion(req.Assertion, func(appId, kid string) (crypto.PublicKey, error) {
+		app := s.apps[appId]
+		if app == nil {
+			code = client.CodeUnknownApp
+			return nil, errors.New("application [" + appId + "] not found")
+		}
+		if !isKeyValid(app, now) {
+			code = client.CodeAppNotVerifiable
+			return nil, errors.New("application [" + appId + "] cannot be verified")
+		}
+		return client.ParsePublicKey(app.PublicKey)
+	}, now, time.Minute)
+	if err != nil {
+		if strings.Contains(err.Error(), "expired") {
+			code = client.CodeAssertionExpired
+		}
+		respond(w, http.StatusUnauthorized, err.Error(), map[string]string{"error": code})
+		return nil
+	}
+	return a
+}
+
+func (s *Server) verify(w http.ResponseWriter, r *http.Request) {
+	a := s.assertion(w, r)
+	if a == nil {
+		return
+	}
+	respond(w, http.StatusOK, "Ok", map[string]interface{}{
+		"app":        a.AppId,
+		"audience":   a.Audiences,
+		"scope":      a.Scopes,
+		"expires_at": a.ExpiresAt,
+	})
+}
+
+// TokenIssuer is the issuer of tokens of fake servers
+const TokenIssuer = "clienttest"
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	a := s.assertion(w, r)
+	if a == nil {
+		return
+	}
+	if app := s.apps[a.AppId]; app == nil || app.Status != client.StatusActive {
+		respond(w, http.StatusForbidden, "new tokens cannot be issued to application ["+a.AppId+"]", map[string]string{"error": client.CodeTokensNotAllowed})
+		return
+	}
+	if ok, _ := s.nonces.Use("jti:"+a.AppId+":"+a.Jti, a.ExpiresAt.Add(time.Minute)); !ok || a.Jti == "" {
+		respond(w, http.StatusConflict, "assertion ["+a.Jti+"] has already been used", map[string]string{"error": client.CodeReplayed})
+		return
+	}
+	now := time.Now().Truncate(time.Second)
+	t := &client.AccessToken{Issuer: TokenIssuer, AppId: a.AppId, Audiences: a.Audiences, Scopes: a.Scopes, IssuedAt: now, ExpiresAt: now.Add(time.Hour), Jti: strconv.FormatInt(now.UnixNano(), 36)}
+	token, err := client.SignAccessToken(t, s.signer, s.kid)
+	if err != nil {
+		respond(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	respond(w, http.StatusOK, "Ok", map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"expires_at":   t.ExpiresAt,
+		"app":          a.AppId,
+		"audience":     a.Audiences,
+		"scope":        a.Scopes,
+	})
+}
+
+func (s *Server) verifyRequest(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Method  string            `json:"method"`
+		Url     string            `json:"url"`
+		Headers map[string]string `json:"headers"`
+		Body    []byte            `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Method == "" || req.Url == "" {
+		respond(w, http.StatusBadRequest, "Parameters [method] and [url] are required!", map[string]string{"error": client.CodeInvalidSignature})
+		return
+	}
+	signed, err := http.NewRequest(req.Method, req.Url, bytes.NewReader(req.Body))
+	if err != nil {
+		respond(w, http.StatusBadRequest, "Parameter [url] must be an absolute URL!", map[string]string{"error": client.CodeInvalidSignature})
+		return
+	}
+	if len(req.Body) == 0 {
+		signed.Body, signed.ContentLength = http.NoBody, 0
+	}
+	for k, v := range req.Headers {
+		signed.Header.Set(k, v)
+	}
+	now := time.Now()
+	var app *client.App
+	verifier := &httpsig.Verifier{
+		Keys: func(_ *http.Request, sig *httpsig.Signature) (crypto.PublicKey, error) {
+			appId, kid := httpsig.SplitAppKeyId(sig.KeyId)
+			if app = s.apps[appId]; app == nil || !isKeyValid(app, now) || (kid != "" && kid != app.Fingerprints.Sha256) {
+				return nil, &httpsig.Error{Kind: httpsig.ErrUnknownKey, Reason: "application [" + appId + "] cannot be verified"}
+			}
+			return client.ParsePublicKey(app.PublicKey)
+		},
+		Nonces: httpsig.StoreNonces(s.nonces),
+	}
+	sig, err := verifier.Verify(signed)
+	if err != nil {
+		status, code := http.StatusUnauthorized, client.CodeInvalidSignature
+		switch {
+		case errors.Is(err, httpsig.ErrMissingSignature):
+			code = client.CodeMissingSignature
+		case errors.Is(err, httpsig.ErrUnknownKey):
+			code = client.CodeAppNotVerifiable
+		case errors.Is(err, httpsig.ErrExpired):
+			code = client.CodeSignatureExpired
+		case errors.Is(err, httpsig.ErrReplayed):
+			status, code = http.StatusConflict, client.CodeReplayed
+		}
+		respond(w, status, err.Error(), map[string]string{"error": code})
+		return
+	}
+	data := map[string]interface{}{"app": app.Id, "kid": app.Fingerprints.Sha256, "components": sig.Components}
+	if !sig.Expires.IsZero() {
+		data["expires_at"] = sig.Expires
+	}
+	respond(w, http.StatusOK, "Ok", data)
+}
+
+// bundleKey returns the bundle entry of an app
+func bundleKey(app *client.App) *client.BundleKey {
+	pubKey, _ := client.ParsePublicKey(app.PublicKey)
+	alg := map[string]string{"RS256": "RSA", "ES256": "ECDSA", "ES384": "ECDSA", "ES512": "ECDSA", "EdDSA": "Ed25519"}[client.Algorithm(pubKey)]
+	return &client.BundleKey{
+		AppId:     app.Id,
+		Kid:       app.Fingerprints.Sha256,
+		Alg:       alg,
+		PublicKey: app.PublicKey,
+		NotBefore: app.TimeUpdated,
+		NotAfter:  app.KeyExpiry,
+	}
+}
+
+func (s *Server) bundle(w http.ResponseWriter, r *http.Request) {
+	etag := `"` + strconv.FormatInt(s.revision, 10) + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	bundle := &client.KeyBundle{Format: 1, Version: s.revision, IssuedAt: now, ExpiresAt: now.Add(24 * time.Hour), Keys: []client.BundleKey{}}
+	for _, app := range s.apps {
+		if !isKeyValid(app, now) {
+			continue
+		}
+		bundle.Keys = append(bundle.Keys, *bundleKey(app))
+	}
+	sort.Slice(bundle.Keys, func(i, j int) bool { return bundle.Keys[i].AppId < bundle.Keys[j].AppId })
+	signed, err := client.SignKeyBundle(bundle, s.signer, s.kid)
+	if err != nil {
+		respond(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(signed)
+}
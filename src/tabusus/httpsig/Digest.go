@@ -0,0 +1,98 @@
+package httpsig
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+const HeaderContentDigest = "Content-Digest"
+
+// DefaultMaxBodySize is the maximum size of bodies whose digest Verifier checks, unless Verifier.MaxBodySize is set
+const DefaultMaxBodySize = 1 << 20
+
+// readBody reads a request's body and replaces it with an in-memory copy, so that it can be read again.
+// Bodies larger than maxSize bytes are rejected (no limit if maxSize is not positive).
+func readBody(r *http.Request, maxSize int64) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	var reader io.Reader = r.Body
+	if maxSize > 0 {
+		reader = io.LimitReader(r.Body, maxSize+1)
+	}
+	body, err := ioutil.ReadAll(reader)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && int64(len(body)) > maxSize {
+		return nil, errors.New("request body is larger than " + strconv.FormatInt(maxSize, 10) + " bytes")
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	return body, nil
+}
+
+// SetContentDigest sets header Content-Digest (sha-256) of a request's body
+func SetContentDigest(r *http.Request) error {
+	body, err := readBody(r, 0)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+	r.Header.Set(HeaderContentDigest, "sha-256="+serializeItem(sum[:]))
+	return nil
+}
+
+// VerifyContentDigest checks a request's body against header Content-Digest, at least one digest of a supported
+// algorithm (sha-256, sha-512) must be present and all of them must match. Bodies larger than maxBodySize bytes are
+// rejected (no limit if maxBodySize is not positive).
+func VerifyContentDigest(r *http.Request, maxBodySize int64) error {
+	value := r.Header.Get(HeaderContentDigest)
+	if value == "" {
+		return errors.New("header " + HeaderContentDigest + " is missing")
+	}
+	digests, err := parseDictionary(value)
+	if err != nil {
+		return errors.New("invalid " + HeaderContentDigest + " header: " + err.Error())
+	}
+	body, err := readBody(r, maxBodySize)
+	if err != nil {
+		return err
+	}
+	checked := false
+	for _, d := range digests {
+		expected, ok := d.item.([]byte)
+		if !ok || d.isList {
+			return errors.New("invalid " + HeaderContentDigest + " header")
+		}
+		var actual []byte
+		switch d.key {
+		case "sha-256":
+			sum := sha256.Sum256(body)
+			actual = sum[:]
+		case "sha-512":
+			sum := sha512.Sum512(body)
+			actual = sum[:]
+		default:
+			continue
+		}
+		if subtle.ConstantTimeCompare(expected, actual) != 1 {
+			return errors.New("content digest (" + d.key + ") does not match the body")
+		}
+		checked = true
+	}
+	if !checked {
+		return errors.New("no supported algorithm in " + HeaderContentDigest + " header (sha-256, sha-512)")
+	}
+	return nil
+}
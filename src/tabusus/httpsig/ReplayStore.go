@@ -0,0 +1,67 @@
+package httpsig
+
+import (
+	"sync"
+	"time"
+)
+
+// ReplayStore remembers nonces until they expire, so that a signature (or any other single-use value) is accepted
+// only once
+type ReplayStore interface {
+	// Use records a nonce until expireAt, returns false if it has already been recorded and has not expired yet
+	Use(nonce string, expireAt time.Time) (bool, error)
+}
+
+// StoreNonces returns a NonceFunc recording nonces of signatures in store, scoped by the app id of their keyid:
+//
+//	v := &httpsig.Verifier{Keys: keys, Nonces: httpsig.StoreNonces(httpsig.NewMemoryReplayStore())}
+func StoreNonces(store ReplayStore) NonceFunc {
+	return func(s *Signature, window time.Duration) error {
+		appId, _ := SplitAppKeyId(s.KeyId)
+		ok, err := store.Use(appId+":"+s.Nonce, time.Now().Add(window))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrReplayed
+		}
+		return nil
+	}
+}
+
+// MemoryReplayStore keeps nonces in memory, replays are detected per process only: verifiers running on several
+// instances need a shared store
+type MemoryReplayStore struct {
+	nonces    map[string]time.Time // nonce -> expiry
+	lastSweep time.Time
+	mutex     sync.Mutex
+}
+
+func NewMemoryReplayStore() *MemoryReplayStore {
+	return &MemoryReplayStore{nonces: map[string]time.Time{}, lastSweep: time.Now()}
+}
+
+func (s *MemoryReplayStore) Use(nonce string, expireAt time.Time) (bool, error) {
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sweep(now)
+	if expiry, ok := s.nonces[nonce]; ok && now.Before(expiry) {
+		return false, nil
+	}
+	s.nonces[nonce] = expireAt
+	return true, nil
+}
+
+// sweep removes expired nonces, at most once per minute
+func (s *MemoryReplayStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for k, expiry := range s.nonces {
+		if !now.Before(expiry) {
+			delete(s.nonces, k)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package httpsig
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryReplayStore(t *testing.T) {
+	s := NewMemoryReplayStore()
+	now := time.Now()
+	tests := []struct {
+		name     string
+		nonce    string
+		expireAt time.Time
+		want     bool
+	}{
+		{"first use", "a", now.Add(time.Minute), true},
+		{"replayed", "a", now.Add(time.Minute), false},
+		{"other nonce", "b", now.Add(time.Minute), true},
+		{"expired", "c", now.Add(-time.Second), true},
+		{"reused after expiry", "c", now.Add(time.Minute), true},
+		{"replayed after renewal", "c", now.Add(time.Minute), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ok, err := s.Use(test.nonce, test.expireAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != test.want {
+				t.Fatalf("Use(%q) = %v, expected %v", test.nonce, ok, test.want)
+			}
+		})
+	}
+}
+
+func TestMemoryReplayStoreSweep(t *testing.T) {
+	s := NewMemoryReplayStore()
+	s.Use("expired", time.Now().Add(-time.Second))
+	s.Use("valid", time.Now().Add(time.Hour))
+	s.lastSweep = time.Now().Add(-2 * time.Minute)
+	s.Use("new", time.Now().Add(time.Hour))
+	if _, ok := s.nonces["expired"]; ok || len(s.nonces) != 2 {
+		t.Fatalf("expired nonces are not swept: %v", s.nonces)
+	}
+}
+
+func TestMemoryReplayStoreConcurrentUse(t *testing.T) {
+	s := NewMemoryReplayStore()
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	accepted := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, _ := s.Use("nonce", time.Now().Add(time.Minute)); ok {
+				mutex.Lock()
+				accepted++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if accepted != 1 {
+		t.Fatalf("nonce accepted %d times", accepted)
+	}
+}
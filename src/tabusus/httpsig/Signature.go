@@ -0,0 +1,421 @@
+// Package httpsig implements HTTP Message Signatures (RFC 9421) for requests: signing with an app's private key and
+// verifying with its public key, along with Content-Digest (RFC 9530) of request bodies.
+//
+// Supported algorithms are rsa-pss-sha512, rsa-v1_5-sha256, ecdsa-p256-sha256, ecdsa-p384-sha384 and ed25519.
+// Supported components are derived components @method, @target-uri, @authority, @scheme, @request-target, @path
+// and @query, and header fields; component parameters are not supported.
+package httpsig
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Signature algorithms (HTTP Signature Algorithms registry)
+const (
+	AlgRsaPssSha512    = "rsa-pss-sha512"
+	AlgRsaV15Sha256    = "rsa-v1_5-sha256"
+	AlgEcdsaP256Sha256 = "ecdsa-p256-sha256"
+	AlgEcdsaP384Sha384 = "ecdsa-p384-sha384"
+	AlgEd25519         = "ed25519"
+)
+
+const (
+	HeaderSignature      = "Signature"
+	HeaderSignatureInput = "Signature-Input"
+)
+
+// DefaultComponents are the components covered by signatures created by Sign if none is specified
+var DefaultComponents = []string{"@method", "@authority", "@path", "@query", "content-digest", "date"}
+
+// Algorithm returns the default signature algorithm of a key, empty if the key is not supported
+func Algorithm(pubKey crypto.PublicKey) string {
+	switch key := pubKey.(type) {
+	case *rsa.PublicKey:
+		return AlgRsaPssSha512
+	case *ecdsa.PublicKey:
+		switch key.Curve.Params().BitSize {
+		case 256:
+			return AlgEcdsaP256Sha256
+		case 384:
+			return AlgEcdsaP384Sha384
+		}
+	case ed25519.PublicKey:
+		return AlgEd25519
+	}
+	return ""
+}
+
+func algorithmHash(alg string) crypto.Hash {
+	switch alg {
+	case AlgRsaPssSha512:
+		return crypto.SHA512
+	case AlgRsaV15Sha256, AlgEcdsaP256Sha256:
+		return crypto.SHA256
+	case AlgEcdsaP384Sha384:
+		return crypto.SHA384
+	}
+	return 0
+}
+
+// checkAlgorithm checks that alg can be used with the key
+func checkAlgorithm(alg string, pubKey crypto.PublicKey) error {
+	ok := false
+	switch key := pubKey.(type) {
+	case *rsa.PublicKey:
+		ok = alg == AlgRsaPssSha512 || alg == AlgRsaV15Sha256
+	case *ecdsa.PublicKey:
+		ok = (alg == AlgEcdsaP256Sha256 && key.Curve.Params().BitSize == 256) || (alg == AlgEcdsaP384Sha384 && key.Curve.Params().BitSize == 384)
+	case ed25519.PublicKey:
+		ok = alg == AlgEd25519
+	}
+	if !ok {
+		return errors.New("algorithm [" + alg + "] cannot be used with the key")
+	}
+	return nil
+}
+
+func signBase(signer crypto.Signer, alg string, base []byte) ([]byte, error) {
+	if err := checkAlgorithm(alg, signer.Public()); err != nil {
+		return nil, err
+	}
+	if alg == AlgEd25519 {
+		return signer.Sign(rand.Reader, base, crypto.Hash(0))
+	}
+	hash := algorithmHash(alg)
+	h := hash.New()
+	h.Write(base)
+	var opts crypto.SignerOpts = hash
+	if alg == AlgRsaPssSha512 {
+		opts = &rsa.PSSOptions{SaltLength: 64, Hash: hash}
+	}
+	signature, err := signer.Sign(rand.Reader, h.Sum(nil), opts)
+	if err != nil {
+		return nil, err
+	}
+	if key, ok := signer.Public().(*ecdsa.PublicKey); ok {
+		// signatures are fixed-size r||s instead of ASN.1 encoded
+		var sig struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(signature, &sig); err != nil {
+			return nil, err
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		sig.R.FillBytes(signature[:size])
+		sig.S.FillBytes(signature[size:])
+	}
+	return signature, nil
+}
+
+func verifyBase(pubKey crypto.PublicKey, alg string, base, signature []byte) error {
+	if err := checkAlgorithm(alg, pubKey); err != nil {
+		return err
+	}
+	if alg == AlgEd25519 {
+		if !ed25519.Verify(pubKey.(ed25519.PublicKey), base, signature) {
+			return errors.New("signature verification failed")
+		}
+		return nil
+	}
+	hash := algorithmHash(alg)
+	h := hash.New()
+	h.Write(base)
+	digest := h.Sum(nil)
+	switch key := pubKey.(type) {
+	case *rsa.PublicKey:
+		if alg == AlgRsaPssSha512 {
+			return rsa.VerifyPSS(key, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto, Hash: hash})
+		}
+		return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid ECDSA signature length")
+		}
+		r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("signature verification failed")
+		}
+		return nil
+	}
+	return errors.New("unsupported key type")
+}
+
+/*----------------------------------------------------------------------*/
+
+// requestAuthority returns the authority of a request: host (lower-case) and port if not the default one
+func requestAuthority(r *http.Request) string {
+	host := r.Host
+	if host == "" && r.URL != nil {
+		host = r.URL.Host
+	}
+	host = strings.ToLower(host)
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		if (port == "443" && requestScheme(r) == "https") || (port == "80" && requestScheme(r) == "http") {
+			return h
+		}
+	}
+	return host
+}
+
+func requestScheme(r *http.Request) string {
+	if r.URL != nil && r.URL.Scheme != "" {
+		return strings.ToLower(r.URL.Scheme)
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// componentValue returns the value of a covered component of a request
+func componentValue(r *http.Request, name string) (string, error) {
+	switch name {
+	case "@method":
+		return r.Method, nil
+	case "@authority":
+		return requestAuthority(r), nil
+	case "@scheme":
+		return requestScheme(r), nil
+	case "@target-uri":
+		return requestScheme(r) + "://" + requestAuthority(r) + r.URL.RequestURI(), nil
+	case "@request-target":
+		return r.URL.RequestURI(), nil
+	case "@path":
+		if path := r.URL.EscapedPath(); path != "" {
+			return path, nil
+		}
+		return "/", nil
+	case "@query":
+		return "?" + r.URL.RawQuery, nil
+	}
+	if strings.HasPrefix(name, "@") {
+		return "", errors.New("unsupported derived component [" + name + "]")
+	}
+	if name != strings.ToLower(name) {
+		return "", errors.New("component names must be lower-case [" + name + "]")
+	}
+	values, ok := r.Header[http.CanonicalHeaderKey(name)]
+	if !ok {
+		return "", errors.New("covered header [" + name + "] is missing")
+	}
+	trimmed := make([]string, len(values))
+	for i, v := range values {
+		trimmed[i] = strings.TrimSpace(v)
+	}
+	return strings.Join(trimmed, ", "), nil
+}
+
+// signatureBase builds the signature base of a request (RFC 9421, section 2.5)
+func signatureBase(r *http.Request, components []string, signatureParams string) ([]byte, error) {
+	var b strings.Builder
+	seen := map[string]bool{}
+	for _, name := range components {
+		if seen[name] {
+			return nil, errors.New("component [" + name + "] is covered more than once")
+		}
+		seen[name] = true
+		value, err := componentValue(r, name)
+		if err != nil {
+			return nil, err
+		}
+		b.WriteString(serializeString(name) + ": " + value + "\n")
+	}
+	b.WriteString(`"@signature-params": ` + signatureParams)
+	return []byte(b.String()), nil
+}
+
+/*----------------------------------------------------------------------*/
+
+// SignOptions are options of Sign
+type SignOptions struct {
+	Label      string        // signature label (default "sig1")
+	KeyId      string        // key identifier, e.g. the app id
+	Alg        string        // signature algorithm (default: derived from the key)
+	Components []string      // covered components (default: DefaultComponents)
+	Nonce      string        // nonce to prevent replays, a random one is generated if empty
+	Tag        string        // application-specific tag, optional
+	ExpiresIn  time.Duration // lifetime of the signature (0: no expires parameter)
+	Created    time.Time     // creation time (default: now)
+}
+
+// Sign signs a request: Date and Content-Digest (if covered) are set if missing, then Signature-Input and Signature
+// are added. The request's body is read to compute its digest and replaced by an in-memory copy.
+func Sign(r *http.Request, signer crypto.Signer, opts SignOptions) error {
+	label := opts.Label
+	if label == "" {
+		label = "sig1"
+	}
+	alg := opts.Alg
+	if alg == "" {
+		alg = Algorithm(signer.Public())
+	}
+	components := opts.Components
+	if len(components) == 0 {
+		components = DefaultComponents
+	}
+	created := opts.Created
+	if created.IsZero() {
+		created = time.Now()
+	}
+	nonce := opts.Nonce
+	if nonce == "" {
+		nonce = randomNonce()
+	}
+	for _, c := range components {
+		switch {
+		case c == "date" && r.Header.Get("Date") == "":
+			r.Header.Set("Date", created.UTC().Format(http.TimeFormat))
+		case c == "content-digest" && r.Header.Get(HeaderContentDigest) == "":
+			if err := SetContentDigest(r); err != nil {
+				return err
+			}
+		}
+	}
+	params := []param{{"created", created.Unix()}}
+	if opts.ExpiresIn > 0 {
+		params = append(params, param{"expires", created.Add(opts.ExpiresIn).Unix()})
+	}
+	params = append(params, param{"keyid", opts.KeyId}, param{"alg", alg}, param{"nonce", nonce})
+	if opts.Tag != "" {
+		params = append(params, param{"tag", opts.Tag})
+	}
+	signatureParams := serializeInnerList(components, params)
+	base, err := signatureBase(r, components, signatureParams)
+	if err != nil {
+		return err
+	}
+	signature, err := signBase(signer, alg, base)
+	if err != nil {
+		return err
+	}
+	r.Header.Add(HeaderSignatureInput, label+"="+signatureParams)
+	r.Header.Add(HeaderSignature, label+"="+serializeItem(signature))
+	return nil
+}
+
+/*----------------------------------------------------------------------*/
+
+// Signature is a signature of a request, parsed from headers Signature-Input and Signature
+type Signature struct {
+	Label      string
+	Components []string
+	Created    time.Time // zero if absent
+	Expires    time.Time // zero if absent
+	KeyId      string
+	Alg        string // empty if absent
+	Nonce      string
+	Tag        string
+
+	signature []byte
+	base      []byte
+}
+
+// Covers checks if a component is covered by the signature
+func (s *Signature) Covers(component string) bool {
+	for _, c := range s.Components {
+		if c == component {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify verifies the signature with a public key; if the signature has no alg parameter, the key's default
+// algorithm is used
+func (s *Signature) Verify(pubKey crypto.PublicKey) error {
+	alg := s.Alg
+	if alg == "" {
+		alg = Algorithm(pubKey)
+	}
+	return verifyBase(pubKey, alg, s.base, s.signature)
+}
+
+// Parse parses signatures of a request, ordered as in header Signature-Input
+func Parse(r *http.Request) ([]*Signature, error) {
+	inputs, err := parseDictionary(strings.Join(r.Header.Values(HeaderSignatureInput), ", "))
+	if err != nil {
+		return nil, errors.New("invalid " + HeaderSignatureInput + " header: " + err.Error())
+	}
+	signatures, err := parseDictionary(strings.Join(r.Header.Values(HeaderSignature), ", "))
+	if err != nil {
+		return nil, errors.New("invalid " + HeaderSignature + " header: " + err.Error())
+	}
+	signatureOf := map[string][]byte{}
+	for _, m := range signatures {
+		if data, ok := m.item.([]byte); ok && !m.isList {
+			signatureOf[m.key] = data
+		}
+	}
+	var result []*Signature
+	for _, m := range inputs {
+		if !m.isList {
+			return nil, errors.New("invalid " + HeaderSignatureInput + " header: signature [" + m.key + "] is not an inner list")
+		}
+		s := &Signature{Label: m.key, Components: m.list, signature: signatureOf[m.key]}
+		if s.signature == nil {
+			return nil, errors.New("signature [" + m.key + "] is missing in " + HeaderSignature + " header")
+		}
+		for _, p := range m.params {
+			var ok bool
+			switch p.name {
+			case "created", "expires":
+				var v int64
+				if v, ok = p.value.(int64); ok && p.name == "created" {
+					s.Created = time.Unix(v, 0)
+				} else if ok {
+					s.Expires = time.Unix(v, 0)
+				}
+			case "keyid":
+				s.KeyId, ok = p.value.(string)
+			case "alg":
+				s.Alg, ok = p.value.(string)
+			case "nonce":
+				s.Nonce, ok = p.value.(string)
+			case "tag":
+				s.Tag, ok = p.value.(string)
+			default:
+				ok = true
+			}
+			if !ok {
+				return nil, errors.New("invalid parameter [" + p.name + "] of signature [" + m.key + "]")
+			}
+		}
+		if s.base, err = signatureBase(r, s.Components, serializeInnerList(m.list, m.params)); err != nil {
+			return nil, errors.New("signature [" + m.key + "]: " + err.Error())
+		}
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+/*----------------------------------------------------------------------*/
+
+// AppKeyId returns the keyid apps sign requests with: the app id, optionally followed by ":" and the key id
+// (SHA-256 fingerprint of the app's public key)
+func AppKeyId(appId, kid string) string {
+	if kid == "" {
+		return appId
+	}
+	return appId + ":" + kid
+}
+
+// SplitAppKeyId splits a keyid into app id and key id (empty if not specified)
+func SplitAppKeyId(keyId string) (string, string) {
+	if i := strings.IndexByte(keyId, ':'); i >= 0 {
+		return keyId[:i], keyId[i+1:]
+	}
+	return keyId, ""
+}
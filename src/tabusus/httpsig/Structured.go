@@ -0,0 +1,283 @@
+package httpsig
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Minimal parser/serializer of Structured Field Values (RFC 8941), covering what HTTP message signatures need:
+// dictionaries whose members are inner lists of strings or byte sequences, with parameters.
+
+// param is a parameter of an item or inner list, value is string, int64, bool, token or []byte
+type param struct {
+	name  string
+	value interface{}
+}
+
+// token is a bare token value, serialized without quotes
+type token string
+
+// member is a member of a dictionary: an item or an inner list (of string items), with parameters
+type member struct {
+	key    string
+	item   interface{}
+	list   []string
+	isList bool
+	params []param
+}
+
+type sfParser struct {
+	s string
+	i int
+}
+
+func (p *sfParser) eof() bool {
+	return p.i >= len(p.s)
+}
+
+func (p *sfParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.s[p.i]
+}
+
+func (p *sfParser) skipSP() {
+	for !p.eof() && p.s[p.i] == ' ' {
+		p.i++
+	}
+}
+
+func (p *sfParser) skipOWS() {
+	for !p.eof() && (p.s[p.i] == ' ' || p.s[p.i] == '\t') {
+		p.i++
+	}
+}
+
+func isLcAlpha(c byte) bool {
+	return c >= 'a' && c <= 'z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (p *sfParser) key() (string, error) {
+	start := p.i
+	if c := p.peek(); !isLcAlpha(c) && c != '*' {
+		return "", errors.New("invalid key")
+	}
+	for !p.eof() {
+		c := p.s[p.i]
+		if !isLcAlpha(c) && !isDigit(c) && c != '_' && c != '-' && c != '.' && c != '*' {
+			break
+		}
+		p.i++
+	}
+	return p.s[start:p.i], nil
+}
+
+func (p *sfParser) str() (string, error) {
+	if p.peek() != '"' {
+		return "", errors.New("string expected")
+	}
+	p.i++
+	var b strings.Builder
+	for !p.eof() {
+		c := p.s[p.i]
+		p.i++
+		switch {
+		case c == '\\':
+			if p.eof() || (p.s[p.i] != '"' && p.s[p.i] != '\\') {
+				return "", errors.New("invalid escape in string")
+			}
+			b.WriteByte(p.s[p.i])
+			p.i++
+		case c == '"':
+			return b.String(), nil
+		case c < 0x20 || c > 0x7e:
+			return "", errors.New("invalid character in string")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", errors.New("unterminated string")
+}
+
+func (p *sfParser) bareItem() (interface{}, error) {
+	c := p.peek()
+	switch {
+	case c == '"':
+		return p.str()
+	case c == ':':
+		end := strings.IndexByte(p.s[p.i+1:], ':')
+		if end < 0 {
+			return nil, errors.New("unterminated byte sequence")
+		}
+		data, err := base64.StdEncoding.DecodeString(p.s[p.i+1 : p.i+1+end])
+		if err != nil {
+			return nil, errors.New("invalid byte sequence")
+		}
+		p.i += end + 2
+		return data, nil
+	case c == '?':
+		if p.i+1 < len(p.s) && (p.s[p.i+1] == '0' || p.s[p.i+1] == '1') {
+			p.i += 2
+			return p.s[p.i-1] == '1', nil
+		}
+		return nil, errors.New("invalid boolean")
+	case c == '-' || isDigit(c):
+		start := p.i
+		p.i++
+		for !p.eof() && isDigit(p.s[p.i]) {
+			p.i++
+		}
+		if !p.eof() && p.s[p.i] == '.' {
+			return nil, errors.New("decimals are not supported")
+		}
+		return strconv.ParseInt(p.s[start:p.i], 10, 64)
+	case c == '*' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+		start := p.i
+		for !p.eof() && strings.IndexByte(" ;,()\"=", p.s[p.i]) < 0 {
+			p.i++
+		}
+		return token(p.s[start:p.i]), nil
+	}
+	return nil, errors.New("invalid item")
+}
+
+func (p *sfParser) params() ([]param, error) {
+	var result []param
+	for p.peek() == ';' {
+		p.i++
+		p.skipSP()
+		name, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		var value interface{} = true
+		if p.peek() == '=' {
+			p.i++
+			if value, err = p.bareItem(); err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, param{name, value})
+	}
+	return result, nil
+}
+
+// innerList parses an inner list of string items, items must not have parameters
+func (p *sfParser) innerList() ([]string, error) {
+	if p.peek() != '(' {
+		return nil, errors.New("inner list expected")
+	}
+	p.i++
+	var items []string
+	for {
+		p.skipSP()
+		if p.peek() == ')' {
+			p.i++
+			return items, nil
+		}
+		item, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() == ';' {
+			return nil, errors.New("parameters of component identifiers are not supported")
+		}
+		items = append(items, item)
+		if c := p.peek(); c != ' ' && c != ')' {
+			return nil, errors.New("invalid inner list")
+		}
+	}
+}
+
+// parseDictionary parses a dictionary field value
+func parseDictionary(value string) ([]member, error) {
+	p := &sfParser{s: value}
+	var result []member
+	p.skipSP()
+	for !p.eof() {
+		key, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		m := member{key: key, item: true}
+		if p.peek() == '=' {
+			p.i++
+			if p.peek() == '(' {
+				m.isList = true
+				m.list, err = p.innerList()
+			} else {
+				m.item, err = p.bareItem()
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		if m.params, err = p.params(); err != nil {
+			return nil, err
+		}
+		result = append(result, m)
+		p.skipOWS()
+		if p.eof() {
+			break
+		}
+		if p.peek() != ',' {
+			return nil, errors.New("invalid dictionary")
+		}
+		p.i++
+		p.skipOWS()
+		if p.eof() {
+			return nil, errors.New("trailing comma in dictionary")
+		}
+	}
+	return result, nil
+}
+
+func serializeString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func serializeItem(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return serializeString(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case bool:
+		if v {
+			return "?1"
+		}
+		return "?0"
+	case token:
+		return string(v)
+	case []byte:
+		return ":" + base64.StdEncoding.EncodeToString(v) + ":"
+	}
+	return ""
+}
+
+func serializeParams(params []param) string {
+	var b strings.Builder
+	for _, p := range params {
+		b.WriteString(";" + p.name)
+		if v, ok := p.value.(bool); !ok || !v {
+			b.WriteString("=" + serializeItem(p.value))
+		}
+	}
+	return b.String()
+}
+
+// serializeInnerList serializes an inner list of strings with parameters
+func serializeInnerList(items []string, params []param) string {
+	quoted := make([]string, len(items))
+	for i, item := range items {
+		quoted[i] = serializeString(item)
+	}
+	return "(" + strings.Join(quoted, " ") + ")" + serializeParams(params)
+}
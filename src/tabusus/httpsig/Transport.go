@@ -0,0 +1,29 @@
+package httpsig
+
+import (
+	"crypto"
+	"net/http"
+)
+
+// Transport is an http.RoundTripper that signs outgoing requests, e.g. with an app's private key and its id as keyid
+type Transport struct {
+	Signer  crypto.Signer
+	Options SignOptions
+	Base    http.RoundTripper // default: http.DefaultTransport
+}
+
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the request
+	r = r.Clone(r.Context())
+	if err := Sign(r, t.Signer, t.Options); err != nil {
+		if r.Body != nil {
+			r.Body.Close()
+		}
+		return nil, err
+	}
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(r)
+}
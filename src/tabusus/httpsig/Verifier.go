@@ -0,0 +1,166 @@
+package httpsig
+
+import (
+	"crypto"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Verification failures, wrapped in *Error
+var (
+	ErrMissingSignature  = errors.New("request is not signed")
+	ErrInvalidSignature  = errors.New("invalid signature")
+	ErrUnknownKey        = errors.New("unknown key")
+	ErrExpired           = errors.New("signature has expired")
+	ErrComponentsMissing = errors.New("required components are not covered")
+	ErrReplayed          = errors.New("signature has been replayed")
+)
+
+// Error reports why a request's signature is rejected, Kind is one of the Err* values above
+type Error struct {
+	Kind   error
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return e.Kind.Error() + ": " + e.Reason
+}
+
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
+
+// KeyFunc returns the public key identified by a signature's keyid, or ErrUnknownKey (or another error) if there is none
+type KeyFunc func(r *http.Request, s *Signature) (crypto.PublicKey, error)
+
+// NonceFunc records a signature's nonce, returns ErrReplayed if it has been used within the given window
+type NonceFunc func(s *Signature, window time.Duration) error
+
+// Verifier verifies signatures of requests
+type Verifier struct {
+	Keys KeyFunc
+
+	// Components that must be covered (default: @method, @path and date); content-digest is also required if the
+	// request has a body
+	RequiredComponents []string
+	// Tolerated clock difference between signers and the verifier (default 1 minute)
+	MaxSkew time.Duration
+	// Maximum age of signatures, measured from their created parameter (default 5 minutes), signatures must have
+	// either created or date covered
+	MaxAge time.Duration
+	// Label of the signature to verify (default: the first signature of the request)
+	Label string
+	// Nonces, if not nil, is called to reject replayed signatures (see StoreNonces); signatures without nonce are
+	// rejected then
+	Nonces NonceFunc
+	// Maximum size in bytes of request bodies read to check their digest (default DefaultMaxBodySize)
+	MaxBodySize int64
+}
+
+var defaultRequiredComponents = []string{"@method", "@path", "date"}
+
+// Verify verifies the signature of a request, returns the verified signature or *Error
+func (v *Verifier) Verify(r *http.Request) (*Signature, error) {
+	now := time.Now()
+	if r.Header.Get(HeaderSignatureInput) == "" {
+		return nil, &Error{ErrMissingSignature, "headers " + HeaderSignatureInput + " and " + HeaderSignature + " are required"}
+	}
+	signatures, err := Parse(r)
+	if err != nil {
+		return nil, &Error{ErrInvalidSignature, err.Error()}
+	}
+	var s *Signature
+	for _, sig := range signatures {
+		if v.Label == "" || sig.Label == v.Label {
+			s = sig
+			break
+		}
+	}
+	if s == nil {
+		return nil, &Error{ErrMissingSignature, "signature [" + v.Label + "] not found"}
+	}
+	required := v.RequiredComponents
+	if len(required) == 0 {
+		required = defaultRequiredComponents
+	}
+	if r.ContentLength != 0 && r.Body != nil && r.Body != http.NoBody {
+		required = append(append([]string{}, required...), "content-digest")
+	}
+	for _, c := range required {
+		if !s.Covers(c) {
+			return nil, &Error{ErrComponentsMissing, "component [" + c + "] must be covered by the signature"}
+		}
+	}
+
+	skew, maxAge := v.MaxSkew, v.MaxAge
+	if skew <= 0 {
+		skew = time.Minute
+	}
+	if maxAge <= 0 {
+		maxAge = 5 * time.Minute
+	}
+	created := s.Created
+	if created.IsZero() {
+		if t, err := http.ParseTime(r.Header.Get("Date")); err == nil && s.Covers("date") {
+			created = t
+		} else {
+			return nil, &Error{ErrInvalidSignature, "signature has no created parameter and does not cover a valid date"}
+		}
+	}
+	if created.After(now.Add(skew)) {
+		return nil, &Error{ErrInvalidSignature, "signature is created in the future"}
+	}
+	if now.After(created.Add(maxAge + skew)) {
+		return nil, &Error{ErrExpired, "signature is older than " + maxAge.String()}
+	}
+	if !s.Expires.IsZero() && now.After(s.Expires.Add(skew)) {
+		return nil, &Error{ErrExpired, "signature expired at " + s.Expires.UTC().Format(time.RFC3339)}
+	}
+
+	pubKey, err := v.Keys(r, s)
+	if err != nil {
+		var e *Error
+		if errors.As(err, &e) {
+			return nil, err
+		}
+		if errors.Is(err, ErrUnknownKey) {
+			return nil, &Error{ErrUnknownKey, "key [" + s.KeyId + "]: " + err.Error()}
+		}
+		return nil, err
+	}
+	if err := s.Verify(pubKey); err != nil {
+		return nil, &Error{ErrInvalidSignature, err.Error()}
+	}
+	if s.Covers("content-digest") {
+		maxBodySize := v.MaxBodySize
+		if maxBodySize <= 0 {
+			maxBodySize = DefaultMaxBodySize
+		}
+		if err := VerifyContentDigest(r, maxBodySize); err != nil {
+			return nil, &Error{ErrInvalidSignature, err.Error()}
+		}
+	}
+	if v.Nonces != nil {
+		if s.Nonce == "" {
+			return nil, &Error{ErrInvalidSignature, "signature must have a nonce parameter"}
+		}
+		if err := v.Nonces(s, maxAge+2*skew); err != nil {
+			if errors.Is(err, ErrReplayed) {
+				return nil, &Error{ErrReplayed, "nonce [" + s.Nonce + "] has already been used"}
+			}
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func randomNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
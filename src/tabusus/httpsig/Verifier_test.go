@@ -0,0 +1,159 @@
+package httpsig
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSigners(t *testing.T) map[string]crypto.Signer {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]crypto.Signer{"Ed25519": edKey, "ECDSA": ecKey, "RSA": rsaKey}
+}
+
+func signedRequest(t *testing.T, signer crypto.Signer, body string, opts SignOptions) *http.Request {
+	r, err := http.NewRequest(http.MethodPost, "https://api.example.com/orders?id=1", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.KeyId == "" {
+		opts.KeyId = "my-app"
+	}
+	if err := Sign(r, signer, opts); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestVerify(t *testing.T) {
+	for name, signer := range testSigners(t) {
+		tests := []struct {
+			name    string
+			opts    SignOptions
+			tamper  func(r *http.Request)
+			maxBody int64
+			want    error
+		}{
+			{name: "good"},
+			{name: "tampered path", tamper: func(r *http.Request) { r.URL.Path = "/admin" }, want: ErrInvalidSignature},
+			{name: "tampered header", tamper: func(r *http.Request) { r.Header.Set("Date", time.Now().Add(time.Second).UTC().Format(http.TimeFormat)) }, want: ErrInvalidSignature},
+			{name: "expired", opts: SignOptions{Created: time.Now().Add(-time.Hour)}, want: ErrExpired},
+			{name: "expires parameter", opts: SignOptions{Created: time.Now().Add(-2 * time.Minute), ExpiresIn: time.Second}, want: ErrExpired},
+			{name: "created in the future", opts: SignOptions{Created: time.Now().Add(time.Hour)}, want: ErrInvalidSignature},
+			{name: "missing components", opts: SignOptions{Components: []string{"@method", "content-digest"}}, want: ErrComponentsMissing},
+			{name: "tampered body", tamper: func(r *http.Request) { r.Body = ioutil.NopCloser(strings.NewReader(`{"amount":1000}`)) }, want: ErrInvalidSignature},
+			{name: "body too large", maxBody: 4, want: ErrInvalidSignature},
+			{name: "unsigned", tamper: func(r *http.Request) { r.Header.Del(HeaderSignatureInput) }, want: ErrMissingSignature},
+		}
+		for _, test := range tests {
+			t.Run(name+"/"+test.name, func(t *testing.T) {
+				r := signedRequest(t, signer, `{"amount":10}`, test.opts)
+				if test.tamper != nil {
+					test.tamper(r)
+				}
+				v := &Verifier{
+					Keys:        func(r *http.Request, s *Signature) (crypto.PublicKey, error) { return signer.Public(), nil },
+					MaxBodySize: test.maxBody,
+				}
+				s, err := v.Verify(r)
+				if test.want == nil {
+					if err != nil {
+						t.Fatalf("unexpected error: %s", err)
+					}
+					if s.KeyId != "my-app" || !s.Covers("content-digest") {
+						t.Fatalf("unexpected signature: %+v", s)
+					}
+					return
+				}
+				if !errors.Is(err, test.want) {
+					t.Fatalf("expected error [%s], got [%v]", test.want, err)
+				}
+			})
+		}
+	}
+}
+
+func TestVerifyReplayed(t *testing.T) {
+	_, signer, _ := ed25519.GenerateKey(rand.Reader)
+	v := &Verifier{
+		Keys:   func(r *http.Request, s *Signature) (crypto.PublicKey, error) { return signer.Public(), nil },
+		Nonces: StoreNonces(NewMemoryReplayStore()),
+	}
+	tests := []struct {
+		name string
+		opts SignOptions
+		want error
+	}{
+		{"first use", SignOptions{Nonce: "n1"}, nil},
+		{"replayed", SignOptions{Nonce: "n1"}, ErrReplayed},
+		{"other nonce", SignOptions{Nonce: "n2"}, nil},
+		{"same nonce, other app", SignOptions{Nonce: "n1", KeyId: "other-app"}, nil},
+		{"same nonce, key fingerprint in keyid", SignOptions{Nonce: "n2", KeyId: "my-app:abc"}, ErrReplayed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := v.Verify(signedRequest(t, signer, "", test.opts))
+			if test.want == nil && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if test.want != nil && !errors.Is(err, test.want) {
+				t.Fatalf("expected error [%s], got [%v]", test.want, err)
+			}
+		})
+	}
+}
+
+func TestContentDigest(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		digest  string // empty: computed from body
+		maxBody int64
+		wantErr bool
+	}{
+		{name: "sha-256", body: "hello"},
+		{name: "empty body", body: ""},
+		{name: "sha-512", body: "hello", digest: "sha-512=:m3HSJL1i83hdltRq0+o9czGb+8KJDKra4t/3JRlnPKcjI8PZm6XBHXx6zG4UuMXaDEZjR1wuXDre9G9zvN7AQw==:"},
+		{name: "mismatch", body: "hello", digest: "sha-256=:zgYJL7lI2f+sfRo3bkBLJrdXW8wR7gWkYV/vT+w6MIs=:", wantErr: true},
+		{name: "unsupported algorithm only", body: "hello", digest: "md5=:XUFAKrxLKna5cZ2REBfFkg==:", wantErr: true},
+		{name: "malformed", body: "hello", digest: "sha-256=abc", wantErr: true},
+		{name: "too large", body: "hello", maxBody: 4, wantErr: true},
+		{name: "limit", body: "hello", maxBody: 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodPost, "https://example.com/", strings.NewReader(test.body))
+			if test.digest == "" {
+				if err := SetContentDigest(r); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				r.Header.Set(HeaderContentDigest, test.digest)
+			}
+			err := VerifyContentDigest(r, test.maxBody)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("expected error: %v, got [%v]", test.wantErr, err)
+			}
+		})
+	}
+}
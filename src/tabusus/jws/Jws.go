@@ -0,0 +1,410 @@
+// Package jws implements the JSON Web Signatures (RFC 7515) shared by Tabusus and its client: signing and verifying
+// JWS in compact serialization, public keys in JWK format (RFC 7517) and assertions apps sign with their keys.
+// It depends on the standard library only.
+package jws
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var b64 = base64.RawURLEncoding
+
+const (
+	ktyRsa = "RSA"
+	ktyEc  = "EC"
+	ktyOkp = "OKP"
+)
+
+// algorithms maps JWS algorithms to the key type, curve (EC keys) and hash they use
+var algorithms = map[string]struct {
+	kty   string
+	curve string
+	hash  crypto.Hash
+	pss   bool
+}{
+	"RS256": {ktyRsa, "", crypto.SHA256, false},
+	"RS384": {ktyRsa, "", crypto.SHA384, false},
+	"RS512": {ktyRsa, "", crypto.SHA512, false},
+	"PS256": {ktyRsa, "", crypto.SHA256, true},
+	"PS384": {ktyRsa, "", crypto.SHA384, true},
+	"PS512": {ktyRsa, "", crypto.SHA512, true},
+	"ES256": {ktyEc, "P-256", crypto.SHA256, false},
+	"ES384": {ktyEc, "P-384", crypto.SHA384, false},
+	"ES512": {ktyEc, "P-521", crypto.SHA512, false},
+	"EdDSA": {ktyOkp, "Ed25519", 0, false},
+}
+
+// Algorithm returns the JWS algorithm used to sign with a key: RS256 for RSA, ES256/ES384/ES512 for ECDSA
+// (depending on the curve) and EdDSA for Ed25519; empty if the key is not supported
+func Algorithm(pubKey crypto.PublicKey) string {
+	switch key := pubKey.(type) {
+	case *rsa.PublicKey:
+		return "RS256"
+	case *ecdsa.PublicKey:
+		switch key.Curve.Params().Name {
+		case "P-256":
+			return "ES256"
+		case "P-384":
+			return "ES384"
+		case "P-521":
+			return "ES512"
+		}
+	case ed25519.PublicKey:
+		return "EdDSA"
+	}
+	return ""
+}
+
+// Sign signs a payload, returns the JWS in compact serialization; the header must include "alg"
+func Sign(signer crypto.Signer, header map[string]interface{}, payload []byte) (string, error) {
+	alg, _ := header["alg"].(string)
+	spec, ok := algorithms[alg]
+	if !ok {
+		return "", errors.New("unsupported algorithm [" + alg + "]")
+	}
+	headerData, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	signingInput := b64.EncodeToString(headerData) + "." + b64.EncodeToString(payload)
+	var signature []byte
+	if spec.kty == ktyOkp {
+		signature, err = signer.Sign(rand.Reader, []byte(signingInput), crypto.Hash(0))
+	} else {
+		h := spec.hash.New()
+		h.Write([]byte(signingInput))
+		var opts crypto.SignerOpts = spec.hash
+		if spec.pss {
+			opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: spec.hash}
+		}
+		signature, err = signer.Sign(rand.Reader, h.Sum(nil), opts)
+	}
+	if err != nil {
+		return "", err
+	}
+	if key, ok := signer.Public().(*ecdsa.PublicKey); ok {
+		// JWS uses fixed-size r||s instead of ASN.1 encoded ECDSA signatures
+		var sig struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(signature, &sig); err != nil {
+			return "", err
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		sig.R.FillBytes(signature[:size])
+		sig.S.FillBytes(signature[size:])
+	}
+	return signingInput + "." + b64.EncodeToString(signature), nil
+}
+
+// Verify verifies signature of a JWS (signing input is "header.payload") with the specified algorithm and public key.
+// The key must be of the algorithm's type, ECDSA keys must also be on the algorithm's curve.
+func Verify(alg string, pubKey crypto.PublicKey, signingInput, signature []byte) error {
+	spec, ok := algorithms[alg]
+	if !ok {
+		return errors.New("unsupported algorithm [" + alg + "]")
+	}
+	mismatch := errors.New("algorithm [" + alg + "] does not match the key")
+	switch key := pubKey.(type) {
+	case ed25519.PublicKey:
+		if spec.kty != ktyOkp {
+			return mismatch
+		}
+		if !ed25519.Verify(key, signingInput, signature) {
+			return errors.New("signature verification failed")
+		}
+		return nil
+	case *rsa.PublicKey:
+		if spec.kty != ktyRsa {
+			return mismatch
+		}
+		h := spec.hash.New()
+		h.Write(signingInput)
+		if spec.pss {
+			return rsa.VerifyPSS(key, spec.hash, h.Sum(nil), signature, nil)
+		}
+		return rsa.VerifyPKCS1v15(key, spec.hash, h.Sum(nil), signature)
+	case *ecdsa.PublicKey:
+		if spec.kty != ktyEc || key.Curve.Params().Name != spec.curve {
+			return mismatch
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid ECDSA signature length")
+		}
+		h := spec.hash.New()
+		h.Write(signingInput)
+		r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, h.Sum(nil), r, s) {
+			return errors.New("signature verification failed")
+		}
+		return nil
+	}
+	return errors.New("unsupported key type")
+}
+
+// Header is the protected header of JWS produced by Tabusus and apps
+type Header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// Split decodes a JWS in compact serialization without verifying it, returns its header, payload, signing input and
+// signature
+func Split(token string) (*Header, []byte, []byte, []byte, error) {
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return nil, nil, nil, nil, errors.New("not a JWS in compact serialization")
+	}
+	header := &Header{}
+	headerData, err := b64.DecodeString(parts[0])
+	if err == nil {
+		err = json.Unmarshal(headerData, header)
+	}
+	if err != nil {
+		return nil, nil, nil, nil, errors.New("invalid JWS header")
+	}
+	payload, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, nil, nil, errors.New("invalid JWS payload encoding")
+	}
+	signature, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, nil, nil, errors.New("invalid JWS signature encoding")
+	}
+	return header, payload, []byte(parts[0] + "." + parts[1]), signature, nil
+}
+
+/*----------------------------------------------------------------------*/
+
+// Jwk is a public key in JWK format (RFC 7517)
+type Jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// Jwks is a JWK set
+type Jwks struct {
+	Keys []Jwk `json:"keys"`
+}
+
+// NewJwk converts a public key to JWK format
+func NewJwk(pubKey crypto.PublicKey, kid string) Jwk {
+	jwk := Jwk{Kid: kid, Use: "sig", Alg: Algorithm(pubKey)}
+	switch key := pubKey.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = ktyRsa
+		jwk.N = b64.EncodeToString(key.N.Bytes())
+		jwk.E = b64.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		jwk.Kty, jwk.Crv = ktyEc, key.Curve.Params().Name
+		jwk.X = b64.EncodeToString(key.X.FillBytes(make([]byte, size)))
+		jwk.Y = b64.EncodeToString(key.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.Kty, jwk.Crv = ktyOkp, "Ed25519"
+		jwk.X = b64.EncodeToString(key)
+	}
+	return jwk
+}
+
+// PublicKey converts the JWK to a public key
+func (jwk Jwk) PublicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case ktyRsa:
+		n, err1 := b64.DecodeString(jwk.N)
+		e, err2 := b64.DecodeString(jwk.E)
+		if err1 != nil || err2 != nil || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case ktyEc:
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("unsupported curve [" + jwk.Crv + "]")
+		}
+		x, err1 := b64.DecodeString(jwk.X)
+		y, err2 := b64.DecodeString(jwk.Y)
+		if err1 != nil || err2 != nil {
+			return nil, errors.New("invalid EC key")
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("invalid EC key")
+		}
+		return key, nil
+	case ktyOkp:
+		x, err := b64.DecodeString(jwk.X)
+		if jwk.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid OKP key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, errors.New("unsupported key type [" + jwk.Kty + "]")
+}
+
+// Key returns the key with specified id, nil if not found or invalid
+func (s *Jwks) Key(kid string) crypto.PublicKey {
+	for _, jwk := range s.Keys {
+		if jwk.Kid == kid {
+			key, _ := jwk.PublicKey()
+			return key
+		}
+	}
+	return nil
+}
+
+/*----------------------------------------------------------------------*/
+
+// Claims are the JWT claims of assertions and access tokens
+type Claims struct {
+	Iss      string          `json:"iss"`
+	Sub      string          `json:"sub"`
+	ClientId string          `json:"client_id,omitempty"`
+	Aud      json.RawMessage `json:"aud,omitempty"`
+	Scope    string          `json:"scope,omitempty"`
+	Iat      int64           `json:"iat,omitempty"`
+	Nbf      int64           `json:"nbf,omitempty"`
+	Exp      int64           `json:"exp"`
+	Jti      string          `json:"jti,omitempty"`
+}
+
+// Audiences decodes claim "aud", which is either a string or an array of strings
+func (c *Claims) Audiences() ([]string, error) {
+	if len(c.Aud) == 0 {
+		return nil, nil
+	}
+	var aud string
+	if json.Unmarshal(c.Aud, &aud) == nil {
+		return []string{aud}, nil
+	}
+	var auds []string
+	if json.Unmarshal(c.Aud, &auds) != nil {
+		return nil, errors.New("claim aud must be a string or an array of strings")
+	}
+	return auds, nil
+}
+
+// SetAudiences encodes claim "aud": a string for a single audience, an array otherwise
+func (c *Claims) SetAudiences(audiences []string) {
+	c.Aud = nil
+	if len(audiences) == 1 {
+		c.Aud, _ = json.Marshal(audiences[0])
+	} else if len(audiences) > 1 {
+		c.Aud, _ = json.Marshal(audiences)
+	}
+}
+
+// Assertion is a JWT signed by an app with its private key to prove its identity.
+// Claims: "iss" and "sub" are the app id, "aud" (string or array), "scope" (space-separated), "iat", "nbf", "exp" and "jti".
+type Assertion struct {
+	Alg       string    // signature algorithm, set by ParseAssertion
+	Kid       string    // id of the signing key (SHA-256 fingerprint of the app's public key), optional
+	AppId     string    // claims "iss" and "sub"
+	Audiences []string  // claim "aud"
+	Scopes    []string  // claim "scope" (space-separated)
+	IssuedAt  time.Time // claim "iat"
+	NotBefore time.Time // claim "nbf", optional
+	ExpiresAt time.Time // claim "exp"
+	Jti       string    // claim "jti", unique id of the assertion
+}
+
+// Lifetime returns the requested lifetime of the assertion
+func (a *Assertion) Lifetime() time.Duration {
+	if a.IssuedAt.IsZero() {
+		return time.Until(a.ExpiresAt)
+	}
+	return a.ExpiresAt.Sub(a.IssuedAt)
+}
+
+// Claims returns the JWT claims of the assertion
+func (a *Assertion) Claims() *Claims {
+	claims := &Claims{Iss: a.AppId, Sub: a.AppId, Scope: strings.Join(a.Scopes, " "), Exp: a.ExpiresAt.Unix(), Jti: a.Jti}
+	if !a.IssuedAt.IsZero() {
+		claims.Iat = a.IssuedAt.Unix()
+	}
+	if !a.NotBefore.IsZero() {
+		claims.Nbf = a.NotBefore.Unix()
+	}
+	claims.SetAudiences(a.Audiences)
+	return claims
+}
+
+// ParseAssertion decodes an app assertion without verifying its signature, returns the assertion, the signing input
+// and the signature (see Verify)
+func ParseAssertion(token string) (*Assertion, []byte, []byte, error) {
+	header, payload, signingInput, signature, err := Split(token)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, nil, nil, errors.New("invalid assertion claims")
+	}
+	a := &Assertion{Alg: header.Alg, Kid: header.Kid, AppId: claims.Sub, Scopes: strings.Fields(claims.Scope), Jti: claims.Jti}
+	if a.AppId == "" {
+		a.AppId = claims.Iss
+	}
+	if claims.Iss != "" && claims.Iss != a.AppId {
+		return nil, nil, nil, errors.New("claims iss and sub must both be the application id")
+	}
+	if a.AppId == "" {
+		return nil, nil, nil, errors.New("claim sub (application id) is required")
+	}
+	if claims.Exp == 0 {
+		return nil, nil, nil, errors.New("claim exp is required")
+	}
+	a.ExpiresAt = time.Unix(claims.Exp, 0)
+	if claims.Iat > 0 {
+		a.IssuedAt = time.Unix(claims.Iat, 0)
+	}
+	if claims.Nbf > 0 {
+		a.NotBefore = time.Unix(claims.Nbf, 0)
+	}
+	if a.Audiences, err = claims.Audiences(); err != nil {
+		return nil, nil, nil, err
+	}
+	return a, signingInput, signature, nil
+}
+
+// CheckTimes checks the validity period of an assertion at time now, with tolerated clock skew
+func (a *Assertion) CheckTimes(now time.Time, skew time.Duration) error {
+	if now.After(a.ExpiresAt.Add(skew)) {
+		return errors.New("assertion has expired")
+	}
+	if !a.NotBefore.IsZero() && now.Add(skew).Before(a.NotBefore) {
+		return errors.New("assertion is not valid yet")
+	}
+	if !a.IssuedAt.IsZero() && now.Add(skew).Before(a.IssuedAt) {
+		return errors.New("assertion is issued in the future")
+	}
+	return nil
+}
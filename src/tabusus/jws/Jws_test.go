@@ -0,0 +1,185 @@
+package jws
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testKeys(t *testing.T) map[string]crypto.Signer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]crypto.Signer{"RSA": rsaKey}
+	for name, curve := range map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()} {
+		if keys[name], err = ecdsa.GenerateKey(curve, rand.Reader); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, keys["Ed25519"], err = ed25519.GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestSignVerify(t *testing.T) {
+	keys := testKeys(t)
+	tests := []struct {
+		alg     string
+		key     string
+		wantErr bool
+	}{
+		{"RS256", "RSA", false},
+		{"RS384", "RSA", false},
+		{"RS512", "RSA", false},
+		{"PS256", "RSA", false},
+		{"PS384", "RSA", false},
+		{"PS512", "RSA", false},
+		{"ES256", "P-256", false},
+		{"ES384", "P-384", false},
+		{"ES512", "P-521", false},
+		{"EdDSA", "Ed25519", false},
+		// algorithms must match the key type, and the curve for ECDSA
+		{"ES256", "P-384", true},
+		{"ES384", "P-256", true},
+		{"ES512", "P-256", true},
+		{"RS256", "P-256", true},
+		{"ES256", "RSA", true},
+		{"EdDSA", "RSA", true},
+		{"HS256", "RSA", true},
+		{"none", "Ed25519", true},
+	}
+	for _, test := range tests {
+		t.Run(test.alg+"/"+test.key, func(t *testing.T) {
+			signer := keys[test.key]
+			signAlg := test.alg
+			if _, ok := algorithms[signAlg]; !ok || test.wantErr {
+				// sign with the key's own algorithm, then verify with the one under test
+				signAlg = Algorithm(signer.Public())
+			}
+			token, err := Sign(signer, map[string]interface{}{"alg": signAlg, "kid": "k1"}, []byte(`{"sub":"my-app"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			header, payload, signingInput, signature, err := Split(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header.Alg != signAlg || header.Kid != "k1" || string(payload) != `{"sub":"my-app"}` {
+				t.Fatalf("unexpected header %+v or payload %s", header, payload)
+			}
+			err = Verify(test.alg, signer.Public(), signingInput, signature)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("expected error: %v, got [%v]", test.wantErr, err)
+			}
+			if err == nil {
+				// tampered payload
+				signingInput[len(signingInput)-1] ^= 1
+				if Verify(test.alg, signer.Public(), signingInput, signature) == nil {
+					t.Fatal("tampered payload is accepted")
+				}
+			}
+		})
+	}
+}
+
+func TestJwk(t *testing.T) {
+	for name, signer := range testKeys(t) {
+		t.Run(name, func(t *testing.T) {
+			data, err := json.Marshal(Jwks{Keys: []Jwk{NewJwk(signer.Public(), "k1")}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var jwks Jwks
+			if err := json.Unmarshal(data, &jwks); err != nil {
+				t.Fatal(err)
+			}
+			if jwks.Keys[0].Alg != Algorithm(signer.Public()) {
+				t.Fatalf("unexpected alg [%s]", jwks.Keys[0].Alg)
+			}
+			key := jwks.Key("k1")
+			if key == nil || jwks.Key("k2") != nil {
+				t.Fatal("key is not found by its id")
+			}
+			if !key.(interface{ Equal(crypto.PublicKey) bool }).Equal(signer.Public()) {
+				t.Fatal("key does not match after a round trip")
+			}
+		})
+	}
+}
+
+func TestParseAssertion(t *testing.T) {
+	_, signer, _ := ed25519.GenerateKey(rand.Reader)
+	now := time.Unix(time.Now().Unix(), 0)
+	sign := func(claims string) string {
+		token, err := Sign(signer, map[string]interface{}{"alg": "EdDSA", "typ": "JWT"}, []byte(claims))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	exp := now.Add(time.Minute).Unix()
+	tests := []struct {
+		name      string
+		token     string
+		audiences []string
+		wantErr   bool
+	}{
+		{"single audience", sign(`{"iss":"my-app","sub":"my-app","aud":"api","exp":` + strconv.FormatInt(exp, 10) + `}`), []string{"api"}, false},
+		{"audience list", sign(`{"sub":"my-app","aud":["api","admin"],"exp":` + strconv.FormatInt(exp, 10) + `}`), []string{"api", "admin"}, false},
+		{"iss only", sign(`{"iss":"my-app","exp":` + strconv.FormatInt(exp, 10) + `}`), nil, false},
+		{"iss and sub differ", sign(`{"iss":"other","sub":"my-app","exp":` + strconv.FormatInt(exp, 10) + `}`), nil, true},
+		{"no app id", sign(`{"exp":` + strconv.FormatInt(exp, 10) + `}`), nil, true},
+		{"no exp", sign(`{"sub":"my-app"}`), nil, true},
+		{"invalid aud", sign(`{"sub":"my-app","aud":1,"exp":` + strconv.FormatInt(exp, 10) + `}`), nil, true},
+		{"not a JWS", "abc.def", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, signingInput, signature, err := ParseAssertion(test.token)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("expected error: %v, got [%v]", test.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if a.AppId != "my-app" || a.Alg != "EdDSA" || !a.ExpiresAt.Equal(now.Add(time.Minute)) || len(a.Audiences) != len(test.audiences) {
+				t.Fatalf("unexpected assertion %+v", a)
+			}
+			if err := Verify(a.Alg, signer.Public(), signingInput, signature); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCheckTimes(t *testing.T) {
+	now := time.Now()
+	skew := time.Minute
+	tests := []struct {
+		name    string
+		a       Assertion
+		wantErr bool
+	}{
+		{"valid", Assertion{IssuedAt: now, ExpiresAt: now.Add(time.Minute)}, false},
+		{"expired within skew", Assertion{ExpiresAt: now.Add(-30 * time.Second)}, false},
+		{"expired", Assertion{ExpiresAt: now.Add(-2 * time.Minute)}, true},
+		{"not valid yet", Assertion{NotBefore: now.Add(2 * time.Minute), ExpiresAt: now.Add(time.Hour)}, true},
+		{"issued in the future", Assertion{IssuedAt: now.Add(2 * time.Minute), ExpiresAt: now.Add(time.Hour)}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.a.CheckTimes(now, skew); (err != nil) != test.wantErr {
+				t.Fatalf("expected error: %v, got [%v]", test.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+)
+
+// EchoContextKey is the key of the authenticated app (*Caller) in Echo's context
+const EchoContextKey = "tabusus.caller"
+
+// Echo returns an Echo middleware rejecting requests that cannot be authenticated. The caller is stored in both
+// Echo's context (see EchoCaller) and the request's context (see CallerFrom).
+func (a *Authenticator) Echo() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			caller, err := a.Authenticate(c.Request())
+			if err == ErrUnauthenticated && a.opts.Optional {
+				return next(c)
+			}
+			if err != nil {
+				if a.opts.ErrorHandler != nil {
+					a.opts.ErrorHandler(c.Response(), c.Request(), err)
+					return nil
+				}
+				status, body := errorResponse(err)
+				if status == http.StatusUnauthorized {
+					c.Response().Header().Set("WWW-Authenticate", `Bearer, Signature`)
+				}
+				return c.JSON(status, body)
+			}
+			c.Set(EchoContextKey, caller)
+			c.SetRequest(c.Request().WithContext(WithCaller(c.Request().Context(), caller)))
+			return next(c)
+		}
+	}
+}
+
+// EchoCaller returns the authenticated app of an Echo request, nil if none
+func EchoCaller(c echo.Context) *Caller {
+	caller, _ := c.Get(EchoContextKey).(*Caller)
+	return caller
+}
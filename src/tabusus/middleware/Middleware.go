@@ -0,0 +1,177 @@
+// Package middleware authenticates requests of apps registered with Tabusus, for services built with net/http or
+// Echo. Requests are either signed with the app's key as HTTP message signatures (see package httpsig), with the
+// app id as keyid (optionally followed by ":" and the key's fingerprint), or carry an access token issued by Tabusus
+// as bearer token. The authenticated app is available to handlers via CallerFrom.
+package middleware
+
+import (
+	"context"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"tabusus/client"
+	"tabusus/httpsig"
+)
+
+var base64Url = base64.RawURLEncoding
+
+// Authentication methods
+const (
+	MethodSignature = "signature"
+	MethodToken     = "token"
+)
+
+// Caller is the authenticated app of a request
+type Caller struct {
+	AppId     string
+	Kid       string   // fingerprint of the app's key (signature), or id of Tabusus' key (token)
+	Method    string   // MethodSignature or MethodToken
+	Scopes    []string // granted scopes (token only)
+	Audiences []string // audiences (token only)
+	ExpiresAt time.Time
+}
+
+// HasScope checks if the caller has been granted a scope
+func (c *Caller) HasScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type contextKey struct{}
+
+// WithCaller returns a copy of ctx carrying the caller
+func WithCaller(ctx context.Context, caller *Caller) context.Context {
+	return context.WithValue(ctx, contextKey{}, caller)
+}
+
+// CallerFrom returns the authenticated app of a request's context, nil if none
+func CallerFrom(ctx context.Context) *Caller {
+	caller, _ := ctx.Value(contextKey{}).(*Caller)
+	return caller
+}
+
+// AppId returns the id of the authenticated app of a request's context, empty if none
+func AppId(ctx context.Context) string {
+	if caller := CallerFrom(ctx); caller != nil {
+		return caller.AppId
+	}
+	return ""
+}
+
+/*----------------------------------------------------------------------*/
+
+// ErrUnauthenticated is returned if a request carries neither a signature nor a token
+var ErrUnauthenticated = errors.New("request is neither signed nor carries an access token")
+
+// Options configure an Authenticator
+type Options struct {
+	// Keys resolves app keys to verify signatures with, signatures are not accepted if nil
+	Keys KeyResolver
+	// Signature verification settings; the Keys field is ignored. Replays are rejected with an in-memory
+	// httpsig.MemoryReplayStore unless Nonces is set, e.g. to httpsig.StoreNonces of a store shared among instances.
+	Signatures httpsig.Verifier
+	// Tokens verifies access tokens (see NewTokenVerifier), tokens are not accepted if nil
+	Tokens *TokenVerifier
+	// Optional is true to let unauthenticated requests through (without caller); invalid credentials are still rejected
+	Optional bool
+	// ErrorHandler writes the response of rejected requests (default: 401 with a JSON body)
+	ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// Authenticator authenticates requests
+type Authenticator struct {
+	opts     Options
+	verifier httpsig.Verifier
+}
+
+// New creates an Authenticator
+func New(opts Options) *Authenticator {
+	a := &Authenticator{opts: opts, verifier: opts.Signatures}
+	a.verifier.Keys = a.signatureKey
+	if a.verifier.Nonces == nil {
+		a.verifier.Nonces = httpsig.StoreNonces(httpsig.NewMemoryReplayStore())
+	}
+	return a
+}
+
+func (a *Authenticator) signatureKey(r *http.Request, s *httpsig.Signature) (crypto.PublicKey, error) {
+	appId, kid := httpsig.SplitAppKeyId(s.KeyId)
+	if appId == "" {
+		return nil, unknownKey("keyid is required")
+	}
+	return a.opts.Keys.ResolveKey(r.Context(), appId, kid)
+}
+
+// Authenticate authenticates a request, returns ErrUnauthenticated if it carries no credentials
+func (a *Authenticator) Authenticate(r *http.Request) (*Caller, error) {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") && a.opts.Tokens != nil {
+		t, err := a.opts.Tokens.Verify(r.Context(), strings.TrimSpace(auth[7:]))
+		if err != nil {
+			return nil, err
+		}
+		return &Caller{AppId: t.AppId, Kid: t.Kid, Method: MethodToken, Scopes: t.Scopes, Audiences: t.Audiences, ExpiresAt: t.ExpiresAt}, nil
+	}
+	if r.Header.Get(httpsig.HeaderSignatureInput) != "" && a.opts.Keys != nil {
+		s, err := a.verifier.Verify(r)
+		if err != nil {
+			return nil, err
+		}
+		appId, _ := httpsig.SplitAppKeyId(s.KeyId)
+		caller := &Caller{AppId: appId, Method: MethodSignature, ExpiresAt: s.Expires}
+		if pubKey, err := a.opts.Keys.ResolveKey(r.Context(), appId, ""); err == nil {
+			caller.Kid, _ = client.KeyFingerprint(pubKey)
+		}
+		return caller, nil
+	}
+	return nil, ErrUnauthenticated
+}
+
+// Handler wraps a net/http handler, rejecting requests that cannot be authenticated
+func (a *Authenticator) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller, err := a.Authenticate(r)
+		if err == ErrUnauthenticated && a.opts.Optional {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			a.reject(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithCaller(r.Context(), caller)))
+	})
+}
+
+func (a *Authenticator) reject(w http.ResponseWriter, r *http.Request, err error) {
+	if a.opts.ErrorHandler != nil {
+		a.opts.ErrorHandler(w, r, err)
+		return
+	}
+	status, body := errorResponse(err)
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer, Signature`)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// errorResponse returns the status and body (in the same format as Tabusus' API) of a rejected request
+func errorResponse(err error) (int, map[string]interface{}) {
+	status := http.StatusUnauthorized
+	var sigErr *httpsig.Error
+	if !errors.As(err, &sigErr) && err != ErrUnauthenticated && !errors.Is(err, ErrInvalidToken) {
+		// key resolution failed for other reasons, e.g. registry is unreachable
+		status = http.StatusServiceUnavailable
+	}
+	return status, map[string]interface{}{"status": status, "message": err.Error()}
+}
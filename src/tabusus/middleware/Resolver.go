@@ -0,0 +1,229 @@
+package middleware
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"tabusus/client"
+	"tabusus/httpsig"
+)
+
+// KeyResolver returns the public key of an app; kid (SHA-256 fingerprint of the key) is checked if not empty.
+// Returns an error wrapping httpsig.ErrUnknownKey if the app does not exist or its key cannot currently be used.
+type KeyResolver interface {
+	ResolveKey(ctx context.Context, appId, kid string) (crypto.PublicKey, error)
+}
+
+func unknownKey(reason string) error {
+	return &httpsig.Error{Kind: httpsig.ErrUnknownKey, Reason: reason}
+}
+
+// checkKid checks a key against the kid requested by the caller
+func checkKid(pubKey crypto.PublicKey, kid string) error {
+	if kid == "" {
+		return nil
+	}
+	if fingerprint, err := client.KeyFingerprint(pubKey); err != nil || fingerprint != kid {
+		return unknownKey("key [" + kid + "] is not the app's current key")
+	}
+	return nil
+}
+
+/*----------------------------------------------------------------------*/
+
+type resolvedKey struct {
+	pubKey  crypto.PublicKey // nil: app not found or its key cannot be used
+	reason  string
+	expires time.Time
+}
+
+// RegistryResolver resolves keys one app at a time from the registry's public key endpoint (see
+// client.FetchBundleKey), caching results (including negative ones). It needs no management API access token.
+type RegistryResolver struct {
+	Client      *client.Client
+	Ttl         time.Duration // how long keys are cached (default 1 minute)
+	NegativeTtl time.Duration // how long unknown apps are cached (default 10 seconds)
+	MaxEntries  int           // maximum number of cached apps (default 10000)
+
+	mutex sync.Mutex
+	cache map[string]*resolvedKey
+}
+
+// NewRegistryResolver creates a RegistryResolver with default cache settings
+func NewRegistryResolver(c *client.Client) *RegistryResolver {
+	return &RegistryResolver{Client: c, Ttl: time.Minute, NegativeTtl: 10 * time.Second, MaxEntries: 10000}
+}
+
+func (r *RegistryResolver) cached(appId string, now time.Time) *resolvedKey {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if entry := r.cache[appId]; entry != nil && now.Before(entry.expires) {
+		return entry
+	}
+	return nil
+}
+
+func (r *RegistryResolver) store(appId string, entry *resolvedKey) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.cache == nil {
+		r.cache = map[string]*resolvedKey{}
+	}
+	maxEntries := r.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = 10000
+	}
+	if len(r.cache) >= maxEntries {
+		// drop expired entries first, then arbitrary ones
+		now := time.Now()
+		for id, e := range r.cache {
+			if !now.Before(e.expires) {
+				delete(r.cache, id)
+			}
+		}
+		for id := range r.cache {
+			if len(r.cache) < maxEntries {
+				break
+			}
+			delete(r.cache, id)
+		}
+	}
+	r.cache[appId] = entry
+}
+
+// Invalidate removes an app from the cache, e.g. after its key has been rotated
+func (r *RegistryResolver) Invalidate(appId string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.cache, appId)
+}
+
+// ResolveKey implements KeyResolver
+func (r *RegistryResolver) ResolveKey(ctx context.Context, appId, kid string) (crypto.PublicKey, error) {
+	now := time.Now()
+	entry := r.cached(appId, now)
+	if entry == nil {
+		key, err := r.Client.FetchBundleKey(ctx, appId)
+		switch {
+		case client.IsNotFound(err):
+			entry = &resolvedKey{reason: "application [" + appId + "] not found or cannot be verified"}
+		case err != nil:
+			// registry is unreachable: not cached, so that the next request tries again
+			return nil, err
+		case key.AppId != appId || !key.IsValidAt(now):
+			entry = &resolvedKey{reason: "application [" + appId + "] cannot be verified"}
+		default:
+			if pubKey, err := client.ParsePublicKey(key.PublicKey); err != nil {
+				entry = &resolvedKey{reason: "application [" + appId + "] has an invalid key"}
+			} else {
+				entry = &resolvedKey{pubKey: pubKey}
+			}
+		}
+		ttl := r.Ttl
+		if entry.pubKey == nil {
+			ttl = r.NegativeTtl
+		}
+		if ttl > 0 {
+			entry.expires = now.Add(ttl)
+			r.store(appId, entry)
+		}
+	}
+	if entry.pubKey == nil {
+		return nil, unknownKey(entry.reason)
+	}
+	if err := checkKid(entry.pubKey, kid); err != nil {
+		return nil, err
+	}
+	return entry.pubKey, nil
+}
+
+/*----------------------------------------------------------------------*/
+
+// BundleResolver resolves keys offline from the registry's signed key bundle, which it refreshes periodically.
+// Bundles are verified with pinned signing keys (see client.FetchBundleJwks).
+type BundleResolver struct {
+	Client  *client.Client
+	Keys    *client.Jwks  // keys that sign bundles
+	Refresh time.Duration // how often the bundle is refreshed (default 1 minute)
+
+	mutex  sync.RWMutex
+	bundle *client.KeyBundle
+	etag   string
+}
+
+// NewBundleResolver creates a BundleResolver and downloads the current bundle
+func NewBundleResolver(ctx context.Context, c *client.Client, keys *client.Jwks) (*BundleResolver, error) {
+	r := &BundleResolver{Client: c, Keys: keys, Refresh: time.Minute}
+	if err := r.Update(ctx); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Update downloads the bundle if it has changed since the last update
+func (r *BundleResolver) Update(ctx context.Context) error {
+	r.mutex.RLock()
+	etag := r.etag
+	r.mutex.RUnlock()
+	signed, etag, err := r.Client.FetchKeyBundle(ctx, etag)
+	if err == client.ErrNotModified {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	bundle, err := signed.Verify(r.Keys, time.Now())
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.bundle != nil && bundle.Version < r.bundle.Version {
+		return errors.New("key bundle is older than the current one")
+	}
+	r.bundle, r.etag = bundle, etag
+	return nil
+}
+
+// Run refreshes the bundle until ctx is done; errors are logged and the current bundle is kept until it expires
+func (r *BundleResolver) Run(ctx context.Context) {
+	refresh := r.Refresh
+	if refresh <= 0 {
+		refresh = time.Minute
+	}
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Update(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("Error while refreshing key bundle: %s", err)
+			}
+		}
+	}
+}
+
+// ResolveKey implements KeyResolver
+func (r *BundleResolver) ResolveKey(ctx context.Context, appId, kid string) (crypto.PublicKey, error) {
+	r.mutex.RLock()
+	bundle := r.bundle
+	r.mutex.RUnlock()
+	now := time.Now()
+	if bundle == nil || now.After(bundle.ExpiresAt) {
+		return nil, errors.New("key bundle has expired")
+	}
+	key := bundle.Key(appId, kid)
+	if key == nil || !key.IsValidAt(now) {
+		if kid != "" && bundle.Key(appId, "") != nil {
+			return nil, unknownKey("key [" + kid + "] is not the app's current key")
+		}
+		return nil, unknownKey("application [" + appId + "] cannot be verified")
+	}
+	return client.ParsePublicKey(key.PublicKey)
+}
@@ -0,0 +1,169 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"tabusus/client"
+)
+
+// TokenVerifier verifies access tokens issued by Tabusus, with signing keys downloaded from a JWKS endpoint.
+// Tokens are accepted only if issued by Issuer for Audience, see NewTokenVerifier.
+type TokenVerifier struct {
+	JwksUrl    string        // URL of Tabusus' token signing keys, e.g. https://tabusus.example.com/.well-known/jwks.json
+	Issuer     string        // expected "iss" claim (Tabusus' tokens.issuer), required
+	Audience   string        // the token must list this audience (the service being protected), required
+	MaxSkew    time.Duration // tolerated clock difference (default 1 minute)
+	Refresh    time.Duration // how often keys are refreshed (default 1 hour); unknown kids trigger a refresh at most every minute
+	HttpClient *http.Client
+
+	mutex     sync.Mutex
+	keys      *client.Jwks
+	fetchedAt time.Time
+}
+
+const minJwksRefresh = time.Minute
+
+// NewTokenVerifier creates a TokenVerifier with default settings; the JWKS URL, issuer and audience are all required,
+// so that tokens issued by another issuer or for another service are not accepted
+func NewTokenVerifier(jwksUrl, issuer, audience string) (*TokenVerifier, error) {
+	v := &TokenVerifier{JwksUrl: jwksUrl, Issuer: issuer, Audience: audience}
+	if err := v.check(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// check checks that the verifier is configured
+func (v *TokenVerifier) check() error {
+	if v.JwksUrl == "" || v.Issuer == "" || v.Audience == "" {
+		return errors.New("token verifier requires JWKS URL, issuer and audience")
+	}
+	return nil
+}
+
+// ErrInvalidToken is wrapped by errors of tokens that are rejected
+var ErrInvalidToken = errors.New("invalid access token")
+
+type tokenError struct {
+	reason string
+}
+
+func (e *tokenError) Error() string {
+	return ErrInvalidToken.Error() + ": " + e.reason
+}
+
+func (e *tokenError) Unwrap() error {
+	return ErrInvalidToken
+}
+
+func invalidToken(reason string) error {
+	return &tokenError{reason}
+}
+
+func (v *TokenVerifier) fetchKeys(ctx context.Context) (*client.Jwks, error) {
+	httpClient := v.HttpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	req, err := http.NewRequest(http.MethodGet, v.JwksUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("cannot fetch token signing keys: " + resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	keys := &client.Jwks{}
+	if err := json.Unmarshal(body, keys); err != nil {
+		return nil, errors.New("invalid JWK set: " + err.Error())
+	}
+	return keys, nil
+}
+
+// signingKeys returns cached keys, refreshing them if they are stale or do not include kid
+func (v *TokenVerifier) signingKeys(ctx context.Context, kid string) (*client.Jwks, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	refresh := v.Refresh
+	if refresh <= 0 {
+		refresh = time.Hour
+	}
+	age := time.Since(v.fetchedAt)
+	if v.keys == nil || age > refresh || (v.keys.Key(kid) == nil && age > minJwksRefresh) {
+		keys, err := v.fetchKeys(ctx)
+		if err != nil {
+			if v.keys == nil {
+				return nil, err
+			}
+			// keep using the keys we have
+		} else {
+			v.keys = keys
+		}
+		v.fetchedAt = time.Now()
+	}
+	return v.keys, nil
+}
+
+// Verify verifies a token, returns its claims
+func (v *TokenVerifier) Verify(ctx context.Context, token string) (*client.AccessToken, error) {
+	if err := v.check(); err != nil {
+		return nil, err
+	}
+	kid, err := tokenKid(token)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := v.signingKeys(ctx, kid)
+	if err != nil {
+		return nil, err
+	}
+	skew := v.MaxSkew
+	if skew <= 0 {
+		skew = time.Minute
+	}
+	t, err := client.VerifyAccessToken(token, keys, time.Now(), skew)
+	if err != nil {
+		return nil, invalidToken(err.Error())
+	}
+	if t.Issuer != v.Issuer {
+		return nil, invalidToken("token is not issued by [" + v.Issuer + "]")
+	}
+	if !t.HasAudience(v.Audience) {
+		return nil, invalidToken("token is not intended for [" + v.Audience + "]")
+	}
+	return t, nil
+}
+
+// tokenKid extracts the kid from a token's header
+func tokenKid(token string) (string, error) {
+	var header struct {
+		Kid string `json:"kid"`
+	}
+	end := strings.IndexByte(token, '.')
+	if end < 0 {
+		return "", invalidToken("malformed token")
+	}
+	data, err := base64Url.DecodeString(token[:end])
+	if err == nil {
+		err = json.Unmarshal(data, &header)
+	}
+	if err != nil {
+		return "", invalidToken("malformed token header")
+	}
+	return header.Kid, nil
+}
@@ -1,5 +1,20 @@
 package utils
 
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"reflect"
+)
+
+// RandomHex generates a random hex string from n random bytes
+func RandomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
 // ToInt32 casts/converts a value to int32
 func ToInt32(v interface{}) (int32, bool) {
 	switch v := v.(type) {
@@ -27,6 +42,33 @@ func ToInt32(v interface{}) (int32, bool) {
 	return 0, false
 }
 
+// ToInt64 casts/converts a value to int64
+func ToInt64(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int:
+		return int64(v), true
+	case uint:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case uint8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case int64:
+		return int64(v), true
+	case uint64:
+		return int64(v), true
+	}
+	return 0, false
+}
+
 // ToString casts/converts a value to string
 func ToString(v interface{}) (string, bool) {
 	switch v := v.(type) {
@@ -35,3 +77,25 @@ func ToString(v interface{}) (string, bool) {
 	}
 	return "", false
 }
+
+// ToStringSlice casts/converts a slice value (e.g. []interface{} decoded from storage) to []string,
+// non-string elements are skipped
+func ToStringSlice(v interface{}) ([]string, bool) {
+	if v == nil {
+		return nil, false
+	}
+	if s, ok := v.([]string); ok {
+		return s, true
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, false
+	}
+	result := make([]string, 0, rv.Len())
+	for i := 0; i < rv.Len(); i++ {
+		if s, ok := ToString(rv.Index(i).Interface()); ok {
+			result = append(result, s)
+		}
+	}
+	return result, true
+}